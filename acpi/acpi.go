@@ -0,0 +1,185 @@
+// Package acpi builds the ACPI tables which describe the machine to the
+// guest: the processors, the NUMA topology, the PM registers and, in the
+// DSDT, the PCI host bridge.
+package acpi
+
+import (
+	"encoding/binary"
+)
+
+const (
+	oemID       = "GOKVM "
+	oemTableID  = "GOKVMVM "
+	creatorID   = "GKVM"
+	headerSize  = 36
+	rsdpSize    = 36
+	facsSize    = 64
+	tableAlign  = 16
+	facsAlign   = 64
+	fadtRev     = 6
+	fadtSize    = 276
+	fadtMinorV  = 3
+	xsdtRev     = 1
+	dsdtRev     = 2
+	rsdpRev     = 2
+	centuryCMOS = 0x32
+
+	// Flags of the FADT.
+	fadtWBINVD     = 1 << 0
+	fadtProcC1     = 1 << 2
+	fadtPwrButton  = 1 << 4
+	fadtSlpButton  = 1 << 5
+	fadtTmrValExt  = 1 << 8
+	bootArchLegacy = 1 << 0
+	bootArch8042   = 1 << 1
+)
+
+// Table is an ACPI table: the standard header followed by Body.
+type Table struct {
+	Signature string
+	Revision  uint8
+	Body      []byte
+}
+
+// Bytes returns the table with its header. The checksum makes all of its
+// bytes add up to zero.
+func (t *Table) Bytes() []byte {
+	b := make([]byte, headerSize, headerSize+len(t.Body))
+
+	copy(b[0:4], t.Signature)
+	binary.LittleEndian.PutUint32(b[4:], uint32(headerSize+len(t.Body)))
+	b[8] = t.Revision
+	copy(b[10:16], oemID)
+	copy(b[16:24], oemTableID)
+	binary.LittleEndian.PutUint32(b[24:], 1) // OEM revision
+	copy(b[28:32], creatorID)
+	binary.LittleEndian.PutUint32(b[32:], 1) // creator revision
+
+	b = append(b, t.Body...)
+	b[9] = checksum(b)
+
+	return b
+}
+
+func checksum(b []byte) uint8 {
+	sum := uint8(0)
+	for _, c := range b {
+		sum += c
+	}
+
+	return -sum
+}
+
+// PM locates the fixed hardware registers of ACPI in the I/O ports. The
+// guest gets its SCI on IRQ SCI.
+type PM struct {
+	SCI       uint16
+	PM1EvtBlk uint32
+	PM1CntBlk uint32
+	PMTmrBlk  uint32
+	GPE0Blk   uint32
+	GPE0Len   uint8
+}
+
+// Build lays out the tables from addr on, the RSDP first, and returns them
+// to be copied there. The FADT with pm points at the DSDT with the AML
+// dsdt, and the XSDT at the FADT and tables.
+func Build(addr uint64, pm PM, dsdt []byte, tables ...*Table) []byte {
+	b := make([]byte, rsdpSize)
+
+	place := func(t []byte, align int) uint64 {
+		for len(b)%align != 0 {
+			b = append(b, 0)
+		}
+
+		at := addr + uint64(len(b))
+		b = append(b, t...)
+
+		return at
+	}
+
+	facs := place(newFACS(), facsAlign)
+	dsdtAddr := place((&Table{Signature: "DSDT", Revision: dsdtRev, Body: dsdt}).Bytes(), tableAlign)
+
+	entries := []uint64{place(newFADT(pm, facs, dsdtAddr).Bytes(), tableAlign)}
+	for _, t := range tables {
+		entries = append(entries, place(t.Bytes(), tableAlign))
+	}
+
+	xsdt := place(newXSDT(entries).Bytes(), tableAlign)
+
+	copy(b, newRSDP(xsdt))
+
+	return b
+}
+
+// newRSDP is a Root System Description Pointer of ACPI 2.0, which only
+// points at the XSDT.
+func newRSDP(xsdt uint64) []byte {
+	b := make([]byte, rsdpSize)
+
+	copy(b[0:8], "RSD PTR ")
+	copy(b[9:15], oemID)
+	b[15] = rsdpRev
+	binary.LittleEndian.PutUint32(b[20:], rsdpSize)
+	binary.LittleEndian.PutUint64(b[24:], xsdt)
+
+	b[8] = checksum(b[:20])
+	b[32] = checksum(b)
+
+	return b
+}
+
+func newXSDT(entries []uint64) *Table {
+	body := make([]byte, 0, 8*len(entries))
+	for _, e := range entries {
+		body = binary.LittleEndian.AppendUint64(body, e)
+	}
+
+	return &Table{Signature: "XSDT", Revision: xsdtRev, Body: body}
+}
+
+// newFACS is a Firmware ACPI Control Structure, which has no header of a
+// table and no checksum.
+func newFACS() []byte {
+	b := make([]byte, facsSize)
+
+	copy(b[0:4], "FACS")
+	binary.LittleEndian.PutUint32(b[4:], facsSize)
+	b[32] = 2 // version
+
+	return b
+}
+
+// newFADT is a Fixed ACPI Description Table. The machine has the legacy
+// devices of a PC, so it is not hardware-reduced.
+func newFADT(pm PM, facs, dsdt uint64) *Table {
+	body := make([]byte, fadtSize-headerSize)
+	at := func(off int) []byte { return body[off-headerSize:] }
+
+	binary.LittleEndian.PutUint32(at(36), uint32(facs))
+	binary.LittleEndian.PutUint32(at(40), uint32(dsdt))
+	binary.LittleEndian.PutUint16(at(46), pm.SCI)
+	binary.LittleEndian.PutUint32(at(56), pm.PM1EvtBlk)
+	binary.LittleEndian.PutUint32(at(64), pm.PM1CntBlk)
+	binary.LittleEndian.PutUint32(at(76), pm.PMTmrBlk)
+	binary.LittleEndian.PutUint32(at(80), pm.GPE0Blk)
+
+	at(88)[0] = 4 // PM1_EVT_LEN
+	at(89)[0] = 2 // PM1_CNT_LEN
+	at(91)[0] = 4 // PM_TMR_LEN
+	at(92)[0] = pm.GPE0Len
+
+	// C2 and C3 are not supported.
+	binary.LittleEndian.PutUint16(at(96), 101)
+	binary.LittleEndian.PutUint16(at(98), 1001)
+
+	at(108)[0] = centuryCMOS
+	binary.LittleEndian.PutUint16(at(109), bootArchLegacy|bootArch8042)
+	binary.LittleEndian.PutUint32(at(112), fadtWBINVD|fadtProcC1|fadtPwrButton|fadtSlpButton|fadtTmrValExt)
+	at(131)[0] = fadtMinorV
+	binary.LittleEndian.PutUint64(at(132), facs)
+	binary.LittleEndian.PutUint64(at(140), dsdt)
+
+	return &Table{Signature: "FACP", Revision: fadtRev, Body: body}
+}
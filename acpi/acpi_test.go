@@ -0,0 +1,198 @@
+package acpi_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+func sum(b []byte) uint8 {
+	s := uint8(0)
+	for _, c := range b {
+		s += c
+	}
+
+	return s
+}
+
+func TestTableBytes(t *testing.T) {
+	t.Parallel()
+
+	b := (&acpi.Table{Signature: "TEST", Revision: 2, Body: []byte{1, 2, 3}}).Bytes()
+
+	if len(b) != 39 || string(b[:4]) != "TEST" || binary.LittleEndian.Uint32(b[4:]) != 39 {
+		t.Fatalf("expected: %v, actual: %v", "TEST of 39 bytes", b)
+	}
+
+	if s := sum(b); s != 0 {
+		t.Fatalf("expected: %v, actual: %v", 0, s)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+
+	const addr = 0xe0000
+
+	pm := acpi.PM{SCI: 9, PM1EvtBlk: 0x600, PM1CntBlk: 0x604, PMTmrBlk: 0x608}
+	b := acpi.Build(addr, pm, acpi.Scope(`\_SB_`), acpi.NewMADT(2, 2), acpi.NewSLIT(2, func(i, j int) uint8 {
+		return uint8(10 + 10*(i^j))
+	}))
+
+	// The RSDP, with a checksum over its first 20 bytes and over all of
+	// its 36 bytes.
+	if string(b[:8]) != "RSD PTR " || sum(b[:20]) != 0 || sum(b[:36]) != 0 {
+		t.Fatalf("expected: %v, actual: %v", "RSD PTR ", b[:36])
+	}
+
+	table := func(gpa uint64) []byte {
+		off := gpa - addr
+		n := binary.LittleEndian.Uint32(b[off+4:])
+
+		if s := sum(b[off : off+uint64(n)]); s != 0 {
+			t.Fatalf("expected: %v, actual: %v", 0, s)
+		}
+
+		return b[off : off+uint64(n)]
+	}
+
+	xsdt := table(binary.LittleEndian.Uint64(b[24:]))
+
+	signatures := []string{}
+
+	for off := 36; off < len(xsdt); off += 8 {
+		signatures = append(signatures, string(table(binary.LittleEndian.Uint64(xsdt[off:]))[:4]))
+	}
+
+	if s := []string{"FACP", "APIC", "SLIT"}; !reflect.DeepEqual(signatures, s) {
+		t.Fatalf("expected: %v, actual: %v", s, signatures)
+	}
+
+	fadt := table(binary.LittleEndian.Uint64(xsdt[36:]))
+	if sci := binary.LittleEndian.Uint16(fadt[46:]); sci != 9 {
+		t.Fatalf("expected: %v, actual: %v", 9, sci)
+	}
+
+	if string(table(binary.LittleEndian.Uint64(fadt[140:]))[:4]) != "DSDT" {
+		t.Fatalf("expected: %v, actual: %v", "DSDT", fadt[140:148])
+	}
+
+	if facs := binary.LittleEndian.Uint64(fadt[132:]); facs%64 != 0 || string(b[facs-addr:][:4]) != "FACS" {
+		t.Fatalf("expected: %v, actual: %v", "FACS", facs)
+	}
+}
+
+func TestMADT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.NewMADT(2, 1).Bytes()
+
+	if len(b) != 36+8+2*8 {
+		t.Fatalf("expected: %v, actual: %v", 36+8+2*8, len(b))
+	}
+
+	// The local APIC 0 is enabled, 1 is online capable.
+	for i, flags := range []uint32{1, 2} {
+		lapic := b[44+8*i:]
+		if lapic[0] != 0 || lapic[3] != uint8(i) || binary.LittleEndian.Uint32(lapic[4:]) != flags {
+			t.Fatalf("expected: %v, actual: %v", flags, lapic[:8])
+		}
+	}
+}
+
+func TestSRAT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.NewSRAT([]uint32{0, 1}, []acpi.MemAffinity{
+		{Node: 1, Base: 1 << 32, Size: 1 << 30, Hotplug: true},
+	}).Bytes()
+
+	if len(b) != 36+12+2*16+40 {
+		t.Fatalf("expected: %v, actual: %v", 36+12+2*16+40, len(b))
+	}
+
+	// The local APIC 1 is in node 1.
+	if lapic := b[48+16:]; lapic[2] != 1 || lapic[3] != 1 || lapic[4]&1 == 0 {
+		t.Fatalf("expected: %v, actual: %v", "node 1", lapic[:16])
+	}
+
+	mem := b[48+32:]
+	if binary.LittleEndian.Uint32(mem[2:]) != 1 || binary.LittleEndian.Uint64(mem[8:]) != 1<<32 ||
+		binary.LittleEndian.Uint64(mem[16:]) != 1<<30 || binary.LittleEndian.Uint32(mem[28:]) != 3 {
+		t.Fatalf("expected: %v, actual: %v", "hotpluggable node 1", mem)
+	}
+}
+
+func TestSLIT(t *testing.T) {
+	t.Parallel()
+
+	b := acpi.NewSLIT(2, func(i, j int) uint8 { return uint8(10*i + j) }).Bytes()
+
+	if expected := []byte{2, 0, 0, 0, 0, 0, 0, 0, 0, 1, 10, 11}; !bytes.Equal(b[36:], expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, b[36:])
+	}
+}
+
+func TestAML(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		actual   []byte
+		expected []byte
+	}{
+		{"EISAID", acpi.EISAID("PNP0A03"), []byte{0x0c, 0x41, 0xd0, 0x0a, 0x03}},
+		{"root path", acpi.Path(`\_SB_`), []byte("\\_SB_")},
+		{"padded path", acpi.Path("S5"), []byte("S5__")},
+		{"dual path", acpi.Path(`\_SB_.LK0A`), append([]byte{'\\', 0x2e}, "_SB_LK0A"...)},
+		{"multi path", acpi.Path("A.B.C"), append([]byte{0x2f, 3}, "A___B___C___"...)},
+		{"integers", append(acpi.Integer(1), acpi.Integer(0x1234)...), []byte{0x01, 0x0b, 0x34, 0x12}},
+		{"name", acpi.Name("_UID", acpi.Integer(0)), []byte{0x08, '_', 'U', 'I', 'D', 0}},
+		{"package", acpi.Package(acpi.Integer(5), acpi.Integer(0)), []byte{0x12, 5, 2, 0x0a, 5, 0}},
+		{"irq", acpi.ResourceTemplate(acpi.IRQNoFlags(9)), []byte{0x11, 8, 0x0a, 5, 0x22, 0, 2, 0x79, 0}},
+		{
+			"region", acpi.OperationRegion("PRST", acpi.SystemIO, 0x630, 2),
+			append(append([]byte{0x5b, 0x80}, "PRST"...), 1, 0x0b, 0x30, 0x06, 0x0a, 2),
+		},
+		{
+			"field", acpi.Field("PRST", acpi.ByteAcc|acpi.WriteAsZeros, acpi.FieldUnit{"CSEL", 8}, acpi.FieldUnit{"", 4}),
+			append(append(append([]byte{0x5b, 0x81, 13}, "PRST"...), 0x41), append([]byte("CSEL"), 8, 0, 4)...),
+		},
+		{
+			"if", acpi.If(acpi.LEqual(acpi.Arg(0), acpi.Integer(1)), acpi.Notify("CP01", acpi.Arg(1))),
+			append([]byte{0xa0, 10, 0x93, 0x68, 1, 0x86}, append([]byte("CP01"), 0x69)...),
+		},
+		{
+			"while", acpi.While(acpi.LLess(acpi.Local(0), acpi.Integer(2)), acpi.Increment(acpi.Local(0))),
+			[]byte{0xa2, 7, 0x95, 0x60, 0x0a, 2, 0x75, 0x60},
+		},
+		{"store", acpi.Store(acpi.Arg(0), acpi.Path("CSEL")), append([]byte{0x70, 0x68}, "CSEL"...)},
+		{"call", acpi.Call("CSTA", acpi.Integer(0)), append([]byte("CSTA"), 0)},
+		{"return", acpi.Return(acpi.Local(0)), []byte{0xa4, 0x60}},
+		{"acquire", acpi.Acquire("CPLK"), append(append([]byte{0x5b, 0x23}, "CPLK"...), 0xff, 0xff)},
+	} {
+		if !bytes.Equal(tt.actual, tt.expected) {
+			t.Fatalf("%s: expected: %x, actual: %x", tt.name, tt.expected, tt.actual)
+		}
+	}
+}
+
+func TestPkgLength(t *testing.T) {
+	t.Parallel()
+
+	// 100 bytes of terms need a PkgLength of two bytes: the scope has
+	// 4 bytes of name and the PkgLength, 106 bytes in all.
+	b := acpi.Scope("S", make([]byte, 100))
+	if b[0] != 0x10 || b[1] != 0x40|106&0xf || b[2] != 106>>4 {
+		t.Fatalf("expected: %v, actual: %v", 106, b[:3])
+	}
+
+	// Longer than 4K, PkgLength has three bytes.
+	b = acpi.Scope("S", make([]byte, 5000))
+	if n := int(b[1]&0xf) | int(b[2])<<4 | int(b[3])<<12; b[1]>>6 != 2 || n != 5007 {
+		t.Fatalf("expected: %v, actual: %v", 5007, n)
+	}
+}
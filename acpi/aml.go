@@ -0,0 +1,384 @@
+package acpi
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// The AML encoding of the few ASL constructs the DSDT needs. Each function
+// returns the byte code of one term.
+// See chapter 20 "ACPI Machine Language (AML) Specification" of ACPI.
+
+const (
+	zeroOp       = 0x00
+	oneOp        = 0x01
+	nameOp       = 0x08
+	bytePrefix   = 0x0a
+	wordPrefix   = 0x0b
+	dwordPrefix  = 0x0c
+	stringPrefix = 0x0d
+	qwordPrefix  = 0x0e
+	scopeOp      = 0x10
+	bufferOp     = 0x11
+	packageOp    = 0x12
+	methodOp     = 0x14
+	extOpPrefix  = 0x5b
+	mutexOp      = 0x01
+	acquireOp    = 0x23
+	releaseOp    = 0x27
+	opRegionOp   = 0x80
+	fieldOp      = 0x81
+	deviceOp     = 0x82
+	local0Op     = 0x60
+	arg0Op       = 0x68
+	storeOp      = 0x70
+	incrementOp  = 0x75
+	notifyOp     = 0x86
+	lEqualOp     = 0x93
+	lLessOp      = 0x95
+	ifOp         = 0xa0
+	whileOp      = 0xa2
+	returnOp     = 0xa4
+	rootChar     = '\\'
+	dualNamePfx  = 0x2e
+	multiNamePfx = 0x2f
+
+	// Resource descriptors.
+	irqNoFlagsDesc = 0x22
+	ioPortDesc     = 0x47
+	endTagDesc     = 0x79
+	dwordAddrDesc  = 0x87
+	wordAddrDesc   = 0x88
+	addrTypeMemory = 0
+	addrTypeIO     = 1
+	addrTypeBus    = 2
+	// The range is fixed and produced by the device, such as the windows
+	// of a bridge.
+	addrFixed = 0x0c
+)
+
+// The address space of an OperationRegion, and the flags of a Field.
+const (
+	SystemIO = 1
+
+	ByteAcc      = 1
+	WriteAsZeros = 2 << 5
+)
+
+// pkgLength prefixes b with its PkgLength, which counts itself.
+func pkgLength(b []byte) []byte {
+	n := len(b) + 1
+	if n < 1<<6 {
+		return append(encodeLength(n, 0), b...)
+	}
+
+	extra := 1
+	for n+extra >= 1<<(4+8*extra) {
+		extra++
+	}
+
+	return append(encodeLength(n+extra, extra), b...)
+}
+
+// lengthBytes is the number of bytes after the lead byte of the PkgLength
+// encoding of n, if n does not count them.
+func lengthBytes(n int) int {
+	if n < 1<<6 {
+		return 0
+	}
+
+	extra := 1
+	for n >= 1<<(4+8*extra) {
+		extra++
+	}
+
+	return extra
+}
+
+// encodeLength encodes n in the lead byte and extra more bytes.
+func encodeLength(n, extra int) []byte {
+	if extra == 0 {
+		return []byte{uint8(n)}
+	}
+
+	lead := []byte{uint8(extra<<6) | uint8(n&0xf)}
+
+	for i := 0; i < extra; i++ {
+		lead = append(lead, uint8(n>>(4+8*i)))
+	}
+
+	return lead
+}
+
+// nameString encodes a path such as "\_SB_.PCI0", whose segments are
+// padded to four characters.
+func nameString(path string) []byte {
+	b := []byte{}
+
+	if strings.HasPrefix(path, "\\") {
+		b = append(b, rootChar)
+		path = path[1:]
+	}
+
+	segs := strings.Split(path, ".")
+
+	switch {
+	case len(segs) == 2:
+		b = append(b, dualNamePfx)
+	case len(segs) > 2:
+		b = append(b, multiNamePfx, uint8(len(segs)))
+	}
+
+	for _, s := range segs {
+		b = append(b, (s + "___")[:4]...)
+	}
+
+	return b
+}
+
+func concat(terms [][]byte) []byte {
+	b := []byte{}
+	for _, t := range terms {
+		b = append(b, t...)
+	}
+
+	return b
+}
+
+// Scope opens the existing object path.
+func Scope(path string, terms ...[]byte) []byte {
+	return append([]byte{scopeOp}, pkgLength(append(nameString(path), concat(terms)...))...)
+}
+
+// Device declares a device.
+func Device(name string, terms ...[]byte) []byte {
+	return append([]byte{extOpPrefix, deviceOp}, pkgLength(append(nameString(name), concat(terms)...))...)
+}
+
+// Method declares a method with args arguments.
+func Method(name string, args uint8, terms ...[]byte) []byte {
+	return append([]byte{methodOp}, pkgLength(append(append(nameString(name), args&0x7), concat(terms)...))...)
+}
+
+// Path refers to the object at path, e.g. in a package.
+func Path(path string) []byte {
+	return nameString(path)
+}
+
+// Name declares a named object.
+func Name(name string, obj []byte) []byte {
+	return append(append([]byte{nameOp}, nameString(name)...), obj...)
+}
+
+// Integer is a constant, in as few bytes as possible.
+func Integer(v uint64) []byte {
+	switch {
+	case v == 0:
+		return []byte{zeroOp}
+	case v == 1:
+		return []byte{oneOp}
+	case v <= 0xff:
+		return []byte{bytePrefix, uint8(v)}
+	case v <= 0xffff:
+		return binary.LittleEndian.AppendUint16([]byte{wordPrefix}, uint16(v))
+	case v <= 0xffffffff:
+		return binary.LittleEndian.AppendUint32([]byte{dwordPrefix}, uint32(v))
+	}
+
+	return binary.LittleEndian.AppendUint64([]byte{qwordPrefix}, v)
+}
+
+// String is a constant string.
+func String(s string) []byte {
+	return append(append([]byte{stringPrefix}, s...), 0)
+}
+
+// EISAID is the compressed form of an ID such as "PNP0A03".
+func EISAID(id string) []byte {
+	vendor := uint16(id[0]-'@')<<10 | uint16(id[1]-'@')<<5 | uint16(id[2]-'@')
+
+	product := uint16(0)
+	for _, c := range id[3:7] {
+		product <<= 4
+
+		switch {
+		case c >= '0' && c <= '9':
+			product |= uint16(c - '0')
+		default:
+			product |= uint16(c-'A') + 10
+		}
+	}
+
+	return []byte{dwordPrefix, uint8(vendor >> 8), uint8(vendor), uint8(product >> 8), uint8(product)}
+}
+
+// Package is a package of the elements.
+func Package(elems ...[]byte) []byte {
+	return append([]byte{packageOp}, pkgLength(append([]byte{uint8(len(elems))}, concat(elems)...))...)
+}
+
+// Buffer is a buffer with the bytes b.
+func Buffer(b []byte) []byte {
+	return append([]byte{bufferOp}, pkgLength(append(Integer(uint64(len(b))), b...))...)
+}
+
+// ResourceTemplate is a buffer of resource descriptors.
+func ResourceTemplate(descs ...[]byte) []byte {
+	return Buffer(append(concat(descs), endTagDesc, 0))
+}
+
+// IRQNoFlags is an edge-triggered, active-high interrupt on the IRQs.
+func IRQNoFlags(irqs ...uint8) []byte {
+	mask := uint16(0)
+	for _, irq := range irqs {
+		mask |= 1 << irq
+	}
+
+	return binary.LittleEndian.AppendUint16([]byte{irqNoFlagsDesc}, mask)
+}
+
+// IO is a range of I/O ports the device decodes with 16 bits.
+func IO(minimum, maximum uint16, align, length uint8) []byte {
+	b := []byte{ioPortDesc, 1}
+	b = binary.LittleEndian.AppendUint16(b, minimum)
+	b = binary.LittleEndian.AppendUint16(b, maximum)
+
+	return append(b, align, length)
+}
+
+func wordAddress(typ, typeFlags uint8, minimum, maximum uint16) []byte {
+	b := []byte{wordAddrDesc, 13, 0, typ, addrFixed, typeFlags}
+
+	for _, v := range []uint16{0, minimum, maximum, 0, maximum - minimum + 1} {
+		b = binary.LittleEndian.AppendUint16(b, v)
+	}
+
+	return b
+}
+
+// WordBusNumber is a range of bus numbers a bridge produces.
+func WordBusNumber(minimum, maximum uint16) []byte {
+	return wordAddress(addrTypeBus, 0, minimum, maximum)
+}
+
+// WordIO is a range of I/O ports a bridge produces.
+func WordIO(minimum, maximum uint16) []byte {
+	// The ISA and non-ISA ranges.
+	return wordAddress(addrTypeIO, 3, minimum, maximum)
+}
+
+// DWordMemory is a range of non-cacheable, read-write memory a bridge
+// produces.
+func DWordMemory(minimum, maximum uint32) []byte {
+	b := []byte{dwordAddrDesc, 23, 0, addrTypeMemory, addrFixed, 1}
+
+	for _, v := range []uint32{0, minimum, maximum, 0, maximum - minimum + 1} {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+
+	return b
+}
+
+// OperationRegion declares the region of length bytes at offset in space.
+func OperationRegion(name string, space uint8, offset, length uint64) []byte {
+	b := append([]byte{extOpPrefix, opRegionOp}, nameString(name)...)
+	b = append(b, space)
+	b = append(b, Integer(offset)...)
+
+	return append(b, Integer(length)...)
+}
+
+// FieldUnit is a named field of Bits bits. The bits of a unit without a
+// name are skipped.
+type FieldUnit struct {
+	Name string
+	Bits int
+}
+
+// Field lays out the units over the region, in its order.
+func Field(region string, flags uint8, units ...FieldUnit) []byte {
+	b := append(nameString(region), flags)
+
+	for _, u := range units {
+		name := []byte{0}
+		if len(u.Name) > 0 {
+			name = nameString(u.Name)
+		}
+
+		// The length is encoded as a PkgLength which does not count
+		// itself.
+		b = append(append(b, name...), encodeLength(u.Bits, lengthBytes(u.Bits))...)
+	}
+
+	return append([]byte{extOpPrefix, fieldOp}, pkgLength(b)...)
+}
+
+// Mutex declares a mutex.
+func Mutex(name string) []byte {
+	return append(append([]byte{extOpPrefix, mutexOp}, nameString(name)...), 0)
+}
+
+// Acquire waits for the mutex without a timeout.
+func Acquire(name string) []byte {
+	return append(append([]byte{extOpPrefix, acquireOp}, nameString(name)...), 0xff, 0xff)
+}
+
+// Release releases the mutex.
+func Release(name string) []byte {
+	return append([]byte{extOpPrefix, releaseOp}, nameString(name)...)
+}
+
+// Local is the local variable LocalN of a method.
+func Local(n uint8) []byte {
+	return []byte{local0Op + n}
+}
+
+// Arg is the argument ArgN of a method.
+func Arg(n uint8) []byte {
+	return []byte{arg0Op + n}
+}
+
+// Store stores the value of src into dst.
+func Store(src, dst []byte) []byte {
+	return append(append([]byte{storeOp}, src...), dst...)
+}
+
+// Increment adds one to the variable.
+func Increment(v []byte) []byte {
+	return append([]byte{incrementOp}, v...)
+}
+
+// LEqual tests if a equals b.
+func LEqual(a, b []byte) []byte {
+	return append(append([]byte{lEqualOp}, a...), b...)
+}
+
+// LLess tests if a is less than b.
+func LLess(a, b []byte) []byte {
+	return append(append([]byte{lLessOp}, a...), b...)
+}
+
+// If runs the terms if pred is true.
+func If(pred []byte, terms ...[]byte) []byte {
+	return append([]byte{ifOp}, pkgLength(append(pred, concat(terms)...))...)
+}
+
+// While runs the terms as long as pred is true.
+func While(pred []byte, terms ...[]byte) []byte {
+	return append([]byte{whileOp}, pkgLength(append(pred, concat(terms)...))...)
+}
+
+// Return returns v from the method.
+func Return(v []byte) []byte {
+	return append([]byte{returnOp}, v...)
+}
+
+// Notify sends the notification v to the object at path.
+func Notify(path string, v []byte) []byte {
+	return append(append([]byte{notifyOp}, nameString(path)...), v...)
+}
+
+// Call invokes the method at path with the arguments.
+func Call(path string, args ...[]byte) []byte {
+	return append(nameString(path), concat(args)...)
+}
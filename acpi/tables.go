@@ -0,0 +1,105 @@
+package acpi
+
+import (
+	"encoding/binary"
+)
+
+const (
+	madtRev = 5
+	sratRev = 3
+	slitRev = 1
+
+	lapicAddr      = 0xfee00000
+	madtPCATCompat = 1 << 0
+
+	madtTypeLAPIC      = 0
+	lapicEnabled       = 1 << 0
+	lapicOnlineCapable = 1 << 1
+
+	sratTypeLAPIC  = 0
+	sratTypeMemory = 1
+	sratEnabled    = 1 << 0
+	sratHotplug    = 1 << 1
+)
+
+// NewMADT is a Multiple APIC Description Table with a local APIC of ID i
+// for vCPU i. The first present vCPUs are enabled, the others can be
+// plugged later. The I/O APIC is left out, so that the guest keeps routing
+// the interrupts through the PIC as with the MP table.
+func NewMADT(nCPUs, present int) *Table {
+	body := make([]byte, 8, 8+8*nCPUs)
+
+	binary.LittleEndian.PutUint32(body[0:], lapicAddr)
+	binary.LittleEndian.PutUint32(body[4:], madtPCATCompat)
+
+	for i := 0; i < nCPUs; i++ {
+		flags := uint32(lapicOnlineCapable)
+		if i < present {
+			flags = lapicEnabled
+		}
+
+		body = append(body, madtTypeLAPIC, 8, uint8(i), uint8(i))
+		body = binary.LittleEndian.AppendUint32(body, flags)
+	}
+
+	return &Table{Signature: "APIC", Revision: madtRev, Body: body}
+}
+
+// MemAffinity is a range of the guest physical memory in a NUMA node.
+type MemAffinity struct {
+	Node    uint32
+	Base    uint64
+	Size    uint64
+	Hotplug bool
+}
+
+// NewSRAT is a System Resource Affinity Table. cpuNodes[i] is the node of
+// the vCPU with the local APIC ID i.
+func NewSRAT(cpuNodes []uint32, mems []MemAffinity) *Table {
+	// The first reserved field is 1 for compatibility.
+	body := make([]byte, 12)
+	body[0] = 1
+
+	for apicID, node := range cpuNodes {
+		e := make([]byte, 16)
+		e[0], e[1] = sratTypeLAPIC, 16
+		e[2] = uint8(node)
+		e[3] = uint8(apicID)
+		binary.LittleEndian.PutUint32(e[4:], sratEnabled)
+		e[9], e[10], e[11] = uint8(node>>8), uint8(node>>16), uint8(node>>24)
+
+		body = append(body, e...)
+	}
+
+	for _, m := range mems {
+		flags := uint32(sratEnabled)
+		if m.Hotplug {
+			flags |= sratHotplug
+		}
+
+		e := make([]byte, 40)
+		e[0], e[1] = sratTypeMemory, 40
+		binary.LittleEndian.PutUint32(e[2:], m.Node)
+		binary.LittleEndian.PutUint64(e[8:], m.Base)
+		binary.LittleEndian.PutUint64(e[16:], m.Size)
+		binary.LittleEndian.PutUint32(e[28:], flags)
+
+		body = append(body, e...)
+	}
+
+	return &Table{Signature: "SRAT", Revision: sratRev, Body: body}
+}
+
+// NewSLIT is a System Locality Information Table with the distances
+// between n nodes.
+func NewSLIT(n int, distance func(i, j int) uint8) *Table {
+	body := binary.LittleEndian.AppendUint64(nil, uint64(n))
+
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			body = append(body, distance(i, j))
+		}
+	}
+
+	return &Table{Signature: "SLIT", Revision: slitRev, Body: body}
+}
@@ -0,0 +1,64 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	ErrReadOnly    = errors.New("block device is read-only")
+	ErrOutOfRange  = errors.New("access beyond the end of the block device")
+	ErrUnsupported = errors.New("unsupported image feature")
+)
+
+// Backend is the storage behind a virtio-blk device. Offsets and sizes are
+// in bytes of the virtual disk seen by the guest, regardless of how the
+// image lays them out on the host.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Size returns the virtual size of the disk in bytes.
+	Size() uint64
+	Sync() error
+	Close() error
+}
+
+// Open opens the disk image at path for reading and writing.
+// The image format is selected by its header: qcow2 images
+// are recognized by their magic, anything else is used as raw.
+func Open(path string) (Backend, error) {
+	return open(path, os.O_RDWR, 0)
+}
+
+// OpenReadOnly is like Open, but writes to the returned Backend fail.
+func OpenReadOnly(path string) (Backend, error) {
+	return open(path, os.O_RDONLY, 0)
+}
+
+// open opens the image at path, which is the backing file of depth images.
+func open(path string, flag int, depth int) (Backend, error) {
+	file, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(qcow2Magic))
+
+	// Character devices such as /dev/zero and short files simply fall
+	// back to raw.
+	if n, _ := file.ReadAt(magic, 0); n == len(magic) && bytes.Equal(magic, qcow2Magic) {
+		q, err := newQCOW2(file, path, flag == os.O_RDONLY, depth)
+		if err != nil {
+			file.Close()
+
+			return nil, err
+		}
+
+		return q, nil
+	}
+
+	return newRaw(file, flag == os.O_RDONLY)
+}
@@ -0,0 +1,61 @@
+package block_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/block"
+)
+
+func TestOpenRaw(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 0x1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := block.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, ok := d.(*block.Raw); !ok {
+		t.Fatalf("expected *block.Raw, actual: %T", d)
+	}
+
+	if d.Size() != 0x1000 {
+		t.Fatalf("expected: %v, actual: %v", 0x1000, d.Size())
+	}
+
+	expected := []byte{0xde, 0xad, 0xbe, 0xef}
+	if _, err := d.WriteAt(expected, 0x200); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := make([]byte, 4)
+	if _, err := d.ReadAt(actual, 0x200); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestOpenDevZero(t *testing.T) {
+	t.Parallel()
+
+	d, err := block.Open("/dev/zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if d.Size() != 0 {
+		t.Fatalf("expected: 0, actual: %v", d.Size())
+	}
+}
@@ -0,0 +1,123 @@
+package block
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrEngineClosed = errors.New("I/O engine is closed")
+
+type Op uint8
+
+const (
+	OpRead Op = iota
+	OpWrite
+	OpFlush
+)
+
+// Request is a single asynchronous I/O on a Backend.
+type Request struct {
+	Op  Op
+	Buf []byte
+	Off int64
+
+	// Done is called exactly once, from an arbitrary goroutine, when the
+	// request has completed. Requests may complete in any order.
+	Done func(err error)
+}
+
+// Engine runs many requests against a Backend concurrently.
+type Engine interface {
+	Submit(req *Request)
+	Close() error
+}
+
+// NewEngine returns an io_uring based Engine for raw images if the kernel
+// supports it, and a pool of depth goroutines otherwise.
+func NewEngine(b Backend, depth int) Engine {
+	if r, ok := b.(*Raw); ok {
+		if u, err := newURing(r, depth); err == nil {
+			return u
+		}
+	}
+
+	return newPool(b, depth)
+}
+
+// pool is an Engine that runs the synchronous Backend calls on a fixed set
+// of worker goroutines.
+type pool struct {
+	backend Backend
+	reqs    chan *Request
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newPool(b Backend, workers int) *pool {
+	p := &pool{
+		backend: b,
+		reqs:    make(chan *Request, workers),
+	}
+
+	p.wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+
+	return p
+}
+
+func (p *pool) worker() {
+	defer p.wg.Done()
+
+	for req := range p.reqs {
+		req.Done(do(p.backend, req))
+	}
+}
+
+func do(b Backend, req *Request) error {
+	var err error
+
+	switch req.Op {
+	case OpRead:
+		_, err = b.ReadAt(req.Buf, req.Off)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+	case OpWrite:
+		_, err = b.WriteAt(req.Buf, req.Off)
+	case OpFlush:
+		err = b.Sync()
+	}
+
+	return err
+}
+
+func (p *pool) Submit(req *Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		req.Done(ErrEngineClosed)
+
+		return
+	}
+
+	p.reqs <- req
+}
+
+// Close waits for the requests in flight, the Backend is left open.
+func (p *pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	close(p.reqs)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package block_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/block"
+)
+
+func testEngine(t *testing.T, d block.Backend) { // nolint:thelper
+	e := block.NewEngine(d, 8)
+
+	const n = 64
+
+	errs := make(chan error, n)
+
+	// Many more requests than the engine has room for.
+	for i := 0; i < n; i++ {
+		e.Submit(&block.Request{
+			Op:   block.OpWrite,
+			Buf:  bytes.Repeat([]byte{byte(i)}, 0x200),
+			Off:  int64(i) * 0x200,
+			Done: func(err error) { errs <- err },
+		})
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.Submit(&block.Request{Op: block.OpFlush, Done: func(err error) { errs <- err }})
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	bufs := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		bufs[i] = make([]byte, 0x200)
+		e.Submit(&block.Request{
+			Op:   block.OpRead,
+			Buf:  bufs[i],
+			Off:  int64(i) * 0x200,
+			Done: func(err error) { errs <- err },
+		})
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if !bytes.Equal(bytes.Repeat([]byte{byte(i)}, 0x200), bufs[i]) {
+			t.Fatalf("sector %d: unexpected data %v", i, bufs[i][:4])
+		}
+	}
+
+	// Reading beyond the end of the disk fails.
+	e.Submit(&block.Request{
+		Op:   block.OpRead,
+		Buf:  make([]byte, 0x200),
+		Off:  int64(d.Size()),
+		Done: func(err error) { errs <- err },
+	})
+
+	if err := <-errs; !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected: %v, actual: %v", io.ErrUnexpectedEOF, err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineRaw(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 0x10000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := block.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	testEngine(t, d)
+}
+
+func TestEngineQCOW2(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := block.CreateQCOW2(path, 0x10000, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := block.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	testEngine(t, d)
+}
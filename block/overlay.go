@@ -0,0 +1,269 @@
+package block
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// OverlayBlockSize is the granularity at which an Overlay tracks
+// modified data.
+const OverlayBlockSize = 4096
+
+// Committer is implemented by backends that buffer writes and can merge
+// them back into the underlying image.
+type Committer interface {
+	Commit() error
+}
+
+// Overlay is a copy-on-write Backend for ephemeral snapshots. The base
+// image is opened read-only and every write goes to a sparse, already
+// unlinked temporary file of the same size. A bitmap records which blocks
+// have been written, reads of all other blocks fall through to the base.
+type Overlay struct {
+	mu sync.Mutex
+
+	path string
+	size uint64
+	base Backend
+	file *os.File
+
+	// One bit per OverlayBlockSize bytes, set once the block is in file.
+	bitmap []uint64
+}
+
+// NewOverlay opens the image at path read-only and creates its overlay in
+// dir, or in the default temporary directory if dir is empty.
+func NewOverlay(path, dir string) (*Overlay, error) {
+	base, err := OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(dir, "gokvm-snapshot-*.img")
+	if err != nil {
+		base.Close()
+
+		return nil, err
+	}
+
+	// Nobody else needs to see the overlay, and it must not outlive us.
+	if err := os.Remove(file.Name()); err != nil {
+		base.Close()
+		file.Close()
+
+		return nil, err
+	}
+
+	if err := file.Truncate(int64(base.Size())); err != nil {
+		base.Close()
+		file.Close()
+
+		return nil, err
+	}
+
+	blocks := (base.Size() + OverlayBlockSize - 1) / OverlayBlockSize
+
+	return &Overlay{
+		path:   path,
+		size:   base.Size(),
+		base:   base,
+		file:   file,
+		bitmap: make([]uint64, (blocks+63)/64),
+	}, nil
+}
+
+func (o *Overlay) isDirty(blk uint64) bool {
+	return o.bitmap[blk/64]&(1<<(blk%64)) != 0
+}
+
+func (o *Overlay) setDirty(blk uint64) {
+	o.bitmap[blk/64] |= 1 << (blk % 64)
+}
+
+func (o *Overlay) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if off < 0 {
+		return 0, ErrOutOfRange
+	}
+
+	var err error
+
+	n := len(p)
+	if uint64(off) >= o.Size() {
+		return 0, io.EOF
+	} else if uint64(off)+uint64(n) > o.Size() {
+		n = int(o.Size() - uint64(off))
+		err = io.EOF
+	}
+
+	for done := 0; done < n; {
+		pos := uint64(off) + uint64(done)
+		l := OverlayBlockSize - pos%OverlayBlockSize
+
+		if l > uint64(n-done) {
+			l = uint64(n - done)
+		}
+
+		var src io.ReaderAt = o.base
+		if o.isDirty(pos / OverlayBlockSize) {
+			src = o.file
+		}
+
+		if _, err := src.ReadAt(p[done:done+int(l)], int64(pos)); err != nil && !errors.Is(err, io.EOF) {
+			return done, err
+		}
+
+		done += int(l)
+	}
+
+	return n, err
+}
+
+func (o *Overlay) WriteAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if off < 0 || uint64(off)+uint64(len(p)) > o.Size() {
+		return 0, ErrOutOfRange
+	}
+
+	for done := 0; done < len(p); {
+		pos := uint64(off) + uint64(done)
+		blk := pos / OverlayBlockSize
+		l := OverlayBlockSize - pos%OverlayBlockSize
+
+		if l > uint64(len(p)-done) {
+			l = uint64(len(p) - done)
+		}
+
+		// The first partial write to a block has to bring in the rest of
+		// it from the base image.
+		if !o.isDirty(blk) && l != OverlayBlockSize {
+			if err := o.copyUp(blk); err != nil {
+				return done, err
+			}
+		}
+
+		if _, err := o.file.WriteAt(p[done:done+int(l)], int64(pos)); err != nil {
+			return done, err
+		}
+
+		o.setDirty(blk)
+
+		done += int(l)
+	}
+
+	return len(p), nil
+}
+
+func (o *Overlay) copyUp(blk uint64) error {
+	b := make([]byte, OverlayBlockSize)
+	off := int64(blk * OverlayBlockSize)
+
+	n, err := o.base.ReadAt(b, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	_, err = o.file.WriteAt(b[:n], off)
+
+	return err
+}
+
+// Commit writes every modified block back to the base image and empties
+// the overlay. The guest keeps running on top of the updated base.
+func (o *Overlay) Commit() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	base, err := Open(o.path)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, OverlayBlockSize)
+
+	for blk := uint64(0); blk < uint64(len(o.bitmap))*64; blk++ {
+		if o.bitmap[blk/64] == 0 {
+			blk += 63
+
+			continue
+		}
+
+		if !o.isDirty(blk) {
+			continue
+		}
+
+		off := int64(blk * OverlayBlockSize)
+
+		n, err := o.file.ReadAt(b, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			base.Close()
+
+			return err
+		}
+
+		if _, err := base.WriteAt(b[:n], off); err != nil {
+			base.Close()
+
+			return err
+		}
+	}
+
+	if err := base.Sync(); err != nil {
+		base.Close()
+
+		return err
+	}
+
+	if err := base.Close(); err != nil {
+		return err
+	}
+
+	// The read-only handle may have cached metadata of the old image. The
+	// old one is only closed once the new one is in place, so that reads
+	// keep working if the image cannot be opened again.
+	reopened, err := OpenReadOnly(o.path)
+	if err != nil {
+		return err
+	}
+
+	old := o.base
+	o.base = reopened
+
+	if err := old.Close(); err != nil {
+		return err
+	}
+
+	for i := range o.bitmap {
+		o.bitmap[i] = 0
+	}
+
+	// Give the space back to the host.
+	if err := o.file.Truncate(0); err != nil {
+		return err
+	}
+
+	return o.file.Truncate(int64(o.size))
+}
+
+func (o *Overlay) Size() uint64 {
+	return o.size
+}
+
+// Sync is a no-op, the overlay does not survive the process anyway.
+func (o *Overlay) Sync() error {
+	return nil
+}
+
+func (o *Overlay) Close() error {
+	if err := o.base.Close(); err != nil {
+		return err
+	}
+
+	return o.file.Close()
+}
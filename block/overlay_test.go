@@ -0,0 +1,75 @@
+package block_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/block"
+)
+
+func TestOverlay(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "golden.img")
+
+	base := bytes.Repeat([]byte{0x55}, 3*block.OverlayBlockSize)
+	if err := os.WriteFile(path, base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := block.NewOverlay(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	// Straddle the first two blocks.
+	if _, err := o.WriteAt([]byte{0x11, 0x22, 0x33, 0x44}, block.OverlayBlockSize-2); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{0x55, 0x11, 0x22, 0x33, 0x44, 0x55}
+	actual := make([]byte, len(expected))
+
+	if _, err := o.ReadAt(actual, block.OverlayBlockSize-3); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(base, golden) {
+		t.Fatal("base image was modified before commit")
+	}
+
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	golden, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, golden[block.OverlayBlockSize-3:block.OverlayBlockSize+3]) {
+		t.Fatalf("expected: %v, actual: %v", expected, golden[block.OverlayBlockSize-3:block.OverlayBlockSize+3])
+	}
+
+	// Reads now come from the updated base.
+	if _, err := o.ReadAt(actual, block.OverlayBlockSize-3); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
@@ -0,0 +1,880 @@
+package block
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// QCOW2 image format, versions 2 and 3.
+//
+// refs https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	qcow2HeaderV2Len = 72
+	qcow2HeaderV3Len = 104
+
+	// Bits 9-55 of L1, L2 and refcount table entries hold a host offset.
+	qcow2OffsetMask = 0x00ff_ffff_ffff_fe00
+
+	// The refcount of the cluster is exactly one, so it may be written in place.
+	qcow2Copied     = uint64(1) << 63
+	qcow2Compressed = uint64(1) << 62
+	// Version 3 only: the cluster reads as all zeros.
+	qcow2ZeroFlag = uint64(1)
+
+	qcow2IncompatDirty = uint64(1) << 0
+
+	// Offset of the refcount table fields in the header, used when the
+	// table has to be moved to grow it.
+	qcow2RefcountTableOffsetPos = 48
+
+	// Defaults for CreateQCOW2, the same as qemu-img uses.
+	qcow2DefaultClusterBits   = 16
+	qcow2DefaultRefcountOrder = 4
+
+	// The longest backing file name, as in QEMU, and the longest chain of
+	// backing files, so that an image which is its own backing file is
+	// rejected.
+	qcow2MaxBackingFileSize = 1023
+	qcow2MaxBackingDepth    = 16
+
+	// The largest L1 and refcount tables, in bytes, as in QEMU.
+	qcow2MaxL1Size            = 32 << 20
+	qcow2MaxRefcountTableSize = 8 << 20
+
+	// Upper bound for cached L2 tables and refcount blocks. When it is reached
+	// the cache is simply dropped.
+	qcow2MaxCachedTables = 512
+)
+
+var (
+	ErrQCOW2BadHeader = errors.New("invalid qcow2 header")
+	ErrQCOW2Corrupt   = errors.New("qcow2 image is corrupt")
+)
+
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// Version 3 and later.
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+// QCOW2 is a Backend for qcow2 images. Clusters are allocated at the end
+// of the image file when they are first written, and reads of unallocated
+// clusters fall through to the backing file, if there is one.
+type QCOW2 struct {
+	mu sync.Mutex
+
+	file     *os.File
+	readOnly bool
+	hdr      qcow2Header
+	backing  Backend
+
+	clusterSize  uint64
+	l2Entries    uint64 // entries per L2 table
+	refcountBits uint64
+
+	l1            []uint64
+	refcountTable []uint64
+
+	l2Cache       map[uint64][]uint64
+	refblockCache map[uint64][]byte
+
+	// end is the host offset of the next cluster to be allocated.
+	end uint64
+}
+
+func newQCOW2(file *os.File, path string, readOnly bool, depth int) (*QCOW2, error) {
+	q := &QCOW2{
+		file:          file,
+		readOnly:      readOnly,
+		l2Cache:       map[uint64][]uint64{},
+		refblockCache: map[uint64][]byte{},
+	}
+
+	if err := q.readHeader(); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	q.end = q.alignUp(uint64(fileInfo.Size()))
+
+	if q.l1, err = q.readTable(q.hdr.L1TableOffset, uint64(q.hdr.L1Size)); err != nil {
+		return nil, err
+	}
+
+	if q.refcountTable, err = q.readTable(q.hdr.RefcountTableOffset,
+		uint64(q.hdr.RefcountTableClusters)*q.clusterSize/8); err != nil {
+		return nil, err
+	}
+
+	if q.hdr.BackingFileOffset != 0 {
+		if err := q.openBacking(path, depth); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func (q *QCOW2) readHeader() error {
+	b := make([]byte, qcow2HeaderV3Len)
+	if _, err := q.file.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &q.hdr); err != nil {
+		return err
+	}
+
+	h := &q.hdr
+
+	switch h.Version {
+	case 2:
+		h.IncompatibleFeatures = 0
+		h.CompatibleFeatures = 0
+		h.AutoclearFeatures = 0
+		h.RefcountOrder = 4
+		h.HeaderLength = qcow2HeaderV2Len
+	case 3:
+		if h.HeaderLength < qcow2HeaderV3Len {
+			return fmt.Errorf("%w: header length %d", ErrQCOW2BadHeader, h.HeaderLength)
+		}
+	default:
+		return fmt.Errorf("%w: version %d", ErrUnsupported, h.Version)
+	}
+
+	if h.ClusterBits < 9 || h.ClusterBits > 21 {
+		return fmt.Errorf("%w: cluster bits %d", ErrQCOW2BadHeader, h.ClusterBits)
+	}
+
+	if h.RefcountOrder > 6 {
+		return fmt.Errorf("%w: refcount order %d", ErrQCOW2BadHeader, h.RefcountOrder)
+	}
+
+	if h.CryptMethod != 0 {
+		return fmt.Errorf("%w: encryption", ErrUnsupported)
+	}
+
+	// Apart from the dirty bit, every incompatible feature changes the
+	// on-disk layout. A dirty image may have stale refcounts, which would
+	// let us hand out clusters that are still in use.
+	if h.IncompatibleFeatures&qcow2IncompatDirty != 0 {
+		return fmt.Errorf("%w: image is dirty, run 'qemu-img check -r all' first", ErrUnsupported)
+	}
+
+	if h.IncompatibleFeatures != 0 {
+		return fmt.Errorf("%w: incompatible features %#x", ErrUnsupported, h.IncompatibleFeatures)
+	}
+
+	if h.BackingFileSize > qcow2MaxBackingFileSize {
+		return fmt.Errorf("%w: backing file name of %d bytes", ErrQCOW2BadHeader, h.BackingFileSize)
+	}
+
+	q.clusterSize = 1 << h.ClusterBits
+	q.l2Entries = q.clusterSize / 8
+	q.refcountBits = 1 << h.RefcountOrder
+
+	if uint64(h.L1Size)*8 > qcow2MaxL1Size {
+		return fmt.Errorf("%w: L1 table of %d entries", ErrQCOW2BadHeader, h.L1Size)
+	}
+
+	if uint64(h.RefcountTableClusters)*q.clusterSize > qcow2MaxRefcountTableSize {
+		return fmt.Errorf("%w: refcount table of %d clusters", ErrQCOW2BadHeader, h.RefcountTableClusters)
+	}
+
+	// Divided, as the size may be anything.
+	perL1 := q.l2Entries * q.clusterSize
+	if l1Size := h.Size / perL1; l1Size > uint64(h.L1Size) ||
+		l1Size == uint64(h.L1Size) && h.Size%perL1 != 0 {
+		return fmt.Errorf("%w: L1 table too small for %d bytes", ErrQCOW2BadHeader, h.Size)
+	}
+
+	return nil
+}
+
+func (q *QCOW2) openBacking(path string, depth int) error {
+	if depth >= qcow2MaxBackingDepth {
+		return fmt.Errorf("%w: more than %d backing files", ErrUnsupported, qcow2MaxBackingDepth)
+	}
+
+	name := make([]byte, q.hdr.BackingFileSize)
+	if _, err := q.file.ReadAt(name, int64(q.hdr.BackingFileOffset)); err != nil {
+		return fmt.Errorf("backing file name: %w", err)
+	}
+
+	backingPath := string(name)
+	if !filepath.IsAbs(backingPath) {
+		backingPath = filepath.Join(filepath.Dir(path), backingPath)
+	}
+
+	backing, err := open(backingPath, os.O_RDONLY, depth+1)
+	if err != nil {
+		return fmt.Errorf("backing file: %w", err)
+	}
+
+	q.backing = backing
+
+	return nil
+}
+
+func (q *QCOW2) alignUp(off uint64) uint64 {
+	return (off + q.clusterSize - 1) &^ (q.clusterSize - 1)
+}
+
+func (q *QCOW2) readTable(off, n uint64) ([]uint64, error) {
+	if off > q.end || n*8 > q.end-off {
+		return nil, fmt.Errorf("%w: table at %#x past the end of the file", ErrQCOW2Corrupt, off)
+	}
+
+	b := make([]byte, n*8)
+	if _, err := q.file.ReadAt(b, int64(off)); err != nil {
+		return nil, err
+	}
+
+	t := make([]uint64, n)
+	for i := range t {
+		t[i] = binary.BigEndian.Uint64(b[i*8:])
+	}
+
+	return t, nil
+}
+
+func (q *QCOW2) writeEntry(off, val uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, val)
+
+	_, err := q.file.WriteAt(b, int64(off))
+
+	return err
+}
+
+func (q *QCOW2) l2Table(off uint64) ([]uint64, error) {
+	if t, ok := q.l2Cache[off]; ok {
+		return t, nil
+	}
+
+	t, err := q.readTable(off, q.l2Entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(q.l2Cache) >= qcow2MaxCachedTables {
+		q.l2Cache = map[uint64][]uint64{}
+	}
+
+	q.l2Cache[off] = t
+
+	return t, nil
+}
+
+// l2Entry returns the L2 entry for the guest cluster, or 0 if no L2 table
+// is allocated for it.
+func (q *QCOW2) l2Entry(cluster uint64) (uint64, error) {
+	l1Idx := cluster / q.l2Entries
+	if l1Idx >= uint64(len(q.l1)) {
+		return 0, ErrOutOfRange
+	}
+
+	l2Off := q.l1[l1Idx] & qcow2OffsetMask
+	if l2Off == 0 {
+		return 0, nil
+	}
+
+	t, err := q.l2Table(l2Off)
+	if err != nil {
+		return 0, err
+	}
+
+	return t[cluster%q.l2Entries], nil
+}
+
+func (q *QCOW2) ReadAt(p []byte, off int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if off < 0 {
+		return 0, ErrOutOfRange
+	}
+
+	var err error
+
+	n := len(p)
+	if uint64(off) >= q.hdr.Size {
+		return 0, io.EOF
+	} else if uint64(off)+uint64(n) > q.hdr.Size {
+		n = int(q.hdr.Size - uint64(off))
+		err = io.EOF
+	}
+
+	for done := 0; done < n; {
+		pos := uint64(off) + uint64(done)
+		inOff := pos % q.clusterSize
+		l := q.clusterSize - inOff
+
+		if l > uint64(n-done) {
+			l = uint64(n - done)
+		}
+
+		if err := q.readCluster(p[done:done+int(l)], pos/q.clusterSize, inOff); err != nil {
+			return done, err
+		}
+
+		done += int(l)
+	}
+
+	return n, err
+}
+
+// readCluster fills p with data of the guest cluster starting at inOff.
+func (q *QCOW2) readCluster(p []byte, cluster, inOff uint64) error {
+	entry, err := q.l2Entry(cluster)
+	if err != nil {
+		return err
+	}
+
+	hostOff := entry & qcow2OffsetMask
+
+	switch {
+	case entry&qcow2Compressed != 0:
+		data, err := q.readCompressed(entry)
+		if err != nil {
+			return err
+		}
+
+		copy(p, data[inOff:])
+	case entry&qcow2ZeroFlag != 0:
+		zero(p)
+	case hostOff != 0:
+		if _, err := q.file.ReadAt(p, int64(hostOff+inOff)); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	default:
+		return q.readBacking(p, cluster*q.clusterSize+inOff)
+	}
+
+	return nil
+}
+
+func (q *QCOW2) readBacking(p []byte, off uint64) error {
+	if q.backing == nil || off >= q.backing.Size() {
+		zero(p)
+
+		return nil
+	}
+
+	// The backing file may be smaller than this image.
+	n := uint64(len(p))
+	if off+n > q.backing.Size() {
+		n = q.backing.Size() - off
+		zero(p[n:])
+	}
+
+	if _, err := q.backing.ReadAt(p[:n], int64(off)); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+func (q *QCOW2) readCompressed(entry uint64) ([]byte, error) {
+	// Bits 0 to x-1 hold the host offset, bits x to 61 the number of
+	// additional 512-byte sectors used by the compressed data.
+	x := 62 - (q.hdr.ClusterBits - 8)
+	hostOff := entry & (uint64(1)<<x - 1)
+	sectors := (entry>>x)&(uint64(1)<<(q.hdr.ClusterBits-8)-1) + 1
+	size := sectors*512 - hostOff%512
+
+	compressed := make([]byte, size)
+
+	n, err := q.file.ReadAt(compressed, int64(hostOff))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	data := make([]byte, q.clusterSize)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), data); err != nil {
+		return nil, fmt.Errorf("%w: compressed cluster at %#x: %v", ErrQCOW2Corrupt, hostOff, err)
+	}
+
+	return data, nil
+}
+
+func (q *QCOW2) WriteAt(p []byte, off int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if off < 0 || uint64(off)+uint64(len(p)) > q.hdr.Size {
+		return 0, ErrOutOfRange
+	}
+
+	for done := 0; done < len(p); {
+		pos := uint64(off) + uint64(done)
+		inOff := pos % q.clusterSize
+		l := q.clusterSize - inOff
+
+		if l > uint64(len(p)-done) {
+			l = uint64(len(p) - done)
+		}
+
+		if err := q.writeCluster(p[done:done+int(l)], pos/q.clusterSize, inOff); err != nil {
+			return done, err
+		}
+
+		done += int(l)
+	}
+
+	return len(p), nil
+}
+
+func (q *QCOW2) writeCluster(p []byte, cluster, inOff uint64) error {
+	l2Off, err := q.writableL2Table(cluster / q.l2Entries)
+	if err != nil {
+		return err
+	}
+
+	t, err := q.l2Table(l2Off)
+	if err != nil {
+		return err
+	}
+
+	idx := cluster % q.l2Entries
+	entry := t[idx]
+	hostOff := entry & qcow2OffsetMask
+
+	// The common case: the cluster belongs to this image only and holds
+	// plain data.
+	if entry&qcow2Copied != 0 && entry&(qcow2Compressed|qcow2ZeroFlag) == 0 && hostOff != 0 {
+		_, err := q.file.WriteAt(p, int64(hostOff+inOff))
+
+		return err
+	}
+
+	// Otherwise the rest of the cluster has to be preserved, either from
+	// the shared or compressed cluster, the backing file, or zeros.
+	data := make([]byte, q.clusterSize)
+	if uint64(len(p)) != q.clusterSize {
+		if err := q.readCluster(data, cluster, 0); err != nil {
+			return err
+		}
+	}
+
+	copy(data[inOff:], p)
+
+	newOff := hostOff
+	if entry&qcow2Copied == 0 || entry&qcow2Compressed != 0 || hostOff == 0 {
+		if newOff, err = q.allocCluster(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.file.WriteAt(data, int64(newOff)); err != nil {
+		return err
+	}
+
+	t[idx] = newOff | qcow2Copied
+	if err := q.writeEntry(l2Off+idx*8, t[idx]); err != nil {
+		return err
+	}
+
+	// A cluster shared with a snapshot loses one reference. Compressed
+	// clusters may share host clusters with each other, so they are
+	// leaked rather than freed.
+	if entry&(qcow2Copied|qcow2Compressed) == 0 && hostOff != 0 {
+		return q.addRefcount(hostOff/q.clusterSize, -1)
+	}
+
+	return nil
+}
+
+// writableL2Table returns the host offset of an L2 table that may be
+// modified in place, allocating or copying it as needed.
+func (q *QCOW2) writableL2Table(l1Idx uint64) (uint64, error) {
+	if l1Idx >= uint64(len(q.l1)) {
+		return 0, ErrOutOfRange
+	}
+
+	entry := q.l1[l1Idx]
+	oldOff := entry & qcow2OffsetMask
+
+	if entry&qcow2Copied != 0 && oldOff != 0 {
+		return oldOff, nil
+	}
+
+	newOff, err := q.allocCluster()
+	if err != nil {
+		return 0, err
+	}
+
+	t := make([]uint64, q.l2Entries)
+
+	if oldOff != 0 {
+		old, err := q.l2Table(oldOff)
+		if err != nil {
+			return 0, err
+		}
+
+		// Every data cluster is now referenced by one more L2 table,
+		// so none of them may be written in place any more.
+		for i, e := range old {
+			t[i] = e &^ qcow2Copied
+
+			if off := e & qcow2OffsetMask; off != 0 && e&qcow2Compressed == 0 {
+				if err := q.addRefcount(off/q.clusterSize, 1); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	b := make([]byte, q.clusterSize)
+	for i, e := range t {
+		binary.BigEndian.PutUint64(b[i*8:], e)
+	}
+
+	if _, err := q.file.WriteAt(b, int64(newOff)); err != nil {
+		return 0, err
+	}
+
+	q.l2Cache[newOff] = t
+
+	q.l1[l1Idx] = newOff | qcow2Copied
+	if err := q.writeEntry(q.hdr.L1TableOffset+l1Idx*8, q.l1[l1Idx]); err != nil {
+		return 0, err
+	}
+
+	if oldOff != 0 {
+		if err := q.addRefcount(oldOff/q.clusterSize, -1); err != nil {
+			return 0, err
+		}
+	}
+
+	return newOff, nil
+}
+
+// allocCluster reserves a new cluster at the end of the image file.
+// Freed clusters are never reused.
+func (q *QCOW2) allocCluster() (uint64, error) {
+	off := q.end
+	q.end += q.clusterSize
+
+	if err := q.setRefcount(off/q.clusterSize, 1); err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+func (q *QCOW2) refblock(off uint64) ([]byte, error) {
+	if b, ok := q.refblockCache[off]; ok {
+		return b, nil
+	}
+
+	b := make([]byte, q.clusterSize)
+	if _, err := q.file.ReadAt(b, int64(off)); err != nil {
+		return nil, err
+	}
+
+	if len(q.refblockCache) >= qcow2MaxCachedTables {
+		q.refblockCache = map[uint64][]byte{}
+	}
+
+	q.refblockCache[off] = b
+
+	return b, nil
+}
+
+// refcountPos returns the byte range of the refcount entry within its
+// refcount block, and for entries narrower than a byte the bit shift.
+func (q *QCOW2) refcountPos(idx uint64) (uint64, uint64, uint64) {
+	if q.refcountBits < 8 {
+		bit := idx * q.refcountBits
+
+		return bit / 8, 1, bit % 8
+	}
+
+	return idx * q.refcountBits / 8, q.refcountBits / 8, 0
+}
+
+func (q *QCOW2) refcount(cluster uint64) (uint64, error) {
+	perBlock := q.clusterSize * 8 / q.refcountBits
+	tIdx := cluster / perBlock
+
+	if tIdx >= uint64(len(q.refcountTable)) || q.refcountTable[tIdx]&qcow2OffsetMask == 0 {
+		return 0, nil
+	}
+
+	b, err := q.refblock(q.refcountTable[tIdx] & qcow2OffsetMask)
+	if err != nil {
+		return 0, err
+	}
+
+	pos, size, shift := q.refcountPos(cluster % perBlock)
+
+	var v uint64
+	for _, x := range b[pos : pos+size] {
+		v = v<<8 | uint64(x)
+	}
+
+	return (v >> shift) & (uint64(1)<<q.refcountBits - 1), nil
+}
+
+func (q *QCOW2) addRefcount(cluster uint64, delta int64) error {
+	v, err := q.refcount(cluster)
+	if err != nil {
+		return err
+	}
+
+	if delta < 0 && v == 0 {
+		return fmt.Errorf("%w: refcount of cluster %d underflows", ErrQCOW2Corrupt, cluster)
+	}
+
+	return q.setRefcount(cluster, uint64(int64(v)+delta))
+}
+
+func (q *QCOW2) setRefcount(cluster, val uint64) error {
+	perBlock := q.clusterSize * 8 / q.refcountBits
+	tIdx := cluster / perBlock
+
+	if q.refcountBits < 64 && val >= uint64(1)<<q.refcountBits {
+		return fmt.Errorf("%w: refcount of cluster %d overflows", ErrUnsupported, cluster)
+	}
+
+	if tIdx >= uint64(len(q.refcountTable)) {
+		if err := q.growRefcountTable(tIdx + 1); err != nil {
+			return err
+		}
+	}
+
+	blockOff := q.refcountTable[tIdx] & qcow2OffsetMask
+	if blockOff == 0 {
+		blockOff = q.end
+		q.end += q.clusterSize
+
+		b := make([]byte, q.clusterSize)
+		if _, err := q.file.WriteAt(b, int64(blockOff)); err != nil {
+			return err
+		}
+
+		q.refblockCache[blockOff] = b
+
+		q.refcountTable[tIdx] = blockOff
+		if err := q.writeEntry(q.hdr.RefcountTableOffset+tIdx*8, blockOff); err != nil {
+			return err
+		}
+
+		// The new refcount block has to account for itself, which
+		// may well happen in the block itself.
+		if err := q.setRefcount(blockOff/q.clusterSize, 1); err != nil {
+			return err
+		}
+	}
+
+	b, err := q.refblock(blockOff)
+	if err != nil {
+		return err
+	}
+
+	pos, size, shift := q.refcountPos(cluster % perBlock)
+
+	var v uint64
+	for _, x := range b[pos : pos+size] {
+		v = v<<8 | uint64(x)
+	}
+
+	mask := (uint64(1)<<q.refcountBits - 1) << shift
+	v = v&^mask | val<<shift
+
+	for i := int(size) - 1; i >= 0; i-- {
+		b[pos+uint64(i)] = byte(v)
+		v >>= 8
+	}
+
+	_, err = q.file.WriteAt(b[pos:pos+size], int64(blockOff+pos))
+
+	return err
+}
+
+// growRefcountTable moves the refcount table to the end of the image,
+// making room for at least n entries.
+func (q *QCOW2) growRefcountTable(n uint64) error {
+	perBlock := q.clusterSize * 8 / q.refcountBits
+	entries := uint64(len(q.refcountTable))
+	if entries == 0 {
+		entries = 1
+	}
+
+	// Leave room for the refcounts of the new table itself and the
+	// refcount blocks that may have to be allocated for it.
+	for entries < n || entries*perBlock < q.end/q.clusterSize+entries*8/q.clusterSize+64 {
+		entries *= 2
+	}
+
+	clusters := q.alignUp(entries*8) / q.clusterSize
+	entries = clusters * q.clusterSize / 8
+
+	oldOff := q.hdr.RefcountTableOffset
+	oldClusters := uint64(q.hdr.RefcountTableClusters)
+
+	newOff := q.end
+	q.end += clusters * q.clusterSize
+
+	t := make([]uint64, entries)
+	copy(t, q.refcountTable)
+
+	b := make([]byte, clusters*q.clusterSize)
+	for i, e := range t {
+		binary.BigEndian.PutUint64(b[i*8:], e)
+	}
+
+	if _, err := q.file.WriteAt(b, int64(newOff)); err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 12)
+	binary.BigEndian.PutUint64(hdr, newOff)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(clusters))
+
+	if _, err := q.file.WriteAt(hdr, qcow2RefcountTableOffsetPos); err != nil {
+		return err
+	}
+
+	q.refcountTable = t
+	q.hdr.RefcountTableOffset = newOff
+	q.hdr.RefcountTableClusters = uint32(clusters)
+
+	for i := uint64(0); i < clusters; i++ {
+		if err := q.setRefcount(newOff/q.clusterSize+i, 1); err != nil {
+			return err
+		}
+	}
+
+	for i := uint64(0); i < oldClusters; i++ {
+		if err := q.setRefcount(oldOff/q.clusterSize+i, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q *QCOW2) Size() uint64 {
+	return q.hdr.Size
+}
+
+func (q *QCOW2) Sync() error {
+	if q.readOnly {
+		return nil
+	}
+
+	return q.file.Sync()
+}
+
+func (q *QCOW2) Close() error {
+	if q.backing != nil {
+		if err := q.backing.Close(); err != nil {
+			return err
+		}
+	}
+
+	return q.file.Close()
+}
+
+// CreateQCOW2 creates a version 3 qcow2 image with the given virtual size.
+// If backingFile is not empty, unallocated clusters read from it. Like
+// with qemu-img, a relative backingFile is relative to the new image.
+func CreateQCOW2(path string, size uint64, backingFile string) error {
+	const (
+		clusterSize = uint64(1) << qcow2DefaultClusterBits
+		l2Entries   = clusterSize / 8
+	)
+
+	l1Size := (size + clusterSize*l2Entries - 1) / (clusterSize * l2Entries)
+	l1Clusters := (l1Size*8 + clusterSize - 1) / clusterSize
+
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+
+	// Cluster 0 holds the header and the backing file name, cluster 1 the
+	// refcount table, cluster 2 its only refcount block, followed by the
+	// L1 table.
+	hdr := qcow2Header{
+		Version:               3,
+		ClusterBits:           qcow2DefaultClusterBits,
+		Size:                  size,
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         3 * clusterSize,
+		RefcountTableOffset:   clusterSize,
+		RefcountTableClusters: 1,
+		RefcountOrder:         qcow2DefaultRefcountOrder,
+		HeaderLength:          qcow2HeaderV3Len,
+	}
+	hdr.Magic = binary.BigEndian.Uint32(qcow2Magic)
+
+	if len(backingFile) > 0 {
+		// Leave room for the header extension end marker.
+		hdr.BackingFileOffset = qcow2HeaderV3Len + 8
+		hdr.BackingFileSize = uint32(len(backingFile))
+
+		if len(backingFile) > qcow2MaxBackingFileSize {
+			return fmt.Errorf("%w: backing file name too long", ErrQCOW2BadHeader)
+		}
+	}
+
+	img := make([]byte, (3+l1Clusters)*clusterSize)
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+
+	copy(img, buf.Bytes())
+	copy(img[hdr.BackingFileOffset:], backingFile)
+
+	binary.BigEndian.PutUint64(img[clusterSize:], 2*clusterSize)
+
+	for i := uint64(0); i < 3+l1Clusters; i++ {
+		binary.BigEndian.PutUint16(img[2*clusterSize+i*2:], 1)
+	}
+
+	return os.WriteFile(path, img, 0o644)
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
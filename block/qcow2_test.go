@@ -0,0 +1,235 @@
+package block_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/block"
+)
+
+func TestQCOW2ReadWrite(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := block.CreateQCOW2(path, 1<<30, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := block.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.(*block.QCOW2); !ok {
+		t.Fatalf("expected *block.QCOW2, actual: %T", d)
+	}
+
+	if d.Size() != 1<<30 {
+		t.Fatalf("expected: %v, actual: %v", 1<<30, d.Size())
+	}
+
+	// Unallocated clusters read as zeros.
+	actual := make([]byte, 0x200)
+	if _, err := d.ReadAt(actual, 0x1234_0000); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(actual, make([]byte, 0x200)) {
+		t.Fatalf("expected zeros, actual: %v", actual)
+	}
+
+	// Cross a cluster boundary and an L2 table boundary.
+	for _, off := range []int64{0x1_fff0, 512<<20 - 8, 0x3fff_fe00} {
+		expected := bytes.Repeat([]byte{0xaa, 0xbb, 0xcc, 0xdd}, 8)
+		if _, err := d.WriteAt(expected, off); err != nil {
+			t.Fatalf("WriteAt(%#x): %v", off, err)
+		}
+
+		actual := make([]byte, len(expected))
+		if _, err := d.ReadAt(actual, off); err != nil {
+			t.Fatalf("ReadAt(%#x): %v", off, err)
+		}
+
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("expected: %v, actual: %v", expected, actual)
+		}
+	}
+
+	if _, err := d.WriteAt([]byte{0}, 1<<30); !errors.Is(err, block.ErrOutOfRange) {
+		t.Fatalf("expected: %v, actual: %v", block.ErrOutOfRange, err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The data survives reopening the image.
+	d, err = block.OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	actual = make([]byte, 4)
+	if _, err := d.ReadAt(actual, 0x1_fff0); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte{0xaa, 0xbb, 0xcc, 0xdd}, actual) {
+		t.Fatalf("expected: %v, actual: %v", []byte{0xaa, 0xbb, 0xcc, 0xdd}, actual)
+	}
+
+	if _, err := d.WriteAt([]byte{0}, 0); !errors.Is(err, block.ErrReadOnly) {
+		t.Fatalf("expected: %v, actual: %v", block.ErrReadOnly, err)
+	}
+}
+
+func TestQCOW2BackingFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	base := bytes.Repeat([]byte{0x55}, 0x30000)
+	if err := os.WriteFile(filepath.Join(dir, "base.img"), base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "overlay.qcow2")
+	if err := block.CreateQCOW2(path, 0x40000, "base.img"); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := block.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// A partial write copies the rest of the cluster from the backing file.
+	if _, err := d.WriteAt([]byte{0x11, 0x22}, 0x10000+0x100); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		off      int64
+		expected []byte
+	}{
+		{off: 0x0, expected: []byte{0x55, 0x55}},
+		{off: 0x100ff, expected: []byte{0x55, 0x11, 0x22, 0x55}},
+		// Beyond the end of the backing file.
+		{off: 0x2fffe, expected: []byte{0x55, 0x55, 0x00, 0x00}},
+	} {
+		actual := make([]byte, len(tt.expected))
+		if _, err := d.ReadAt(actual, tt.off); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(tt.expected, actual) {
+			t.Fatalf("%#x: expected: %v, actual: %v", tt.off, tt.expected, actual)
+		}
+	}
+
+	// The backing file is never modified.
+	actual, err := os.ReadFile(filepath.Join(dir, "base.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(base, actual) {
+		t.Fatal("backing file was modified")
+	}
+}
+
+func TestQCOW2BadHeader(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "bad.qcow2")
+	if err := os.WriteFile(path, []byte{'Q', 'F', 'I', 0xfb, 0, 0, 0, 9}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := block.Open(path); !errors.Is(err, block.ErrUnsupported) {
+		t.Fatalf("expected: %v, actual: %v", block.ErrUnsupported, err)
+	}
+}
+
+func TestQCOW2BackingChain(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// An image which is its own backing file.
+	path := filepath.Join(dir, "loop.qcow2")
+	if err := block.CreateQCOW2(path, 0x40000, "loop.qcow2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := block.Open(path); !errors.Is(err, block.ErrUnsupported) {
+		t.Fatalf("expected: %v, actual: %v", block.ErrUnsupported, err)
+	}
+
+	// A backing file name longer than QEMU allows.
+	path = filepath.Join(dir, "long.qcow2")
+	if err := block.CreateQCOW2(path, 0x40000, "base.img"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// BackingFileSize is at offset 16 of the header.
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	if _, err := block.Open(path); !errors.Is(err, block.ErrQCOW2BadHeader) {
+		t.Fatalf("expected: %v, actual: %v", block.ErrQCOW2BadHeader, err)
+	}
+}
+
+func TestQCOW2BadTables(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		off  int64
+		val  []byte
+		err  error
+	}{
+		// L1Size at offset 36, past the 32 MiB of QEMU.
+		{"l1size", 36, []byte{0xff, 0xff, 0xff, 0xff}, block.ErrQCOW2BadHeader},
+		// RefcountTableClusters at offset 56, past the 8 MiB of QEMU.
+		{"refcount", 56, []byte{0x00, 0x00, 0x10, 0x00}, block.ErrQCOW2BadHeader},
+		// Size at offset 24, more than the L1 table covers.
+		{"size", 24, []byte{0x40, 0, 0, 0, 0, 0, 0, 0}, block.ErrQCOW2BadHeader},
+		// L1TableOffset at offset 40, past the end of the file.
+		{"l1offset", 40, []byte{0, 0, 0, 0x10, 0, 0, 0, 0}, block.ErrQCOW2Corrupt},
+	} {
+		path := filepath.Join(t.TempDir(), tc.name+".qcow2")
+		if err := block.CreateQCOW2(path, 0x40000, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.WriteAt(tc.val, tc.off); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Close()
+
+		if _, err := block.Open(path); !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected: %v, actual: %v", tc.name, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package block
+
+import (
+	"io"
+	"os"
+)
+
+// Raw is a Backend for plain image files and host block devices,
+// where the guest offset equals the file offset.
+type Raw struct {
+	file     *os.File
+	size     uint64
+	readOnly bool
+}
+
+func newRaw(file *os.File, readOnly bool) (*Raw, error) {
+	// Seeking to the end also works for block devices,
+	// whose Stat size is always 0.
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Raw{
+		file:     file,
+		size:     uint64(size),
+		readOnly: readOnly,
+	}, nil
+}
+
+func (r *Raw) ReadAt(p []byte, off int64) (int, error) {
+	return r.file.ReadAt(p, off)
+}
+
+func (r *Raw) WriteAt(p []byte, off int64) (int, error) {
+	if r.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	return r.file.WriteAt(p, off)
+}
+
+func (r *Raw) Size() uint64 {
+	return r.size
+}
+
+func (r *Raw) Sync() error {
+	if r.readOnly {
+		return nil
+	}
+
+	return r.file.Sync()
+}
+
+func (r *Raw) Close() error {
+	return r.file.Close()
+}
+
+// File returns the underlying host file.
+func (r *Raw) File() *os.File {
+	return r.file
+}
@@ -0,0 +1,24 @@
+package block
+
+import "github.com/bobuhiro11/gokvm/ratelimit"
+
+// throttled is an Engine which holds back reads and writes until the
+// Throttle lets them go. Flushes are never delayed.
+type throttled struct {
+	Engine
+	t *ratelimit.Throttle
+}
+
+// NewThrottledEngine returns an Engine which applies t to the requests
+// before passing them on to e.
+func NewThrottledEngine(e Engine, t *ratelimit.Throttle) Engine {
+	return &throttled{Engine: e, t: t}
+}
+
+func (e *throttled) Submit(req *Request) {
+	if req.Op != OpFlush {
+		e.t.Wait(len(req.Buf))
+	}
+
+	e.Engine.Submit(req)
+}
@@ -0,0 +1,422 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal io_uring, just enough for reads, writes and fsync on one fd.
+//
+// refs https://github.com/torvalds/linux/blob/master/include/uapi/linux/io_uring.h
+// refs https://kernel.dk/io_uring.pdf
+const (
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringEnterGetEvents = 1 << 0
+
+	// IORING_OP_READ and IORING_OP_WRITE appeared in the same release
+	// as this feature flag (5.6).
+	ioringFeatRWCurPos = 1 << 3
+
+	ioringOpNop   = 0
+	ioringOpFsync = 3
+	ioringOpRead  = 22
+	ioringOpWrite = 23
+
+	// user_data of the request which stops the completion goroutine.
+	uringStop = ^uint64(0)
+)
+
+var ErrURingUnsupported = errors.New("io_uring is not supported by the kernel")
+
+type ioSQRingOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Flags       uint32
+	Dropped     uint32
+	Array       uint32
+	_           uint32
+	_           uint64
+}
+
+type ioCQRingOffsets struct {
+	Head        uint32
+	Tail        uint32
+	RingMask    uint32
+	RingEntries uint32
+	Overflow    uint32
+	CQEs        uint32
+	Flags       uint32
+	_           uint32
+	_           uint64
+}
+
+type ioURingParams struct {
+	SQEntries    uint32
+	CQEntries    uint32
+	Flags        uint32
+	SQThreadCPU  uint32
+	SQThreadIdle uint32
+	Features     uint32
+	WQFd         uint32
+	_            [3]uint32
+	SQOff        ioSQRingOffsets
+	CQOff        ioCQRingOffsets
+}
+
+type ioURingSQE struct {
+	Opcode      uint8
+	Flags       uint8
+	IOPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	RWFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	_           [2]uint64
+}
+
+type ioURingCQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// uring is an Engine that hands requests on a raw image to the kernel.
+type uring struct {
+	fd      int
+	file    *Raw
+	entries uint32
+
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	cqHead, cqTail, cqMask *uint32
+	cqeOff                 uint32
+
+	// slots limits the requests in flight to the size of the rings and
+	// hands out their indices, which double as user_data.
+	slots chan uint32
+	reqs  []*Request
+
+	mu     sync.Mutex
+	closed bool
+	// err is why the completion goroutine stopped early, if it did.
+	err  error
+	done chan struct{}
+}
+
+func newURing(r *Raw, depth int) (*uring, error) {
+	p := ioURingParams{}
+
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, uintptr(depth), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("%w: %v", ErrURingUnsupported, errno)
+	}
+
+	u := &uring{
+		fd:      int(fd),
+		file:    r,
+		entries: p.SQEntries,
+		done:    make(chan struct{}),
+	}
+
+	if p.Features&ioringFeatRWCurPos == 0 {
+		u.unmap()
+
+		return nil, ErrURingUnsupported
+	}
+
+	if err := u.mmap(&p); err != nil {
+		u.unmap()
+
+		return nil, err
+	}
+
+	u.slots = make(chan uint32, u.entries)
+	u.reqs = make([]*Request, u.entries)
+
+	for i := uint32(0); i < u.entries; i++ {
+		u.slots <- i
+	}
+
+	go u.complete()
+
+	return u, nil
+}
+
+func (u *uring) mmap(p *ioURingParams) error {
+	var err error
+
+	if u.sqRing, err = unix.Mmap(u.fd, ioringOffSQRing,
+		int(p.SQOff.Array+p.SQEntries*4),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return err
+	}
+
+	if u.cqRing, err = unix.Mmap(u.fd, ioringOffCQRing,
+		int(p.CQOff.CQEs+p.CQEntries*uint32(unsafe.Sizeof(ioURingCQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return err
+	}
+
+	if u.sqes, err = unix.Mmap(u.fd, ioringOffSQEs,
+		int(p.SQEntries*uint32(unsafe.Sizeof(ioURingSQE{}))),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return err
+	}
+
+	u.sqHead = (*uint32)(unsafe.Pointer(&u.sqRing[p.SQOff.Head]))
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[p.SQOff.Tail]))
+	u.sqMask = (*uint32)(unsafe.Pointer(&u.sqRing[p.SQOff.RingMask]))
+	u.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&u.sqRing[p.SQOff.Array])), p.SQEntries)
+
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[p.CQOff.Head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[p.CQOff.Tail]))
+	u.cqMask = (*uint32)(unsafe.Pointer(&u.cqRing[p.CQOff.RingMask]))
+	u.cqeOff = p.CQOff.CQEs
+
+	return nil
+}
+
+func (u *uring) unmap() {
+	for _, b := range [][]byte{u.sqRing, u.cqRing, u.sqes} {
+		if b != nil {
+			_ = unix.Munmap(b)
+		}
+	}
+
+	syscall.Close(u.fd)
+}
+
+func (u *uring) enter(toSubmit, minComplete, flags uint32) error {
+	for {
+		_, _, errno := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd),
+			uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+
+		if errno != 0 {
+			return errno
+		}
+
+		return nil
+	}
+}
+
+// pending is the number of SQEs the kernel has not taken yet.
+func (u *uring) pending() uint32 {
+	return atomic.LoadUint32(u.sqTail) - atomic.LoadUint32(u.sqHead)
+}
+
+// push queues one SQE for req and tells the kernel about it. Once it is on
+// the ring, the SQE is completed by the completion goroutine, even if
+// telling the kernel fails: the next enter submits it.
+func (u *uring) push(sqe ioURingSQE, req *Request) error {
+	u.mu.Lock()
+
+	if err := u.err; err != nil {
+		u.mu.Unlock()
+
+		if req != nil {
+			u.slots <- uint32(sqe.UserData)
+			req.Done(err)
+		}
+
+		return err
+	}
+
+	defer u.mu.Unlock()
+
+	if req != nil {
+		u.reqs[sqe.UserData] = req
+	}
+
+	tail := atomic.LoadUint32(u.sqTail)
+	idx := tail & *u.sqMask
+
+	*(*ioURingSQE)(unsafe.Pointer(&u.sqes[uintptr(idx)*unsafe.Sizeof(sqe)])) = sqe
+	u.sqArray[idx] = idx
+
+	atomic.StoreUint32(u.sqTail, tail+1)
+
+	return u.enter(u.pending(), 0, 0)
+}
+
+func (u *uring) Submit(req *Request) {
+	u.mu.Lock()
+	closed := u.closed
+	u.mu.Unlock()
+
+	if closed {
+		req.Done(ErrEngineClosed)
+
+		return
+	}
+
+	slot := <-u.slots
+
+	sqe := ioURingSQE{
+		Fd:       int32(u.file.File().Fd()),
+		Off:      uint64(req.Off),
+		UserData: uint64(slot),
+	}
+
+	switch req.Op {
+	case OpRead, OpWrite:
+		sqe.Opcode = ioringOpRead
+		if req.Op == OpWrite {
+			sqe.Opcode = ioringOpWrite
+
+			if u.file.readOnly {
+				u.slots <- slot
+				req.Done(ErrReadOnly)
+
+				return
+			}
+		}
+
+		if len(req.Buf) > 0 {
+			sqe.Addr = uint64(uintptr(unsafe.Pointer(&req.Buf[0])))
+			sqe.Len = uint32(len(req.Buf))
+		}
+	case OpFlush:
+		sqe.Opcode = ioringOpFsync
+	}
+
+	// The request completes through the completion goroutine either way.
+	_ = u.push(sqe, req)
+}
+
+func (u *uring) request(slot uint32) *Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.reqs[slot]
+}
+
+func (u *uring) finish(slot uint32, err error) {
+	u.mu.Lock()
+	req := u.reqs[slot]
+	u.reqs[slot] = nil
+	u.mu.Unlock()
+
+	u.slots <- slot
+
+	req.Done(err)
+}
+
+// fail completes every request in flight with err, and the ones submitted
+// later too, as nothing reaps them any more.
+func (u *uring) fail(err error) {
+	u.mu.Lock()
+	u.err = err
+	reqs := []uint32{}
+
+	for slot, req := range u.reqs {
+		if req != nil {
+			reqs = append(reqs, uint32(slot))
+		}
+	}
+	u.mu.Unlock()
+
+	for _, slot := range reqs {
+		u.finish(slot, err)
+	}
+}
+
+// complete reaps completions until Close.
+func (u *uring) complete() {
+	defer close(u.done)
+
+	for {
+		// SQEs which push could not submit go along.
+		if err := u.enter(u.pending(), 1, ioringEnterGetEvents); err != nil {
+			u.fail(err)
+
+			return
+		}
+
+		head := atomic.LoadUint32(u.cqHead)
+		tail := atomic.LoadUint32(u.cqTail)
+
+		for ; head != tail; head++ {
+			off := u.cqeOff + (head&*u.cqMask)*uint32(unsafe.Sizeof(ioURingCQE{}))
+			cqe := *(*ioURingCQE)(unsafe.Pointer(&u.cqRing[off]))
+
+			if cqe.UserData == uringStop {
+				atomic.StoreUint32(u.cqHead, head+1)
+
+				return
+			}
+
+			slot := uint32(cqe.UserData)
+			req := u.request(slot)
+
+			var err error
+
+			switch {
+			case cqe.Res < 0:
+				err = syscall.Errno(-cqe.Res)
+			case req.Op == OpRead && int(cqe.Res) < len(req.Buf):
+				err = io.ErrUnexpectedEOF
+			case req.Op == OpWrite && int(cqe.Res) < len(req.Buf):
+				err = io.ErrShortWrite
+			}
+
+			u.finish(slot, err)
+		}
+
+		atomic.StoreUint32(u.cqHead, head)
+	}
+}
+
+// Close waits for the requests in flight, the Backend is left open.
+func (u *uring) Close() error {
+	u.mu.Lock()
+	u.closed = true
+	u.mu.Unlock()
+
+	// Wait for every slot to come back.
+	for i := uint32(0); i < u.entries; i++ {
+		<-u.slots
+	}
+
+	if err := u.push(ioURingSQE{Opcode: ioringOpNop, UserData: uringStop}, nil); err != nil {
+		u.mu.Lock()
+		failed := u.err != nil
+		u.mu.Unlock()
+
+		// Without the completion goroutine, nothing waits for the stop.
+		if !failed {
+			return err
+		}
+	}
+
+	<-u.done
+	u.unmap()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.err
+}
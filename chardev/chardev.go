@@ -0,0 +1,262 @@
+// Package chardev provides the character devices behind the ports of a
+// virtio-console: a file which receives what the guest writes, a pty, or a
+// UNIX socket which a program on the host connects to.
+package chardev
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/bobuhiro11/gokvm/unixsock"
+	"golang.org/x/sys/unix"
+)
+
+var ErrUnknownType = errors.New("unknown character device type")
+
+const (
+	File   = "file"
+	Pty    = "pty"
+	Socket = "socket"
+)
+
+// Config selects a character device. Path is the file or the socket, a pty
+// needs none.
+type Config struct {
+	Type string
+	Path string
+}
+
+// Port is a port of a virtio-console backed by a character device. The
+// guest finds it as /dev/virtio-ports/NAME, or as an hvc if it is a console.
+type Port struct {
+	Name    string
+	Console bool
+	Config
+}
+
+// Open opens the character device of c.
+func Open(c Config) (io.ReadWriteCloser, error) {
+	switch c.Type {
+	case File:
+		f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		return output{f}, nil
+	case Pty:
+		return OpenPty()
+	case Socket:
+		return Listen(c.Path)
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownType, c.Type)
+}
+
+// output is a file which only takes what the guest writes.
+type output struct {
+	*os.File
+}
+
+func (o output) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// PtyDev is the master side of a pty, the guest is at the other end.
+type PtyDev struct {
+	*os.File
+	slave *os.File
+}
+
+// OpenPty creates a pty in raw mode.
+func OpenPty() (*PtyDev, error) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PtyDev{File: m}
+
+	if err := p.open(); err != nil {
+		m.Close()
+
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *PtyDev) open() error {
+	fd := int(p.File.Fd())
+
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		return err
+	}
+
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		return err
+	}
+
+	// The slave is kept open: the master reads EIO while nobody has it
+	// open, and it keeps its raw mode.
+	if p.slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|syscall.O_NOCTTY, 0); err != nil {
+		return err
+	}
+
+	t, err := unix.IoctlGetTermios(int(p.slave.Fd()), unix.TCGETS)
+	if err != nil {
+		return err
+	}
+
+	// cfmakeraw(3), so that nothing is echoed back to the guest.
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+
+	return unix.IoctlSetTermios(int(p.slave.Fd()), unix.TCSETS, t)
+}
+
+// Path returns the path of the slave, e.g. /dev/pts/3.
+func (p *PtyDev) Path() string {
+	return p.slave.Name()
+}
+
+func (p *PtyDev) Close() error {
+	p.slave.Close()
+
+	return p.File.Close()
+}
+
+// SocketDev is a UNIX socket which a program on the host connects to. A new
+// connection replaces the previous one, and what the guest writes while
+// nobody is connected is dropped.
+type SocketDev struct {
+	l net.Listener
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	c      net.Conn
+	closed bool
+}
+
+// Listen listens on the UNIX socket at path.
+func Listen(path string) (*SocketDev, error) {
+	unixsock.RemoveStale(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SocketDev{l: l}
+	s.cond = sync.NewCond(&s.mu)
+
+	go s.accept()
+
+	return s, nil
+}
+
+func (s *SocketDev) accept() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.c != nil {
+			s.c.Close()
+		}
+
+		s.c = c
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// conn waits for a connection, or returns nil once closed.
+func (s *SocketDev) conn() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.c == nil && !s.closed {
+		s.cond.Wait()
+	}
+
+	return s.c
+}
+
+// drop forgets c after it failed.
+func (s *SocketDev) drop(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.Close()
+
+	if s.c == c {
+		s.c = nil
+	}
+}
+
+// Read reads from the current connection, waiting for one if needed.
+func (s *SocketDev) Read(p []byte) (int, error) {
+	for {
+		c := s.conn()
+		if c == nil {
+			return 0, io.EOF
+		}
+
+		n, err := c.Read(p)
+		if err != nil {
+			s.drop(c)
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Write writes to the current connection, if any.
+func (s *SocketDev) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	c := s.c
+	s.mu.Unlock()
+
+	if c == nil {
+		return len(p), nil
+	}
+
+	if _, err := c.Write(p); err != nil {
+		s.drop(c)
+	}
+
+	return len(p), nil
+}
+
+func (s *SocketDev) Close() error {
+	err := s.l.Close()
+
+	s.mu.Lock()
+	s.closed = true
+
+	if s.c != nil {
+		s.c.Close()
+		s.c = nil
+	}
+
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return err
+}
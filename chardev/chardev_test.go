@@ -0,0 +1,140 @@
+package chardev_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/chardev"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "console.log")
+
+	dev, err := chardev.Open(chardev.Config{Type: chardev.File, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dev.Close()
+
+	if _, err := dev.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dev.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected: %v, actual: %v", io.EOF, err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "hello\n" {
+		t.Fatalf("expected: %q, actual: %q", "hello\n", b)
+	}
+}
+
+func TestSocket(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+
+	dev, err := chardev.Open(chardev.Config{Type: chardev.Socket, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dev.Close()
+
+	// Nobody is connected yet.
+	if n, err := dev.Write([]byte("lost")); err != nil || n != 4 {
+		t.Fatalf("expected: %v, actual: %v, %v", 4, n, err)
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(dev, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected: %s, actual: %s", "ping", buf)
+	}
+
+	if _, err := dev.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "pong" {
+		t.Fatalf("expected: %s, actual: %s", "pong", buf)
+	}
+}
+
+func TestPty(t *testing.T) {
+	t.Parallel()
+
+	p, err := chardev.OpenPty()
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skip(err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer p.Close()
+
+	s, err := os.OpenFile(p.Path(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	// Raw mode: "\n" is not turned into "\r\n" and nothing is echoed.
+	if _, err := p.Write([]byte("a\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "a\n" {
+		t.Fatalf("expected: %q, actual: %q", "a\n", buf)
+	}
+
+	if _, err := s.Write([]byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(p, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "b\n" {
+		t.Fatalf("expected: %q, actual: %q", "b\n", buf)
+	}
+}
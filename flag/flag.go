@@ -6,20 +6,734 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/chardev"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/netem"
+	"github.com/bobuhiro11/gokvm/netsock"
+	"github.com/bobuhiro11/gokvm/numa"
+	"github.com/bobuhiro11/gokvm/pcap"
+	"github.com/bobuhiro11/gokvm/ratelimit"
+	"github.com/bobuhiro11/gokvm/rng"
+	"github.com/bobuhiro11/gokvm/usernet"
 )
 
-var ErrorInvalidSubcommands = errors.New("expected 'boot' or 'probe' subcommands")
+var (
+	ErrorInvalidSubcommands = errors.New("expected 'boot', 'probe' or 'switch' subcommands")
+	ErrorInvalidOption      = errors.New("invalid option")
+)
 
 type BootArgs struct {
 	Kernel     string
 	MemSize    int
+	MemBackend memory.Backend
+	// NUMA splits the cpus and the memory into nodes.
+	NUMA       numa.Config
 	NCPUs      int
 	Dev        string
 	Initrd     string
 	Params     string
 	TapIfName  string
+	TapQueues  int
 	Disk       string
 	TraceCount int
+
+	// TapVhost moves the frames between the tap and the guest in the
+	// kernel with vhost-net.
+	TapVhost bool
+	// NetUser selects the user mode network instead of a tap.
+	NetUser  bool
+	HostFwds []usernet.HostFwd
+	// NetVhostUser is the socket of a vhost-user backend which runs the
+	// network of the guest.
+	NetVhostUser string
+	// NetSocket connects the guest to other guests over a UNIX socket
+	// if its Type is set.
+	NetSocket netsock.Config
+	// NetCapture records the frames of the guest if its Path is set.
+	NetCapture pcap.Config
+	// NetShaping impairs the network of the guest.
+	NetShaping netem.Config
+
+	// DiskSnapshot discards the writes to Disk on exit.
+	DiskSnapshot bool
+	// DiskQueues is the number of virtio-blk request queues, 0 means one
+	// per vCPU.
+	DiskQueues int
+	// DiskLimits throttles the I/O on Disk.
+	DiskLimits ratelimit.Limits
+	// DiskVhostUser is the socket of a vhost-user backend which serves the
+	// disk instead of Disk.
+	DiskVhostUser string
+
+	// VsockCID is the address of the guest on a virtio-vsock device, whose
+	// host side is the UNIX socket VsockPath. There is none without it.
+	VsockCID  uint64
+	VsockPath string
+
+	// ConsolePorts are the ports of a virtio-console, there is none
+	// without them.
+	ConsolePorts []chardev.Port
+
+	// Rng adds a virtio-rng device if set.
+	Rng *rng.Config
+
+	// MemBalloon adds a virtio-balloon device.
+	MemBalloon bool
+
+	// ShareDir is a directory of the host the guest mounts through
+	// virtio-9p by ShareTag. There is none without it.
+	ShareDir string
+	ShareTag string
+
+	// Pmem is a file the guest maps as virtio-pmem, read-only with
+	// PmemReadonly. There is none without it.
+	Pmem         string
+	PmemReadonly bool
+
+	// MemHotplug is the size of the memory the guest may plug at run time
+	// through virtio-mem, in blocks of MemHotplugBlock, 0 for the default,
+	// into NUMA node MemHotplugNode. There is none without it.
+	MemHotplug      int
+	MemHotplugBlock int
+	MemHotplugNode  int
+
+	// MaxCPUs is the number of cpus with CPU hotplug, of which NCPUs are
+	// there at boot. 0 is for none.
+	MaxCPUs int
+
+	// MgmtSock is the path of the UNIX socket for the management interface.
+	MgmtSock string
+}
+
+// parseDrive parses the value of -drive, e.g.
+// "file=vda.img,snapshot=on,queues=2,iops=100".
+func (c *BootArgs) parseDrive(s string) error {
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		switch k {
+		case "file":
+			c.Disk = v
+		case "vhost-user":
+			c.DiskVhostUser = v
+		case "snapshot":
+			if c.DiskSnapshot, err = parseOnOff(v); err != nil {
+				return fmt.Errorf("snapshot: %w", err)
+			}
+		case "queues":
+			if c.DiskQueues, err = strconv.Atoi(v); err != nil || c.DiskQueues < 1 {
+				return fmt.Errorf("%w: queues must be a positive number", ErrorInvalidOption)
+			}
+		default:
+			if err := setLimit(&c.DiskLimits, k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if (len(c.Disk) == 0) == (len(c.DiskVhostUser) == 0) {
+		return fmt.Errorf("%w: either file or vhost-user is required", ErrorInvalidOption)
+	}
+
+	return nil
+}
+
+// parseVsock parses the value of -vsock, e.g. "cid=3,uds=/tmp/v.sock".
+func (c *BootArgs) parseVsock(s string) error {
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		switch k {
+		case "cid":
+			// 0 to 2 are reserved, 2 being the host.
+			if c.VsockCID, err = strconv.ParseUint(v, 10, 32); err != nil || c.VsockCID < 3 {
+				return fmt.Errorf("%w: cid must be a number of at least 3", ErrorInvalidOption)
+			}
+		case "uds":
+			c.VsockPath = v
+		default:
+			return fmt.Errorf("%w: unknown vsock option %q", ErrorInvalidOption, k)
+		}
+	}
+
+	if c.VsockCID == 0 || len(c.VsockPath) == 0 {
+		return fmt.Errorf("%w: vsock needs cid and uds", ErrorInvalidOption)
+	}
+
+	return nil
+}
+
+// parseConsolePort parses a value of -console-port, e.g.
+// "name=org.gokvm.log,file=/tmp/guest.log" or "console=on,pty=on".
+func (c *BootArgs) parseConsolePort(s string) error {
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	p := chardev.Port{}
+
+	for k, v := range opts {
+		switch k {
+		case "name":
+			p.Name = v
+		case "console":
+			if p.Console, err = parseOnOff(v); err != nil {
+				return fmt.Errorf("console: %w", err)
+			}
+		case chardev.File, chardev.Socket:
+			if len(p.Type) > 0 {
+				return fmt.Errorf("%w: only one of file, socket and pty", ErrorInvalidOption)
+			}
+
+			p.Type, p.Path = k, v
+		case chardev.Pty:
+			if len(p.Type) > 0 {
+				return fmt.Errorf("%w: only one of file, socket and pty", ErrorInvalidOption)
+			}
+
+			if on, err := parseOnOff(v); err != nil || !on {
+				return fmt.Errorf("%w: pty must be on", ErrorInvalidOption)
+			}
+
+			p.Type = k
+		default:
+			return fmt.Errorf("%w: unknown console port option %q", ErrorInvalidOption, k)
+		}
+	}
+
+	if len(p.Type) == 0 {
+		return fmt.Errorf("%w: console port needs file, socket or pty", ErrorInvalidOption)
+	}
+
+	c.ConsolePorts = append(c.ConsolePorts, p)
+
+	return nil
+}
+
+// parseRng parses the value of -rng, "on" or e.g. "seed=42,rate=1k".
+func (c *BootArgs) parseRng(s string) error {
+	c.Rng = &rng.Config{}
+
+	if s == "on" {
+		return nil
+	}
+
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		switch k {
+		case "seed":
+			if c.Rng.Seed, err = strconv.ParseUint(v, 0, 64); err != nil {
+				return fmt.Errorf("seed: %w", err)
+			}
+
+			c.Rng.Seeded = true
+		case "rate", "burst":
+			n, err := ParseSize(v, "")
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+
+			if k == "rate" {
+				c.Rng.Rate = uint64(n)
+			} else {
+				c.Rng.Burst = uint64(n)
+			}
+		default:
+			return fmt.Errorf("%w: unknown rng option %q", ErrorInvalidOption, k)
+		}
+	}
+
+	return nil
+}
+
+// parseShare parses the value of -share, e.g. "/srv/data:data".
+func (c *BootArgs) parseShare(s string) error {
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("%w: share needs /host/dir:tag", ErrorInvalidOption)
+	}
+
+	c.ShareDir, c.ShareTag = s[:i], s[i+1:]
+
+	return nil
+}
+
+// parsePmem parses the value of -pmem, e.g. "file=data.img,readonly=on".
+func (c *BootArgs) parsePmem(s string) error {
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		switch k {
+		case "file":
+			c.Pmem = v
+		case "readonly":
+			if c.PmemReadonly, err = parseOnOff(v); err != nil {
+				return fmt.Errorf("readonly: %w", err)
+			}
+		default:
+			return fmt.Errorf("%w: unknown pmem option %q", ErrorInvalidOption, k)
+		}
+	}
+
+	if len(c.Pmem) == 0 {
+		return fmt.Errorf("%w: pmem needs file", ErrorInvalidOption)
+	}
+
+	return nil
+}
+
+// parseMemHotplug parses the value of -mem-hotplug, e.g.
+// "size=8G,block=2M,node=1".
+func (c *BootArgs) parseMemHotplug(s string) error {
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		switch k {
+		case "size":
+			c.MemHotplug, err = ParseSize(v, "g")
+		case "block":
+			c.MemHotplugBlock, err = ParseSize(v, "m")
+		case "node":
+			c.MemHotplugNode, err = strconv.Atoi(v)
+		default:
+			return fmt.Errorf("%w: unknown mem-hotplug option %q", ErrorInvalidOption, k)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	if c.MemHotplug <= 0 {
+		return fmt.Errorf("%w: mem-hotplug needs size", ErrorInvalidOption)
+	}
+
+	return nil
+}
+
+// parseNetdev parses the value of -netdev, e.g.
+// "user,hostfwd=tcp::2222-:22", "tap,ifname=tap0,queues=2" or
+// "stream,path=/tmp/sw.sock", all of them optionally with
+// pcap=FILE[,pcap_size=N][,pcap_files=N] and the impairments of
+// ParseNetem. Unlike the other options, hostfwd may be given more than
+// once.
+func (c *BootArgs) parseNetdev(s string) error {
+	typ, rest, _ := strings.Cut(s, ",")
+
+	var kvs []string
+	if len(rest) > 0 {
+		kvs = strings.Split(rest, ",")
+	}
+
+	switch typ {
+	case "user":
+		c.NetUser = true
+	case "tap", "vhost-user":
+	case netsock.Dgram, netsock.Stream:
+		c.NetSocket.Type = typ
+	default:
+		return fmt.Errorf("%w: unknown netdev %q", ErrorInvalidOption, typ)
+	}
+
+	for _, kv := range kvs {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("%w: %q is not key=value", ErrorInvalidOption, kv)
+		}
+
+		switch {
+		case k == "pcap":
+			c.NetCapture.Path = v
+		case k == "pcap_size":
+			n, err := ParseSize(v, "")
+			if err != nil {
+				return fmt.Errorf("pcap_size: %w", err)
+			}
+
+			c.NetCapture.MaxSize = int64(n)
+		case k == "pcap_files":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("%w: pcap_files must be a positive number", ErrorInvalidOption)
+			}
+
+			c.NetCapture.Files = n
+		case typ == "user" && k == "hostfwd":
+			f, err := usernet.ParseHostFwd(v)
+			if err != nil {
+				return err
+			}
+
+			c.HostFwds = append(c.HostFwds, f)
+		case typ == "tap" && k == "ifname":
+			c.TapIfName = v
+		case typ == "tap" && k == "queues":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("%w: queues must be a positive number", ErrorInvalidOption)
+			}
+
+			c.TapQueues = n
+		case typ == "tap" && k == "vhost":
+			on, err := parseOnOff(v)
+			if err != nil {
+				return fmt.Errorf("vhost: %w", err)
+			}
+
+			c.TapVhost = on
+		case typ == "vhost-user" && k == "path":
+			c.NetVhostUser = v
+		case len(c.NetSocket.Type) > 0 && k == "path":
+			c.NetSocket.Path = v
+		case typ == netsock.Dgram && k == "local":
+			c.NetSocket.Local = v
+		case typ == netsock.Stream && k == "server":
+			s, err := parseOnOff(v)
+			if err != nil {
+				return fmt.Errorf("server: %w", err)
+			}
+
+			c.NetSocket.Server = s
+		default:
+			if err := setNetem(&c.NetShaping, k, v); err != nil {
+				return fmt.Errorf("netdev %s: %w", typ, err)
+			}
+		}
+	}
+
+	if typ == "tap" && len(c.TapIfName) == 0 {
+		return fmt.Errorf("%w: ifname is required", ErrorInvalidOption)
+	}
+
+	if typ == "vhost-user" && len(c.NetVhostUser) == 0 {
+		return fmt.Errorf("%w: path is required", ErrorInvalidOption)
+	}
+
+	if len(c.NetSocket.Type) > 0 && len(c.NetSocket.Path) == 0 {
+		return fmt.Errorf("%w: path is required", ErrorInvalidOption)
+	}
+
+	return nil
+}
+
+// ParseLimits updates l with the I/O limits in s, e.g. "iops=100,bps=10M".
+func ParseLimits(s string, l *ratelimit.Limits) error {
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		if err := setLimit(l, k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseMemBackend parses the memory backend in s, e.g. "memfd",
+// "hugetlbfs,pagesize=1G,prealloc=on", "anon,thp=on" or "file=/dev/shm/vm".
+func ParseMemBackend(s string, b *memory.Backend) error {
+	typ, rest, _ := strings.Cut(s, ",")
+
+	if k, v, ok := strings.Cut(typ, "="); ok && k == "file" {
+		typ, b.Path = string(memory.File), v
+	}
+
+	switch memory.BackendType(typ) {
+	case memory.Memfd, memory.Anon, memory.Hugetlbfs, memory.File:
+		b.Type = memory.BackendType(typ)
+	default:
+		return fmt.Errorf("%w: unknown memory backend %q", ErrorInvalidOption, typ)
+	}
+
+	if b.Type == memory.File && len(b.Path) == 0 {
+		return fmt.Errorf("%w: file needs a path", ErrorInvalidOption)
+	}
+
+	if len(rest) == 0 {
+		return nil
+	}
+
+	opts, err := ParseOptions(rest)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		if err := setMemBackend(b, k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setMemBackend(b *memory.Backend, k, v string) error {
+	var err error
+
+	switch k {
+	case "pagesize":
+		if b.Type != memory.Hugetlbfs {
+			return fmt.Errorf("%w: pagesize is for hugetlbfs", ErrorInvalidOption)
+		}
+
+		var n int
+
+		n, err = ParseSize(v, "")
+		b.PageSize = uint64(n)
+	case "prealloc":
+		b.Prealloc, err = parseOnOff(v)
+	case "thp":
+		b.THP, err = parseOnOff(v)
+	case "discard":
+		if b.Type != memory.File {
+			return fmt.Errorf("%w: discard is for file", ErrorInvalidOption)
+		}
+
+		b.Discard, err = parseOnOff(v)
+	default:
+		return fmt.Errorf("%w: %q", ErrorInvalidOption, k)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", k, err)
+	}
+
+	return nil
+}
+
+// ParseNUMA adds to c the node or the distance in s, e.g.
+// "node,cpus=0-1:4,mem=2G,hostnode=0" or "dist,src=0,dst=1,val=21". The
+// nodes are numbered in the order they are given.
+func ParseNUMA(s string, c *numa.Config) error {
+	typ, rest, _ := strings.Cut(s, ",")
+
+	opts := map[string]string{}
+
+	if len(rest) > 0 {
+		var err error
+		if opts, err = ParseOptions(rest); err != nil {
+			return err
+		}
+	}
+
+	switch typ {
+	case "node":
+		return parseNUMANode(opts, c)
+	case "dist":
+		return parseNUMADist(opts, c)
+	}
+
+	return fmt.Errorf("%w: unknown numa option %q", ErrorInvalidOption, typ)
+}
+
+func parseNUMANode(opts map[string]string, c *numa.Config) error {
+	n := numa.Node{HostNode: -1}
+
+	for k, v := range opts {
+		var err error
+
+		switch k {
+		case "cpus":
+			n.CPUs, err = parseCPUs(v)
+		case "mem":
+			var sz int
+
+			sz, err = ParseSize(v, "g")
+			n.Mem = uint64(sz)
+		case "hostnode":
+			n.HostNode, err = strconv.Atoi(v)
+			if err == nil && n.HostNode < 0 {
+				err = fmt.Errorf("%w: %d", ErrorInvalidOption, n.HostNode)
+			}
+		default:
+			return fmt.Errorf("%w: unknown numa node option %q", ErrorInvalidOption, k)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	if n.Mem == 0 || len(n.CPUs) == 0 {
+		return fmt.Errorf("%w: numa node needs cpus and mem", ErrorInvalidOption)
+	}
+
+	c.Nodes = append(c.Nodes, n)
+
+	return nil
+}
+
+func parseNUMADist(opts map[string]string, c *numa.Config) error {
+	vals := map[string]int{}
+
+	for _, k := range []string{"src", "dst", "val"} {
+		v, ok := opts[k]
+		if !ok {
+			return fmt.Errorf("%w: numa dist needs %s", ErrorInvalidOption, k)
+		}
+
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+
+		vals[k] = int(n)
+	}
+
+	if len(opts) != len(vals) {
+		return fmt.Errorf("%w: numa dist takes src, dst and val", ErrorInvalidOption)
+	}
+
+	if c.Distances == nil {
+		c.Distances = map[[2]int]uint8{}
+	}
+
+	c.Distances[[2]int{vals["src"], vals["dst"]}] = uint8(vals["val"])
+
+	return nil
+}
+
+// parseCPUs parses a list of cpus as "0-1:4", ranges separated by colons.
+func parseCPUs(s string) ([]int, error) {
+	cpus := []int{}
+
+	for _, r := range strings.Split(s, ":") {
+		lo, hi, isRange := strings.Cut(r, "-")
+		if !isRange {
+			hi = lo
+		}
+
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, err
+		}
+
+		last, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, err
+		}
+
+		if first < 0 || last < first {
+			return nil, fmt.Errorf("%w: cpus %q", ErrorInvalidOption, r)
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// ParseNetem updates c with the impairments in s, e.g.
+// "rate=1M,delay=100ms,jitter=10ms,loss=1%,seed=42". rate is in bytes per
+// second, loss, duplicate and reorder are percentages.
+func ParseNetem(s string, c *netem.Config) error {
+	opts, err := ParseOptions(s)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range opts {
+		if err := setNetem(c, k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setNetem(c *netem.Config, k, v string) error {
+	var err error
+
+	switch k {
+	case "rate":
+		var n int
+
+		n, err = ParseSize(v, "")
+		c.Rate = uint64(n)
+	case "delay":
+		c.Delay, err = time.ParseDuration(v)
+	case "jitter":
+		c.Jitter, err = time.ParseDuration(v)
+	case "loss":
+		c.Loss, err = parsePercent(v)
+	case "duplicate":
+		c.Duplicate, err = parsePercent(v)
+	case "reorder":
+		c.Reorder, err = parsePercent(v)
+	case "seed":
+		c.Seed, err = strconv.ParseInt(v, 0, 64)
+	default:
+		return fmt.Errorf("%w: %q", ErrorInvalidOption, k)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", k, err)
+	}
+
+	return nil
+}
+
+func parsePercent(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if f < 0 || f > 100 {
+		return 0, fmt.Errorf("%w: %q is not a percentage", ErrorInvalidOption, s)
+	}
+
+	return f, nil
+}
+
+func setLimit(l *ratelimit.Limits, k, v string) error {
+	var p *uint64
+
+	switch k {
+	case "iops":
+		p = &l.IOPS
+	case "bps":
+		p = &l.BPS
+	case "iops_burst":
+		p = &l.IOPSBurst
+	case "bps_burst":
+		p = &l.BPSBurst
+	default:
+		return fmt.Errorf("%w: %q", ErrorInvalidOption, k)
+	}
+
+	n, err := ParseSize(v, "")
+	if err != nil {
+		return fmt.Errorf("%s: %w", k, err)
+	}
+
+	*p = uint64(n)
+
+	return nil
 }
 
 func parseBootArgs(args []string) (*BootArgs, error) {
@@ -41,12 +755,69 @@ func parseBootArgs(args []string) (*BootArgs, error) {
 		"kernel command-line parameters")
 	bootCmd.StringVar(&c.TapIfName, "t", "", `name of tap interface. `+
 		`If the string is an empty, no tap intarface is created. (default"")`)
-	bootCmd.StringVar(&c.Disk, "d", "", "path of disk file (for /dev/vda)")
+	bootCmd.IntVar(&c.TapQueues, "tq", 1, `number of queue pairs of the tap interface. `+
+		`More than one opens it with IFF_MULTI_QUEUE`)
+	bootCmd.Func("netdev", `network backend as user[,hostfwd=[tcp|udp]:[hostaddr]:hostport-:guestport]... `+
+		`for the user mode network, which needs no root, as tap,ifname=NAME[,queues=N][,vhost=on|off], `+
+		`or as dgram,path=PATH[,local=PATH] and stream,path=PATH[,server=on|off] `+
+		`for a UNIX socket to another guest or to "gokvm switch", `+
+		`or as vhost-user,path=PATH for a vhost-user backend. `+
+		`pcap=FILE records the frames of the guest in pcapng format, `+
+		`rotated to FILE.1... once larger than pcap_size=N bytes, keeping pcap_files=N of them. `+
+		`rate=N (bytes per second), delay=DURATION, jitter=DURATION, loss=PERCENT, duplicate=PERCENT, `+
+		`reorder=PERCENT and seed=N impair the network like netem`,
+		c.parseNetdev)
+	bootCmd.StringVar(&c.Disk, "d", "", "path of disk file, raw or qcow2 (for /dev/vda)")
+	bootCmd.Func("drive", `disk with options as file=PATH[,snapshot=on|off][,queues=N]`+
+		`[,iops=N][,bps=N][,iops_burst=N][,bps_burst=N], `+
+		`or as vhost-user=PATH[,queues=N] for a disk served by a vhost-user backend. `+
+		`With snapshot=on the image is not modified, press Ctrl-a s to commit the changes. `+
+		`There is one request queue per cpu unless queues is given. `+
+		`iops and bps limit the requests and bytes per second, bps takes k, M and G suffixes`,
+		c.parseDrive)
+	bootCmd.Func("vsock", `virtio-vsock device as cid=N,uds=PATH. `+
+		`The host connects to port P of the guest by sending "CONNECT P\n" on the UNIX socket PATH, `+
+		`connections of the guest to port P of the host go to the UNIX socket PATH_P`,
+		c.parseVsock)
+	bootCmd.Func("console-port", `port of a virtio-console as [name=NAME,][console=on,]file=PATH|socket=PATH|pty=on, `+
+		`may be given more than once. The guest finds it as /dev/virtio-ports/NAME, or as /dev/hvcN with console=on. `+
+		`file only takes the output of the guest, socket is a UNIX socket for one program at a time`,
+		c.parseConsolePort)
+	bootCmd.Func("rng", `virtio-rng device as on, or with options as [seed=N][,rate=N[,burst=N]]. `+
+		`The entropy comes from getrandom(2) of the host, or is a reproducible stream with seed. `+
+		`rate limits the bytes per second, with k, M and G suffixes`,
+		c.parseRng)
+	bootCmd.BoolVar(&c.MemBalloon, "balloon", false, `add a virtio-balloon device with free page reporting. `+
+		`With -mgmt, "balloon SIZE" sets the memory the guest is to keep`)
+	bootCmd.Func("share", `directory of the host as /host/dir:tag, shared with the guest over virtio-9p. `+
+		`The guest mounts it with "mount -t 9p -o trans=virtio,version=9p2000.L tag /mnt"`,
+		c.parseShare)
+	bootCmd.Func("pmem", `file mapped into the memory of the guest as virtio-pmem, as file=PATH[,readonly=on]. `+
+		`Its size must be a multiple of 2M. The guest finds it as /dev/pmem0, `+
+		`with readonly=on its writes are dropped`,
+		c.parsePmem)
+
+	bootCmd.StringVar(&c.MgmtSock, "mgmt", "", `path of a UNIX socket for the management interface. `+
+		`Send "help" to it for the list of commands (default "")`)
 
 	bootCmd.IntVar(&c.NCPUs, "c", 1, "number of cpus")
+	bootCmd.IntVar(&c.MaxCPUs, "maxcpus", 0, `number of cpus the guest may have at run time through CPU hotplug, `+
+		`of which -c are there at boot. With -mgmt, "cpus N" sets how many there are`)
 
 	msize := bootCmd.String("m", "1G",
 		"memory size: as number[gGmM], optional units, defaults to G")
+
+	bootCmd.Func("mem-backend", `what the memory is allocated from: memfd (the default, shareable), anon, `+
+		`hugetlbfs[,pagesize=2M|1G] or file=PATH[,discard=on], then [,prealloc=on][,thp=on]`,
+		func(s string) error { return ParseMemBackend(s, &c.MemBackend) })
+	bootCmd.Func("numa", `NUMA node as node,cpus=N[-M][:N[-M]]...,mem=SIZE[,hostnode=N], in the order of the nodes, `+
+		`or distance between two nodes as dist,src=N,dst=N,val=N. May be given more than once. `+
+		`The memory of a node is bound to node hostnode of the host, the nodes must add up to -m and -c, or -maxcpus`,
+		func(s string) error { return ParseNUMA(s, &c.NUMA) })
+	bootCmd.Func("mem-hotplug", `memory the guest may plug at run time through virtio-mem, `+
+		`as size=SIZE[,block=SIZE][,node=N]. size is a multiple of 128M, blocks are 2M unless given. `+
+		`With -mgmt, "memhotplug SIZE" sets how much of it the guest is to plug`,
+		c.parseMemHotplug)
 	tc := bootCmd.String("T", "0",
 		"how many instructions to skip between trace prints -- 0 means tracing disabled")
 
@@ -60,6 +831,10 @@ func parseBootArgs(args []string) (*BootArgs, error) {
 		return nil, err
 	}
 
+	if c.MaxCPUs != 0 && c.MaxCPUs < c.NCPUs {
+		return nil, fmt.Errorf("%w: -maxcpus %d is less than -c %d", ErrorInvalidOption, c.MaxCPUs, c.NCPUs)
+	}
+
 	if c.TraceCount, err = ParseSize(*tc, ""); err != nil {
 		return nil, err
 	}
@@ -80,24 +855,85 @@ func parseProbeArgs(args []string) (*ProbeArgs, error) {
 	return c, nil
 }
 
-func ParseArgs(args []string) (*BootArgs, *ProbeArgs, error) {
+// SwitchArgs are the sockets of the L2 switch among guests.
+type SwitchArgs struct {
+	Dgram  string
+	Stream string
+}
+
+func parseSwitchArgs(args []string) (*SwitchArgs, error) {
+	switchCmd := flag.NewFlagSet("switch subcommand", flag.ExitOnError)
+	c := &SwitchArgs{}
+
+	switchCmd.StringVar(&c.Dgram, "dgram", "", `path of a UNIX datagram socket for "-netdev dgram" (default "")`)
+	switchCmd.StringVar(&c.Stream, "stream", "", `path of a UNIX stream socket for "-netdev stream" (default "")`)
+
+	if err := switchCmd.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if len(c.Dgram) == 0 && len(c.Stream) == 0 {
+		return nil, fmt.Errorf("%w: -dgram or -stream is required", ErrorInvalidOption)
+	}
+
+	return c, nil
+}
+
+func ParseArgs(args []string) (*BootArgs, *ProbeArgs, *SwitchArgs, error) {
 	if len(args) < 2 {
-		return nil, nil, ErrorInvalidSubcommands
+		return nil, nil, nil, ErrorInvalidSubcommands
 	}
 
 	switch args[1] {
 	case "boot":
 		conf, err := parseBootArgs(args[2:])
 
-		return conf, nil, err
+		return conf, nil, nil, err
 
 	case "probe":
 		conf, err := parseProbeArgs(args[2:])
 
-		return nil, conf, err
+		return nil, conf, nil, err
+
+	case "switch":
+		conf, err := parseSwitchArgs(args[2:])
+
+		return nil, nil, conf, err
+	}
+
+	return nil, nil, nil, ErrorInvalidSubcommands
+}
+
+// ParseOptions parses a comma separated list of key=value pairs as used by
+// -drive. Keys may appear only once.
+func ParseOptions(s string) (map[string]string, error) {
+	opts := map[string]string{}
+
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || len(k) == 0 {
+			return nil, fmt.Errorf("%w: %q is not key=value", ErrorInvalidOption, kv)
+		}
+
+		if _, ok := opts[k]; ok {
+			return nil, fmt.Errorf("%w: %q given twice", ErrorInvalidOption, k)
+		}
+
+		opts[k] = v
+	}
+
+	return opts, nil
+}
+
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on", "true", "yes":
+		return true, nil
+	case "off", "false", "no":
+		return false, nil
 	}
 
-	return nil, nil, ErrorInvalidSubcommands
+	return false, fmt.Errorf("%w: %q is neither on nor off", ErrorInvalidOption, s)
 }
 
 // ParseSize parses a size string as number[gGmMkK]. The multiplier is optional,
@@ -2,10 +2,21 @@ package flag_test
 
 import (
 	"errors"
+	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/bobuhiro11/gokvm/chardev"
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/netem"
+	"github.com/bobuhiro11/gokvm/netsock"
+	"github.com/bobuhiro11/gokvm/numa"
+	"github.com/bobuhiro11/gokvm/pcap"
+	"github.com/bobuhiro11/gokvm/ratelimit"
+	"github.com/bobuhiro11/gokvm/rng"
+	"github.com/bobuhiro11/gokvm/usernet"
 )
 
 func TestParsesize(t *testing.T) { // nolint:paralleltest
@@ -51,6 +62,8 @@ func TestParseBootArgs(t *testing.T) {
 		"params",
 		"-t",
 		"tap_if_name",
+		"-tq",
+		"2",
 		"-c",
 		"2",
 		"-d",
@@ -61,7 +74,7 @@ func TestParseBootArgs(t *testing.T) {
 		"1M",
 	}
 
-	c, _, err := flag.ParseArgs(args)
+	c, _, _, err := flag.ParseArgs(args)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -86,6 +99,10 @@ func TestParseBootArgs(t *testing.T) {
 		t.Error("invalid name of tap interface")
 	}
 
+	if c.TapQueues != 2 {
+		t.Error("invalid number of tap queues")
+	}
+
 	if c.Disk != "disk_path" {
 		t.Errorf("invalid path of disk file: got %v, want %v", c.Disk, "disk_path")
 	}
@@ -111,7 +128,7 @@ func TestParseBootArgsWithDefaults(t *testing.T) {
 		"boot",
 	}
 
-	c, _, err := flag.ParseArgs(args)
+	c, _, _, err := flag.ParseArgs(args)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -168,7 +185,7 @@ func TestParseProbeArgs(t *testing.T) {
 		"probe",
 	}
 
-	_, probeConfig, err := flag.ParseArgs(args)
+	_, probeConfig, _, err := flag.ParseArgs(args)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -177,3 +194,490 @@ func TestParseProbeArgs(t *testing.T) {
 		t.Fatal("probeConfig is nil")
 	}
 }
+
+func TestParseBootArgsWithDrive(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-drive",
+		"file=golden.qcow2,snapshot=on,queues=4,iops=100,bps=10M",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Disk != "golden.qcow2" {
+		t.Errorf("invalid path of disk file: got %v, want %v", c.Disk, "golden.qcow2")
+	}
+
+	if !c.DiskSnapshot {
+		t.Error("snapshot mode is not enabled")
+	}
+
+	if c.DiskQueues != 4 {
+		t.Errorf("invalid number of queues: got %v, want %v", c.DiskQueues, 4)
+	}
+
+	expected := ratelimit.Limits{IOPS: 100, BPS: 10 << 20}
+	if c.DiskLimits != expected {
+		t.Errorf("invalid limits: got %+v, want %+v", c.DiskLimits, expected)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	t.Parallel()
+
+	l := ratelimit.Limits{IOPS: 100, BPS: 1 << 20}
+
+	if err := flag.ParseLimits("bps=2M,bps_burst=4M", &l); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ratelimit.Limits{IOPS: 100, BPS: 2 << 20, BPSBurst: 4 << 20}
+	if l != expected {
+		t.Fatalf("expected: %+v, actual: %+v", expected, l)
+	}
+
+	if err := flag.ParseLimits("iopz=1", &l); !errors.Is(err, flag.ErrorInvalidOption) {
+		t.Fatalf("expected: %v, actual: %v", flag.ErrorInvalidOption, err)
+	}
+}
+
+func TestParseOptions(t *testing.T) { // nolint:paralleltest
+	for _, tt := range []struct {
+		name string
+		s    string
+		opts map[string]string
+		err  error
+	}{
+		{name: "single", s: "file=a.img", opts: map[string]string{"file": "a.img"}},
+		{name: "multiple", s: "file=a.img,snapshot=on", opts: map[string]string{"file": "a.img", "snapshot": "on"}},
+		{name: "empty value", s: "file=", opts: map[string]string{"file": ""}},
+		{name: "no value", s: "file", err: flag.ErrorInvalidOption},
+		{name: "no key", s: "=a.img", err: flag.ErrorInvalidOption},
+		{name: "duplicate", s: "file=a,file=b", err: flag.ErrorInvalidOption},
+	} {
+		opts, err := flag.ParseOptions(tt.s)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+
+			continue
+		}
+
+		if len(opts) != len(tt.opts) {
+			t.Errorf("%s: got %v, want %v", tt.name, opts, tt.opts)
+		}
+
+		for k, v := range tt.opts {
+			if opts[k] != v {
+				t.Errorf("%s: %s: got %q, want %q", tt.name, k, opts[k], v)
+			}
+		}
+	}
+}
+
+func TestParseBootArgsWithNetdev(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-netdev",
+		"user,hostfwd=tcp::2222-:22,hostfwd=udp:127.0.0.1:5353-:53",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.NetUser {
+		t.Error("user mode network is not enabled")
+	}
+
+	expected := []usernet.HostFwd{
+		{Proto: "tcp", HostPort: 2222, GuestPort: 22},
+		{Proto: "udp", HostAddr: "127.0.0.1", HostPort: 5353, GuestPort: 53},
+	}
+
+	if len(c.HostFwds) != len(expected) {
+		t.Fatalf("expected: %v, actual: %v", expected, c.HostFwds)
+	}
+
+	for i := range expected {
+		if c.HostFwds[i] != expected[i] {
+			t.Fatalf("expected: %v, actual: %v", expected, c.HostFwds)
+		}
+	}
+}
+
+func TestParseBootArgsWithSocketNetdev(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-netdev",
+		"stream,path=/tmp/sw.sock,server=on",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := netsock.Config{Type: netsock.Stream, Path: "/tmp/sw.sock", Server: true}
+	if c.NetSocket != expected {
+		t.Fatalf("expected: %+v, actual: %+v", expected, c.NetSocket)
+	}
+}
+
+func TestParseBootArgsWithVhost(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-netdev",
+		"tap,ifname=tap0,queues=2,vhost=on",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.TapIfName != "tap0" || c.TapQueues != 2 || !c.TapVhost {
+		t.Fatalf("expected: %v, %v, %v, actual: %v, %v, %v", "tap0", 2, true, c.TapIfName, c.TapQueues, c.TapVhost)
+	}
+}
+
+func TestParseBootArgsWithVhostUser(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-netdev",
+		"vhost-user,path=/tmp/net.sock",
+		"-drive",
+		"vhost-user=/tmp/blk.sock,queues=2",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.NetVhostUser != "/tmp/net.sock" {
+		t.Fatalf("expected: %v, actual: %v", "/tmp/net.sock", c.NetVhostUser)
+	}
+
+	if c.DiskVhostUser != "/tmp/blk.sock" || c.DiskQueues != 2 {
+		t.Fatalf("expected: %v, %v, actual: %v, %v", "/tmp/blk.sock", 2, c.DiskVhostUser, c.DiskQueues)
+	}
+}
+
+func TestParseBootArgsWithVsock(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-vsock",
+		"cid=3,uds=/tmp/v.sock",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.VsockCID != 3 || c.VsockPath != "/tmp/v.sock" {
+		t.Fatalf("expected: %v, %v, actual: %v, %v", 3, "/tmp/v.sock", c.VsockCID, c.VsockPath)
+	}
+}
+
+func TestParseBootArgsWithConsolePorts(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-console-port",
+		"name=org.gokvm.log,file=/tmp/guest.log",
+		"-console-port",
+		"console=on,pty=on",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []chardev.Port{
+		{Name: "org.gokvm.log", Config: chardev.Config{Type: chardev.File, Path: "/tmp/guest.log"}},
+		{Console: true, Config: chardev.Config{Type: chardev.Pty}},
+	}
+
+	if !reflect.DeepEqual(expected, c.ConsolePorts) {
+		t.Fatalf("expected: %v, actual: %v", expected, c.ConsolePorts)
+	}
+}
+
+func TestParseBootArgsWithRng(t *testing.T) {
+	t.Parallel()
+
+	for s, expected := range map[string]rng.Config{
+		"on":                       {},
+		"seed=42,rate=1k,burst=64": {Seeded: true, Seed: 42, Rate: 1024, Burst: 64},
+	} {
+		c, _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-rng", s})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Rng == nil || *c.Rng != expected {
+			t.Fatalf("expected: %v, actual: %v", expected, c.Rng)
+		}
+	}
+}
+
+func TestParseBootArgsWithBalloon(t *testing.T) {
+	t.Parallel()
+
+	c, _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-balloon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.MemBalloon {
+		t.Fatalf("expected: %v, actual: %v", true, c.MemBalloon)
+	}
+}
+
+func TestParseBootArgsWithShare(t *testing.T) {
+	t.Parallel()
+
+	c, _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-share", "/srv/data:data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ShareDir != "/srv/data" || c.ShareTag != "data" {
+		t.Fatalf("expected: %v, actual: %v", "/srv/data data", c.ShareDir+" "+c.ShareTag)
+	}
+}
+
+func TestParseBootArgsWithPmem(t *testing.T) {
+	t.Parallel()
+
+	c, _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-pmem", "file=data.img,readonly=on"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Pmem != "data.img" || !c.PmemReadonly {
+		t.Fatalf("expected: %v, actual: %v, %v", "data.img", c.Pmem, c.PmemReadonly)
+	}
+}
+
+func TestParseBootArgsWithMemHotplug(t *testing.T) {
+	t.Parallel()
+
+	c, _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-mem-hotplug", "size=8G,block=4,node=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MemHotplug != 8<<30 || c.MemHotplugBlock != 4<<20 || c.MemHotplugNode != 1 {
+		t.Fatalf("expected: %v, actual: %v, %v, %v", 8<<30, c.MemHotplug, c.MemHotplugBlock, c.MemHotplugNode)
+	}
+}
+
+func TestParseBootArgsWithMaxCPUs(t *testing.T) {
+	t.Parallel()
+
+	c, _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-c", "2", "-maxcpus", "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.NCPUs != 2 || c.MaxCPUs != 8 {
+		t.Fatalf("expected: %v, actual: %v, %v", "2 of 8", c.NCPUs, c.MaxCPUs)
+	}
+
+	if _, _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-c", "2", "-maxcpus", "1"}); !errors.Is(err, flag.ErrorInvalidOption) {
+		t.Fatalf("expected: %v, actual: %v", flag.ErrorInvalidOption, err)
+	}
+}
+
+func TestParseMemBackend(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		s        string
+		expected memory.Backend
+		err      error
+	}{
+		{"memfd", memory.Backend{Type: memory.Memfd}, nil},
+		{"anon,thp=on", memory.Backend{Type: memory.Anon, THP: true}, nil},
+		{
+			"hugetlbfs,pagesize=1G,prealloc=on",
+			memory.Backend{Type: memory.Hugetlbfs, PageSize: 1 << 30, Prealloc: true},
+			nil,
+		},
+		{"file=/dev/hugepages/vm", memory.Backend{Type: memory.File, Path: "/dev/hugepages/vm"}, nil},
+		{
+			"file=/dev/shm/vm,discard=on",
+			memory.Backend{Type: memory.File, Path: "/dev/shm/vm", Discard: true},
+			nil,
+		},
+		{"file=", memory.Backend{}, flag.ErrorInvalidOption},
+		{"memfd,discard=on", memory.Backend{}, flag.ErrorInvalidOption},
+		{"memfd,pagesize=2M", memory.Backend{}, flag.ErrorInvalidOption},
+		{"shm", memory.Backend{}, flag.ErrorInvalidOption},
+	} {
+		actual := memory.Backend{}
+
+		err := flag.ParseMemBackend(tt.s, &actual)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%s: expected: %v, actual: %v", tt.s, tt.err, err)
+		}
+
+		if err == nil && actual != tt.expected {
+			t.Fatalf("%s: expected: %+v, actual: %+v", tt.s, tt.expected, actual)
+		}
+	}
+}
+
+func TestParseBootArgsWithNUMA(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm", "boot", "-c", "4", "-m", "4G",
+		"-numa", "node,cpus=0-1:3,mem=3G,hostnode=0",
+		"-numa", "node,cpus=2,mem=1G",
+		"-numa", "dist,src=0,dst=1,val=21",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := numa.Config{
+		Nodes: []numa.Node{
+			{CPUs: []int{0, 1, 3}, Mem: 3 << 30, HostNode: 0},
+			{CPUs: []int{2}, Mem: 1 << 30, HostNode: -1},
+		},
+		Distances: map[[2]int]uint8{{0, 1}: 21},
+	}
+
+	if !reflect.DeepEqual(c.NUMA, expected) {
+		t.Fatalf("expected: %+v, actual: %+v", expected, c.NUMA)
+	}
+}
+
+func TestParseNUMA(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		"node",
+		"node,cpus=0",
+		"node,mem=1G",
+		"node,cpus=1-0,mem=1G",
+		"node,cpus=a,mem=1G",
+		"node,cpus=0,mem=1G,hostnode=-1",
+		"node,cpus=0,mem=1G,size=1G",
+		"dist,src=0,dst=1",
+		"dist,src=0,dst=1,val=256",
+		"dist,src=0,dst=1,val=20,x=1",
+		"socket,id=0",
+	} {
+		if err := flag.ParseNUMA(s, &numa.Config{}); err == nil {
+			t.Fatalf("%s: expected: an error, actual: %v", s, err)
+		}
+	}
+}
+
+func TestParseSwitchArgs(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"switch",
+		"-dgram",
+		"/tmp/dgram.sock",
+	}
+
+	_, _, c, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Dgram != "/tmp/dgram.sock" || c.Stream != "" {
+		t.Fatalf("expected: %v, actual: %+v", "/tmp/dgram.sock", c)
+	}
+}
+
+func TestParseBootArgsWithPcap(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-netdev",
+		"user,pcap=guest.pcapng,pcap_size=10M,pcap_files=3",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := pcap.Config{Path: "guest.pcapng", MaxSize: 10 << 20, Files: 3}
+	if c.NetCapture != expected {
+		t.Fatalf("expected: %+v, actual: %+v", expected, c.NetCapture)
+	}
+}
+
+func TestParseNetem(t *testing.T) {
+	t.Parallel()
+
+	args := []string{
+		"gokvm",
+		"boot",
+		"-netdev",
+		"user,rate=1M,delay=100ms,loss=1.5%,seed=42",
+	}
+
+	c, _, _, err := flag.ParseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := netem.Config{Rate: 1 << 20, Delay: 100 * time.Millisecond, Loss: 1.5, Seed: 42}
+	if c.NetShaping != expected {
+		t.Fatalf("expected: %+v, actual: %+v", expected, c.NetShaping)
+	}
+
+	if err := flag.ParseNetem("jitter=10ms,reorder=25", &c.NetShaping); err != nil {
+		t.Fatal(err)
+	}
+
+	expected.Jitter = 10 * time.Millisecond
+	expected.Reorder = 25
+
+	if c.NetShaping != expected {
+		t.Fatalf("expected: %+v, actual: %+v", expected, c.NetShaping)
+	}
+
+	if err := flag.ParseNetem("loss=101", &c.NetShaping); !errors.Is(err, flag.ErrorInvalidOption) {
+		t.Fatalf("expected: %v, actual: %v", flag.ErrorInvalidOption, err)
+	}
+}
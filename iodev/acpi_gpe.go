@@ -0,0 +1,105 @@
+package iodev
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	// ACPIGPE0Port is the GPE0 block the FADT locates, with ACPIGPE0Len
+	// bytes: the status registers, then the enable registers.
+	ACPIGPE0Port = 0x620
+	ACPIGPE0Len  = 4
+)
+
+// ACPIGPE is the GPE0 block of ACPI. A general-purpose event raises the
+// SCI if it is enabled, and the guest runs the _Exx method of its number.
+type ACPIGPE struct {
+	mu sync.Mutex
+	// regs are GPE0_STS and GPE0_EN.
+	regs [ACPIGPE0Len]byte
+	// sci injects the SCI.
+	sci func() error
+}
+
+func NewACPIGPE(sci func() error) *ACPIGPE {
+	return &ACPIGPE{sci: sci}
+}
+
+// Raise sets the status of event gpe, and raises the SCI if it is enabled.
+func (a *ACPIGPE) Raise(gpe int) error {
+	a.mu.Lock()
+	a.regs[gpe/8] |= 1 << (gpe % 8)
+	pending := a.pending()
+	a.mu.Unlock()
+
+	if !pending {
+		return nil
+	}
+
+	return a.sci()
+}
+
+// pending tells if an enabled event has its status set.
+func (a *ACPIGPE) pending() bool {
+	half := ACPIGPE0Len / 2
+	for i := 0; i < half; i++ {
+		if a.regs[i]&a.regs[half+i] != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *ACPIGPE) Read(base uint64, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	off := base - ACPIGPE0Port
+	for i := range data {
+		if off+uint64(i) < uint64(len(a.regs)) {
+			data[i] = a.regs[off+uint64(i)]
+		}
+	}
+
+	return nil
+}
+
+func (a *ACPIGPE) Write(base uint64, data []byte) error {
+	a.mu.Lock()
+
+	off := base - ACPIGPE0Port
+	for i, d := range data {
+		switch j := off + uint64(i); {
+		case j < ACPIGPE0Len/2:
+			// Status bits are cleared by writing 1.
+			a.regs[j] &^= d
+		case j < uint64(len(a.regs)):
+			a.regs[j] = d
+		}
+	}
+
+	// The SCI is edge-triggered, so the events which came in while they
+	// were disabled raise it again.
+	pending := a.pending()
+	a.mu.Unlock()
+
+	if !pending {
+		return nil
+	}
+
+	if err := a.sci(); err != nil {
+		log.Printf("GPE: SCI: %v", err)
+	}
+
+	return nil
+}
+
+func (a *ACPIGPE) IOPort() uint64 {
+	return ACPIGPE0Port
+}
+
+func (a *ACPIGPE) Size() uint64 {
+	return ACPIGPE0Len
+}
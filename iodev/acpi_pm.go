@@ -0,0 +1,84 @@
+package iodev
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	// PM1 event and control blocks, as the FADT locates them.
+	ACPIPM1EvtPort = 0x600
+	ACPIPM1CntPort = 0x604
+	// ACPIPMTimerPort is the PM timer, an ACPIPMTimer.
+	ACPIPMTimerPort = 0x608
+
+	pm1CntSCIEn  = 1 << 0
+	pm1CntSlpEn  = 1 << 13
+	pm1CntSlpTyp = 7 << 10
+)
+
+// ACPIPM is the PM1a event and control blocks of ACPI: the status and
+// enable registers of the fixed events, and the control register. The
+// machine is always in ACPI mode.
+type ACPIPM struct {
+	mu sync.Mutex
+	// regs are PM1_STS, PM1_EN and PM1_CNT, little endian.
+	regs [8]byte
+}
+
+func NewACPIPM() *ACPIPM {
+	a := &ACPIPM{}
+	a.regs[4] = pm1CntSCIEn
+
+	return a
+}
+
+func (a *ACPIPM) Read(base uint64, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	off := base - ACPIPM1EvtPort
+	for i := range data {
+		if off+uint64(i) < uint64(len(a.regs)) {
+			data[i] = a.regs[off+uint64(i)]
+		}
+	}
+
+	return nil
+}
+
+func (a *ACPIPM) Write(base uint64, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	off := base - ACPIPM1EvtPort
+	for i, d := range data {
+		switch j := off + uint64(i); {
+		case j < 2:
+			// Status bits are cleared by writing 1.
+			a.regs[j] &^= d
+		case j < uint64(len(a.regs)):
+			a.regs[j] = d
+		}
+	}
+
+	a.regs[4] |= pm1CntSCIEn
+
+	cnt := uint16(a.regs[4]) | uint16(a.regs[5])<<8
+	if cnt&pm1CntSlpEn != 0 {
+		log.Printf("ACPI sleep state %d requested", (cnt&pm1CntSlpTyp)>>10)
+
+		cnt &^= pm1CntSlpEn
+		a.regs[5] = uint8(cnt >> 8)
+	}
+
+	return nil
+}
+
+func (a *ACPIPM) IOPort() uint64 {
+	return ACPIPM1EvtPort
+}
+
+func (a *ACPIPM) Size() uint64 {
+	return 0x8
+}
@@ -43,7 +43,7 @@ func (a *ACPIPMTimer) Write(base uint64, data []byte) error {
 }
 
 func (a *ACPIPMTimer) IOPort() uint64 {
-	return 0x608
+	return ACPIPMTimerPort
 }
 
 func (a *ACPIPMTimer) Size() uint64 {
@@ -22,16 +22,26 @@ func NewCMOS(memBelow4G, memAbove4G uint64) *CMOS {
 		Data:  make([]uint8, dataLen),
 	}
 
-	// We assume 3G RAM at all times for now.....
-	extMem := uint16(0xBC00)
+	// The RAM above 16 MiB and below 4 GiB in 64 KiB units, as the
+	// firmware reads it.
+	extMem := uint64(0)
+	if memBelow4G > 16<<20 {
+		extMem = (memBelow4G - 16<<20) >> 16
+	}
+
+	if extMem > 0xFFFF {
+		extMem = 0xFFFF
+	}
 
 	cmos.Data[0x34] = uint8(extMem)
 	cmos.Data[0x35] = uint8(extMem >> 8)
 
-	// Only valid for PVH boot of firmware with 3G RAM fixed.....
-	cmos.Data[0x5b] = 0
-	cmos.Data[0x5c] = 0
-	cmos.Data[0x5d] = 0
+	// The RAM above 4 GiB in 64 KiB units.
+	highMem := memAbove4G >> 16
+
+	cmos.Data[0x5b] = uint8(highMem)
+	cmos.Data[0x5c] = uint8(highMem >> 8)
+	cmos.Data[0x5d] = uint8(highMem >> 16)
 
 	return cmos
 }
@@ -0,0 +1,143 @@
+package iodev
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	// CPUHotplugPort is the CPU hotplug controller. The guest selects a
+	// vCPU in the first byte and accesses its status in the second.
+	CPUHotplugPort = 0x630
+
+	// The bits of the status. Writing 1 to an event clears it, writing 1
+	// to CPUHotplugEject ejects the vCPU.
+	CPUHotplugEnabled = 1 << 0
+	CPUHotplugInsert  = 1 << 1
+	CPUHotplugRemove  = 1 << 2
+	CPUHotplugEject   = 1 << 3
+)
+
+// CPUHotplug tells the guest which vCPUs are present, and which are to be
+// inserted or removed. The guest ejects the vCPUs it removed.
+type CPUHotplug struct {
+	mu     sync.Mutex
+	sel    uint8
+	status []uint8
+	// notify tells the guest that there are events, through a GPE.
+	notify func() error
+}
+
+// NewCPUHotplug creates a controller of nCPUs vCPUs, of which the first
+// present ones are there at boot.
+func NewCPUHotplug(nCPUs, present int, notify func() error) *CPUHotplug {
+	c := &CPUHotplug{
+		status: make([]uint8, nCPUs),
+		notify: notify,
+	}
+
+	for i := 0; i < present; i++ {
+		c.status[i] = CPUHotplugEnabled
+	}
+
+	return c
+}
+
+// Plug makes vCPU cpu present, and asks the guest to insert it.
+func (c *CPUHotplug) Plug(cpu int) error {
+	c.mu.Lock()
+
+	if c.status[cpu]&(CPUHotplugEnabled|CPUHotplugRemove) == CPUHotplugEnabled {
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	c.status[cpu] = CPUHotplugEnabled | CPUHotplugInsert
+	c.mu.Unlock()
+
+	return c.notify()
+}
+
+// Unplug asks the guest to remove vCPU cpu. It stays present until the
+// guest ejects it.
+func (c *CPUHotplug) Unplug(cpu int) error {
+	c.mu.Lock()
+
+	if c.status[cpu]&CPUHotplugEnabled == 0 {
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	c.status[cpu] = CPUHotplugEnabled | CPUHotplugRemove
+	c.mu.Unlock()
+
+	return c.notify()
+}
+
+// Present returns whether each vCPU is present.
+func (c *CPUHotplug) Present() []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := make([]bool, len(c.status))
+	for i, s := range c.status {
+		p[i] = s&CPUHotplugEnabled != 0
+	}
+
+	return p
+}
+
+func (c *CPUHotplug) Read(base uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range data {
+		switch base + uint64(i) - CPUHotplugPort {
+		case 0:
+			data[i] = c.sel
+		case 1:
+			data[i] = 0
+			if int(c.sel) < len(c.status) {
+				data[i] = c.status[c.sel]
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *CPUHotplug) Write(base uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, d := range data {
+		switch base + uint64(i) - CPUHotplugPort {
+		case 0:
+			c.sel = d
+		case 1:
+			if int(c.sel) >= len(c.status) {
+				continue
+			}
+
+			c.status[c.sel] &^= d & (CPUHotplugInsert | CPUHotplugRemove)
+
+			if d&CPUHotplugEject != 0 {
+				c.status[c.sel] = 0
+
+				log.Printf("vCPU %d ejected", c.sel)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *CPUHotplug) IOPort() uint64 {
+	return CPUHotplugPort
+}
+
+func (c *CPUHotplug) Size() uint64 {
+	return 2
+}
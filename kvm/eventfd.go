@@ -0,0 +1,53 @@
+package kvm
+
+import "unsafe"
+
+// IRQFD connects an eventfd to a GSI, writing to FD raises the interrupt
+// without leaving the kernel.
+type IRQFD struct {
+	FD         uint32
+	GSI        uint32
+	Flags      uint32
+	ResampleFD uint32
+	_          [16]uint8
+}
+
+const IRQFDFlagDeassign = 1 << 0
+
+// SetIRQFD assigns or, with IRQFDFlagDeassign, deassigns an irqfd.
+func SetIRQFD(vmFd uintptr, irqfd *IRQFD) error {
+	_, err := Ioctl(vmFd,
+		IIOW(kvmIRQFD, unsafe.Sizeof(IRQFD{})),
+		uintptr(unsafe.Pointer(irqfd)))
+
+	return err
+}
+
+// IOEventFD makes guest writes to an address signal an eventfd instead of
+// exiting to userspace.
+type IOEventFD struct {
+	DataMatch uint64
+	Addr      uint64
+	Len       uint32
+	FD        int32
+	Flags     uint32
+	_         [36]uint8
+}
+
+const (
+	// IOEventFDFlagDataMatch signals only writes of DataMatch.
+	IOEventFDFlagDataMatch = 1 << 0
+	// IOEventFDFlagPIO is for an I/O port rather than MMIO.
+	IOEventFDFlagPIO      = 1 << 1
+	IOEventFDFlagDeassign = 1 << 2
+)
+
+// SetIOEventFD assigns or, with IOEventFDFlagDeassign, deassigns an
+// ioeventfd.
+func SetIOEventFD(vmFd uintptr, ioeventfd *IOEventFD) error {
+	_, err := Ioctl(vmFd,
+		IIOW(kvmIOEventFD, unsafe.Sizeof(IOEventFD{})),
+		uintptr(unsafe.Pointer(ioeventfd)))
+
+	return err
+}
@@ -36,7 +36,9 @@ const (
 	kvmSetGSIRouting = 0x6A
 
 	kvmReinjectControl = 0x71
+	kvmIRQFD           = 0x76
 	kvmCreatePIT2      = 0x77
+	kvmIOEventFD       = 0x79
 	kvmSetClock        = 0x7B
 	kvmGetClock        = 0x7C
 
@@ -121,6 +123,12 @@ const (
 	CPUIDFeatures   = 0x40000001
 	CPUIDSignature  = 0x40000000
 	CPUIDFuncPerMon = 0x0A
+
+	// Leaves of the topology of the processors.
+	CPUIDFuncVersion    = 0x01
+	CPUIDFuncCache      = 0x04
+	CPUIDFuncTopology   = 0x0B
+	CPUIDFuncTopologyV2 = 0x1F
 )
 
 var (
@@ -156,6 +164,22 @@ func (r *RunData) IO() (uint64, uint64, uint64, uint64, uint64) {
 	return direction, size, port, count, offset
 }
 
+// MMIO interprets MMIO requests from a VM, by unpacking RunData.Data[0:2]:
+// the address, the bytes, and whether the guest writes them.
+func (r *RunData) MMIO() (uint64, []byte, bool) {
+	addr := r.Data[0]
+	l := r.Data[2] & 0xFFFFFFFF
+	isWrite := (r.Data[2]>>32)&0xFF != 0
+
+	if l > 8 {
+		l = 8
+	}
+
+	data := (*[8]byte)(unsafe.Pointer(&r.Data[1]))[:l]
+
+	return addr, data, isWrite
+}
+
 // GetAPIVersion gets the qemu API version, which changes rarely if at all.
 func GetAPIVersion(kvmFd uintptr) (uintptr, error) {
 	return Ioctl(kvmFd, IIO(kvmGetAPIVersion), uintptr(0))
@@ -10,6 +10,7 @@ import (
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/kvm"
+	"golang.org/x/sys/unix"
 )
 
 func TestIRQRouting(t *testing.T) {
@@ -1449,3 +1450,60 @@ func TestGetSetMSRS(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIRQFDAndIOEventFD(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer devKVM.Close()
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kvm.CreateIRQChip(vmFd); err != nil {
+		t.Fatal(err)
+	}
+
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unix.Close(efd)
+
+	irqfd := &kvm.IRQFD{FD: uint32(efd), GSI: 9}
+	if err := kvm.SetIRQFD(vmFd, irqfd); err != nil {
+		t.Fatal(err)
+	}
+
+	irqfd.Flags = kvm.IRQFDFlagDeassign
+	if err := kvm.SetIRQFD(vmFd, irqfd); err != nil {
+		t.Fatal(err)
+	}
+
+	ioeventfd := &kvm.IOEventFD{
+		DataMatch: 1,
+		Addr:      0x6210,
+		Len:       2,
+		FD:        int32(efd),
+		Flags:     kvm.IOEventFDFlagPIO | kvm.IOEventFDFlagDataMatch,
+	}
+	if err := kvm.SetIOEventFD(vmFd, ioeventfd); err != nil {
+		t.Fatal(err)
+	}
+
+	ioeventfd.Flags |= kvm.IOEventFDFlagDeassign
+	if err := kvm.SetIOEventFD(vmFd, ioeventfd); err != nil {
+		t.Fatal(err)
+	}
+}
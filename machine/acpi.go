@@ -0,0 +1,332 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+	"github.com/bobuhiro11/gokvm/iodev"
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/numa"
+)
+
+const (
+	// The ACPI tables are in the BIOS area, where the guest looks for the
+	// RSDP.
+	acpiTablesAddr = 0xe0000
+	acpiTablesSize = 0x10000
+
+	// acpiSCIIRQ is the System Control Interrupt. The PIC of KVM keeps it
+	// edge-triggered.
+	acpiSCIIRQ = 13
+
+	// gpeCPUHotplug is the GPE of the CPU hotplug controller, whose
+	// method is \_GPE._E02.
+	gpeCPUHotplug = 2
+)
+
+// SetNUMA splits the vCPUs and the RAM into the NUMA nodes of c, and binds
+// the RAM of the nodes to the nodes of the host. The guest finds them in
+// the SRAT and the SLIT.
+func (m *Machine) SetNUMA(c numa.Config) error {
+	if err := c.Validate(len(m.vcpuFds), m.memory.Size()); err != nil {
+		return err
+	}
+
+	for i, n := range c.Nodes {
+		if n.HostNode < 0 {
+			continue
+		}
+
+		for _, r := range m.nodeRAM(c, i) {
+			if err := m.memory.Bind(r[0], r[1]-r[0], n.HostNode); err != nil {
+				return fmt.Errorf("node %d: %w", i, err)
+			}
+		}
+	}
+
+	m.numa = c
+
+	return nil
+}
+
+// NUMA returns the NUMA nodes.
+func (m *Machine) NUMA() numa.Config {
+	return m.numa
+}
+
+// EnableCPUHotplug lets vCPUs be plugged into the running guest and
+// unplugged from it through ACPI. Only the first present vCPUs are there
+// at boot, the others wait to be plugged.
+func (m *Machine) EnableCPUHotplug(present int) error {
+	if present < 1 || present > len(m.vcpuFds) {
+		return fmt.Errorf("%d of %d vCPUs present:%w", present, len(m.vcpuFds), ErrBadCPU)
+	}
+
+	m.gpe = iodev.NewACPIGPE(m.injectSCI)
+	m.cpuHotplug = iodev.NewCPUHotplug(len(m.vcpuFds), present, func() error {
+		return m.gpe.Raise(gpeCPUHotplug)
+	})
+	m.bootCPUs = present
+
+	m.AddDevice(m.gpe)
+	m.AddDevice(m.cpuHotplug)
+
+	return nil
+}
+
+// SetCPUs plugs or unplugs vCPUs until n are present, the last ones
+// first. The guest ejects a vCPU once it is done with it.
+func (m *Machine) SetCPUs(n int) error {
+	if m.cpuHotplug == nil {
+		return ErrNoCPUHotplug
+	}
+
+	if n < 1 || n > len(m.vcpuFds) {
+		return fmt.Errorf("%d vCPUs out of range 1-%d:%w", n, len(m.vcpuFds), ErrBadCPU)
+	}
+
+	for cpu, present := range m.cpuHotplug.Present() {
+		var err error
+
+		switch {
+		case cpu < n && !present:
+			err = m.cpuHotplug.Plug(cpu)
+		case cpu >= n && present:
+			err = m.cpuHotplug.Unplug(cpu)
+		}
+
+		if err != nil {
+			return fmt.Errorf("vCPU %d: %w", cpu, err)
+		}
+	}
+
+	return nil
+}
+
+// CPUs returns the number of vCPUs which are present, and the number
+// there can be.
+func (m *Machine) CPUs() (int, int) {
+	if m.cpuHotplug == nil {
+		return len(m.vcpuFds), len(m.vcpuFds)
+	}
+
+	present := 0
+
+	for _, p := range m.cpuHotplug.Present() {
+		if p {
+			present++
+		}
+	}
+
+	return present, len(m.vcpuFds)
+}
+
+// injectSCI injects the System Control Interrupt.
+func (m *Machine) injectSCI() error {
+	if err := kvm.IRQLineStatus(m.vmFd, acpiSCIIRQ, 0); err != nil {
+		return err
+	}
+
+	return kvm.IRQLineStatus(m.vmFd, acpiSCIIRQ, 1)
+}
+
+// nodeRAM returns the guest physical ranges of the RAM of node i of c.
+func (m *Machine) nodeRAM(c numa.Config, i int) [][2]uint64 {
+	off := uint64(0)
+	for _, n := range c.Nodes[:i] {
+		off += n.Mem
+	}
+
+	return m.memory.RAMRanges(off, c.Nodes[i].Mem)
+}
+
+// needsACPI is whether the guest gets ACPI tables. Others find the cpus and
+// the IRQs of the PCI devices in the MP table as before.
+func (m *Machine) needsACPI() bool {
+	return len(m.numa.Nodes) > 0 || m.cpuHotplug != nil
+}
+
+// loadACPI writes the ACPI tables, and adds the PM registers they point
+// at. It returns the address of the RSDP.
+func (m *Machine) loadACPI() (uint64, error) {
+	tables := []*acpi.Table{acpi.NewMADT(len(m.vcpuFds), m.bootCPUs)}
+
+	if len(m.numa.Nodes) > 0 {
+		cpuNodes := make([]uint32, len(m.vcpuFds))
+		for cpu := range cpuNodes {
+			cpuNodes[cpu] = uint32(m.numa.NodeOf(cpu))
+		}
+
+		mems := []acpi.MemAffinity{}
+
+		for i := range m.numa.Nodes {
+			for _, r := range m.nodeRAM(m.numa, i) {
+				mems = append(mems, acpi.MemAffinity{Node: uint32(i), Base: r[0], Size: r[1] - r[0]})
+			}
+		}
+
+		// The guest sets aside room for the memory it may plug.
+		if m.VirtioMem() != nil {
+			gpa, size := m.memory.HotplugRange()
+			mems = append(mems, acpi.MemAffinity{Node: uint32(m.memNode), Base: gpa, Size: size, Hotplug: true})
+		}
+
+		tables = append(tables,
+			acpi.NewSRAT(cpuNodes, mems),
+			acpi.NewSLIT(len(m.numa.Nodes), m.numa.Distance))
+	}
+
+	pm := acpi.PM{
+		SCI:       acpiSCIIRQ,
+		PM1EvtBlk: iodev.ACPIPM1EvtPort,
+		PM1CntBlk: iodev.ACPIPM1CntPort,
+		PMTmrBlk:  iodev.ACPIPMTimerPort,
+	}
+
+	if m.cpuHotplug != nil {
+		pm.GPE0Blk, pm.GPE0Len = iodev.ACPIGPE0Port, iodev.ACPIGPE0Len
+	}
+
+	b := acpi.Build(acpiTablesAddr, pm, m.dsdt(), tables...)
+	if len(b) > acpiTablesSize {
+		return 0, fmt.Errorf("%w: ACPI tables of %d bytes", ErrBadGPA, len(b))
+	}
+
+	copy(m.mem[acpiTablesAddr:], b)
+
+	m.AddDevice(iodev.NewACPIPM())
+	m.AddDevice(iodev.NewACPIPMTimer())
+
+	return acpiTablesAddr, nil
+}
+
+// dsdt is the AML of the PCI host bridge. The interrupt of each PCI device
+// is routed through a link device to its fixed IRQ, which stays
+// edge-triggered.
+func (m *Machine) dsdt() []byte {
+	prt := [][]byte{}
+	links := [][]byte{}
+	linked := map[uint8]bool{}
+
+	for slot, dev := range m.pci.Devices {
+		h := dev.GetDeviceHeader()
+		if h.InterruptPin == 0 {
+			continue
+		}
+
+		link := fmt.Sprintf("LK%02X", h.InterruptLine)
+
+		// The address is the slot with any function, the pin is INTA.
+		prt = append(prt, acpi.Package(
+			acpi.Integer(uint64(slot)<<16|0xffff),
+			acpi.Integer(0),
+			acpi.Path(`\_SB_.`+link),
+			acpi.Integer(0)))
+
+		if linked[h.InterruptLine] {
+			continue
+		}
+
+		linked[h.InterruptLine] = true
+		crs := acpi.ResourceTemplate(acpi.IRQNoFlags(h.InterruptLine))
+
+		links = append(links, acpi.Device(link,
+			acpi.Name("_HID", acpi.EISAID("PNP0C0F")),
+			acpi.Name("_UID", acpi.Integer(uint64(h.InterruptLine))),
+			acpi.Name("_PRS", crs),
+			acpi.Name("_CRS", crs),
+			acpi.Method("_SRS", 1)))
+	}
+
+	pci0 := acpi.Device("PCI0",
+		acpi.Name("_HID", acpi.EISAID("PNP0A03")),
+		acpi.Name("_UID", acpi.Integer(0)),
+		acpi.Name("_CRS", acpi.ResourceTemplate(
+			acpi.WordBusNumber(0, 0),
+			acpi.IO(0xcf8, 0xcf8, 1, 8),
+			acpi.WordIO(0, 0xcf7),
+			acpi.WordIO(0xd00, 0xffff),
+			acpi.DWordMemory(0xa0000, 0xbffff),
+			acpi.DWordMemory(memory.PCIHoleStart, 0xfebfffff))),
+		acpi.Name("_PRT", acpi.Package(prt...)))
+
+	dsdt := acpi.Scope(`\_SB_`, append(append([][]byte{pci0}, links...), m.cpusAML()...)...)
+
+	if m.cpuHotplug != nil {
+		dsdt = append(dsdt, acpi.Scope(`\_GPE`,
+			acpi.Method(fmt.Sprintf("_E%02X", gpeCPUHotplug), 0, acpi.Call(`\_SB_.CSCN`)))...)
+	}
+
+	// The sleep type of S5 the guest writes to power off.
+	dsdt = append(dsdt, acpi.Name(`\_S5_`, acpi.Package(
+		acpi.Integer(5), acpi.Integer(5), acpi.Integer(0), acpi.Integer(0)))...)
+
+	return dsdt
+}
+
+// cpusAML is the AML of the processor devices with hotplug, if any. The
+// guest reads their status from the CPU hotplug controller, and ejects
+// them through it. CSCN notifies the devices with events.
+func (m *Machine) cpusAML() [][]byte {
+	if m.cpuHotplug == nil {
+		return nil
+	}
+
+	n := len(m.vcpuFds)
+	locked := func(terms ...[]byte) [][]byte {
+		return append(append([][]byte{acpi.Acquire("CPLK")}, terms...), acpi.Release("CPLK"))
+	}
+	one := acpi.Integer(1)
+
+	terms := [][]byte{
+		acpi.OperationRegion("PRST", acpi.SystemIO, iodev.CPUHotplugPort, 2),
+		acpi.Field("PRST", acpi.ByteAcc|acpi.WriteAsZeros,
+			acpi.FieldUnit{Name: "CSEL", Bits: 8},
+			acpi.FieldUnit{Name: "CEN_", Bits: 1},
+			acpi.FieldUnit{Name: "CINS", Bits: 1},
+			acpi.FieldUnit{Name: "CRMV", Bits: 1},
+			acpi.FieldUnit{Name: "CEJF", Bits: 1}),
+		acpi.Mutex("CPLK"),
+		acpi.Method("CSTA", 1, append(locked(
+			acpi.Store(acpi.Arg(0), acpi.Path("CSEL")),
+			acpi.Store(acpi.Integer(0), acpi.Local(0)),
+			acpi.If(acpi.LEqual(acpi.Path("CEN_"), one),
+				acpi.Store(acpi.Integer(0xf), acpi.Local(0)))),
+			acpi.Return(acpi.Local(0)))...),
+		acpi.Method("CEJ0", 1, locked(
+			acpi.Store(acpi.Arg(0), acpi.Path("CSEL")),
+			acpi.Store(one, acpi.Path("CEJF")))...),
+		acpi.Method("CSCN", 0, locked(
+			acpi.Store(acpi.Integer(0), acpi.Local(0)),
+			acpi.While(acpi.LLess(acpi.Local(0), acpi.Integer(uint64(n))),
+				acpi.Store(acpi.Local(0), acpi.Path("CSEL")),
+				acpi.If(acpi.LEqual(acpi.Path("CINS"), one),
+					acpi.Call("CTFY", acpi.Local(0), one),
+					acpi.Store(one, acpi.Path("CINS"))),
+				acpi.If(acpi.LEqual(acpi.Path("CRMV"), one),
+					acpi.Call("CTFY", acpi.Local(0), acpi.Integer(3)),
+					acpi.Store(one, acpi.Path("CRMV"))),
+				acpi.Increment(acpi.Local(0))))...),
+	}
+
+	notify := [][]byte{}
+
+	for cpu := 0; cpu < n; cpu++ {
+		name := fmt.Sprintf("CP%02X", cpu)
+		id := acpi.Integer(uint64(cpu))
+
+		// The _UID is the processor UID of the local APIC in the MADT.
+		terms = append(terms, acpi.Device(name,
+			acpi.Name("_HID", acpi.String("ACPI0007")),
+			acpi.Name("_UID", id),
+			acpi.Method("_STA", 0, acpi.Return(acpi.Call("CSTA", id))),
+			acpi.Method("_EJ0", 1, acpi.Call("CEJ0", id))))
+
+		notify = append(notify, acpi.If(acpi.LEqual(acpi.Arg(0), id), acpi.Notify(name, acpi.Arg(1))))
+	}
+
+	// CTFY sends the notification Arg1 to the device of vCPU Arg0: 1 to
+	// check it, 3 to eject it.
+	return append(terms, acpi.Method("CTFY", 2, notify...))
+}
@@ -1,7 +1,6 @@
 package machine
 
 import (
-	"bytes"
 	"debug/elf"
 	"encoding/binary"
 	"encoding/hex"
@@ -9,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/bits"
 	"os"
 	"reflect"
 	"runtime"
@@ -16,16 +16,28 @@ import (
 	"syscall"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/block"
 	"github.com/bobuhiro11/gokvm/bootparam"
+	"github.com/bobuhiro11/gokvm/chardev"
 	"github.com/bobuhiro11/gokvm/ebda"
 	"github.com/bobuhiro11/gokvm/iodev"
 	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/netem"
+	"github.com/bobuhiro11/gokvm/netsock"
+	"github.com/bobuhiro11/gokvm/numa"
+	"github.com/bobuhiro11/gokvm/p9"
+	"github.com/bobuhiro11/gokvm/pcap"
 	"github.com/bobuhiro11/gokvm/pci"
 	"github.com/bobuhiro11/gokvm/pvh"
+	"github.com/bobuhiro11/gokvm/rng"
 	"github.com/bobuhiro11/gokvm/serial"
 	"github.com/bobuhiro11/gokvm/tap"
+	"github.com/bobuhiro11/gokvm/usernet"
 	"github.com/bobuhiro11/gokvm/virtio"
+	"github.com/bobuhiro11/gokvm/vsock"
 	"golang.org/x/arch/x86/x86asm"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -35,12 +47,23 @@ const (
 	initrdAddr  = 0xf000000
 	highMemBase = 0x100000
 
-	serialIRQ    = 4
-	virtioNetIRQ = 9
-	virtioBlkIRQ = 10
+	serialIRQ        = 4
+	virtioNetIRQ     = 9
+	virtioBlkIRQ     = 10
+	virtioVsockIRQ   = 11
+	virtioConsoleIRQ = 5
+	virtioRngIRQ     = 6
+	virtioBalloonIRQ = 7
+	virtioP9IRQ      = 12
+	virtioPmemIRQ    = 14
+	virtioMemIRQ     = 15
 
 	pageTableBase = 0x30_000
 
+	// PmemAlign is the alignment of the size of a virtio-pmem file, which
+	// the guest needs for its namespace.
+	PmemAlign = 2 << 20
+
 	MinMemSize = 1 << 25
 )
 
@@ -119,12 +142,22 @@ var ErrWriteToCF9 = fmt.Errorf("power cycle via 0xcf9")
 // ErrBadVA indicates a bad virtual address was used.
 var ErrBadVA = fmt.Errorf("bad virtual address")
 
+// ErrBadGPA indicates a guest physical address outside of the memory.
+var ErrBadGPA = fmt.Errorf("bad guest physical address")
+
 // ErrBadCPU indicates a cpu number is invalid.
 var ErrBadCPU = fmt.Errorf("bad cpu number")
 
+// ErrNoCPUHotplug indicates vCPUs cannot be plugged into the machine.
+var ErrNoCPUHotplug = fmt.Errorf("no CPU hotplug")
+
 // ErrUnsupported indicates something we do not yet do.
 var ErrUnsupported = fmt.Errorf("unsupported")
 
+// ErrPmemSize indicates a virtio-pmem file whose size is not a multiple of
+// PmemAlign.
+var ErrPmemSize = fmt.Errorf("pmem size must be a non-zero multiple of %d", PmemAlign)
+
 // ErrMemTooSmall indicates the requested memory size is too small.
 var ErrMemTooSmall = fmt.Errorf("mem request must be at least 1<<20")
 
@@ -133,19 +166,43 @@ var ErrNotELF64File = fmt.Errorf("file is not ELF64")
 var errPTNoteHasNoFSize = fmt.Errorf("elf programm PT_NOTE has file size equel zero")
 
 type Machine struct {
-	kvmFd, vmFd    uintptr
-	vcpuFds        []uintptr
+	kvmFd, vmFd uintptr
+	vcpuFds     []uintptr
+	// mem is the RAM indexed by guest physical address, see memory.RAM.
 	mem            []byte
+	memory         *memory.Memory
 	runs           []*kvm.RunData
 	pci            *pci.PCI
 	serial         *serial.Serial
 	devices        []iodev.Device
 	ioportHandlers [0x10000][2]func(port uint64, bytes []byte) error
+
+	// netCapture records the frames of virtio-net if not nil.
+	netCapture *pcap.Writer
+	// netShaping impairs the frames of virtio-net if not nil.
+	netShaping *netem.Netem
+
+	// numa are the NUMA nodes, if any.
+	numa numa.Config
+	// memNode is the NUMA node of the hotplug range, -1 for none.
+	memNode int
+
+	// cpuHotplug lets vCPUs be plugged and unplugged if not nil. Only
+	// bootCPUs of them are present at boot.
+	cpuHotplug *iodev.CPUHotplug
+	gpe        *iodev.ACPIGPE
+	bootCPUs   int
 }
 
 // New creates a new KVM. This includes opening the kvm device, creating VM, creating
 // vCPUs, and attaching memory, disk (if needed), and tap (if needed).
 func New(kvmPath string, nCpus int, memSize int) (*Machine, error) {
+	return NewWithBackend(kvmPath, nCpus, memSize, 0, memory.Backend{})
+}
+
+// NewWithBackend creates a new KVM whose memory is allocated from backend,
+// with hotplugSize bytes above it for AddMemHotplug.
+func NewWithBackend(kvmPath string, nCpus int, memSize, hotplugSize int, backend memory.Backend) (*Machine, error) {
 	if memSize < MinMemSize {
 		return nil, fmt.Errorf("memory size %d:%w", memSize, ErrMemTooSmall)
 	}
@@ -161,6 +218,8 @@ func New(kvmPath string, nCpus int, memSize int) (*Machine, error) {
 		return nil, err
 	}
 
+	m.bootCPUs = nCpus
+
 	// initCPUIDs here manually
 	for cpuNr := range m.runs {
 		if err := m.initCPUID(cpuNr); err != nil {
@@ -168,53 +227,170 @@ func New(kvmPath string, nCpus int, memSize int) (*Machine, error) {
 		}
 	}
 
-	// Another coding anti-pattern reguired by golangci-lint.
-	// Would not pass review in Google.
-	if m.mem, err = syscall.Mmap(-1, 0, memSize,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED|syscall.MAP_ANONYMOUS); err != nil {
+	if m.memory, err = memory.New(m.vmFd, uint64(memSize), uint64(hotplugSize), backend); err != nil {
 		return m, err
 	}
 
-	err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
-		Slot: 0, Flags: 0, GuestPhysAddr: 0, MemorySize: uint64(memSize),
-		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[0]))),
-	})
-	if err != nil {
-		return m, err
-	}
+	m.mem = m.memory.RAM()
 
 	// Poison memory.
 	// 0 is valid instruction and if you start running in the middle of all those
 	// 0's it is impossible to diagnore.
-	for i := highMemBase; i < len(m.mem); i += len(Poison) {
+	// Only below 4 GiB, where code is loaded, so that a large guest does not
+	// get all of its memory allocated up front.
+	low, _ := memory.Split(uint64(memSize))
+	for i := uint64(highMemBase); i < low; i += uint64(len(Poison)) {
 		copy(m.mem[i:], Poison)
 	}
 
 	return m, nil
 }
 
-func (m *Machine) AddTapIf(tapIfName string) error {
-	t, err := tap.New(tapIfName)
+// AddTapIf adds a virtio-net device on the tap interface with the given
+// number of queue pairs, or one if queues is 0. Only more than one needs a
+// tap which takes IFF_MULTI_QUEUE. With vhost, the packets are moved by
+// vhost-net in the kernel if it is available.
+func (m *Machine) AddTapIf(tapIfName string, queues int, vhost bool) error {
+	if queues == 0 {
+		queues = 1
+	}
+
+	taps, err := tap.NewMultiQueue(tapIfName, queues)
+	if err != nil {
+		return err
+	}
+
+	backends := make([]io.ReadWriter, len(taps))
+	for i, t := range taps {
+		backends[i] = t
+	}
+
+	v := m.addNet(backends...)
+
+	if !vhost {
+		return nil
+	}
+
+	// Captures and impairments need every packet to pass gokvm.
+	if m.netCapture != nil || m.netShaping != nil {
+		log.Printf("vhost-net is not used with pcap or impairments")
+
+		return nil
+	}
+
+	h, err := m.newVhostNet(taps)
+	if err != nil {
+		log.Printf("vhost-net is not available, packets are moved by gokvm: %v", err)
+
+		return nil
+	}
+
+	v.SetDataPath(h)
+
+	return nil
+}
+
+// AddUserNet adds a virtio-net device on the user mode network, which
+// needs neither root nor a tap.
+func (m *Machine) AddUserNet(fwds []usernet.HostFwd) error {
+	s, err := usernet.New(fwds)
+	if err != nil {
+		return err
+	}
+
+	m.addNet(s)
+
+	return nil
+}
+
+// AddSocketNet adds a virtio-net device whose frames go over a UNIX socket,
+// to another guest or to a switch.
+func (m *Machine) AddSocketNet(c netsock.Config) error {
+	s, err := netsock.Open(c)
 	if err != nil {
 		return err
 	}
 
-	v := virtio.NewNet(virtioNetIRQ, m, t, m.mem)
+	m.addNet(s)
+
+	return nil
+}
+
+// CaptureNet records the frames of the virtio-net device added after it
+// in pcapng format.
+func (m *Machine) CaptureNet(c pcap.Config) error {
+	w, err := pcap.Create(c)
+	if err != nil {
+		return err
+	}
+
+	m.netCapture = w
+
+	return nil
+}
+
+// ShapeNet impairs the network of the virtio-net device added after it.
+// The impairments can be changed later through Netem.
+func (m *Machine) ShapeNet(c netem.Config) {
+	m.netShaping = netem.New(c)
+}
+
+// Netem returns the impairments of the network, or nil.
+func (m *Machine) Netem() *netem.Netem {
+	return m.netShaping
+}
+
+// addNet adds a virtio-net device with a queue pair per backend. A capture
+// records the frames as the guest sees them, i.e. after the impairments.
+func (m *Machine) addNet(backends ...io.ReadWriter) *virtio.Net {
+	if m.netShaping != nil {
+		for i, b := range backends {
+			backends[i] = m.netShaping.Wrap(b)
+		}
+	}
+
+	if m.netCapture != nil {
+		for i, b := range backends {
+			backends[i] = pcap.Wrap(b, m.netCapture)
+		}
+	}
+
+	v := virtio.NewMultiQueueNet(virtioNetIRQ, m, backends, m.mem)
+
 	go v.TxThreadEntry()
 	go v.RxThreadEntry()
 	// 00:01.0 for Virtio net
 	m.pci.Devices = append(m.pci.Devices, v)
 
+	return v
+}
+
+// AddDisk adds a disk with the given number of request queues, or one
+// queue per vCPU if queues is 0.
+func (m *Machine) AddDisk(diskPath string, queues int) error {
+	v, err := virtio.NewBlk(diskPath, m.diskQueues(queues), virtioBlkIRQ, m, m.mem)
+	if err != nil {
+		return err
+	}
+
+	go v.IOThreadEntry()
+	// 00:02.0 for Virtio blk
+	m.pci.Devices = append(m.pci.Devices, v)
+
 	return nil
 }
 
-func (m *Machine) AddDisk(diskPath string) error {
-	v, err := virtio.NewBlk(diskPath, virtioBlkIRQ, m, m.mem)
+// AddSnapshotDisk adds a disk whose image is never modified by the guest.
+// Writes go to a temporary overlay which is discarded on exit, unless
+// CommitDisks merges it back first.
+func (m *Machine) AddSnapshotDisk(diskPath string, queues int) error {
+	o, err := block.NewOverlay(diskPath, "")
 	if err != nil {
 		return err
 	}
 
+	v := virtio.NewBlkWithBackend(o, m.diskQueues(queues), virtioBlkIRQ, m, m.mem)
+
 	go v.IOThreadEntry()
 	// 00:02.0 for Virtio blk
 	m.pci.Devices = append(m.pci.Devices, v)
@@ -222,6 +398,263 @@ func (m *Machine) AddDisk(diskPath string) error {
 	return nil
 }
 
+func (m *Machine) diskQueues(queues int) int {
+	if queues > 0 {
+		return queues
+	}
+
+	return len(m.vcpuFds)
+}
+
+// Disks returns the virtio-blk devices in the order they were added.
+func (m *Machine) Disks() []*virtio.Blk {
+	disks := []*virtio.Blk{}
+
+	for _, dev := range m.pci.Devices {
+		if v, ok := dev.(*virtio.Blk); ok {
+			disks = append(disks, v)
+		}
+	}
+
+	return disks
+}
+
+// CommitDisks writes the changes of all snapshot disks back to their images.
+func (m *Machine) CommitDisks() error {
+	for _, v := range m.Disks() {
+		if err := v.Commit(); err != nil && !errors.Is(err, virtio.ErrNotSnapshot) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddVsock adds a virtio-vsock device for the guest with the given CID. The
+// host reaches port N of the guest through the UNIX socket at path, and the
+// guest reaches port N of the host at path_N.
+func (m *Machine) AddVsock(cid uint64, path string) error {
+	mux, err := vsock.Listen(cid, path)
+	if err != nil {
+		return err
+	}
+
+	v := virtio.NewVsock(cid, virtioVsockIRQ, m, mux, m.mem)
+
+	go v.TxThreadEntry()
+	go v.RxThreadEntry()
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// AddConsole adds a virtio-console device with a port on each of the given
+// character devices.
+func (m *Machine) AddConsole(ports []chardev.Port) error {
+	vports := make([]virtio.ConsolePort, 0, len(ports))
+
+	for _, p := range ports {
+		dev, err := chardev.Open(p.Config)
+		if err != nil {
+			return fmt.Errorf("console port %q: %w", p.Name, err)
+		}
+
+		if pty, ok := dev.(*chardev.PtyDev); ok {
+			fmt.Printf("virtio-console port %q is on %s\r\n", p.Name, pty.Path())
+		}
+
+		vports = append(vports, virtio.ConsolePort{Name: p.Name, Console: p.Console, Backend: dev})
+	}
+
+	v := virtio.NewConsole(vports, virtioConsoleIRQ, m, m.mem)
+
+	go v.TxThreadEntry()
+	go v.RxThreadEntry()
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// AddRng adds a virtio-rng device which feeds the guest from getrandom(2)
+// of the host, or from a seed.
+func (m *Machine) AddRng(c rng.Config) {
+	v := virtio.NewRng(rng.New(c), virtioRngIRQ, m, m.mem)
+
+	go v.IOThreadEntry()
+	m.pci.Devices = append(m.pci.Devices, v)
+}
+
+// AddBalloon adds a virtio-balloon device, through which the guest gives
+// memory back to the host.
+func (m *Machine) AddBalloon() {
+	v := virtio.NewBalloon(m.discardMemory, virtioBalloonIRQ, m, m.mem)
+
+	go v.IOThreadEntry()
+	m.pci.Devices = append(m.pci.Devices, v)
+}
+
+// AddShare adds a virtio-9p device through which the guest mounts dir of the
+// host by tag.
+func (m *Machine) AddShare(dir, tag string) error {
+	s, err := p9.NewServer(dir)
+	if err != nil {
+		return err
+	}
+
+	v := virtio.NewP9(tag, s, virtioP9IRQ, m, m.mem)
+
+	go v.IOThreadEntry()
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// AddPmem adds a virtio-pmem device on the file at path. The file is mapped
+// into the guest physical memory above the RAM, so that the guest reads it
+// without copies through a queue. With readonly, writes of the guest are
+// dropped and the file is not modified.
+func (m *Machine) AddPmem(path string, readonly bool) error {
+	flags, prot := os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE
+	if readonly {
+		flags, prot = os.O_RDONLY, unix.PROT_READ
+	}
+
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := uint64(st.Size())
+	if size == 0 || size%PmemAlign != 0 {
+		return fmt.Errorf("%s: %w", path, ErrPmemSize)
+	}
+
+	b, err := unix.Mmap(int(f.Fd()), 0, int(size), prot, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+
+	memFlags := memory.Flags(0)
+	if readonly {
+		memFlags = memory.ReadOnly
+	}
+
+	r, err := m.memory.AddDevice(b, memFlags, -1, 0)
+	if err != nil {
+		unix.Munmap(b)
+
+		return err
+	}
+
+	flush := func() error {
+		if readonly {
+			return nil
+		}
+
+		return unix.Msync(b, unix.MS_SYNC)
+	}
+
+	v := virtio.NewPmem(r.GPA, size, flush, virtioPmemIRQ, m, m.mem)
+
+	go v.IOThreadEntry()
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// AddMemHotplug adds a virtio-mem device, through which the guest plugs the
+// hotplug range in blocks of blockSize bytes, virtio.MemBlockSize if 0.
+// With NUMA nodes, the memory goes to node.
+func (m *Machine) AddMemHotplug(blockSize uint64, node int) error {
+	gpa, size := m.memory.HotplugRange()
+
+	if blockSize == 0 {
+		blockSize = virtio.MemBlockSize
+	}
+
+	if len(m.numa.Nodes) == 0 {
+		node = -1
+	} else if node < 0 || node >= len(m.numa.Nodes) {
+		return fmt.Errorf("%w: no node %d", numa.ErrConfig, node)
+	}
+
+	v, err := virtio.NewMem(gpa, size, blockSize, node, m.memory.Plug, m.memory.Unplug, virtioMemIRQ, m, m.mem)
+	if err != nil {
+		return err
+	}
+
+	m.memNode = node
+
+	go v.IOThreadEntry()
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// VirtioMem returns the virtio-mem device, or nil if there is none.
+func (m *Machine) VirtioMem() *virtio.Mem {
+	for _, dev := range m.pci.Devices {
+		if v, ok := dev.(*virtio.Mem); ok {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// ramAbove returns the ranges of RAM from start on, as [start, end).
+func (m *Machine) ramAbove(start uint64) [][2]uint64 {
+	ranges := [][2]uint64{}
+
+	for _, r := range m.memory.Regions() {
+		if r.Kind != memory.RAM || r.End() <= start {
+			continue
+		}
+
+		if r.GPA > start {
+			start = r.GPA
+		}
+
+		ranges = append(ranges, [2]uint64{start, r.End()})
+	}
+
+	return ranges
+}
+
+// Memory returns the guest physical memory.
+func (m *Machine) Memory() *memory.Memory {
+	return m.memory
+}
+
+// Balloon returns the virtio-balloon device, or nil.
+func (m *Machine) Balloon() *virtio.Balloon {
+	for _, dev := range m.pci.Devices {
+		if v, ok := dev.(*virtio.Balloon); ok {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// discardMemory returns the memory of the guest at addr to the host, as
+// far as the memory backend allows.
+func (m *Machine) discardMemory(addr, size uint64) error {
+	// Only the RAM, which comes before the memory of devices.
+	if _, err := m.memory.Translate(addr, size); err != nil || addr+size > uint64(len(m.mem)) {
+		return fmt.Errorf("%w: 0x%x+0x%x", ErrBadGPA, addr, size)
+	}
+
+	return m.memory.DiscardRAM(addr, size)
+}
+
 // Translate translates a virtual address for all active CPUs
 // and returns a []*Translate or error.
 func (m *Machine) Translate(vaddr uint64) ([]*kvm.Translation, error) {
@@ -274,7 +707,7 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 	copy(m.mem[pvh.EBDAPointer:], edbabytes)
 
 	// Create EBDA/mptables - Required for booting into Linux with PVH.
-	e, err := ebda.New(len(m.vcpuFds))
+	e, err := ebda.New(m.bootCPUs)
 	if err != nil {
 		return err
 	}
@@ -337,7 +770,17 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 		}
 	}
 
-	pvhstartinfo := pvh.NewStartInfo(bootparam.EBDAStart, cmdlineAddr)
+	rsdp := uint64(bootparam.EBDAStart)
+
+	if m.needsACPI() {
+		if rsdp, err = m.loadACPI(); err != nil {
+			return err
+		}
+	} else {
+		m.AddDevice(iodev.NewACPIPMTimer())
+	}
+
+	pvhstartinfo := pvh.NewStartInfo(rsdp, cmdlineAddr)
 
 	if initrd != nil {
 		initrdSize, err := initrd.ReadAt(m.mem[initrdAddr:], 0)
@@ -374,12 +817,10 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 
 	memmapentries = append(memmapentries, entry0)
 
-	entry := pvh.NewMemMapTableEntry(
-		pvh.HighRAMStart,
-		uint64(len(m.mem)-pvh.HighRAMStart),
-		bootparam.E820Ram)
-
-	memmapentries = append(memmapentries, entry)
+	for _, r := range m.ramAbove(pvh.HighRAMStart) {
+		memmapentries = append(memmapentries,
+			pvh.NewMemMapTableEntry(r[0], r[1]-r[0], bootparam.E820Ram))
+	}
 
 	pvhstartinfo.MemMapEntries = uint32(len(memmapentries))
 
@@ -410,8 +851,7 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 	}
 
 	m.AddDevice(&iodev.FWDebug{}) // Port 0x402
-	m.AddDevice(iodev.NewCMOS(0xC000000, 0x0))
-	m.AddDevice(iodev.NewACPIPMTimer())
+	m.AddDevice(iodev.NewCMOS(memory.Split(m.memory.Size())))
 	m.initIOPortHandlers()
 
 	return nil
@@ -425,7 +865,7 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		err               error
 	)
 
-	e, err := ebda.New(len(m.vcpuFds))
+	e, err := ebda.New(m.bootCPUs)
 	if err != nil {
 		return err
 	}
@@ -486,11 +926,10 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		bootparam.MBBIOSEnd-bootparam.MBBIOSBegin,
 		bootparam.E820Reserved,
 	)
-	bootParam.AddE820Entry(
-		highMemBase,
-		uint64(len(m.mem)-highMemBase),
-		bootparam.E820Ram,
-	)
+
+	for _, r := range m.ramAbove(highMemBase) {
+		bootParam.AddE820Entry(r[0], r[1]-r[0], bootparam.E820Ram)
+	}
 
 	bootParam.Hdr.VidMode = 0xFFFF                                                                  // Proto ALL
 	bootParam.Hdr.TypeOfLoader = 0xFF                                                               // Proto 2.00+
@@ -566,7 +1005,14 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		return err
 	}
 
-	m.AddDevice(iodev.NewCMOS(0xC000_0000, 0x0))
+	// The guest finds the RSDP by scanning the BIOS area.
+	if m.needsACPI() {
+		if _, err := m.loadACPI(); err != nil {
+			return err
+		}
+	}
+
+	m.AddDevice(iodev.NewCMOS(memory.Split(m.memory.Size())))
 	m.AddDevice(&iodev.Noop{Port: 0x80, Psize: 0xA0})
 	m.initIOPortHandlers()
 
@@ -772,6 +1218,8 @@ func (m *Machine) initCPUID(cpu int) error {
 			cpuid.Entries[i].Ebx = 0x4b4d564b // KVMK
 			cpuid.Entries[i].Ecx = 0x564b4d56 // VMKV
 			cpuid.Entries[i].Edx = 0x4d       // M
+		} else {
+			setCPUTopology(&cpuid.Entries[i], cpu, len(m.vcpuFds))
 		}
 	}
 
@@ -782,6 +1230,41 @@ func (m *Machine) initCPUID(cpu int) error {
 	return nil
 }
 
+// setCPUTopology makes vCPU cpu a core of its own in a single package of
+// nCPUs cores, with the local APIC ID cpu as in the MP table and the MADT.
+func setCPUTopology(e *kvm.CPUIDEntry2, cpu, nCPUs int) {
+	// The bits of the APIC ID which number the cores.
+	coreBits := uint32(bits.Len(uint(nCPUs - 1)))
+
+	switch e.Function {
+	case kvm.CPUIDFuncVersion:
+		e.Ebx = e.Ebx&0xffff | uint32(nCPUs)<<16 | uint32(cpu)<<24
+		if nCPUs > 1 {
+			e.Edx |= 1 << 28 // HTT
+		} else {
+			e.Edx &^= 1 << 28
+		}
+	case kvm.CPUIDFuncCache:
+		cores := uint32(nCPUs - 1)
+		if cores > 63 {
+			cores = 63
+		}
+
+		e.Eax = e.Eax&^(0x3f<<26) | cores<<26
+	case kvm.CPUIDFuncTopology, kvm.CPUIDFuncTopologyV2:
+		switch e.Index {
+		case 0: // SMT, a thread per core.
+			e.Eax, e.Ebx, e.Ecx = 0, 1, 1<<8
+		case 1: // Core
+			e.Eax, e.Ebx, e.Ecx = coreBits, uint32(nCPUs), 2<<8|1
+		default:
+			e.Eax, e.Ebx, e.Ecx = 0, 0, e.Index
+		}
+
+		e.Edx = uint32(cpu)
+	}
+}
+
 // SingleStep enables single stepping the guest.
 func (m *Machine) SingleStep(onoff bool) error {
 	for cpu := range m.vcpuFds {
@@ -862,6 +1345,15 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 		return true, nil
 	case kvm.EXITDEBUG:
 		return false, kvm.ErrDebug
+	case kvm.EXITMMIO:
+		addr, data, isWrite := m.runs[cpu].MMIO()
+
+		// KVM exits on writes to read-only memory, which are dropped.
+		if isWrite && m.memory.IsReadOnly(addr, uint64(len(data))) {
+			return true, nil
+		}
+
+		return false, fmt.Errorf("%w: %s at 0x%x", kvm.ErrUnexpectedExitReason, exit.String(), addr)
 
 	case kvm.EXITDCR,
 		kvm.EXITEXCEPTION,
@@ -869,7 +1361,6 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 		kvm.EXITHYPERCALL,
 		kvm.EXITINTERNALERROR,
 		kvm.EXITIRQWINDOWOPEN,
-		kvm.EXITMMIO,
 		kvm.EXITNMI,
 		kvm.EXITS390RESET,
 		kvm.EXITS390SIEIC,
@@ -1025,22 +1516,105 @@ func (m *Machine) InjectVirtioBlkIRQ() error {
 	return nil
 }
 
-// ReadAt implements io.ReadAt for the kvm guest pvh.
-func (m *Machine) ReadAt(b []byte, off int64) (int, error) {
-	mem := bytes.NewReader(m.mem)
+// InjectVirtioVsockIRQ injects a virtio vsock interrupt.
+func (m *Machine) InjectVirtioVsockIRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioVsockIRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioVsockIRQ, 1); err != nil {
+		return err
+	}
 
-	return mem.ReadAt(b, off)
+	return nil
 }
 
-// WriteAt implements io.WriteAt for the kvm guest pvh.
-func (m *Machine) WriteAt(b []byte, off int64) (int, error) {
-	if off > int64(len(m.mem)) {
-		return 0, syscall.EFBIG
+// InjectVirtioConsoleIRQ injects a virtio console interrupt.
+func (m *Machine) InjectVirtioConsoleIRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioConsoleIRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioConsoleIRQ, 1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InjectVirtioRngIRQ injects a virtio rng interrupt.
+func (m *Machine) InjectVirtioRngIRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioRngIRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioRngIRQ, 1); err != nil {
+		return err
 	}
 
-	n := copy(m.mem[off:], b)
+	return nil
+}
 
-	return n, nil
+// InjectVirtioBalloonIRQ injects a virtio balloon interrupt.
+func (m *Machine) InjectVirtioBalloonIRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioBalloonIRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioBalloonIRQ, 1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InjectVirtioP9IRQ injects a virtio 9p interrupt.
+func (m *Machine) InjectVirtioP9IRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioP9IRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioP9IRQ, 1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InjectVirtioPmemIRQ injects a virtio pmem interrupt.
+func (m *Machine) InjectVirtioPmemIRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioPmemIRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioPmemIRQ, 1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InjectVirtioMemIRQ injects a virtio mem interrupt.
+func (m *Machine) InjectVirtioMemIRQ() error {
+	if err := kvm.IRQLineStatus(m.vmFd, virtioMemIRQ, 0); err != nil {
+		return err
+	}
+
+	if err := kvm.IRQLineStatus(m.vmFd, virtioMemIRQ, 1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadAt implements io.ReadAt for the kvm guest pvh.
+func (m *Machine) ReadAt(b []byte, off int64) (int, error) {
+	return m.memory.ReadAt(b, off)
+}
+
+// WriteAt implements io.WriteAt for the kvm guest pvh.
+func (m *Machine) WriteAt(b []byte, off int64) (int, error) {
+	return m.memory.WriteAt(b, off)
 }
 
 func showone(indent string, in interface{}) string {
@@ -1095,7 +1669,7 @@ func (m *Machine) VtoP(cpu int, vaddr uint64) (int64, error) {
 
 	// There can exist a valid translation for memory that does not exist.
 	// For now, we call that an error.
-	if t.Valid == 0 || t.PhysicalAddress > uint64(len(m.mem)) {
+	if _, err := m.memory.Translate(t.PhysicalAddress, 1); t.Valid == 0 || err != nil {
 		return -1, fmt.Errorf("%#x:valid not set:%w", vaddr, ErrBadVA)
 	}
 
@@ -2,17 +2,22 @@ package machine_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/bobuhiro11/gokvm/kvm"
 	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/numa"
 	"github.com/bobuhiro11/gokvm/pvh"
+	"github.com/bobuhiro11/gokvm/virtio"
 	"golang.org/x/arch/x86/x86asm"
 )
 
@@ -26,11 +31,11 @@ func testNewAndLoadLinux(t *testing.T, kernel, tap, guestIPv4, hostIPv4, prefixL
 		t.Fatal(err)
 	}
 
-	if err := m.AddTapIf(tap); err != nil {
+	if err := m.AddTapIf(tap, 0, false); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := m.AddDisk("../vda.img"); err != nil {
+	if err := m.AddDisk("../vda.img", 0); err != nil {
 		t.Fatal(err)
 	}
 
@@ -564,6 +569,36 @@ func TestMemTooSmall(t *testing.T) {
 	}
 }
 
+func TestAddPmem(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "pmem.img")
+	if err := os.WriteFile(path, []byte("odd"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddPmem(path, true); !errors.Is(err, machine.ErrPmemSize) {
+		t.Fatalf("expected: %v, actual: %v", machine.ErrPmemSize, err)
+	}
+
+	if err := os.Truncate(path, machine.PmemAlign); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddPmem(path, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGetReg(t *testing.T) { // nolint:paralleltest
 	regs := []x86asm.Reg{
 		x86asm.RAX,
@@ -619,3 +654,157 @@ func TestGetReg(t *testing.T) { // nolint:paralleltest
 		t.Errorf("GetReg(r, x86asm.AL): got nil, want err")
 	}
 }
+
+func TestSetNUMA(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 2, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := numa.Config{Nodes: []numa.Node{
+		{CPUs: []int{0}, Mem: 32 << 20, HostNode: 0},
+		{CPUs: []int{1}, Mem: 16 << 20, HostNode: -1},
+	}}
+
+	if err := m.SetNUMA(c); !errors.Is(err, numa.ErrConfig) {
+		t.Fatalf("expected: %v, actual: %v", numa.ErrConfig, err)
+	}
+
+	// The host has no such node.
+	c.Nodes[1].Mem, c.Nodes[1].HostNode = 32<<20, 1000
+	if err := m.SetNUMA(c); err == nil {
+		t.Fatalf("expected: %v, actual: %v", "an error", err)
+	}
+
+	c.Nodes[1].HostNode = -1
+	if err := m.SetNUMA(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := m.NUMA(); len(n.Nodes) != 2 {
+		t.Fatalf("expected: %v, actual: %v", 2, len(n.Nodes))
+	}
+}
+
+func TestAddMemHotplug(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddMemHotplug(0, 0); !errors.Is(err, virtio.ErrMemSize) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrMemSize, err)
+	}
+
+	m, err = machine.NewWithBackend("/dev/kvm", 1, machine.MinMemSize, memory.HotplugChunk, memory.Backend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddMemHotplug(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.VirtioMem().SetRequestedSize(memory.HotplugChunk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCPUHotplug(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 4, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetCPUs(2); !errors.Is(err, machine.ErrNoCPUHotplug) {
+		t.Fatalf("expected: %v, actual: %v", machine.ErrNoCPUHotplug, err)
+	}
+
+	if err := m.EnableCPUHotplug(5); !errors.Is(err, machine.ErrBadCPU) {
+		t.Fatalf("expected: %v, actual: %v", machine.ErrBadCPU, err)
+	}
+
+	if err := m.EnableCPUHotplug(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetCPUs(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if present, possible := m.CPUs(); present != 3 || possible != 4 {
+		t.Fatalf("expected: %v, actual: %v of %v", "3 of 4", present, possible)
+	}
+
+	// The vCPUs stay until the guest ejects them.
+	if err := m.SetCPUs(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if present, _ := m.CPUs(); present != 3 {
+		t.Fatalf("expected: %v, actual: %v", 3, present)
+	}
+}
+
+// fakeBzImage is a kernel which LoadLinux takes, but which does not run.
+func fakeBzImage() *bytes.Reader {
+	b := make([]byte, 4096)
+	copy(b[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(b[0x206:], 0x0206)
+	b[512] = 0xf4 // hlt
+
+	return bytes.NewReader(b)
+}
+
+func TestACPIOnlyWhenNeeded(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	for _, hotplug := range []bool{false, true} {
+		m, err := machine.New("/dev/kvm", 2, machine.MinMemSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hotplug {
+			if err := m.EnableCPUHotplug(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := m.LoadLinux(fakeBzImage(), nil, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// The BIOS area, where the guest looks for the RSDP.
+		bios := make([]byte, 0x20000)
+		if _, err := m.ReadAt(bios, 0xe0000); err != nil {
+			t.Fatal(err)
+		}
+
+		if found := bytes.Contains(bios, []byte("RSD PTR ")); found != hotplug {
+			t.Fatalf("expected: %v, actual: %v", hotplug, found)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/tap"
+	"github.com/bobuhiro11/gokvm/vhost"
+	"github.com/bobuhiro11/gokvm/virtio"
+	"golang.org/x/sys/unix"
+)
+
+var ErrVhostStarted = errors.New("vhost-net is already started")
+
+// vhostNet runs the queue pairs of virtio-net in the kernel, one
+// /dev/vhost-net per pair. The guest kicks the queues through ioeventfds,
+// and vhost-net interrupts it through irqfds, so packets never pass gokvm.
+type vhostNet struct {
+	m        *Machine
+	taps     []*tap.Tap
+	devs     []*vhost.Dev
+	features uint64
+	started  bool
+}
+
+// newVhostNet opens a vhost-net for each tap.
+func (m *Machine) newVhostNet(taps []*tap.Tap) (*vhostNet, error) {
+	h := &vhostNet{m: m, taps: taps, features: ^uint64(0)}
+
+	for range taps {
+		d, err := vhost.OpenNet()
+		if err != nil {
+			h.close()
+
+			return nil, err
+		}
+
+		h.devs = append(h.devs, d)
+
+		f, err := d.Features()
+		if err != nil {
+			h.close()
+
+			return nil, err
+		}
+
+		h.features &= f
+	}
+
+	return h, nil
+}
+
+func (h *vhostNet) close() {
+	for _, d := range h.devs {
+		d.Close()
+	}
+}
+
+func (h *vhostNet) Features() uint64 {
+	return h.features
+}
+
+// Start hands the queues to vhost-net. Whatever was set up is undone if it
+// fails, so that gokvm can run the queues itself.
+func (h *vhostNet) Start(features uint64, queues []*virtio.VirtQueue) error {
+	if h.started {
+		return ErrVhostStarted
+	}
+
+	var undo []func()
+
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	mem := []vhost.MemoryRegion{}
+
+	for _, r := range h.m.memory.Table() {
+		mem = append(mem, vhost.MemoryRegion{
+			GuestPhysAddr: r.GPA,
+			MemorySize:    r.Size(),
+			UserspaceAddr: uint64(uintptr(unsafe.Pointer(&r.Mem[0]))),
+		})
+	}
+
+	for pair, d := range h.devs {
+		if err := d.SetMemTable(mem); err != nil {
+			rollback()
+
+			return err
+		}
+
+		// The tap takes care of struct virtio_net_hdr and the offloads,
+		// vhost-net only needs to know about the rest.
+		if err := d.SetFeatures(features & h.features); err != nil {
+			rollback()
+
+			return err
+		}
+
+		for i := 0; i < 2; i++ {
+			sel := 2*pair + i
+
+			vq := queues[sel]
+			if vq == nil {
+				continue
+			}
+
+			u, err := h.startVring(d, i, sel, vq)
+			undo = append(undo, u...)
+
+			if err != nil {
+				rollback()
+
+				return err
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := d.SetNetBackend(i, h.taps[pair].Fd()); err != nil {
+				rollback()
+
+				return err
+			}
+
+			d, i := d, i
+			undo = append(undo, func() { _ = d.SetNetBackend(i, -1) })
+		}
+	}
+
+	h.started = true
+
+	return nil
+}
+
+// startVring connects queue sel of the device to vring index of d. It
+// returns what undoes the steps which were done.
+func (h *vhostNet) startVring(d *vhost.Dev, index, sel int, vq *virtio.VirtQueue) ([]func(), error) {
+	kick, call, undo, err := h.m.queueEventFDs(virtio.NetIOPortStart, sel, virtioNetIRQ)
+	if err != nil {
+		return undo, err
+	}
+
+	err = d.SetVring(vringOf(index, vq, kick, call))
+
+	return undo, err
+}
+
+// queueEventFDs makes a kick, signalled when the guest notifies queue sel
+// of the virtio device at port, and a call which interrupts the guest on
+// gsi. It returns what undoes the steps which were done.
+func (m *Machine) queueEventFDs(port uint64, sel int, gsi uint32) (int, int, []func(), error) {
+	var undo []func()
+
+	kick, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return -1, -1, undo, fmt.Errorf("eventfd: %w", err)
+	}
+
+	undo = append(undo, func() { unix.Close(kick) })
+
+	call, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return -1, -1, undo, fmt.Errorf("eventfd: %w", err)
+	}
+
+	undo = append(undo, func() { unix.Close(call) })
+
+	// The guest writes the index of the queue to the notify register.
+	ioeventfd := &kvm.IOEventFD{
+		DataMatch: uint64(sel),
+		Addr:      port + 16,
+		Len:       2,
+		FD:        int32(kick),
+		Flags:     kvm.IOEventFDFlagPIO | kvm.IOEventFDFlagDataMatch,
+	}
+	if err := kvm.SetIOEventFD(m.vmFd, ioeventfd); err != nil {
+		return -1, -1, undo, fmt.Errorf("KVM_IOEVENTFD: %w", err)
+	}
+
+	undo = append(undo, func() {
+		ioeventfd.Flags |= kvm.IOEventFDFlagDeassign
+		_ = kvm.SetIOEventFD(m.vmFd, ioeventfd)
+	})
+
+	irqfd := &kvm.IRQFD{FD: uint32(call), GSI: gsi}
+	if err := kvm.SetIRQFD(m.vmFd, irqfd); err != nil {
+		return -1, -1, undo, fmt.Errorf("KVM_IRQFD: %w", err)
+	}
+
+	undo = append(undo, func() {
+		irqfd.Flags = kvm.IRQFDFlagDeassign
+		_ = kvm.SetIRQFD(m.vmFd, irqfd)
+	})
+
+	return kick, call, undo, nil
+}
+
+// vringOf describes vq, in the memory of the guest, to vhost.
+func vringOf(index int, vq *virtio.VirtQueue, kick, call int) vhost.Vring {
+	return vhost.Vring{
+		Index: index,
+		Num:   virtio.QueueSize,
+		Desc:  uintptr(unsafe.Pointer(&vq.DescTable)),
+		Avail: uintptr(unsafe.Pointer(&vq.AvailRing)),
+		Used:  uintptr(unsafe.Pointer(&vq.UsedRing)),
+		Kick:  kick,
+		Call:  call,
+	}
+}
@@ -0,0 +1,200 @@
+package machine
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/block"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/vhostuser"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+var (
+	ErrVhostUserStarted = errors.New("vhost-user device is already started")
+	ErrVhostUserOnly    = errors.New("the device is served by a vhost-user backend")
+	ErrVhostUserMemory  = errors.New("anonymous memory cannot be shared with a vhost-user backend")
+)
+
+// vhostUser runs the queues of a virtio device in a vhost-user backend. As
+// with vhost-net, the guest kicks the backend through ioeventfds and the
+// backend interrupts it through irqfds.
+type vhostUser struct {
+	m       *Machine
+	f       *vhostuser.Frontend
+	port    uint64
+	gsi     uint32
+	started bool
+}
+
+func (h *vhostUser) Features() uint64 {
+	return h.f.Features()
+}
+
+// Start shares the memory of the guest with the backend and hands it the
+// queues. Whatever was set up in gokvm is undone if it fails.
+func (h *vhostUser) Start(features uint64, queues []*virtio.VirtQueue) error {
+	if h.started {
+		return ErrVhostUserStarted
+	}
+
+	var undo []func()
+
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	if err := h.f.SetFeatures(features); err != nil {
+		return err
+	}
+
+	// The backend can only map the regions backed by a file descriptor,
+	// which the RAM must be.
+	mem := []vhostuser.MemoryRegion{}
+
+	for _, r := range h.m.memory.Table() {
+		if r.FD < 0 && r.Kind == memory.RAM {
+			return ErrVhostUserMemory
+		}
+
+		if r.FD < 0 {
+			continue
+		}
+
+		mem = append(mem, vhostuser.MemoryRegion{
+			GuestPhysAddr: r.GPA,
+			MemorySize:    r.Size(),
+			UserspaceAddr: uint64(uintptr(unsafe.Pointer(&r.Mem[0]))),
+			MmapOffset:    r.Offset,
+			FD:            r.FD,
+		})
+	}
+
+	if err := h.f.SetMemTable(mem); err != nil {
+		return err
+	}
+
+	for sel, vq := range queues {
+		if vq == nil {
+			continue
+		}
+
+		kick, call, u, err := h.m.queueEventFDs(h.port, sel, h.gsi)
+		undo = append(undo, u...)
+
+		if err == nil {
+			err = h.f.SetVring(vringOf(sel, vq, kick, call))
+		}
+
+		if err != nil {
+			rollback()
+
+			return err
+		}
+	}
+
+	h.started = true
+
+	return nil
+}
+
+// offlineNet is the backend of a virtio-net device whose queues are run
+// by a vhost-user backend. It only sees frames if that fails to start.
+type offlineNet struct{}
+
+func (offlineNet) Read(p []byte) (int, error) {
+	return 0, ErrVhostUserOnly
+}
+
+func (offlineNet) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// offlineDisk is the backend of a virtio-blk device whose queues are run by
+// a vhost-user backend. It fails every request if that fails to start.
+type offlineDisk struct {
+	size uint64
+}
+
+func (d offlineDisk) ReadAt(p []byte, off int64) (int, error) {
+	return 0, ErrVhostUserOnly
+}
+
+func (d offlineDisk) WriteAt(p []byte, off int64) (int, error) {
+	return 0, ErrVhostUserOnly
+}
+
+func (d offlineDisk) Size() uint64 {
+	return d.size
+}
+
+func (d offlineDisk) Sync() error {
+	return ErrVhostUserOnly
+}
+
+func (d offlineDisk) Close() error {
+	return nil
+}
+
+var _ block.Backend = offlineDisk{}
+
+// AddVhostUserNet adds a virtio-net device with a single queue pair, run
+// by the vhost-user backend listening on path.
+func (m *Machine) AddVhostUserNet(path string) error {
+	f, err := vhostuser.Dial(path)
+	if err != nil {
+		return err
+	}
+
+	if m.netCapture != nil || m.netShaping != nil {
+		log.Printf("pcap and impairments are not applied to vhost-user")
+	}
+
+	v := virtio.NewNet(virtioNetIRQ, m, offlineNet{}, m.mem)
+	v.SetDataPath(&vhostUser{m: m, f: f, port: virtio.NetIOPortStart, gsi: virtioNetIRQ})
+
+	go v.TxThreadEntry()
+	go v.RxThreadEntry()
+	// 00:01.0 for Virtio net
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// AddVhostUserDisk adds a virtio-blk device run by the vhost-user backend
+// listening on path, with as many of the given number of queues as the
+// backend supports, or one per vCPU if queues is 0.
+func (m *Machine) AddVhostUserDisk(path string, queues int) error {
+	f, err := vhostuser.Dial(path)
+	if err != nil {
+		return err
+	}
+
+	// The capacity in sectors, the first field of struct virtio_blk_config.
+	c, err := f.Config(0, 8)
+	if err != nil {
+		f.Close()
+
+		return err
+	}
+
+	queues = m.diskQueues(queues)
+	if n := f.QueueNum(); queues > n {
+		queues = n
+	}
+
+	disk := offlineDisk{size: binary.LittleEndian.Uint64(c) * virtio.SectorSize}
+
+	v := virtio.NewBlkWithBackend(disk, queues, virtioBlkIRQ, m, m.mem)
+	v.SetDataPath(&vhostUser{m: m, f: f, port: virtio.BlkIOPortStart, gsi: virtioBlkIRQ})
+
+	go v.IOThreadEntry()
+	// 00:02.0 for Virtio blk
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
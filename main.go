@@ -5,12 +5,13 @@ import (
 	"os"
 
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/netsock"
 	"github.com/bobuhiro11/gokvm/probe"
 	"github.com/bobuhiro11/gokvm/vmm"
 )
 
 func main() {
-	bootArgs, probeArgs, err := flag.ParseArgs(os.Args)
+	bootArgs, probeArgs, switchArgs, err := flag.ParseArgs(os.Args)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -22,10 +23,47 @@ func main() {
 			Initrd:     bootArgs.Initrd,
 			Params:     bootArgs.Params,
 			TapIfName:  bootArgs.TapIfName,
+			TapQueues:  bootArgs.TapQueues,
+			TapVhost:   bootArgs.TapVhost,
+			NetUser:    bootArgs.NetUser,
+			HostFwds:   bootArgs.HostFwds,
+			NetSocket:  bootArgs.NetSocket,
+			NetCapture: bootArgs.NetCapture,
+			NetShaping: bootArgs.NetShaping,
 			Disk:       bootArgs.Disk,
 			NCPUs:      bootArgs.NCPUs,
 			MemSize:    bootArgs.MemSize,
+			MemBackend: bootArgs.MemBackend,
+			NUMA:       bootArgs.NUMA,
 			TraceCount: bootArgs.TraceCount,
+
+			DiskSnapshot: bootArgs.DiskSnapshot,
+			DiskQueues:   bootArgs.DiskQueues,
+			DiskLimits:   bootArgs.DiskLimits,
+
+			NetVhostUser:  bootArgs.NetVhostUser,
+			DiskVhostUser: bootArgs.DiskVhostUser,
+
+			VsockCID:  bootArgs.VsockCID,
+			VsockPath: bootArgs.VsockPath,
+
+			ConsolePorts: bootArgs.ConsolePorts,
+			Rng:          bootArgs.Rng,
+			MemBalloon:   bootArgs.MemBalloon,
+
+			ShareDir: bootArgs.ShareDir,
+			ShareTag: bootArgs.ShareTag,
+
+			Pmem:         bootArgs.Pmem,
+			PmemReadonly: bootArgs.PmemReadonly,
+
+			MemHotplug:      bootArgs.MemHotplug,
+			MemHotplugBlock: bootArgs.MemHotplugBlock,
+			MemHotplugNode:  bootArgs.MemHotplugNode,
+
+			MaxCPUs: bootArgs.MaxCPUs,
+
+			MgmtSock: bootArgs.MgmtSock,
 		}
 
 		vmm := vmm.New(*c)
@@ -48,4 +86,10 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+
+	if switchArgs != nil {
+		if err := netsock.NewSwitch().ListenAndServe(switchArgs.Dgram, switchArgs.Stream); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,874 @@
+// Package memory lays out the physical memory of the guest and registers it
+// with KVM as memory slots: the RAM below the PCI hole, the rest of the RAM
+// above 4 GiB, the range memory is plugged into at run time, and the memory
+// of devices above them.
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// PCIHoleStart is where the RAM below 4 GiB ends. The hole up to
+	// 4 GiB is for the MMIO of PCI, the IOAPIC, the LAPIC and the
+	// firmware.
+	PCIHoleStart = 0xC000_0000
+	// HighBase is where the rest of the RAM starts.
+	HighBase = 1 << 32
+
+	// DeviceAlign aligns the memory of devices, which comes after the
+	// RAM.
+	DeviceAlign = 1 << 30
+
+	// HotplugChunk is the unit of the slots of the hotplug range. A chunk
+	// has a slot while any of it is plugged.
+	HotplugChunk = 128 << 20
+
+	pageSize = 4096
+
+	// The memory policy of mbind(2) that allocates from the nodes only,
+	// and its flag to move what is allocated already.
+	mpolBind   = 2
+	mpolMFMove = 1 << 1
+)
+
+var (
+	ErrBadGPA  = errors.New("bad guest physical address")
+	ErrOverlap = errors.New("memory regions overlap")
+	ErrNoSlot  = errors.New("no free memory slot")
+	ErrBackend = errors.New("bad memory backend")
+)
+
+// Flags of a slot, as the flags of struct kvm_userspace_memory_region.
+type Flags uint32
+
+const (
+	LogDirty Flags = 1 << 0
+	ReadOnly Flags = 1 << 1
+)
+
+// Kind tells the RAM from the memory of devices.
+type Kind int
+
+const (
+	RAM Kind = iota
+	Device
+	// Hotplug is RAM plugged at run time.
+	Hotplug
+)
+
+// Region is a range of the guest physical memory in a KVM slot, mapped at
+// Mem on the host.
+type Region struct {
+	Slot  uint32
+	GPA   uint64
+	Mem   []byte
+	Flags Flags
+	Kind  Kind
+	// FD and Offset locate Mem in a file, which other processes such as
+	// vhost-user backends map. FD is -1 for memory only gokvm has.
+	FD     int
+	Offset uint64
+}
+
+func (r *Region) Size() uint64 {
+	return uint64(len(r.Mem))
+}
+
+func (r *Region) End() uint64 {
+	return r.GPA + r.Size()
+}
+
+// BackendType is what the RAM is allocated from.
+type BackendType string
+
+const (
+	// Memfd is a sealed memfd, the default. vhost-user backends and other
+	// processes can map it, but not resize it.
+	Memfd BackendType = "memfd"
+	// Anon is anonymous memory, which only gokvm can map.
+	Anon BackendType = "anon"
+	// Hugetlbfs is a memfd of huge pages.
+	Hugetlbfs BackendType = "hugetlbfs"
+	// File is a file, which is created if it does not exist. On a
+	// hugetlbfs mount, its huge pages are used.
+	File BackendType = "file"
+)
+
+// Backend configures the allocation of the RAM. The zero Backend is a
+// memfd.
+type Backend struct {
+	Type BackendType
+	// Path is the file of File.
+	Path string
+	// PageSize is the size of the huge pages of Hugetlbfs, 2 MiB or
+	// 1 GiB. It is 2 MiB if zero.
+	PageSize uint64
+	// Prealloc allocates all of the RAM up front, rather than when the
+	// guest first touches it.
+	Prealloc bool
+	// THP asks for transparent huge pages.
+	THP bool
+	// Discard lets the balloon give the RAM of a File back to the host,
+	// which punches holes in the file.
+	Discard bool
+}
+
+// Memory is the guest physical memory of a VM.
+type Memory struct {
+	vmFd uintptr
+
+	mu      sync.RWMutex
+	regions []*Region
+	// ram is the host mapping of the RAM, indexed by guest physical
+	// address. The PCI hole is reserved but not accessible.
+	ram        []byte
+	fd         int
+	deviceNext uint64
+
+	// The size of the pages of the RAM, and whether they may be given
+	// back to the host.
+	ramPageSize uint64
+	discard     bool
+
+	// The hotplug range, which is a file of its own, and the number of
+	// bytes plugged in each of its chunks.
+	hotplugGPA  uint64
+	hotplugSize uint64
+	hotplugFd   int
+	plugged     map[uint64]uint64
+}
+
+// Split returns how much of size bytes of RAM goes below the PCI hole, and
+// how much above 4 GiB.
+func Split(size uint64) (uint64, uint64) {
+	if size <= PCIHoleStart {
+		return size, 0
+	}
+
+	return PCIHoleStart, size - PCIHoleStart
+}
+
+// New allocates size bytes of RAM from backend and registers it with the
+// VM. It reserves hotplug bytes above the RAM for Plug, a multiple of
+// HotplugChunk.
+func New(vmFd uintptr, size, hotplug uint64, backend Backend) (*Memory, error) {
+	if backend.THP && backend.Type == Hugetlbfs {
+		return nil, fmt.Errorf("%w: transparent huge pages of hugetlbfs", ErrBackend)
+	}
+
+	if hotplug%HotplugChunk != 0 {
+		return nil, fmt.Errorf("%w: hotplug size %d is not a multiple of %d", ErrBackend, hotplug, HotplugChunk)
+	}
+
+	fd, align, err := backend.open(size)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Memory{
+		vmFd:        vmFd,
+		fd:          fd,
+		ramPageSize: align,
+		discard:     backend.Type != File || backend.Discard,
+		hotplugSize: hotplug,
+		hotplugFd:   -1,
+		plugged:     map[uint64]uint64{},
+	}
+
+	if hotplug > 0 {
+		// Huge pages only if the RAM has them, the RAM of a File is not
+		// to be shared with the hotplug range.
+		hb := Backend{}
+		if backend.Type == Hugetlbfs {
+			hb = Backend{Type: Hugetlbfs, PageSize: backend.PageSize}
+		}
+
+		m.hotplugFd, _, err = hb.open(hotplug)
+	}
+
+	if err == nil {
+		err = m.mapRAM(size, align, backend)
+	}
+
+	if err != nil {
+		for _, fd := range []int{m.fd, m.hotplugFd} {
+			if fd >= 0 {
+				unix.Close(fd)
+			}
+		}
+
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// open returns the file of the RAM, -1 for Anon, and the size of its pages.
+func (b Backend) open(size uint64) (int, uint64, error) {
+	var (
+		fd    int
+		align = uint64(pageSize)
+		err   error
+	)
+
+	switch b.Type {
+	case "", Memfd:
+		fd, err = unix.MemfdCreate("gokvm", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	case Anon:
+		return -1, align, nil
+	case Hugetlbfs:
+		flags := unix.MFD_CLOEXEC | unix.MFD_HUGETLB
+
+		switch b.PageSize {
+		case 0, 2 << 20:
+			flags, align = flags|unix.MFD_HUGE_2MB, 2<<20
+		case 1 << 30:
+			flags, align = flags|unix.MFD_HUGE_1GB, 1<<30
+		default:
+			return -1, 0, fmt.Errorf("%w: page size %d", ErrBackend, b.PageSize)
+		}
+
+		fd, err = unix.MemfdCreate("gokvm", flags)
+	case File:
+		fd, err = unix.Open(b.Path, unix.O_RDWR|unix.O_CREAT|unix.O_CLOEXEC, 0o600)
+	default:
+		return -1, 0, fmt.Errorf("%w: %q", ErrBackend, b.Type)
+	}
+
+	if err != nil {
+		return -1, 0, err
+	}
+
+	if err := b.size(fd, size, &align); err != nil {
+		unix.Close(fd)
+
+		return -1, 0, err
+	}
+
+	return fd, align, nil
+}
+
+// size makes the file at fd size bytes long. A file on hugetlbfs is aligned
+// to its huge pages.
+func (b Backend) size(fd int, size uint64, align *uint64) error {
+	var fs unix.Statfs_t
+	if err := unix.Fstatfs(fd, &fs); err != nil {
+		return err
+	}
+
+	if fs.Type == unix.HUGETLBFS_MAGIC {
+		*align = uint64(fs.Bsize)
+	}
+
+	if size%*align != 0 {
+		return fmt.Errorf("%w: %d is not a multiple of the page size %d", ErrBackend, size, *align)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	// An existing file is not shrunk.
+	if uint64(st.Size) < size {
+		if err := unix.Ftruncate(fd, int64(size)); err != nil {
+			return err
+		}
+	}
+
+	if b.Type == "" || b.Type == Memfd {
+		_, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS,
+			unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_SEAL)
+
+		return err
+	}
+
+	return nil
+}
+
+// mapRAM reserves the address space up to the end of the RAM and maps the
+// backend into it on both sides of the PCI hole, so that ram is indexed by
+// guest physical address. The reservation is aligned to the pages of the
+// backend. The hotplug range follows at the next DeviceAlign above 4 GiB.
+func (m *Memory) mapRAM(size, align uint64, backend Backend) error {
+	low, high := Split(size)
+
+	end := low
+	if high > 0 {
+		end = HighBase + high
+	}
+
+	if m.hotplugSize > 0 {
+		m.hotplugGPA = alignUp(end, DeviceAlign)
+		if m.hotplugGPA < HighBase {
+			m.hotplugGPA = HighBase
+		}
+
+		end = m.hotplugGPA + m.hotplugSize
+	}
+
+	reserved, err := unix.Mmap(-1, 0, int(end+align), unix.PROT_NONE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE)
+	if err != nil {
+		return err
+	}
+
+	base := uint64(uintptr(unsafe.Pointer(&reserved[0])))
+	skip := alignUp(base, align) - base
+	m.ram = reserved[skip : skip+end : skip+end]
+
+	parts := []struct{ gpa, size, offset uint64 }{
+		{0, low, 0},
+		{HighBase, high, low},
+	}
+
+	for _, p := range parts {
+		if p.size == 0 {
+			continue
+		}
+
+		b := m.ram[p.gpa : p.gpa+p.size]
+		if err := mmapFixed(b, m.fd, p.offset, backend.Prealloc); err != nil {
+			return err
+		}
+
+		if backend.THP {
+			if err := unix.Madvise(b, unix.MADV_HUGEPAGE); err != nil {
+				return err
+			}
+		}
+
+		if _, err := m.Add(p.gpa, b, 0, RAM, m.fd, p.offset); err != nil {
+			return err
+		}
+	}
+
+	// The hotplug range is mapped up front, its slots come with Plug.
+	if m.hotplugSize > 0 {
+		return mmapFixed(m.ram[m.hotplugGPA:end], m.hotplugFd, 0, false)
+	}
+
+	return nil
+}
+
+// mmapFixed maps the file at b, which is already mapped, or anonymous
+// memory if fd is -1.
+func mmapFixed(b []byte, fd int, offset uint64, populate bool) error {
+	flags := unix.MAP_SHARED | unix.MAP_FIXED
+	if fd < 0 {
+		flags, offset = flags|unix.MAP_ANONYMOUS, 0
+	}
+
+	if populate {
+		flags |= unix.MAP_POPULATE
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_MMAP,
+		uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)),
+		unix.PROT_READ|unix.PROT_WRITE, uintptr(flags),
+		uintptr(fd), uintptr(offset))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// RAM returns the RAM indexed by guest physical address. Its length is the
+// end of the RAM, or of the hotplug range if there is one. The PCI hole and
+// the gap below the hotplug range must not be touched.
+func (m *Memory) RAM() []byte {
+	return m.ram
+}
+
+// Size is the size of the RAM, without the hole and the plugged memory.
+func (m *Memory) Size() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	size := uint64(0)
+
+	for _, r := range m.regions {
+		if r.Kind == RAM {
+			size += r.Size()
+		}
+	}
+
+	return size
+}
+
+// FD is the file of the RAM, -1 if it is anonymous.
+func (m *Memory) FD() int {
+	return m.fd
+}
+
+// Regions returns the regions in the order of their addresses.
+func (m *Memory) Regions() []Region {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	regions := make([]Region, len(m.regions))
+	for i, r := range m.regions {
+		regions[i] = *r
+	}
+
+	return regions
+}
+
+// Add registers b as the guest physical memory at gpa in a free slot.
+func (m *Memory) Add(gpa uint64, b []byte, flags Flags, kind Kind, fd int, offset uint64) (*Region, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.add(gpa, b, flags, kind, fd, offset)
+}
+
+func (m *Memory) add(gpa uint64, b []byte, flags Flags, kind Kind, fd int, offset uint64) (*Region, error) {
+	end := gpa + uint64(len(b))
+	if len(b) == 0 || gpa%pageSize != 0 || end < gpa {
+		return nil, fmt.Errorf("%w: 0x%x+0x%x", ErrBadGPA, gpa, len(b))
+	}
+
+	for _, r := range m.regions {
+		if gpa < r.End() && r.GPA < end {
+			return nil, fmt.Errorf("%w: 0x%x+0x%x", ErrOverlap, gpa, len(b))
+		}
+	}
+
+	r := &Region{Slot: m.freeSlot(), GPA: gpa, Mem: b, Flags: flags, Kind: kind, FD: fd, Offset: offset}
+
+	if err := m.register(r); err != nil {
+		return nil, err
+	}
+
+	m.regions = append(m.regions, r)
+	sort.Slice(m.regions, func(i, j int) bool { return m.regions[i].GPA < m.regions[j].GPA })
+
+	return r, nil
+}
+
+// AddDevice registers b as the memory of a device, at the next free
+// address above the RAM and the memory of the other devices.
+func (m *Memory) AddDevice(b []byte, flags Flags, fd int, offset uint64) (*Region, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.deviceNext == 0 {
+		m.deviceNext = alignUp(uint64(len(m.ram)), DeviceAlign)
+		if m.deviceNext < HighBase {
+			m.deviceNext = HighBase
+		}
+	}
+
+	r, err := m.add(m.deviceNext, b, flags, Device, fd, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	m.deviceNext = alignUp(r.End(), DeviceAlign)
+
+	return r, nil
+}
+
+// Remove unregisters the region at gpa. The mapping on the host is left
+// to the caller.
+func (m *Memory) Remove(gpa uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.remove(gpa)
+}
+
+func (m *Memory) remove(gpa uint64) error {
+	for i, r := range m.regions {
+		if r.GPA != gpa {
+			continue
+		}
+
+		// A slot of size zero is deleted.
+		err := kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{Slot: r.Slot})
+		if err != nil {
+			return err
+		}
+
+		m.regions = append(m.regions[:i], m.regions[i+1:]...)
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: 0x%x", ErrBadGPA, gpa)
+}
+
+// Table returns the regions for the memory tables of vhost: those of Regions
+// without the plugged chunks, and the whole of the hotplug range, which the
+// guest may plug after the table is set. Its Slot is meaningless.
+func (m *Memory) Table() []Region {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	regions := []Region{}
+
+	for _, r := range m.regions {
+		if r.Kind != Hotplug {
+			regions = append(regions, *r)
+		}
+	}
+
+	if m.hotplugSize > 0 {
+		regions = append(regions, Region{
+			GPA:  m.hotplugGPA,
+			Mem:  m.ram[m.hotplugGPA : m.hotplugGPA+m.hotplugSize],
+			Kind: Hotplug,
+			FD:   m.hotplugFd,
+		})
+	}
+
+	sort.Slice(regions, func(i, j int) bool { return regions[i].GPA < regions[j].GPA })
+
+	return regions
+}
+
+// HotplugRange returns the address and the size of the hotplug range, a
+// size of 0 if there is none.
+func (m *Memory) HotplugRange() (uint64, uint64) {
+	return m.hotplugGPA, m.hotplugSize
+}
+
+// Plug makes the size bytes at gpa in the hotplug range memory of the guest,
+// adding the slots of their chunks. They must not be plugged already.
+func (m *Memory) Plug(gpa, size uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	done := uint64(0)
+
+	err := m.eachChunk(gpa, size, func(chunk, start, n uint64) error {
+		if m.plugged[chunk]+n > HotplugChunk {
+			return fmt.Errorf("%w: 0x%x+0x%x is plugged", ErrOverlap, start, n)
+		}
+
+		if m.plugged[chunk] == 0 {
+			b := m.ram[chunk : chunk+HotplugChunk]
+			if _, err := m.add(chunk, b, 0, Hotplug, m.hotplugFd, chunk-m.hotplugGPA); err != nil {
+				return err
+			}
+		}
+
+		m.plugged[chunk] += n
+		done += n
+
+		return nil
+	})
+	if err != nil {
+		if done > 0 {
+			_ = m.unplug(gpa, done)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Unplug frees the size bytes at gpa in the hotplug range, and removes the
+// slots of the chunks with nothing plugged left. The guest reads zeros
+// there if they are plugged again.
+func (m *Memory) Unplug(gpa, size uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.unplug(gpa, size)
+}
+
+func (m *Memory) unplug(gpa, size uint64) error {
+	return m.eachChunk(gpa, size, func(chunk, start, n uint64) error {
+		if m.plugged[chunk] < n {
+			return fmt.Errorf("%w: 0x%x+0x%x is not plugged", ErrBadGPA, start, n)
+		}
+
+		err := unix.Fallocate(m.hotplugFd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+			int64(start-m.hotplugGPA), int64(n))
+		if err != nil {
+			return err
+		}
+
+		if m.plugged[chunk] -= n; m.plugged[chunk] > 0 {
+			return nil
+		}
+
+		delete(m.plugged, chunk)
+
+		return m.remove(chunk)
+	})
+}
+
+// eachChunk calls f with the chunks of the size bytes at gpa, the start
+// of the bytes in the chunk and their number.
+func (m *Memory) eachChunk(gpa, size uint64, f func(chunk, start, n uint64) error) error {
+	end := gpa + size
+	if size == 0 || gpa%pageSize != 0 || size%pageSize != 0 || gpa < m.hotplugGPA ||
+		end > m.hotplugGPA+m.hotplugSize || end < gpa {
+		return fmt.Errorf("%w: 0x%x+0x%x is not in the hotplug range", ErrBadGPA, gpa, size)
+	}
+
+	for start := gpa; start < end; {
+		chunk := start &^ (HotplugChunk - 1)
+
+		n := chunk + HotplugChunk - start
+		if n > end-start {
+			n = end - start
+		}
+
+		if err := f(chunk, start, n); err != nil {
+			return err
+		}
+
+		start += n
+	}
+
+	return nil
+}
+
+// SetFlags changes the flags of the region at gpa, e.g. to start logging
+// the pages the guest writes.
+func (m *Memory) SetFlags(gpa uint64, flags Flags) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.regions {
+		if r.GPA != gpa {
+			continue
+		}
+
+		old := r.Flags
+		r.Flags = flags
+
+		if err := m.register(r); err != nil {
+			r.Flags = old
+
+			return err
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: 0x%x", ErrBadGPA, gpa)
+}
+
+func (m *Memory) register(r *Region) error {
+	return kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
+		Slot:          r.Slot,
+		Flags:         uint32(r.Flags),
+		GuestPhysAddr: r.GPA,
+		MemorySize:    r.Size(),
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&r.Mem[0]))),
+	})
+}
+
+// freeSlot is the lowest slot number not in use.
+func (m *Memory) freeSlot() uint32 {
+	used := map[uint32]bool{}
+	for _, r := range m.regions {
+		used[r.Slot] = true
+	}
+
+	slot := uint32(0)
+	for used[slot] {
+		slot++
+	}
+
+	return slot
+}
+
+func (m *Memory) find(gpa, size uint64) *Region {
+	for _, r := range m.regions {
+		if r.GPA <= gpa && gpa+size <= r.End() && gpa+size >= gpa {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// Translate returns the host memory of the size bytes at gpa, which must be
+// in a single region.
+func (m *Memory) Translate(gpa, size uint64) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.find(gpa, size)
+	if r == nil {
+		return nil, fmt.Errorf("%w: 0x%x+0x%x", ErrBadGPA, gpa, size)
+	}
+
+	off := gpa - r.GPA
+
+	return r.Mem[off : off+size : off+size], nil
+}
+
+// DiscardRAM returns the RAM at gpa to the host, the guest reads zeros
+// there afterwards. Only whole pages of the backend are discarded, so none
+// of a 4 KiB page on huge pages, and nothing of a File unless the Backend
+// allows it.
+func (m *Memory) DiscardRAM(gpa, size uint64) error {
+	start, end := alignUp(gpa, m.ramPageSize), (gpa+size)&^(m.ramPageSize-1)
+	if !m.discard || end <= start {
+		return nil
+	}
+
+	b, err := m.Translate(start, end-start)
+	if err != nil {
+		return err
+	}
+
+	// MADV_REMOVE frees the pages of a file, MADV_DONTNEED those of
+	// anonymous memory.
+	if err := unix.Madvise(b, unix.MADV_REMOVE); err != nil {
+		return unix.Madvise(b, unix.MADV_DONTNEED)
+	}
+
+	return nil
+}
+
+// IsReadOnly tells whether the guest may only read the size bytes at gpa.
+func (m *Memory) IsReadOnly(gpa, size uint64) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.find(gpa, size)
+
+	return r != nil && r.Flags&ReadOnly != 0
+}
+
+// ReadAt reads the guest physical memory at off, up to the end of its
+// region.
+func (m *Memory) ReadAt(b []byte, off int64) (int, error) {
+	mem, err := m.upToEnd(off)
+	if err != nil {
+		return 0, io.EOF
+	}
+
+	n := copy(b, mem)
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteAt writes the guest physical memory at off, up to the end of its
+// region.
+func (m *Memory) WriteAt(b []byte, off int64) (int, error) {
+	mem, err := m.upToEnd(off)
+	if err != nil {
+		return 0, syscall.EFBIG
+	}
+
+	n := copy(mem, b)
+	if n < len(b) {
+		return n, syscall.EFBIG
+	}
+
+	return n, nil
+}
+
+func (m *Memory) upToEnd(off int64) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.find(uint64(off), 1)
+	if off < 0 || r == nil {
+		return nil, ErrBadGPA
+	}
+
+	return r.Mem[uint64(off)-r.GPA:], nil
+}
+
+// RAMRanges returns the guest physical ranges of the size bytes of RAM
+// from the offset off on, as [start, end). Offsets count the RAM only, so
+// they skip the PCI hole.
+func (m *Memory) RAMRanges(off, size uint64) [][2]uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ranges := [][2]uint64{}
+
+	for _, r := range m.regions {
+		if r.Kind != RAM || size == 0 {
+			continue
+		}
+
+		if off >= r.Size() {
+			off -= r.Size()
+
+			continue
+		}
+
+		n := r.Size() - off
+		if n > size {
+			n = size
+		}
+
+		ranges = append(ranges, [2]uint64{r.GPA + off, r.GPA + off + n})
+		off, size = 0, size-n
+	}
+
+	return ranges
+}
+
+// Bind allocates the size bytes at gpa from the node of the host, and
+// moves there what is already allocated.
+func (m *Memory) Bind(gpa, size uint64, node int) error {
+	b, err := m.Translate(gpa, size)
+	if err != nil {
+		return err
+	}
+
+	mask := make([]uint64, node/64+1)
+	mask[node/64] |= 1 << (node % 64)
+
+	_, _, errno := unix.Syscall6(unix.SYS_MBIND,
+		uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), mpolBind,
+		uintptr(unsafe.Pointer(&mask[0])), uintptr(64*len(mask)+1), mpolMFMove)
+	if errno != 0 {
+		return fmt.Errorf("mbind to node %d: %w", node, errno)
+	}
+
+	return nil
+}
+
+// DirtyLog returns the bitmap of the pages of the region at gpa the guest
+// wrote since the last call, which needs LogDirty. Bit 0 is the first page.
+func (m *Memory) DirtyLog(gpa uint64) ([]uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r := m.find(gpa, 1)
+	if r == nil || r.GPA != gpa {
+		return nil, fmt.Errorf("%w: 0x%x", ErrBadGPA, gpa)
+	}
+
+	pages := (r.Size() + pageSize - 1) / pageSize
+	bitmap := make([]uint64, (pages+63)/64)
+
+	err := kvm.GetDirtyLog(m.vmFd, &kvm.DirtyLog{
+		Slot:   r.Slot,
+		BitMap: uint64(uintptr(unsafe.Pointer(&bitmap[0]))),
+	})
+
+	return bitmap, err
+}
+
+func alignUp(n, align uint64) uint64 {
+	return (n + align - 1) &^ (align - 1)
+}
@@ -0,0 +1,310 @@
+package memory_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memory"
+	"golang.org/x/sys/unix"
+)
+
+func TestSplit(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct{ size, low, high uint64 }{
+		{1 << 30, 1 << 30, 0},
+		{memory.PCIHoleStart, memory.PCIHoleStart, 0},
+		{4 << 30, memory.PCIHoleStart, 1 << 30},
+	} {
+		if low, high := memory.Split(tt.size); low != tt.low || high != tt.high {
+			t.Fatalf("expected: %v, actual: %v", [2]uint64{tt.low, tt.high}, [2]uint64{low, high})
+		}
+	}
+}
+
+func newMemory(t *testing.T, size uint64) *memory.Memory {
+	t.Helper()
+
+	m, err := newMemoryWithBackend(t, size, 0, memory.Backend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func newMemoryWithBackend(t *testing.T, size, hotplug uint64, backend memory.Backend) (*memory.Memory, error) {
+	t.Helper()
+
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	devKVM, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { devKVM.Close() })
+
+	vmFd, err := kvm.CreateVM(devKVM.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return memory.New(vmFd, size, hotplug, backend)
+}
+
+func TestHighRAM(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t, memory.PCIHoleStart+16<<20)
+
+	regions := m.Regions()
+	if len(regions) != 2 {
+		t.Fatalf("expected: %v, actual: %v", 2, len(regions))
+	}
+
+	if regions[1].GPA != memory.HighBase || regions[1].Size() != 16<<20 || regions[1].Offset != memory.PCIHoleStart {
+		t.Fatalf("expected: %v, actual: %v", memory.HighBase, regions[1].GPA)
+	}
+
+	if m.Size() != memory.PCIHoleStart+16<<20 {
+		t.Fatalf("expected: %v, actual: %v", memory.PCIHoleStart+16<<20, m.Size())
+	}
+
+	// The hole is not memory.
+	if _, err := m.Translate(memory.PCIHoleStart, 1); !errors.Is(err, memory.ErrBadGPA) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBadGPA, err)
+	}
+
+	// RAM and high RAM are the same memfd.
+	if _, err := m.WriteAt([]byte("high"), memory.HighBase); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 4)
+	if _, err := unix.Pread(m.FD(), b, memory.PCIHoleStart); err != nil || string(b) != "high" {
+		t.Fatalf("expected: %v, actual: %v (%v)", "high", string(b), err)
+	}
+}
+
+func TestAddDevice(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t, 16<<20)
+
+	b, err := unix.Mmap(-1, 0, 2<<20, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer unix.Munmap(b)
+
+	r, err := m.AddDevice(b, memory.ReadOnly, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.GPA != memory.HighBase || r.Slot != 1 {
+		t.Fatalf("expected: %v, actual: %v", memory.HighBase, r.GPA)
+	}
+
+	if !m.IsReadOnly(r.GPA, 8) || m.IsReadOnly(0, 8) {
+		t.Fatalf("expected: %v, actual: %v", true, m.IsReadOnly(r.GPA, 8))
+	}
+
+	if _, err := m.Add(r.GPA+4096, b[:4096], 0, memory.Device, -1, 0); !errors.Is(err, memory.ErrOverlap) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrOverlap, err)
+	}
+
+	// Translate does not cross regions.
+	if _, err := m.Translate(r.GPA+2<<20-4, 8); !errors.Is(err, memory.ErrBadGPA) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBadGPA, err)
+	}
+
+	if err := m.Remove(r.GPA); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Translate(r.GPA, 1); !errors.Is(err, memory.ErrBadGPA) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBadGPA, err)
+	}
+}
+
+func TestDirtyLog(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t, 16<<20)
+
+	if err := m.SetFlags(0, memory.LogDirty); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing ran, so nothing is dirty.
+	bitmap, err := m.DirtyLog(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bitmap) != 16<<20/4096/64 || bitmap[0] != 0 {
+		t.Fatalf("expected: %v, actual: %v", 16<<20/4096/64, len(bitmap))
+	}
+}
+
+func TestBackends(t *testing.T) {
+	t.Parallel()
+
+	// The memfd is sealed.
+	m := newMemory(t, 16<<20)
+	if err := unix.Ftruncate(m.FD(), 32<<20); !errors.Is(err, unix.EPERM) {
+		t.Fatalf("expected: %v, actual: %v", unix.EPERM, err)
+	}
+
+	m, err := newMemoryWithBackend(t, 16<<20, 0, memory.Backend{Type: memory.Anon, Prealloc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.FD() != -1 || m.Regions()[0].FD != -1 {
+		t.Fatalf("expected: %v, actual: %v", -1, m.FD())
+	}
+
+	path := filepath.Join(t.TempDir(), "ram")
+
+	m, err = newMemoryWithBackend(t, 16<<20, 0, memory.Backend{Type: memory.File, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.WriteAt([]byte("file"), 0x1000); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil || len(b) != 16<<20 || string(b[0x1000:0x1004]) != "file" {
+		t.Fatalf("expected: %v, actual: %v (%v)", "file", len(b), err)
+	}
+
+	// The RAM is whole huge pages.
+	_, err = newMemoryWithBackend(t, 16<<20+4096, 0, memory.Backend{Type: memory.Hugetlbfs})
+	if !errors.Is(err, memory.ErrBackend) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBackend, err)
+	}
+
+	_, err = newMemoryWithBackend(t, 16<<20, 0, memory.Backend{Type: memory.Hugetlbfs, PageSize: 4096})
+	if !errors.Is(err, memory.ErrBackend) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBackend, err)
+	}
+}
+
+func TestDiscardRAM(t *testing.T) {
+	t.Parallel()
+
+	for _, discard := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "ram")
+
+		m, err := newMemoryWithBackend(t, 16<<20, 0, memory.Backend{Type: memory.File, Path: path, Discard: discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.WriteAt([]byte("file"), 0x1000); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := m.DiscardRAM(0x1000, 0x1000); err != nil {
+			t.Fatal(err)
+		}
+
+		// The file keeps the data, unless it may be discarded.
+		b := make([]byte, 4)
+		if _, err := m.ReadAt(b, 0x1000); err != nil {
+			t.Fatal(err)
+		}
+
+		if kept := string(b) == "file"; kept == discard {
+			t.Fatalf("expected: %v, actual: %v", !discard, kept)
+		}
+	}
+}
+
+func TestHotplug(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newMemoryWithBackend(t, 16<<20, 2<<20, memory.Backend{}); !errors.Is(err, memory.ErrBackend) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBackend, err)
+	}
+
+	m, err := newMemoryWithBackend(t, 16<<20, 2*memory.HotplugChunk, memory.Backend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gpa, size := m.HotplugRange()
+	if gpa != memory.HighBase || size != 2*memory.HotplugChunk || uint64(len(m.RAM())) != gpa+size {
+		t.Fatalf("expected: %v, actual: %v", memory.HighBase, gpa)
+	}
+
+	hotplugSlots := func() int {
+		n := 0
+
+		for _, r := range m.Regions() {
+			if r.Kind == memory.Hotplug {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	// Plugging the end of the first chunk and the start of the second
+	// adds both of their slots.
+	if err := m.Plug(gpa+memory.HotplugChunk-2<<20, 4<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := hotplugSlots(); n != 2 {
+		t.Fatalf("expected: %v, actual: %v", 2, n)
+	}
+
+	if _, err := m.WriteAt([]byte("plugged"), int64(gpa+memory.HotplugChunk)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Unplug(gpa+memory.HotplugChunk, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := hotplugSlots(); n != 1 {
+		t.Fatalf("expected: %v, actual: %v", 1, n)
+	}
+
+	if err := m.Unplug(gpa+memory.HotplugChunk, 2<<20); !errors.Is(err, memory.ErrBadGPA) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBadGPA, err)
+	}
+
+	// The memory is freed, and is zero when plugged again.
+	if err := m.Plug(gpa+memory.HotplugChunk, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 7)
+	if _, err := m.ReadAt(b, int64(gpa+memory.HotplugChunk)); err != nil || !bytes.Equal(b, make([]byte, 7)) {
+		t.Fatalf("expected: %v, actual: %v (%v)", make([]byte, 7), b, err)
+	}
+
+	// The table of vhost has the whole range, plugged or not.
+	table := m.Table()
+	if r := table[len(table)-1]; r.GPA != gpa || r.Size() != size || r.FD < 0 {
+		t.Fatalf("expected: %v, actual: %v", gpa, r.GPA)
+	}
+
+	if err := m.Plug(gpa+size, 2<<20); !errors.Is(err, memory.ErrBadGPA) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrBadGPA, err)
+	}
+}
@@ -0,0 +1,155 @@
+// Package mgmt implements the management interface of a running VM, a
+// line based text protocol on a UNIX socket, e.g.
+//
+//	$ socat - UNIX-CONNECT:/tmp/gokvm.sock
+//	throttle vda iops=100,bps=10M
+//	iops=100,bps=10485760,iops_burst=0,bps_burst=0
+//	ok
+//
+// Each request is a command followed by its arguments separated by spaces.
+// The reply is the output of the command followed by a line "ok", or a
+// single line "error: <message>".
+package mgmt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/unixsock"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrUsage          = errors.New("invalid arguments")
+)
+
+// HandlerFunc runs a command and returns its output.
+type HandlerFunc func(args []string) (string, error)
+
+type command struct {
+	usage string
+	f     HandlerFunc
+}
+
+type Server struct {
+	mu       sync.RWMutex
+	commands map[string]command
+
+	ln net.Listener
+}
+
+func New() *Server {
+	s := &Server{
+		commands: map[string]command{},
+	}
+
+	s.Handle("help", "help", func([]string) (string, error) {
+		return s.help(), nil
+	})
+
+	return s
+}
+
+// Handle registers f for the command name. usage is shown by help.
+func (s *Server) Handle(name, usage string, f HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands[name] = command{usage: usage, f: f}
+}
+
+func (s *Server) help() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	usages := make([]string, 0, len(s.commands))
+	for _, c := range s.commands {
+		usages = append(usages, c.usage)
+	}
+
+	sort.Strings(usages)
+
+	return strings.Join(usages, "\n")
+}
+
+// Exec runs a single request line.
+func (s *Server) Exec(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	s.mu.RLock()
+	c, ok := s.commands[fields[0]]
+	s.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownCommand, fields[0])
+	}
+
+	return c.f(fields[1:])
+}
+
+// Listen serves the management interface on a UNIX socket at path. A stale
+// socket left behind at path is replaced.
+func (s *Server) Listen(path string) error {
+	unixsock.RemoveStale(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	s.ln = ln
+
+	go s.serve()
+
+	return nil
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	sc := bufio.NewScanner(conn)
+
+	for sc.Scan() {
+		out, err := s.Exec(sc.Text())
+		if err != nil {
+			out = fmt.Sprintf("error: %v\n", err)
+		} else {
+			if len(out) > 0 && !strings.HasSuffix(out, "\n") {
+				out += "\n"
+			}
+
+			out += "ok\n"
+		}
+
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) Close() error {
+	if s.ln == nil {
+		return nil
+	}
+
+	return s.ln.Close()
+}
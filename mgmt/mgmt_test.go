@@ -0,0 +1,81 @@
+package mgmt_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/mgmt"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	s := mgmt.New()
+	s.Handle("echo", "echo [args...]", func(args []string) (string, error) {
+		return fmt.Sprint(args), nil
+	})
+	s.Handle("fail", "fail", func([]string) (string, error) {
+		return "", errors.New("failed")
+	})
+
+	path := filepath.Join(t.TempDir(), "mgmt.sock")
+	if err := s.Listen(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	for _, tt := range []struct {
+		req  string
+		resp []string
+	}{
+		{req: "echo a b", resp: []string{"[a b]", "ok"}},
+		{req: "fail", resp: []string{"error: failed"}},
+		{req: "nope", resp: []string{`error: unknown command: "nope"`}},
+		{req: "help", resp: []string{"echo [args...]", "fail", "help", "ok"}},
+	} {
+		if _, err := fmt.Fprintln(conn, tt.req); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range tt.resp {
+			actual, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != expected+"\n" {
+				t.Fatalf("%s: expected: %q, actual: %q", tt.req, expected+"\n", actual)
+			}
+		}
+	}
+}
+
+func TestListenKeepsFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mgmt.New().Listen(path); err == nil {
+		t.Fatalf("expected: %v, actual: %v", "an error", err)
+	}
+
+	if b, err := os.ReadFile(path); err != nil || string(b) != "data" {
+		t.Fatalf("expected: %v, actual: %v %v", "data", string(b), err)
+	}
+}
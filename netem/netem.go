@@ -0,0 +1,187 @@
+// Package netem impairs the network of a guest like the netem qdisc of
+// Linux: it limits the bandwidth, delays frames with jitter, and drops,
+// duplicates and reorders them. It sits between virtio-net and its
+// backend and applies to both directions.
+//
+// The random decisions come from a seeded generator, so a run can be
+// repeated with the same seed.
+package netem
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Config describes the impairments. The zero value passes every frame
+// through unchanged.
+type Config struct {
+	// Rate is the bandwidth in bytes per second.
+	Rate uint64
+	// Delay is added to every frame, varied by up to ±Jitter.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Loss, Duplicate and Reorder are percentages of the frames which are
+	// dropped, sent twice, and sent without Delay ahead of the others.
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	// Seed of the random decisions. 0 picks one, which Config reports.
+	Seed int64
+}
+
+// Stats counts the frames and what happened to them.
+type Stats struct {
+	Frames     uint64
+	Bytes      uint64
+	Lost       uint64
+	Duplicated uint64
+	Reordered  uint64
+	// Overflows are frames dropped because too many were in flight.
+	Overflows uint64
+}
+
+type direction int
+
+const (
+	// toBackend are the frames sent by the guest.
+	toBackend direction = iota
+	// toGuest are the frames received by the guest.
+	toGuest
+)
+
+// Frames in flight beyond this are dropped, like the limit of netem.
+const maxQueuedFrames = 1000
+
+// Netem holds the impairments of a NIC, shared by its queue pairs.
+type Netem struct {
+	mu    sync.Mutex
+	cfg   Config
+	rng   *rand.Rand
+	busy  [2]time.Time
+	stats Stats
+}
+
+func New(c Config) *Netem {
+	n := &Netem{}
+	n.SetConfig(c)
+
+	return n
+}
+
+// SetConfig replaces the impairments. The random decisions start over
+// from the seed.
+func (n *Netem) SetConfig(c Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if c.Seed == 0 {
+		c.Seed = time.Now().UnixNano()
+	}
+
+	n.cfg = c
+	n.rng = rand.New(rand.NewSource(c.Seed)) // nolint:gosec
+}
+
+func (n *Netem) Config() Config {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.cfg
+}
+
+func (n *Netem) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.stats
+}
+
+// chance returns true with a probability of percent.
+func (n *Netem) chance(percent float64) bool {
+	return percent > 0 && n.rng.Float64()*100 < percent
+}
+
+// schedule decides when a frame of l bytes, which arrives now, leaves. It
+// returns no time for a lost frame, and two for a duplicated one.
+func (n *Netem) schedule(dir direction, l int, now time.Time) []time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stats.Frames++
+	n.stats.Bytes += uint64(l)
+
+	if n.chance(n.cfg.Loss) {
+		n.stats.Lost++
+
+		return nil
+	}
+
+	copies := 1
+	if n.chance(n.cfg.Duplicate) {
+		n.stats.Duplicated++
+		copies++
+	}
+
+	times := make([]time.Time, 0, copies)
+
+	for i := 0; i < copies; i++ {
+		t := now
+
+		// The link sends one frame after another at Rate.
+		if n.cfg.Rate > 0 {
+			if n.busy[dir].After(t) {
+				t = n.busy[dir]
+			}
+
+			t = t.Add(time.Duration(float64(l) / float64(n.cfg.Rate) * float64(time.Second)))
+			n.busy[dir] = t
+		}
+
+		delay := n.cfg.Delay
+		if n.cfg.Jitter > 0 {
+			delay += time.Duration((n.rng.Float64()*2 - 1) * float64(n.cfg.Jitter))
+		}
+
+		if n.chance(n.cfg.Reorder) {
+			n.stats.Reordered++
+			delay = 0
+		}
+
+		if delay > 0 {
+			t = t.Add(delay)
+		}
+
+		times = append(times, t)
+	}
+
+	return times
+}
+
+// passThrough returns whether there are no impairments, so that frames
+// may skip the queues.
+func (n *Netem) passThrough() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c := n.cfg
+	c.Seed = 0
+
+	return c == (Config{})
+}
+
+// count counts a frame of l bytes which passed through.
+func (n *Netem) count(l int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stats.Frames++
+	n.stats.Bytes += uint64(l)
+}
+
+func (n *Netem) overflow() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stats.Overflows++
+}
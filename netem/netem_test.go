@@ -0,0 +1,269 @@
+package netem_test
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/netem"
+)
+
+var errEmpty = errors.New("empty")
+
+type mockBackend struct {
+	mu      sync.Mutex
+	written [][]byte
+	toRead  [][]byte
+}
+
+func (m *mockBackend) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.written = append(m.written, append([]byte(nil), p...))
+
+	return len(p), nil
+}
+
+func (m *mockBackend) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.toRead) == 0 {
+		return 0, errEmpty
+	}
+
+	n := copy(p, m.toRead[0])
+	m.toRead = m.toRead[1:]
+
+	return n, nil
+}
+
+func (m *mockBackend) frames() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([][]byte(nil), m.written...)
+}
+
+// waitFrames waits until n frames have been written to m.
+func waitFrames(t *testing.T, m *mockBackend, n int) [][]byte {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if f := m.frames(); len(f) >= n {
+			return f
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("expected: %d frames, actual: %d", n, len(m.frames()))
+
+	return nil
+}
+
+func write(t *testing.T, rw io.ReadWriter, frames int) {
+	t.Helper()
+
+	for i := 0; i < frames; i++ {
+		if _, err := rw.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	t.Parallel()
+
+	m := &mockBackend{toRead: [][]byte{{1, 2, 3}}}
+	rw := netem.New(netem.Config{}).Wrap(m)
+
+	write(t, rw, 1)
+
+	if n := len(m.frames()); n != 1 {
+		t.Fatalf("expected: %d, actual: %d", 1, n)
+	}
+
+	buf := make([]byte, 16)
+
+	n, err := rw.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Fatalf("expected: %d, actual: %d", 3, n)
+	}
+
+	if _, err := rw.Read(buf); !errors.Is(err, netem.ErrNoPacket) {
+		t.Fatalf("expected: %v, actual: %v", netem.ErrNoPacket, err)
+	}
+}
+
+// TestPassThroughDoesNotQueue checks that without impairments no frame is
+// held back, even more than netem keeps in flight.
+func TestPassThroughDoesNotQueue(t *testing.T) {
+	t.Parallel()
+
+	m := &mockBackend{}
+	for i := 0; i < 1500; i++ {
+		m.toRead = append(m.toRead, []byte{byte(i)})
+	}
+
+	n := netem.New(netem.Config{})
+	rw := n.Wrap(m)
+
+	write(t, rw, 1500)
+
+	if l := len(m.frames()); l != 1500 {
+		t.Fatalf("expected: %d, actual: %d", 1500, l)
+	}
+
+	buf := make([]byte, 16)
+
+	reads := 0
+	for ; ; reads++ {
+		if _, err := rw.Read(buf); err != nil {
+			break
+		}
+	}
+
+	if reads != 1500 {
+		t.Fatalf("expected: %d, actual: %d", 1500, reads)
+	}
+
+	if s := n.Stats(); s.Frames != 3000 || s.Overflows != 0 {
+		t.Fatalf("expected: %v, actual: %+v", "3000 frames", s)
+	}
+}
+
+func TestLossIsReproducible(t *testing.T) {
+	t.Parallel()
+
+	var results [2][][]byte
+
+	for i := range results {
+		m := &mockBackend{}
+		n := netem.New(netem.Config{Loss: 50, Seed: 42})
+
+		write(t, n.Wrap(m), 100)
+
+		results[i] = m.frames()
+
+		if s := n.Stats(); s.Lost+uint64(len(results[i])) != 100 {
+			t.Fatalf("expected: %d, actual: %+v", 100, s)
+		}
+	}
+
+	if len(results[0]) == 0 || len(results[0]) == 100 {
+		t.Fatalf("expected some frames to be lost, actual: %d of 100 sent", len(results[0]))
+	}
+
+	if len(results[0]) != len(results[1]) {
+		t.Fatalf("expected: %d, actual: %d", len(results[0]), len(results[1]))
+	}
+
+	for i := range results[0] {
+		if results[0][i][0] != results[1][i][0] {
+			t.Fatalf("expected: %v, actual: %v", results[0], results[1])
+		}
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	t.Parallel()
+
+	m := &mockBackend{}
+	write(t, netem.New(netem.Config{Duplicate: 100}).Wrap(m), 3)
+
+	if n := len(m.frames()); n != 6 {
+		t.Fatalf("expected: %d, actual: %d", 6, n)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	t.Parallel()
+
+	m := &mockBackend{toRead: [][]byte{{1}}}
+	rw := netem.New(netem.Config{Delay: 50 * time.Millisecond}).Wrap(m)
+
+	notified := make(chan struct{}, 1)
+	rw.(interface{ SetRxNotifier(f func()) }).SetRxNotifier(func() {
+		notified <- struct{}{}
+	})
+
+	start := time.Now()
+
+	write(t, rw, 1)
+
+	if n := len(m.frames()); n != 0 {
+		t.Fatalf("expected: %d, actual: %d", 0, n)
+	}
+
+	if _, err := rw.Read(make([]byte, 16)); !errors.Is(err, netem.ErrNoPacket) {
+		t.Fatalf("expected: %v, actual: %v", netem.ErrNoPacket, err)
+	}
+
+	waitFrames(t, m, 1)
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("not notified of the delayed frame")
+	}
+
+	if _, err := rw.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("expected: >= %v, actual: %v", 50*time.Millisecond, d)
+	}
+}
+
+func TestRate(t *testing.T) {
+	t.Parallel()
+
+	m := &mockBackend{}
+	rw := netem.New(netem.Config{Rate: 100000}).Wrap(m)
+	frame := make([]byte, 1000)
+	start := time.Now()
+
+	// 10 frames of 1000 bytes take 100ms at 100000 bytes per second.
+	for i := 0; i < 10; i++ {
+		if _, err := rw.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFrames(t, m, 10)
+
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("expected: >= %v, actual: %v", 100*time.Millisecond, d)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	t.Parallel()
+
+	m := &mockBackend{}
+	n := netem.New(netem.Config{Delay: 20 * time.Millisecond, Reorder: 50, Seed: 1})
+
+	write(t, n.Wrap(m), 10)
+
+	frames := waitFrames(t, m, 10)
+	sorted := true
+
+	for i := 1; i < len(frames); i++ {
+		if frames[i][0] < frames[i-1][0] {
+			sorted = false
+		}
+	}
+
+	if sorted || n.Stats().Reordered == 0 {
+		t.Fatalf("expected reordered frames, actual: %v, %+v", frames, n.Stats())
+	}
+}
@@ -0,0 +1,249 @@
+package netem
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoPacket = errors.New("no packet for the guest")
+
+// Large enough for a frame with segmentation offload and its
+// struct virtio_net_hdr.
+const maxFrameSize = 0x10000 + 64
+
+type timedFrame struct {
+	t     time.Time
+	frame []byte
+}
+
+// queue is a list of frames sorted by the time they leave.
+type queue []timedFrame
+
+func (q *queue) insert(f timedFrame) {
+	i := sort.Search(len(*q), func(i int) bool { return (*q)[i].t.After(f.t) })
+
+	*q = append(*q, timedFrame{})
+	copy((*q)[i+1:], (*q)[i:])
+	(*q)[i] = f
+}
+
+func (q *queue) pop() []byte {
+	f := (*q)[0].frame
+	(*q)[0] = timedFrame{}
+	*q = (*q)[1:]
+
+	return f
+}
+
+// Shaper is the backend of a queue pair with the impairments of a Netem.
+// Frames written by the guest go to the backend it wraps when their time
+// has come. Frames of the backend are queued the same way, and Read
+// returns them once they are due.
+type Shaper struct {
+	n  *Netem
+	rw io.ReadWriter
+
+	mu      sync.Mutex
+	tx, rx  queue
+	txTimer *time.Timer
+	rxTimer *time.Timer
+	notify  func()
+	buf     []byte
+}
+
+// Wrap returns a backend which behaves like rw, including the optional
+// interfaces of virtio-net it implements, but with the impairments of n.
+func (n *Netem) Wrap(rw io.ReadWriter) io.ReadWriter {
+	s := &Shaper{
+		n:   n,
+		rw:  rw,
+		buf: make([]byte, maxFrameSize),
+	}
+
+	if b, ok := rw.(vnetHdrBackend); ok {
+		return &vnetHdrShaper{Shaper: s, tap: b}
+	}
+
+	return s
+}
+
+// Write queues a frame of the guest.
+func (s *Shaper) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Without impairments, the frame is not copied, once those queued
+	// before it are gone.
+	if len(s.tx) == 0 && s.n.passThrough() {
+		s.n.count(len(p))
+
+		return s.rw.Write(p)
+	}
+
+	now := time.Now()
+	times := s.n.schedule(toBackend, len(p), now)
+
+	for _, t := range times {
+		if !t.After(now) && len(s.tx) == 0 {
+			if _, err := s.rw.Write(p); err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		if len(s.tx) >= maxQueuedFrames {
+			s.n.overflow()
+
+			continue
+		}
+
+		s.tx.insert(timedFrame{t: t, frame: append([]byte(nil), p...)})
+	}
+
+	s.armTx(now)
+
+	return len(p), nil
+}
+
+// flushTx sends the frames of the guest which are due.
+func (s *Shaper) flushTx() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for len(s.tx) > 0 && !s.tx[0].t.After(now) {
+		_, _ = s.rw.Write(s.tx.pop())
+	}
+
+	s.armTx(now)
+}
+
+func (s *Shaper) armTx(now time.Time) {
+	if len(s.tx) == 0 {
+		return
+	}
+
+	d := s.tx[0].t.Sub(now)
+
+	if s.txTimer == nil {
+		s.txTimer = time.AfterFunc(d, s.flushTx)
+	} else {
+		s.txTimer.Reset(d)
+	}
+}
+
+// Read returns the next frame for the guest which is due, or ErrNoPacket.
+func (s *Shaper) Read(p []byte) (int, error) {
+	s.mu.Lock()
+
+	if len(s.rx) == 0 && s.n.passThrough() {
+		n, err := s.rw.Read(p)
+		s.mu.Unlock()
+
+		if err != nil || n <= 0 {
+			return 0, ErrNoPacket
+		}
+
+		s.n.count(n)
+
+		return n, nil
+	}
+
+	now := time.Now()
+
+	// Take everything the backend has, so the frames are timed from
+	// when they arrived.
+	for {
+		n, err := s.rw.Read(s.buf)
+		if err != nil || n <= 0 {
+			break
+		}
+
+		for _, t := range s.n.schedule(toGuest, n, now) {
+			if len(s.rx) >= maxQueuedFrames {
+				s.n.overflow()
+
+				continue
+			}
+
+			s.rx.insert(timedFrame{t: t, frame: append([]byte(nil), s.buf[:n]...)})
+		}
+	}
+
+	if len(s.rx) > 0 && !s.rx[0].t.After(now) {
+		n := copy(p, s.rx.pop())
+		s.mu.Unlock()
+
+		return n, nil
+	}
+
+	if len(s.rx) > 0 {
+		d := s.rx[0].t.Sub(now)
+
+		if s.rxTimer == nil {
+			s.rxTimer = time.AfterFunc(d, s.notifyRx)
+		} else {
+			s.rxTimer.Reset(d)
+		}
+	}
+
+	s.mu.Unlock()
+
+	return 0, ErrNoPacket
+}
+
+func (s *Shaper) notifyRx() {
+	s.mu.Lock()
+	notify := s.notify
+	s.mu.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+// SetRxNotifier registers f to be called when a delayed frame for the
+// guest is due, or when the wrapped backend has frames.
+func (s *Shaper) SetRxNotifier(f func()) {
+	s.mu.Lock()
+	s.notify = f
+	s.mu.Unlock()
+
+	if n, ok := s.rw.(interface{ SetRxNotifier(f func()) }); ok {
+		n.SetRxNotifier(f)
+	}
+}
+
+type vnetHdrBackend interface {
+	SetVnetHdrSize(n int) error
+	SetOffload(flags uint) error
+}
+
+// vnetHdrShaper is a Shaper of a backend with virtio_net_hdr, like a tap.
+// The frames are shaped as they are, so a frame with segmentation offload
+// counts as one.
+type vnetHdrShaper struct {
+	*Shaper
+	tap vnetHdrBackend
+}
+
+func (s *vnetHdrShaper) SetVnetHdrSize(n int) error {
+	return s.tap.SetVnetHdrSize(n)
+}
+
+func (s *vnetHdrShaper) SetOffload(flags uint) error {
+	return s.tap.SetOffload(flags)
+}
+
+func (s *vnetHdrShaper) SetQueueEnabled(enabled bool) error {
+	if e, ok := s.rw.(interface{ SetQueueEnabled(bool) error }); ok {
+		return e.SetQueueEnabled(enabled)
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+// Package netsock carries the ethernet frames of virtio-net over UNIX
+// sockets, so that guests on one host can talk to each other without taps
+// and bridges. The framing is that of QEMU:
+//
+//	dgram   one frame per datagram
+//	stream  each frame is preceded by its length as a 32 bit big endian
+//
+// Guests may be connected back to back, or through a Switch.
+package netsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/unixsock"
+)
+
+var (
+	ErrNoPacket     = errors.New("no packet for the guest")
+	ErrClosed       = errors.New("socket backend is closed")
+	ErrInvalidType  = errors.New("invalid socket backend type")
+	ErrFrameTooLong = errors.New("frame too long")
+)
+
+const (
+	Dgram  = "dgram"
+	Stream = "stream"
+
+	// MaxFrameSize is the largest frame accepted from a peer. virtio-net
+	// does not offer offloads to the guest on a socket, so anything
+	// beyond an ethernet frame with a VLAN tag is bogus.
+	MaxFrameSize = 1522
+
+	// Frames waiting for the guest beyond this are dropped.
+	maxQueuedFrames = 1024
+)
+
+// Config describes a socket backend.
+type Config struct {
+	// Type is Dgram or Stream.
+	Type string
+	// Path is the socket of the peer. With Server, it is where to listen.
+	Path string
+	// Local is the path to bind a Dgram socket to. If empty, the kernel
+	// picks an abstract address.
+	Local string
+	// Server makes a Stream backend listen on Path instead of connecting.
+	Server bool
+}
+
+// Conn is a network backend for virtio-net on a UNIX socket. Write takes
+// frames from the guest, Read returns frames for it.
+type Conn struct {
+	cfg Config
+
+	mu       sync.Mutex
+	conn     net.Conn
+	remote   *net.UnixAddr
+	listener net.Listener
+	closed   bool
+
+	queueMu sync.Mutex
+	queue   [][]byte
+	notify  func()
+}
+
+// Open creates a backend as described by c. A Stream server does not wait
+// for its peer; frames of the guest are dropped until the peer connects.
+func Open(c Config) (*Conn, error) {
+	s := &Conn{cfg: c}
+
+	switch c.Type {
+	case Dgram:
+		local := &net.UnixAddr{Name: c.Local, Net: "unixgram"}
+		if len(c.Local) > 0 {
+			unixsock.RemoveStale(c.Local)
+		}
+
+		conn, err := net.ListenUnixgram("unixgram", local)
+		if err != nil {
+			return nil, err
+		}
+
+		s.conn = conn
+		s.remote = &net.UnixAddr{Name: c.Path, Net: "unixgram"}
+
+		go s.readDgram(conn)
+	case Stream:
+		if !c.Server {
+			conn, err := net.Dial("unix", c.Path)
+			if err != nil {
+				return nil, err
+			}
+
+			s.conn = conn
+
+			go s.readStream(conn)
+
+			break
+		}
+
+		unixsock.RemoveStale(c.Path)
+
+		l, err := net.Listen("unix", c.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		s.listener = l
+
+		go s.accept(l)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidType, c.Type)
+	}
+
+	return s, nil
+}
+
+// accept serves one peer at a time. A new peer replaces the previous one,
+// e.g. when the other end has been restarted.
+func (s *Conn) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+
+		s.conn = conn
+		s.mu.Unlock()
+
+		go s.readStream(conn)
+	}
+}
+
+func (s *Conn) readDgram(conn net.Conn) {
+	buf := make([]byte, MaxFrameSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+
+			continue
+		}
+
+		s.enqueue(append([]byte(nil), buf[:n]...))
+	}
+}
+
+func (s *Conn) readStream(conn net.Conn) {
+	for {
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			s.mu.Lock()
+			if s.conn == conn {
+				s.conn = nil
+			}
+			s.mu.Unlock()
+
+			conn.Close()
+
+			return
+		}
+
+		s.enqueue(frame)
+	}
+}
+
+// ReadFrame reads a length prefixed frame from a stream.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var l [4]byte
+
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(l[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLong, n)
+	}
+
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// WriteFrame writes p to a stream with its length in front.
+func WriteFrame(w io.Writer, p []byte) error {
+	buf := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	copy(buf[4:], p)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+func (s *Conn) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// SetRxNotifier registers f to be called whenever a frame for the guest
+// is queued.
+func (s *Conn) SetRxNotifier(f func()) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	s.notify = f
+}
+
+func (s *Conn) enqueue(frame []byte) {
+	s.queueMu.Lock()
+
+	if len(s.queue) >= maxQueuedFrames {
+		s.queueMu.Unlock()
+
+		return
+	}
+
+	s.queue = append(s.queue, frame)
+	notify := s.notify
+	s.queueMu.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+// Read returns the next frame for the guest, or ErrNoPacket.
+func (s *Conn) Read(p []byte) (int, error) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	if len(s.queue) == 0 {
+		return 0, ErrNoPacket
+	}
+
+	n := copy(p, s.queue[0])
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+
+	return n, nil
+}
+
+// Write sends a frame of the guest to the peer. Like on a cable without
+// anything at the other end, frames are dropped while there is no peer.
+func (s *Conn) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	if s.conn == nil {
+		return len(p), nil
+	}
+
+	if s.cfg.Type == Dgram {
+		_, _ = s.conn.(*net.UnixConn).WriteToUnix(p, s.remote)
+
+		return len(p), nil
+	}
+
+	if err := WriteFrame(s.conn, p); err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return len(p), nil
+}
+
+// Close closes the socket, and removes it from the file system if it has
+// been created by Open.
+func (s *Conn) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+
+	if s.cfg.Type == Dgram && len(s.cfg.Local) > 0 {
+		os.Remove(s.cfg.Local)
+	}
+
+	return nil
+}
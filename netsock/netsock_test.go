@@ -0,0 +1,227 @@
+package netsock_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/netsock"
+)
+
+func frame(dst, src byte, payload string) []byte {
+	f := []byte{dst, dst, dst, dst, dst, dst, src, src, src, src, src, src, 0x88, 0xb5}
+
+	return append(f, payload...)
+}
+
+// recv waits for a frame on c, which is notified through ch.
+func recv(t *testing.T, c *netsock.Conn, ch chan struct{}) []byte {
+	t.Helper()
+
+	buf := make([]byte, netsock.MaxFrameSize)
+	deadline := time.After(time.Second)
+
+	for {
+		n, err := c.Read(buf)
+		if err == nil {
+			return buf[:n]
+		}
+
+		if !errors.Is(err, netsock.ErrNoPacket) {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-ch:
+		case <-deadline:
+			t.Fatal("no frame")
+		}
+	}
+}
+
+func open(t *testing.T, c netsock.Config) (*netsock.Conn, chan struct{}) {
+	t.Helper()
+
+	conn, err := netsock.Open(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	ch := make(chan struct{}, 1)
+	conn.SetRxNotifier(func() {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	})
+
+	return conn, ch
+}
+
+func TestDgram(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.sock")
+	b := filepath.Join(dir, "b.sock")
+
+	ca, cha := open(t, netsock.Config{Type: netsock.Dgram, Path: b, Local: a})
+	cb, chb := open(t, netsock.Config{Type: netsock.Dgram, Path: a, Local: b})
+
+	f := frame(2, 1, "hello")
+	if _, err := ca.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := recv(t, cb, chb); !bytes.Equal(f, actual) {
+		t.Fatalf("expected: %x, actual: %x", f, actual)
+	}
+
+	f = frame(1, 2, "world")
+	if _, err := cb.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := recv(t, ca, cha); !bytes.Equal(f, actual) {
+		t.Fatalf("expected: %x, actual: %x", f, actual)
+	}
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "s.sock")
+
+	srv, chs := open(t, netsock.Config{Type: netsock.Stream, Path: path, Server: true})
+	cli, chc := open(t, netsock.Config{Type: netsock.Stream, Path: path})
+
+	f := frame(1, 2, "hello")
+	if _, err := cli.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := recv(t, srv, chs); !bytes.Equal(f, actual) {
+		t.Fatalf("expected: %x, actual: %x", f, actual)
+	}
+
+	f = frame(2, 1, "world")
+	if _, err := srv.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := recv(t, cli, chc); !bytes.Equal(f, actual) {
+		t.Fatalf("expected: %x, actual: %x", f, actual)
+	}
+}
+
+func TestOpenInvalidType(t *testing.T) {
+	t.Parallel()
+
+	if _, err := netsock.Open(netsock.Config{Type: "raw"}); !errors.Is(err, netsock.ErrInvalidType) {
+		t.Fatalf("expected: %v, actual: %v", netsock.ErrInvalidType, err)
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	dgram := filepath.Join(dir, "dgram.sock")
+	stream := filepath.Join(dir, "stream.sock")
+
+	sw := netsock.NewSwitch()
+
+	errc := make(chan error, 1)
+
+	go func() { errc <- sw.ListenAndServe(dgram, stream) }()
+
+	// Wait for the switch to listen.
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		conn, err := netsock.Open(netsock.Config{Type: netsock.Stream, Path: stream})
+		if err == nil {
+			conn.Close()
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c1, ch1 := open(t, netsock.Config{Type: netsock.Dgram, Path: dgram})
+	c2, ch2 := open(t, netsock.Config{Type: netsock.Dgram, Path: dgram})
+	c3, ch3 := open(t, netsock.Config{Type: netsock.Stream, Path: stream})
+
+	// A dgram peer becomes a port with its first frame. The switch
+	// accepts c3 asynchronously, so 4 is announced until c3 hears it.
+	f := frame(0xff, 4, "hello")
+
+	for heard := false; !heard; {
+		if _, err := c2.Write(f); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-ch3:
+			heard = true
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("c3 is not connected to the switch")
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	for {
+		if _, err := c3.Read(make([]byte, netsock.MaxFrameSize)); err != nil {
+			break
+		}
+	}
+
+	// Nobody knows 6 yet, so the frame is flooded.
+	f = frame(6, 2, "flood")
+	if _, err := c1.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := recv(t, c2, ch2); !bytes.Equal(f, actual) {
+		t.Fatalf("expected: %x, actual: %x", f, actual)
+	}
+
+	if actual := recv(t, c3, ch3); !bytes.Equal(f, actual) {
+		t.Fatalf("expected: %x, actual: %x", f, actual)
+	}
+
+	// The switch has learned 2, so the reply goes only there.
+	f = frame(2, 6, "unicast")
+	if _, err := c3.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := recv(t, c1, ch1); !bytes.Equal(f, actual) {
+		t.Fatalf("expected: %x, actual: %x", f, actual)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if n, err := c2.Read(make([]byte, netsock.MaxFrameSize)); !errors.Is(err, netsock.ErrNoPacket) {
+		t.Fatalf("expected: %v, actual: %d bytes, %v", netsock.ErrNoPacket, n, err)
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatal(err)
+	default:
+	}
+}
@@ -0,0 +1,225 @@
+package netsock
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/unixsock"
+)
+
+var ErrNoSocket = errors.New("switch needs a dgram or a stream socket")
+
+// Entries of the forwarding database are forgotten after this, like on a
+// Linux bridge.
+const fdbAgeingTime = 300 * time.Second
+
+// Switch is a learning ethernet switch. Every peer of its sockets is a
+// port: a frame goes to the port where its destination address was last
+// seen as a source, and is flooded to all other ports if it is unknown or
+// a broadcast.
+type Switch struct {
+	mu      sync.Mutex
+	ports   map[string]*port
+	fdb     map[[6]byte]fdbEntry
+	streams int
+}
+
+type port struct {
+	name string
+	send func([]byte) error
+	// dgram ports are removed when sending fails, as there is no
+	// connection to tell that the peer has gone away.
+	dgram bool
+}
+
+type fdbEntry struct {
+	port *port
+	seen time.Time
+}
+
+func NewSwitch() *Switch {
+	return &Switch{
+		ports: map[string]*port{},
+		fdb:   map[[6]byte]fdbEntry{},
+	}
+}
+
+// ListenAndServe creates the sockets at dgramPath and streamPath, either
+// may be empty, and switches frames among their peers. It returns when one
+// of them fails.
+func (sw *Switch) ListenAndServe(dgramPath, streamPath string) error {
+	if len(dgramPath) == 0 && len(streamPath) == 0 {
+		return ErrNoSocket
+	}
+
+	errc := make(chan error, 2)
+
+	if len(dgramPath) > 0 {
+		unixsock.RemoveStale(dgramPath)
+
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: dgramPath, Net: "unixgram"})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		go func() { errc <- sw.ServeDgram(conn) }()
+	}
+
+	if len(streamPath) > 0 {
+		unixsock.RemoveStale(streamPath)
+
+		l, err := net.Listen("unix", streamPath)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		go func() { errc <- sw.ServeStream(l) }()
+	}
+
+	return <-errc
+}
+
+// ServeDgram switches the frames of the peers sending to conn. A peer
+// becomes a port with its first frame, and is removed once it is gone.
+func (sw *Switch) ServeDgram(conn *net.UnixConn) error {
+	buf := make([]byte, MaxFrameSize)
+
+	for {
+		n, addr, err := conn.ReadFromUnix(buf)
+		if err != nil {
+			return err
+		}
+
+		// Unbound peers cannot be replied to.
+		if addr == nil || len(addr.Name) == 0 {
+			continue
+		}
+
+		name := "dgram:" + addr.Name
+
+		sw.mu.Lock()
+		p, ok := sw.ports[name]
+		if !ok {
+			to := addr
+			p = &port{
+				name:  name,
+				dgram: true,
+				send: func(frame []byte) error {
+					_, err := conn.WriteToUnix(frame, to)
+
+					return err
+				},
+			}
+			sw.ports[name] = p
+		}
+		sw.mu.Unlock()
+
+		sw.forward(p, buf[:n])
+	}
+}
+
+// ServeStream accepts peers on l, each of them is a port until it
+// disconnects.
+func (sw *Switch) ServeStream(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go sw.serveStreamConn(conn)
+	}
+}
+
+func (sw *Switch) serveStreamConn(conn net.Conn) {
+	var mu sync.Mutex
+
+	p := &port{
+		send: func(frame []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return WriteFrame(conn, frame)
+		},
+	}
+
+	sw.mu.Lock()
+	sw.streams++
+	p.name = "stream:" + strconv.Itoa(sw.streams)
+	sw.ports[p.name] = p
+	sw.mu.Unlock()
+
+	defer sw.removePort(p)
+	defer conn.Close()
+
+	for {
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			return
+		}
+
+		sw.forward(p, frame)
+	}
+}
+
+func (sw *Switch) removePort(p *port) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	delete(sw.ports, p.name)
+
+	for mac, e := range sw.fdb {
+		if e.port == p {
+			delete(sw.fdb, mac)
+		}
+	}
+}
+
+// forward learns the source of frame, which came in on port in, and sends
+// it on towards its destination.
+func (sw *Switch) forward(in *port, frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+
+	var dst, src [6]byte
+
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+
+	now := time.Now()
+
+	sw.mu.Lock()
+
+	// A multicast source address is bogus, do not learn it.
+	if src[0]&1 == 0 {
+		sw.fdb[src] = fdbEntry{port: in, seen: now}
+	}
+
+	var out []*port
+
+	if e, ok := sw.fdb[dst]; ok && dst[0]&1 == 0 && now.Sub(e.seen) < fdbAgeingTime {
+		if e.port != in {
+			out = append(out, e.port)
+		}
+	} else {
+		for _, p := range sw.ports {
+			if p != in {
+				out = append(out, p)
+			}
+		}
+	}
+
+	sw.mu.Unlock()
+
+	for _, p := range out {
+		if err := p.send(frame); err != nil && p.dgram {
+			sw.removePort(p)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Package numa describes the NUMA topology of a guest: which vCPUs and how
+// much of the RAM are in each node, and how far apart the nodes are.
+package numa
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// LocalDistance and RemoteDistance are the distances of the SLIT when
+	// none is given, as in ACPI.
+	LocalDistance  = 10
+	RemoteDistance = 20
+
+	// MemAlign aligns the RAM of the nodes, so that it can be bound to the
+	// nodes of the host even on huge pages.
+	MemAlign = 2 << 20
+)
+
+var ErrConfig = errors.New("bad NUMA configuration")
+
+// Node is a NUMA node of the guest.
+type Node struct {
+	CPUs []int
+	// Mem is the size of its RAM. The RAM of the nodes follows one another
+	// in the order of the nodes.
+	Mem uint64
+	// HostNode is the node of the host the RAM is bound to, -1 for none.
+	HostNode int
+}
+
+// Config is the NUMA topology. The zero Config has no nodes, and the guest
+// is not told about NUMA.
+type Config struct {
+	Nodes []Node
+	// Distances between two nodes which are not the defaults.
+	Distances map[[2]int]uint8
+}
+
+// Validate checks that every one of the nCPUs vCPUs is in exactly one node,
+// and that the nodes have memSize bytes of RAM in all.
+func (c *Config) Validate(nCPUs int, memSize uint64) error {
+	if len(c.Nodes) == 0 {
+		return nil
+	}
+
+	seen := make([]bool, nCPUs)
+	mem := uint64(0)
+
+	for i, n := range c.Nodes {
+		if n.Mem == 0 || n.Mem%MemAlign != 0 {
+			return fmt.Errorf("%w: node %d has %d bytes of memory, not a multiple of 2M", ErrConfig, i, n.Mem)
+		}
+
+		mem += n.Mem
+
+		for _, cpu := range n.CPUs {
+			if cpu < 0 || cpu >= nCPUs {
+				return fmt.Errorf("%w: node %d: no cpu %d", ErrConfig, i, cpu)
+			}
+
+			if seen[cpu] {
+				return fmt.Errorf("%w: cpu %d is in two nodes", ErrConfig, cpu)
+			}
+
+			seen[cpu] = true
+		}
+	}
+
+	for cpu, ok := range seen {
+		if !ok {
+			return fmt.Errorf("%w: cpu %d is in no node", ErrConfig, cpu)
+		}
+	}
+
+	if mem != memSize {
+		return fmt.Errorf("%w: the nodes have %d bytes of memory, not %d", ErrConfig, mem, memSize)
+	}
+
+	for k, d := range c.Distances {
+		if k[0] < 0 || k[0] >= len(c.Nodes) || k[1] < 0 || k[1] >= len(c.Nodes) {
+			return fmt.Errorf("%w: no nodes %d and %d", ErrConfig, k[0], k[1])
+		}
+
+		if (k[0] == k[1]) != (d == LocalDistance) || d < LocalDistance {
+			return fmt.Errorf("%w: distance %d from %d to %d", ErrConfig, d, k[0], k[1])
+		}
+	}
+
+	return nil
+}
+
+// Distance is the distance from node i to node j. Unless given, it is the
+// distance from j to i, or the default.
+func (c *Config) Distance(i, j int) uint8 {
+	if d, ok := c.Distances[[2]int{i, j}]; ok {
+		return d
+	}
+
+	if d, ok := c.Distances[[2]int{j, i}]; ok {
+		return d
+	}
+
+	if i == j {
+		return LocalDistance
+	}
+
+	return RemoteDistance
+}
+
+// NodeOf returns the node of cpu, 0 without nodes.
+func (c *Config) NodeOf(cpu int) int {
+	for i, n := range c.Nodes {
+		for _, c := range n.CPUs {
+			if c == cpu {
+				return i
+			}
+		}
+	}
+
+	return 0
+}
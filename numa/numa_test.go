@@ -0,0 +1,81 @@
+package numa_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/numa"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	two := func() numa.Config {
+		return numa.Config{Nodes: []numa.Node{
+			{CPUs: []int{0, 1}, Mem: 1 << 30, HostNode: -1},
+			{CPUs: []int{2}, Mem: 1 << 30, HostNode: 0},
+		}}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		modify func(*numa.Config)
+		err    error
+	}{
+		{"ok", func(*numa.Config) {}, nil},
+		{"none", func(c *numa.Config) { c.Nodes = nil }, nil},
+		{"cpu twice", func(c *numa.Config) { c.Nodes[1].CPUs = []int{1, 2} }, numa.ErrConfig},
+		{"cpu in no node", func(c *numa.Config) { c.Nodes[1].CPUs = nil }, numa.ErrConfig},
+		{"no such cpu", func(c *numa.Config) { c.Nodes[1].CPUs = []int{2, 3} }, numa.ErrConfig},
+		{"too little memory", func(c *numa.Config) { c.Nodes[1].Mem = 512 << 20 }, numa.ErrConfig},
+		{"unaligned memory", func(c *numa.Config) { c.Nodes[1].Mem = 1<<30 + 4096 }, numa.ErrConfig},
+		{"distance", func(c *numa.Config) { c.Distances = map[[2]int]uint8{{0, 1}: 21} }, nil},
+		{"no such node", func(c *numa.Config) { c.Distances = map[[2]int]uint8{{0, 2}: 21} }, numa.ErrConfig},
+		{"too near", func(c *numa.Config) { c.Distances = map[[2]int]uint8{{0, 1}: 10} }, numa.ErrConfig},
+		{"local", func(c *numa.Config) { c.Distances = map[[2]int]uint8{{1, 1}: 20} }, numa.ErrConfig},
+	} {
+		c := two()
+		tt.modify(&c)
+
+		if err := c.Validate(3, 2<<30); !errors.Is(err, tt.err) {
+			t.Fatalf("%s: expected: %v, actual: %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	t.Parallel()
+
+	c := numa.Config{
+		Nodes:     make([]numa.Node, 3),
+		Distances: map[[2]int]uint8{{0, 1}: 15, {1, 0}: 16, {2, 0}: 30},
+	}
+
+	for _, tt := range []struct {
+		i, j     int
+		expected uint8
+	}{
+		{0, 0, numa.LocalDistance},
+		{0, 1, 15},
+		{1, 0, 16},
+		{0, 2, 30},
+		{2, 0, 30},
+		{1, 2, numa.RemoteDistance},
+	} {
+		if d := c.Distance(tt.i, tt.j); d != tt.expected {
+			t.Fatalf("%d to %d: expected: %v, actual: %v", tt.i, tt.j, tt.expected, d)
+		}
+	}
+}
+
+func TestNodeOf(t *testing.T) {
+	t.Parallel()
+
+	c := numa.Config{Nodes: []numa.Node{{CPUs: []int{0, 2}}, {CPUs: []int{1}}}}
+
+	for cpu, expected := range []int{0, 1, 0} {
+		if n := c.NodeOf(cpu); n != expected {
+			t.Fatalf("cpu %d: expected: %v, actual: %v", cpu, expected, n)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package p9
+
+import "encoding/binary"
+
+// Message types of 9P2000.L. The reply to a T-message is the type plus one.
+const (
+	tlerror      = 6
+	tstatfs      = 8
+	tlopen       = 12
+	tlcreate     = 14
+	tsymlink     = 16
+	tmknod       = 18
+	trename      = 20
+	treadlink    = 22
+	tgetattr     = 24
+	tsetattr     = 26
+	txattrwalk   = 30
+	txattrcreate = 32
+	treaddir     = 40
+	tfsync       = 50
+	tlock        = 52
+	tgetlock     = 54
+	tlink        = 70
+	tmkdir       = 72
+	trenameat    = 74
+	tunlinkat    = 76
+	tversion     = 100
+	tauth        = 102
+	tattach      = 104
+	tflush       = 108
+	twalk        = 110
+	tread        = 116
+	twrite       = 118
+	tclunk       = 120
+	tremove      = 122
+)
+
+// headerSize is size[4] type[1] tag[2].
+const headerSize = 7
+
+// ioHeaderSize is the header of Rread and Rreaddir, with their count[4].
+const ioHeaderSize = headerSize + 4
+
+// noFid is the afid of Tattach without authentication.
+const noFid = ^uint32(0)
+
+// qid is type[1] version[4] path[8].
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+const (
+	qtDir     = 0x80
+	qtSymlink = 0x02
+	qtFile    = 0x00
+)
+
+// decoder reads the fields of a message. A short message sets err, after
+// which every field reads as zero.
+type decoder struct {
+	b   []byte
+	err bool
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err || len(d.b) < n {
+		d.err = true
+
+		return make([]byte, n)
+	}
+
+	b := d.b[:n]
+	d.b = d.b[n:]
+
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+func (d *decoder) data() []byte {
+	return d.next(int(d.u32()))
+}
+
+// encoder appends the fields of a message.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.b = binary.LittleEndian.AppendUint16(e.b, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.b = binary.LittleEndian.AppendUint32(e.b, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.b = binary.LittleEndian.AppendUint64(e.b, v)
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+// message starts a message of type typ. finish fills in its size.
+func message(typ uint8, tag uint16) *encoder {
+	e := &encoder{b: make([]byte, 4, 64)}
+	e.u8(typ)
+	e.u16(tag)
+
+	return e
+}
+
+func (e *encoder) finish() []byte {
+	binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)))
+
+	return e.b
+}
@@ -0,0 +1,211 @@
+package p9_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/p9"
+	"golang.org/x/sys/unix"
+)
+
+// msg encodes a T-message of tag 1 with the fields given.
+func msg(typ uint8, fields ...interface{}) []byte {
+	b := []byte{0, 0, 0, 0, typ, 1, 0}
+
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint8:
+			b = append(b, v)
+		case uint16:
+			b = binary.LittleEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.LittleEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.LittleEndian.AppendUint64(b, v)
+		case string:
+			b = binary.LittleEndian.AppendUint16(b, uint16(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+
+	return b
+}
+
+// call sends a T-message and checks that the reply is of type typ.
+func call(t *testing.T, s *p9.Server, typ uint8, req []byte) []byte {
+	t.Helper()
+
+	resp := s.Handle(req)
+	if size := binary.LittleEndian.Uint32(resp); int(size) != len(resp) {
+		t.Fatalf("expected: %v, actual: %v", len(resp), size)
+	}
+
+	if resp[4] != typ {
+		t.Fatalf("expected: %v, actual: %v (%v)", typ, resp[4], resp[7:])
+	}
+
+	return resp[7:]
+}
+
+// lerror sends a T-message that is to fail with errno.
+func lerror(t *testing.T, s *p9.Server, errno unix.Errno, req []byte) {
+	t.Helper()
+
+	resp := call(t, s, 7, req)
+	if actual := unix.Errno(binary.LittleEndian.Uint32(resp)); actual != errno {
+		t.Fatalf("expected: %v, actual: %v", errno, actual)
+	}
+}
+
+func session(t *testing.T, root string) *p9.Server {
+	t.Helper()
+
+	s, err := p9.NewServer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	resp := call(t, s, 101, msg(100, uint32(1<<20), "9P2000.L"))
+	if msize := binary.LittleEndian.Uint32(resp); msize != p9.MaxMessageSize {
+		t.Fatalf("expected: %v, actual: %v", p9.MaxMessageSize, msize)
+	}
+
+	// Tattach of fid 0 to the root.
+	call(t, s, 105, msg(104, uint32(0), ^uint32(0), "root", "", uint32(0)))
+
+	return s
+}
+
+func TestReadWrite(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	s := session(t, root)
+
+	// Twalk clones fid 0 to fid 1, which Tlcreate turns into a new file.
+	call(t, s, 111, msg(110, uint32(0), uint32(1), uint16(0)))
+	call(t, s, 15, msg(14, uint32(1), "hello", uint32(unix.O_RDWR), uint32(0o644), uint32(0)))
+
+	resp := call(t, s, 119, msg(118, uint32(1), uint64(0), []byte("world")))
+	if n := binary.LittleEndian.Uint32(resp); n != 5 {
+		t.Fatalf("expected: %v, actual: %v", 5, n)
+	}
+
+	resp = call(t, s, 117, msg(116, uint32(1), uint64(1), uint32(100)))
+	if data := string(resp[4:]); data != "orld" {
+		t.Fatalf("expected: %v, actual: %v", "orld", data)
+	}
+
+	call(t, s, 121, msg(120, uint32(1)))
+
+	b, err := os.ReadFile(filepath.Join(root, "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "world" {
+		t.Fatalf("expected: %v, actual: %v", "world", string(b))
+	}
+
+	// Tlcreate does not replace a file.
+	call(t, s, 111, msg(110, uint32(0), uint32(1), uint16(0)))
+	lerror(t, s, unix.EEXIST, msg(14, uint32(1), "hello", uint32(unix.O_RDWR), uint32(0o644), uint32(0)))
+}
+
+func TestReaddir(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	s := session(t, root)
+
+	call(t, s, 73, msg(72, uint32(0), "sub", uint32(0o755), uint32(0)))
+	call(t, s, 17, msg(16, uint32(0), "link", "sub", uint32(0)))
+
+	call(t, s, 111, msg(110, uint32(0), uint32(1), uint16(0)))
+	call(t, s, 13, msg(12, uint32(1), uint32(unix.O_RDONLY|unix.O_DIRECTORY)))
+
+	resp := call(t, s, 41, msg(40, uint32(1), uint64(0), uint32(4096)))
+	data := resp[4 : 4+binary.LittleEndian.Uint32(resp)]
+	names := []string{}
+
+	// qid[13] offset[8] type[1] name[s]
+	for len(data) > 0 {
+		l := int(binary.LittleEndian.Uint16(data[22:]))
+		names = append(names, string(data[24:24+l]))
+		data = data[24+l:]
+	}
+
+	sort.Strings(names)
+
+	if expected := []string{".", "..", "link", "sub"}; len(names) != len(expected) ||
+		names[0] != expected[0] || names[1] != expected[1] ||
+		names[2] != expected[2] || names[3] != expected[3] {
+		t.Fatalf("expected: %v, actual: %v", expected, names)
+	}
+
+	// Everything was read.
+	resp = call(t, s, 41, msg(40, uint32(1), uint64(4), uint32(4096)))
+	if n := binary.LittleEndian.Uint32(resp); n != 0 {
+		t.Fatalf("expected: %v, actual: %v", 0, n)
+	}
+
+	call(t, s, 77, msg(76, uint32(0), "sub", uint32(unix.AT_REMOVEDIR)))
+
+	if _, err := os.Stat(filepath.Join(root, "sub")); !os.IsNotExist(err) {
+		t.Fatalf("expected: %v, actual: %v", os.ErrNotExist, err)
+	}
+}
+
+func TestConfinement(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := os.Symlink("/", filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := session(t, root)
+
+	// ".." of the root is the root.
+	resp := call(t, s, 111, msg(110, uint32(0), uint32(1), uint16(2), "..", ".."))
+	if n := binary.LittleEndian.Uint16(resp); n != 2 {
+		t.Fatalf("expected: %v, actual: %v", 2, n)
+	}
+
+	if a, b := resp[2+5:2+13], resp[2+13+5:2+26]; string(a) != string(b) {
+		t.Fatalf("expected: %v, actual: %v", a, b)
+	}
+
+	// The symlink is walked to, but not through. fid 2 is not created.
+	resp = call(t, s, 111, msg(110, uint32(0), uint32(2), uint16(2), "out", "etc"))
+	if n := binary.LittleEndian.Uint16(resp); n != 1 {
+		t.Fatalf("expected: %v, actual: %v", 1, n)
+	}
+
+	lerror(t, s, unix.EBADF, msg(12, uint32(2), uint32(unix.O_RDONLY)))
+
+	// Nor is it opened.
+	call(t, s, 111, msg(110, uint32(0), uint32(2), uint16(1), "out"))
+	lerror(t, s, unix.ELOOP, msg(12, uint32(2), uint32(unix.O_RDONLY)))
+
+	resp = call(t, s, 23, msg(22, uint32(2)))
+	if target := string(resp[2:]); target != "/" {
+		t.Fatalf("expected: %v, actual: %v", "/", target)
+	}
+
+	// A name is a single component.
+	lerror(t, s, unix.EINVAL, msg(72, uint32(0), "../x", uint32(0o755), uint32(0)))
+
+	// Extended attributes are not supported.
+	lerror(t, s, unix.EOPNOTSUPP, msg(30, uint32(0), uint32(3), "user.x"))
+}
@@ -0,0 +1,1197 @@
+// Package p9 serves a directory of the host over 9P2000.L, the dialect of
+// the Linux v9fs client, so that a guest can mount it through virtio-9p.
+package p9
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// MaxMessageSize bounds the msize negotiated by Tversion. A virtqueue of
+// QueueSize descriptors without indirect descriptors does not carry much
+// more than this.
+const MaxMessageSize = 64 << 10
+
+const version = "9P2000.L"
+
+// setattr valid bits.
+const (
+	setattrMode     = 0x1
+	setattrUID      = 0x2
+	setattrGID      = 0x4
+	setattrSize     = 0x8
+	setattrATime    = 0x10
+	setattrMTime    = 0x20
+	setattrATimeSet = 0x80
+	setattrMTimeSet = 0x100
+)
+
+// lopenFlags are the flags of Tlopen and Tlcreate passed on to the host.
+const lopenFlags = unix.O_ACCMODE | unix.O_TRUNC | unix.O_APPEND | unix.O_NONBLOCK |
+	unix.O_DSYNC | unix.O_SYNC | unix.O_DIRECTORY
+
+var ErrNotDir = errors.New("not a directory")
+
+// fid is a file of the guest: a path relative to the root, opened by
+// Tlopen or Tlcreate.
+type fid struct {
+	path    string
+	file    *os.File
+	dirents []dirent
+}
+
+type dirent struct {
+	qid  qid
+	typ  uint8
+	name string
+}
+
+// Server serves the tree under root. Paths are resolved beneath root
+// without following symlinks, so the guest cannot reach outside of it.
+type Server struct {
+	root int
+
+	mu    sync.Mutex
+	msize uint32
+	fids  map[uint32]*fid
+}
+
+func NewServer(root string) (*Server, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !st.IsDir() {
+		return nil, ErrNotDir
+	}
+
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		root:  fd,
+		msize: MaxMessageSize,
+		fids:  map[uint32]*fid{},
+	}, nil
+}
+
+// Close closes the files of the guest and the root.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for n, f := range s.fids {
+		s.closeFid(f)
+		delete(s.fids, n)
+	}
+
+	return unix.Close(s.root)
+}
+
+// Handle serves a T-message and returns its R-message. Failures are
+// Rlerror with the errno of the host.
+func (s *Server) Handle(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := &decoder{b: req}
+	size := d.u32()
+	typ := d.u8()
+	tag := d.u16()
+
+	if d.err || int(size) > len(req) || size < headerSize {
+		return lerror(tag, unix.EPROTO)
+	}
+
+	d.b = req[headerSize:size]
+	e := message(typ+1, tag)
+
+	if err := s.dispatch(typ, d, e); err != nil {
+		return lerror(tag, err)
+	}
+
+	return e.finish()
+}
+
+func lerror(tag uint16, err error) []byte {
+	errno := unix.EIO
+	errors.As(err, &errno)
+
+	e := message(tlerror+1, tag)
+	e.u32(uint32(errno))
+
+	return e.finish()
+}
+
+// handlers serve the T-messages by type. Tauth and the extended attributes
+// are not supported, so they are answered with EOPNOTSUPP.
+var handlers = map[uint8]func(*Server, *decoder, *encoder) error{
+	tversion:  (*Server).version,
+	tattach:   (*Server).attach,
+	tflush:    (*Server).flush,
+	twalk:     (*Server).walk,
+	tlopen:    (*Server).lopen,
+	tlcreate:  (*Server).lcreate,
+	tread:     (*Server).read,
+	twrite:    (*Server).write,
+	tclunk:    (*Server).clunk,
+	tremove:   (*Server).remove,
+	tgetattr:  (*Server).getattr,
+	tsetattr:  (*Server).setattr,
+	treaddir:  (*Server).readdir,
+	tstatfs:   (*Server).statfs,
+	tmkdir:    (*Server).mkdir,
+	tsymlink:  (*Server).symlink,
+	treadlink: (*Server).readlink,
+	tmknod:    (*Server).mknod,
+	trename:   (*Server).rename,
+	trenameat: (*Server).renameat,
+	tunlinkat: (*Server).unlinkat,
+	tlink:     (*Server).link,
+	tfsync:    (*Server).fsync,
+	tlock:     (*Server).lock,
+	tgetlock:  (*Server).getlock,
+}
+
+func (s *Server) dispatch(typ uint8, d *decoder, e *encoder) error {
+	h, ok := handlers[typ]
+	if !ok {
+		return unix.EOPNOTSUPP
+	}
+
+	return h(s, d, e)
+}
+
+// args checks that the fields read so far were all there.
+func args(d *decoder) error {
+	if d.err {
+		return unix.EPROTO
+	}
+
+	return nil
+}
+
+func (s *Server) fid(n uint32) (*fid, error) {
+	f, ok := s.fids[n]
+	if !ok {
+		return nil, unix.EBADF
+	}
+
+	return f, nil
+}
+
+// at calls fn with the directory of rel, opened beneath the root, and the
+// base name of rel for the *at(2) system calls. No symlink is followed on
+// the way, even one that replaced a directory since the walk.
+func (s *Server) at(rel string, fn func(dir int, name string) error) error {
+	dir, err := unix.Openat2(s.root, filepath.Dir(rel), &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS,
+	})
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dir)
+
+	return fn(dir, filepath.Base(rel))
+}
+
+// openAt opens rel itself, without following it if it is a symlink.
+func (s *Server) openAt(rel string, flags int, perm uint32) (int, error) {
+	fd := -1
+	err := s.at(rel, func(dir int, name string) (err error) {
+		fd, err = unix.Openat(dir, name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, perm&0o7777)
+
+		return err
+	})
+
+	return fd, err
+}
+
+func (s *Server) stat(rel string) (unix.Stat_t, error) {
+	var st unix.Stat_t
+
+	err := s.at(rel, func(dir int, name string) error {
+		return unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	})
+
+	return st, err
+}
+
+// child is the path of name in the directory of f. The guest names a
+// single component, so anything else is refused.
+func child(f *fid, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", unix.EINVAL
+	}
+
+	return filepath.Join(f.path, name), nil
+}
+
+func (s *Server) qid(rel string) (qid, error) {
+	st, err := s.stat(rel)
+	if err != nil {
+		return qid{}, err
+	}
+
+	return qidOf(&st), nil
+}
+
+func qidOf(st *unix.Stat_t) qid {
+	q := qid{typ: qtFile, path: st.Ino}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		q.typ = qtDir
+	case unix.S_IFLNK:
+		q.typ = qtSymlink
+	}
+
+	return q
+}
+
+func (s *Server) closeFid(f *fid) {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+func (s *Server) version(d *decoder, e *encoder) error {
+	msize := d.u32()
+	v := d.str()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	// A new session: everything of the previous one is gone.
+	for n, f := range s.fids {
+		s.closeFid(f)
+		delete(s.fids, n)
+	}
+
+	if msize > MaxMessageSize {
+		msize = MaxMessageSize
+	}
+
+	s.msize = msize
+
+	if v != version {
+		v = "unknown"
+	}
+
+	e.u32(msize)
+	e.str(v)
+
+	return nil
+}
+
+// flush has nothing to cancel: requests are served one at a time.
+func (s *Server) flush(d *decoder, e *encoder) error {
+	d.u16() // oldtag
+
+	return args(d)
+}
+
+func (s *Server) attach(d *decoder, e *encoder) error {
+	n := d.u32()
+	afid := d.u32()
+	d.str() // uname
+	d.str() // aname
+	d.u32() // n_uname
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	if afid != noFid {
+		return unix.EOPNOTSUPP
+	}
+
+	if _, ok := s.fids[n]; ok {
+		return unix.EBADF
+	}
+
+	q, err := s.qid(".")
+	if err != nil {
+		return err
+	}
+
+	s.fids[n] = &fid{path: "."}
+	e.qid(q)
+
+	return nil
+}
+
+func (s *Server) walk(d *decoder, e *encoder) error {
+	n := d.u32()
+	newN := d.u32()
+	names := make([]string, d.u16())
+
+	for i := range names {
+		names[i] = d.str()
+	}
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.fids[newN]; ok && newN != n {
+		return unix.EBADF
+	}
+
+	path := f.path
+	qids := []qid{}
+
+	for _, name := range names {
+		next := filepath.Join(path, name)
+
+		switch {
+		case name == "..":
+			// The parent of the root is the root.
+			next = filepath.Dir(path)
+		case name == "" || name == "." || strings.ContainsRune(name, '/'):
+			err = unix.EINVAL
+		}
+
+		var q qid
+		if err == nil {
+			q, err = s.qid(next)
+		}
+
+		if err != nil {
+			if len(qids) == 0 {
+				return err
+			}
+
+			break
+		}
+
+		qids = append(qids, q)
+		path = next
+	}
+
+	// newfid exists only if every name was walked.
+	if len(qids) == len(names) {
+		if newN == n {
+			f.path = path
+		} else {
+			s.fids[newN] = &fid{path: path}
+		}
+	}
+
+	e.u16(uint16(len(qids)))
+
+	for _, q := range qids {
+		e.qid(q)
+	}
+
+	return nil
+}
+
+// open opens path for f. Only the flags of lopenFlags come from the guest.
+func (s *Server) open(f *fid, path string, flags int, perm uint32) error {
+	fd, err := s.openAt(path, flags, perm)
+	if err != nil {
+		return err
+	}
+
+	f.file = os.NewFile(uintptr(fd), path)
+	f.path = path
+	f.dirents = nil
+
+	return nil
+}
+
+func (s *Server) openReply(f *fid, e *encoder) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.file.Fd()), &st); err != nil {
+		return err
+	}
+
+	e.qid(qidOf(&st))
+	e.u32(0) // iounit: msize decides
+
+	return nil
+}
+
+func (s *Server) lopen(d *decoder, e *encoder) error {
+	n := d.u32()
+	flags := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.file != nil {
+		return unix.EBADF
+	}
+
+	if err := s.open(f, f.path, int(flags)&lopenFlags, 0); err != nil {
+		return err
+	}
+
+	return s.openReply(f, e)
+}
+
+func (s *Server) lcreate(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	flags := d.u32()
+	mode := d.u32()
+	d.u32() // gid
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.file != nil {
+		return unix.EBADF
+	}
+
+	path, err := child(f, name)
+	if err != nil {
+		return err
+	}
+
+	// The fid of the directory becomes the new file.
+	if err := s.open(f, path, int(flags)&lopenFlags|unix.O_CREAT|unix.O_EXCL, mode); err != nil {
+		return err
+	}
+
+	return s.openReply(f, e)
+}
+
+func (s *Server) read(d *decoder, e *encoder) error {
+	n := d.u32()
+	off := d.u64()
+	count := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.file == nil {
+		return unix.EBADF
+	}
+
+	if max := s.msize - ioHeaderSize; count > max {
+		count = max
+	}
+
+	buf := make([]byte, count)
+
+	l, err := unix.Pread(int(f.file.Fd()), buf, int64(off))
+	if err != nil {
+		return err
+	}
+
+	e.u32(uint32(l))
+	e.b = append(e.b, buf[:l]...)
+
+	return nil
+}
+
+func (s *Server) write(d *decoder, e *encoder) error {
+	n := d.u32()
+	off := d.u64()
+	data := d.data()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.file == nil {
+		return unix.EBADF
+	}
+
+	// pwrite(2) appends to a file opened with O_APPEND, as the guest
+	// expects.
+	l, err := unix.Pwrite(int(f.file.Fd()), data, int64(off))
+	if err != nil {
+		return err
+	}
+
+	e.u32(uint32(l))
+
+	return nil
+}
+
+func (s *Server) clunk(d *decoder, e *encoder) error {
+	n := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	s.closeFid(f)
+	delete(s.fids, n)
+
+	return nil
+}
+
+func (s *Server) remove(d *decoder, e *encoder) error {
+	n := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	// The fid is clunked even when the removal fails.
+	s.closeFid(f)
+	delete(s.fids, n)
+
+	if f.path == "." {
+		return unix.EBUSY
+	}
+
+	return s.at(f.path, func(dir int, name string) error {
+		err := unix.Unlinkat(dir, name, 0)
+		if errors.Is(err, unix.EISDIR) {
+			err = unix.Unlinkat(dir, name, unix.AT_REMOVEDIR)
+		}
+
+		return err
+	})
+}
+
+func (s *Server) getattr(d *decoder, e *encoder) error {
+	n := d.u32()
+	d.u64() // request_mask: everything is returned
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	st, err := s.stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	e.u64(0x7ff) // P9_GETATTR_BASIC
+	e.qid(qidOf(&st))
+	e.u32(st.Mode)
+	e.u32(st.Uid)
+	e.u32(st.Gid)
+	e.u64(uint64(st.Nlink))
+	e.u64(st.Rdev)
+	e.u64(uint64(st.Size))
+	e.u64(uint64(st.Blksize))
+	e.u64(uint64(st.Blocks))
+	e.u64(uint64(st.Atim.Sec))
+	e.u64(uint64(st.Atim.Nsec))
+	e.u64(uint64(st.Mtim.Sec))
+	e.u64(uint64(st.Mtim.Nsec))
+	e.u64(uint64(st.Ctim.Sec))
+	e.u64(uint64(st.Ctim.Nsec))
+	e.u64(0) // btime
+	e.u64(0)
+	e.u64(0) // gen
+	e.u64(0) // data_version
+
+	return nil
+}
+
+func (s *Server) setattr(d *decoder, e *encoder) error {
+	n := d.u32()
+	valid := d.u32()
+	mode := d.u32()
+	uid := d.u32()
+	gid := d.u32()
+	size := d.u64()
+	atime := unix.Timespec{Sec: int64(d.u64()), Nsec: int64(d.u64())}
+	mtime := unix.Timespec{Sec: int64(d.u64()), Nsec: int64(d.u64())}
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if valid&setattrMode != 0 {
+		if err := s.chmod(f.path, mode); err != nil {
+			return err
+		}
+	}
+
+	if valid&setattrSize != 0 {
+		fd, err := s.openAt(f.path, unix.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+
+		err = unix.Ftruncate(fd, int64(size))
+		unix.Close(fd)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.at(f.path, func(dir int, name string) error {
+		if valid&(setattrUID|setattrGID) != 0 {
+			u, g := -1, -1
+			if valid&setattrUID != 0 {
+				u = int(uid)
+			}
+
+			if valid&setattrGID != 0 {
+				g = int(gid)
+			}
+
+			if err := unix.Fchownat(dir, name, u, g, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return err
+			}
+		}
+
+		if valid&(setattrATime|setattrMTime) == 0 {
+			return nil
+		}
+
+		ts := []unix.Timespec{
+			times(valid, setattrATime, setattrATimeSet, atime),
+			times(valid, setattrMTime, setattrMTimeSet, mtime),
+		}
+
+		return unix.UtimesNanoAt(dir, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+// chmod changes the mode of rel through /proc/self/fd, as fchmodat(2) has
+// no AT_SYMLINK_NOFOLLOW. The mode of a symlink cannot be changed anyway.
+func (s *Server) chmod(rel string, mode uint32) error {
+	fd, err := s.openAt(rel, unix.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return unix.EOPNOTSUPP
+	}
+
+	return unix.Chmod(fmt.Sprintf("/proc/self/fd/%d", fd), mode&0o7777)
+}
+
+// times is the timestamp for utimensat(2): untouched, now, or the one given.
+func times(valid, bit, set uint32, t unix.Timespec) unix.Timespec {
+	switch {
+	case valid&bit == 0:
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	case valid&set == 0:
+		return unix.Timespec{Nsec: unix.UTIME_NOW}
+	default:
+		return t
+	}
+}
+
+func direntType(mode uint32) uint8 {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		return unix.DT_DIR
+	case unix.S_IFLNK:
+		return unix.DT_LNK
+	case unix.S_IFCHR:
+		return unix.DT_CHR
+	case unix.S_IFBLK:
+		return unix.DT_BLK
+	case unix.S_IFIFO:
+		return unix.DT_FIFO
+	case unix.S_IFSOCK:
+		return unix.DT_SOCK
+	default:
+		return unix.DT_REG
+	}
+}
+
+// snapshot lists the directory of f, "." and ".." first. The offset of an
+// entry is its index plus one, so that a guest can resume where it left.
+func (s *Server) snapshot(f *fid) ([]dirent, error) {
+	entries, err := f.file.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	dirents := make([]dirent, 0, len(entries)+2)
+
+	// ".." of the root is the root.
+	dots := []struct{ name, path string }{{".", f.path}, {"..", filepath.Dir(f.path)}}
+
+	for _, dot := range dots {
+		st, err := s.stat(dot.path)
+		if err != nil {
+			return nil, err
+		}
+
+		dirents = append(dirents, dirent{qid: qidOf(&st), typ: unix.DT_DIR, name: dot.name})
+	}
+
+	for _, ent := range entries {
+		var st unix.Stat_t
+		if err := unix.Fstatat(int(f.file.Fd()), ent.Name(), &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			// Removed since it was listed.
+			continue
+		}
+
+		dirents = append(dirents, dirent{qid: qidOf(&st), typ: direntType(st.Mode), name: ent.Name()})
+	}
+
+	return dirents, nil
+}
+
+func (s *Server) readdir(d *decoder, e *encoder) error {
+	n := d.u32()
+	off := d.u64()
+	count := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.file == nil {
+		return unix.EBADF
+	}
+
+	if off == 0 || f.dirents == nil {
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if f.dirents, err = s.snapshot(f); err != nil {
+			return err
+		}
+	}
+
+	if max := s.msize - ioHeaderSize; count > max {
+		count = max
+	}
+
+	data := &encoder{}
+
+	for i := off; i < uint64(len(f.dirents)); i++ {
+		ent := f.dirents[i]
+
+		// qid[13] offset[8] type[1] name[s]
+		if len(data.b)+13+8+1+2+len(ent.name) > int(count) {
+			break
+		}
+
+		data.qid(ent.qid)
+		data.u64(i + 1)
+		data.u8(ent.typ)
+		data.str(ent.name)
+	}
+
+	e.u32(uint32(len(data.b)))
+	e.b = append(e.b, data.b...)
+
+	return nil
+}
+
+func (s *Server) statfs(d *decoder, e *encoder) error {
+	n := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	fd, err := s.openAt(f.path, unix.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(fd)
+
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(fd, &st); err != nil {
+		return err
+	}
+
+	e.u32(uint32(st.Type))
+	e.u32(uint32(st.Bsize))
+	e.u64(st.Blocks)
+	e.u64(st.Bfree)
+	e.u64(st.Bavail)
+	e.u64(st.Files)
+	e.u64(st.Ffree)
+	e.u64(uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32)
+	e.u32(uint32(st.Namelen))
+
+	return nil
+}
+
+// create makes name in the directory fid n with mk and replies its qid.
+func (s *Server) create(n uint32, name string, e *encoder, mk func(dir int, name string) error) error {
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	path, err := child(f, name)
+	if err != nil {
+		return err
+	}
+
+	if err := s.at(path, mk); err != nil {
+		return err
+	}
+
+	q, err := s.qid(path)
+	if err != nil {
+		return err
+	}
+
+	e.qid(q)
+
+	return nil
+}
+
+func (s *Server) mkdir(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	mode := d.u32()
+	d.u32() // gid: files belong to the user running gokvm
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	return s.create(n, name, e, func(dir int, name string) error {
+		return unix.Mkdirat(dir, name, mode&0o7777)
+	})
+}
+
+func (s *Server) symlink(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	target := d.str()
+	d.u32() // gid
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	// The target is not resolved on the host, so it may point anywhere.
+	return s.create(n, name, e, func(dir int, name string) error {
+		return unix.Symlinkat(target, dir, name)
+	})
+}
+
+func (s *Server) mknod(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	mode := d.u32()
+	major := d.u32()
+	minor := d.u32()
+	d.u32() // gid
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	return s.create(n, name, e, func(dir int, name string) error {
+		return unix.Mknodat(dir, name, mode, int(unix.Mkdev(major, minor)))
+	})
+}
+
+func (s *Server) readlink(d *decoder, e *encoder) error {
+	n := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.PathMax)
+
+	return s.at(f.path, func(dir int, name string) error {
+		l, err := unix.Readlinkat(dir, name, buf)
+		if err != nil {
+			return err
+		}
+
+		e.str(string(buf[:l]))
+
+		return nil
+	})
+}
+
+// move renames from to to and follows it with the fids under from.
+func (s *Server) move(from, to string) error {
+	if from == "." {
+		return unix.EBUSY
+	}
+
+	err := s.at(from, func(oldDir int, oldName string) error {
+		return s.at(to, func(newDir int, newName string) error {
+			return unix.Renameat(oldDir, oldName, newDir, newName)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range s.fids {
+		switch {
+		case f.path == from:
+			f.path = to
+		case strings.HasPrefix(f.path, from+"/"):
+			f.path = to + f.path[len(from):]
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) rename(d *decoder, e *encoder) error {
+	n := d.u32()
+	dn := d.u32()
+	name := d.str()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	dir, err := s.fid(dn)
+	if err != nil {
+		return err
+	}
+
+	to, err := child(dir, name)
+	if err != nil {
+		return err
+	}
+
+	return s.move(f.path, to)
+}
+
+func (s *Server) renameat(d *decoder, e *encoder) error {
+	oldN := d.u32()
+	oldName := d.str()
+	newN := d.u32()
+	newName := d.str()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	oldDir, err := s.fid(oldN)
+	if err != nil {
+		return err
+	}
+
+	newDir, err := s.fid(newN)
+	if err != nil {
+		return err
+	}
+
+	from, err := child(oldDir, oldName)
+	if err != nil {
+		return err
+	}
+
+	to, err := child(newDir, newName)
+	if err != nil {
+		return err
+	}
+
+	return s.move(from, to)
+}
+
+func (s *Server) unlinkat(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	flags := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	path, err := child(f, name)
+	if err != nil {
+		return err
+	}
+
+	return s.at(path, func(dir int, name string) error {
+		return unix.Unlinkat(dir, name, int(flags)&unix.AT_REMOVEDIR)
+	})
+}
+
+func (s *Server) link(d *decoder, e *encoder) error {
+	dn := d.u32()
+	n := d.u32()
+	name := d.str()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	dir, err := s.fid(dn)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	path, err := child(dir, name)
+	if err != nil {
+		return err
+	}
+
+	return s.at(f.path, func(oldDir int, oldName string) error {
+		return s.at(path, func(newDir int, newName string) error {
+			return unix.Linkat(oldDir, oldName, newDir, newName, 0)
+		})
+	})
+}
+
+func (s *Server) fsync(d *decoder, e *encoder) error {
+	n := d.u32()
+	d.u32() // datasync
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.file == nil {
+		return unix.EBADF
+	}
+
+	return f.file.Sync()
+}
+
+// lock grants every POSIX lock. Locks hold among the processes of the
+// guest, which v9fs tracks itself, not against the host.
+func (s *Server) lock(d *decoder, e *encoder) error {
+	n := d.u32()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	if _, err := s.fid(n); err != nil {
+		return err
+	}
+
+	e.u8(0) // P9_LOCK_SUCCESS
+
+	return nil
+}
+
+func (s *Server) getlock(d *decoder, e *encoder) error {
+	n := d.u32()
+	d.u8() // type
+	start := d.u64()
+	length := d.u64()
+	procID := d.u32()
+	clientID := d.str()
+
+	if err := args(d); err != nil {
+		return err
+	}
+
+	if _, err := s.fid(n); err != nil {
+		return err
+	}
+
+	e.u8(unix.F_UNLCK)
+	e.u64(start)
+	e.u64(length)
+	e.u32(procID)
+	e.str(clientID)
+
+	return nil
+}
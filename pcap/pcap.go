@@ -0,0 +1,216 @@
+// Package pcap records the frames of a network backend in pcapng format,
+// which tcpdump and Wireshark read.
+//
+// refs https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("capture is closed")
+
+// Direction of a frame, as seen from the guest.
+type Direction uint32
+
+const (
+	// Inbound frames are received by the guest.
+	Inbound Direction = 1
+	// Outbound frames are sent by the guest.
+	Outbound Direction = 2
+)
+
+const (
+	blockSHB = 0x0a0d0d0a
+	blockIDB = 0x00000001
+	blockEPB = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+	linkTypeEther  = 1
+
+	optEndOfOpt = 0
+	optTSResol  = 9 // if_tsresol
+	optFlags    = 2 // epb_flags
+
+	// The timestamps are in nanoseconds.
+	tsResolNano = 9
+)
+
+// Config describes where to capture to.
+type Config struct {
+	// Path is the file the capture goes to.
+	Path string
+	// MaxSize rotates the file once it grows beyond this many bytes: Path
+	// is renamed to Path.1, Path.1 to Path.2 and so on. 0 disables the
+	// rotation.
+	MaxSize int64
+	// Files is how many of the rotated files are kept besides Path. It
+	// defaults to 1.
+	Files int
+}
+
+// Writer writes frames to a pcapng file. It is safe for concurrent use,
+// e.g. by the queue pairs of a multiqueue device.
+type Writer struct {
+	mu     sync.Mutex
+	cfg    Config
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// Create starts a capture to c.Path, which is truncated.
+func Create(c Config) (*Writer, error) {
+	if c.Files == 0 {
+		c.Files = 1
+	}
+
+	w := &Writer{cfg: c}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// open creates the file and writes the headers every file starts with.
+func (w *Writer) open() error {
+	f, err := os.Create(w.cfg.Path)
+	if err != nil {
+		return err
+	}
+
+	w.f = f
+	w.size = 0
+
+	// Section Header Block, the length of the section is unspecified.
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+
+	if err := w.writeBlock(blockSHB, shb); err != nil {
+		return err
+	}
+
+	// Interface Description Block for the ethernet of the guest.
+	idb := make([]byte, 8, 20)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeEther)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snaplen
+	idb = appendOption(idb, optTSResol, []byte{tsResolNano})
+	idb = appendOption(idb, optEndOfOpt, nil)
+
+	return w.writeBlock(blockIDB, idb)
+}
+
+func appendOption(b []byte, code uint16, v []byte) []byte {
+	var hdr [4]byte
+
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(v)))
+
+	b = append(b, hdr[:]...)
+	b = append(b, v...)
+
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+// writeBlock writes a block with its type and lengths around body, which
+// must be padded to 32 bits.
+func (w *Writer) writeBlock(typ uint32, body []byte) error {
+	l := uint32(12 + len(body))
+	buf := make([]byte, 0, l)
+
+	buf = binary.LittleEndian.AppendUint32(buf, typ)
+	buf = binary.LittleEndian.AppendUint32(buf, l)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, l)
+
+	n, err := w.f.Write(buf)
+	w.size += int64(n)
+
+	return err
+}
+
+// WritePacket records frame as an Enhanced Packet Block.
+func (w *Writer) WritePacket(dir Direction, t time.Time, frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if w.cfg.MaxSize > 0 && w.size >= w.cfg.MaxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	ts := uint64(t.UnixNano())
+
+	body := make([]byte, 20, 20+len(frame)+16)
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(frame)))
+	body = append(body, frame...)
+
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+
+	var flags [4]byte
+
+	binary.LittleEndian.PutUint32(flags[:], uint32(dir))
+	body = appendOption(body, optFlags, flags[:])
+	body = appendOption(body, optEndOfOpt, nil)
+
+	return w.writeBlock(blockEPB, body)
+}
+
+// rotate moves the current file aside and starts a new one.
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	for i := w.cfg.Files; i > 0; i-- {
+		from := w.cfg.Path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", w.cfg.Path, i-1)
+		}
+
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", w.cfg.Path, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return w.open()
+}
+
+// Close flushes and closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	return w.f.Close()
+}
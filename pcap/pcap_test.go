@@ -0,0 +1,258 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/netem"
+	"github.com/bobuhiro11/gokvm/pcap"
+)
+
+type packet struct {
+	dir   pcap.Direction
+	ts    uint64
+	frame []byte
+}
+
+// readPackets parses the Enhanced Packet Blocks of a pcapng file.
+func readPackets(t *testing.T, path string) []packet {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if typ := binary.LittleEndian.Uint32(b); typ != 0x0a0d0d0a {
+		t.Fatalf("expected: %#x, actual: %#x", 0x0a0d0d0a, typ)
+	}
+
+	var pkts []packet
+
+	for len(b) > 0 {
+		typ := binary.LittleEndian.Uint32(b[0:])
+		l := binary.LittleEndian.Uint32(b[4:])
+
+		if trailer := binary.LittleEndian.Uint32(b[l-4:]); trailer != l {
+			t.Fatalf("expected: %d, actual: %d", l, trailer)
+		}
+
+		if typ == 6 {
+			body := b[8 : l-4]
+			capLen := binary.LittleEndian.Uint32(body[12:])
+			p := packet{
+				ts:    uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:])),
+				frame: body[20 : 20+capLen],
+			}
+
+			opts := body[20+(capLen+3)&^3:]
+			if code := binary.LittleEndian.Uint16(opts); code != 2 {
+				t.Fatalf("expected: %d, actual: %d", 2, code)
+			}
+
+			p.dir = pcap.Direction(binary.LittleEndian.Uint32(opts[4:]))
+			pkts = append(pkts, p)
+		}
+
+		b = b[l:]
+	}
+
+	return pkts
+}
+
+func TestWritePacket(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "cap.pcapng")
+
+	w, err := pcap.Create(pcap.Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 123456789)
+
+	if err := w.WritePacket(pcap.Outbound, now, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WritePacket(pcap.Inbound, now, []byte("world!!!")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pkts := readPackets(t, path)
+	if len(pkts) != 2 {
+		t.Fatalf("expected: %d, actual: %d", 2, len(pkts))
+	}
+
+	if pkts[0].dir != pcap.Outbound || string(pkts[0].frame) != "hello" {
+		t.Fatalf("expected: %v %q, actual: %v %q", pcap.Outbound, "hello", pkts[0].dir, pkts[0].frame)
+	}
+
+	if pkts[1].dir != pcap.Inbound || string(pkts[1].frame) != "world!!!" {
+		t.Fatalf("expected: %v %q, actual: %v %q", pcap.Inbound, "world!!!", pkts[1].dir, pkts[1].frame)
+	}
+
+	if pkts[0].ts != uint64(now.UnixNano()) {
+		t.Fatalf("expected: %d, actual: %d", now.UnixNano(), pkts[0].ts)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "cap.pcapng")
+
+	w, err := pcap.Create(pcap.Config{Path: path, MaxSize: 256, Files: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, 100)
+
+	for i := 0; i < 10; i++ {
+		frame[0] = byte(i)
+
+		if err := w.WritePacket(pcap.Outbound, time.Now(), frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every file takes two frames before it exceeds 256 bytes.
+	for i, name := range []string{path, path + ".1", path + ".2"} {
+		pkts := readPackets(t, name)
+		if len(pkts) != 2 {
+			t.Fatalf("%s: expected: %d, actual: %d", name, 2, len(pkts))
+		}
+
+		if expected := byte(8 - 2*i); pkts[0].frame[0] != expected {
+			t.Fatalf("%s: expected: %d, actual: %d", name, expected, pkts[0].frame[0])
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected: %v, actual: %v", os.ErrNotExist, err)
+	}
+}
+
+type mockTap struct {
+	bytes.Buffer
+	hdrSize int
+}
+
+func (m *mockTap) SetVnetHdrSize(n int) error {
+	m.hdrSize = n
+
+	return nil
+}
+
+func (m *mockTap) SetOffload(flags uint) error {
+	return nil
+}
+
+func TestWrap(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "cap.pcapng")
+
+	w, err := pcap.Create(pcap.Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tap := &mockTap{}
+	rw := pcap.Wrap(tap, w)
+
+	b, ok := rw.(interface{ SetVnetHdrSize(n int) error })
+	if !ok {
+		t.Fatal("virtio_net_hdr is not supported by the capture")
+	}
+
+	if err := b.SetVnetHdrSize(12); err != nil {
+		t.Fatal(err)
+	}
+
+	if tap.hdrSize != 12 {
+		t.Fatalf("expected: %d, actual: %d", 12, tap.hdrSize)
+	}
+
+	frame := append(make([]byte, 12), "frame"...)
+	if _, err := rw.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	if _, err := rw.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+
+	pkts := readPackets(t, path)
+	if len(pkts) != 2 {
+		t.Fatalf("expected: %d, actual: %d", 2, len(pkts))
+	}
+
+	for i, dir := range []pcap.Direction{pcap.Outbound, pcap.Inbound} {
+		if pkts[i].dir != dir || string(pkts[i].frame) != "frame" {
+			t.Fatalf("expected: %v %q, actual: %v %q", dir, "frame", pkts[i].dir, pkts[i].frame)
+		}
+	}
+}
+
+func TestWrapNetem(t *testing.T) {
+	t.Parallel()
+
+	w, err := pcap.Create(pcap.Config{Path: filepath.Join(t.TempDir(), "cap.pcapng")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// A frame of the tap for the guest, which netem delays.
+	tap := &mockTap{}
+	_, _ = tap.Write(append(make([]byte, 10), "frame"...))
+
+	rw := pcap.Wrap(netem.New(netem.Config{Delay: 20 * time.Millisecond}).Wrap(tap), w)
+
+	if _, ok := rw.(interface{ SetVnetHdrSize(n int) error }); !ok {
+		t.Fatal("virtio_net_hdr is not supported by the capture")
+	}
+
+	n, ok := rw.(interface{ SetRxNotifier(f func()) })
+	if !ok {
+		t.Fatal("the notifier of netem is not supported by the capture")
+	}
+
+	notified := make(chan struct{}, 1)
+	n.SetRxNotifier(func() {
+		notified <- struct{}{}
+	})
+
+	if _, err := rw.Read(make([]byte, 64)); !errors.Is(err, netem.ErrNoPacket) {
+		t.Fatalf("expected: %v, actual: %v", netem.ErrNoPacket, err)
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("not notified of the delayed frame")
+	}
+
+	if _, err := rw.Read(make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,126 @@
+package pcap
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// The default size of struct virtio_net_hdr in front of the frames of a
+// tap opened with IFF_VNET_HDR.
+const defaultVnetHdrSize = 10
+
+// Capture is a network backend which records the frames read from and
+// written to the backend it wraps. Read frames are Inbound, written ones
+// Outbound.
+type Capture struct {
+	rw io.ReadWriter
+	w  *Writer
+
+	// hdrSize is the size of the struct virtio_net_hdr in front of every
+	// frame, which is not recorded.
+	hdrSize atomic.Int32
+}
+
+func (c *Capture) Read(p []byte) (int, error) {
+	n, err := c.rw.Read(p)
+	if err == nil && n > 0 {
+		c.record(Inbound, p[:n])
+	}
+
+	return n, err
+}
+
+func (c *Capture) Write(p []byte) (int, error) {
+	c.record(Outbound, p)
+
+	return c.rw.Write(p)
+}
+
+func (c *Capture) record(dir Direction, frame []byte) {
+	if hdr := int(c.hdrSize.Load()); len(frame) >= hdr {
+		frame = frame[hdr:]
+	}
+
+	// A failing capture must not take the network down.
+	_ = c.w.WritePacket(dir, time.Now(), frame)
+}
+
+// vnetHdrCapture is a Capture of a backend with virtio_net_hdr, like a
+// tap, which keeps the offloads and queues of the backend usable.
+type vnetHdrCapture struct {
+	*Capture
+	tap interface {
+		SetVnetHdrSize(n int) error
+		SetOffload(flags uint) error
+	}
+}
+
+func (c *vnetHdrCapture) SetVnetHdrSize(n int) error {
+	if err := c.tap.SetVnetHdrSize(n); err != nil {
+		return err
+	}
+
+	c.hdrSize.Store(int32(n))
+
+	return nil
+}
+
+func (c *vnetHdrCapture) SetOffload(flags uint) error {
+	return c.tap.SetOffload(flags)
+}
+
+func (c *vnetHdrCapture) SetQueueEnabled(enabled bool) error {
+	if e, ok := c.rw.(interface{ SetQueueEnabled(bool) error }); ok {
+		return e.SetQueueEnabled(enabled)
+	}
+
+	return nil
+}
+
+// vnetHdrNotifierCapture is a vnetHdrCapture of a backend which also
+// notifies of frames for the guest, like a tap behind netem.
+type vnetHdrNotifierCapture struct {
+	*vnetHdrCapture
+	n interface{ SetRxNotifier(f func()) }
+}
+
+func (c *vnetHdrNotifierCapture) SetRxNotifier(f func()) {
+	c.n.SetRxNotifier(f)
+}
+
+// notifierCapture is a Capture of a backend which notifies of frames for
+// the guest rather than raising SIGIO.
+type notifierCapture struct {
+	*Capture
+	n interface{ SetRxNotifier(f func()) }
+}
+
+func (c *notifierCapture) SetRxNotifier(f func()) {
+	c.n.SetRxNotifier(f)
+}
+
+// Wrap returns a backend which behaves like rw, including the optional
+// interfaces of virtio-net it implements, and records its frames to w.
+func Wrap(rw io.ReadWriter, w *Writer) io.ReadWriter {
+	c := &Capture{rw: rw, w: w}
+
+	switch b := rw.(type) {
+	case interface {
+		SetVnetHdrSize(n int) error
+		SetOffload(flags uint) error
+	}:
+		c.hdrSize.Store(defaultVnetHdrSize)
+		v := &vnetHdrCapture{Capture: c, tap: b}
+
+		if n, ok := rw.(interface{ SetRxNotifier(f func()) }); ok {
+			return &vnetHdrNotifierCapture{vnetHdrCapture: v, n: n}
+		}
+
+		return v
+	case interface{ SetRxNotifier(f func()) }:
+		return &notifierCapture{Capture: c, n: b}
+	}
+
+	return c
+}
@@ -0,0 +1,153 @@
+// Package ratelimit holds back requests with token buckets, for the disks
+// and the entropy of a guest.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limits caps the rate of requests and bytes. Zero means no limit. A burst
+// is the size of the token bucket, which defaults to one second worth of
+// the rate.
+type Limits struct {
+	IOPS      uint64
+	BPS       uint64
+	IOPSBurst uint64
+	BPSBurst  uint64
+}
+
+// Stats counts the requests which had to wait for tokens.
+type Stats struct {
+	Requests  uint64
+	Bytes     uint64
+	Throttled uint64
+	Time      time.Duration
+}
+
+type bucket struct {
+	rate  float64
+	size  float64
+	level float64
+	last  time.Time
+}
+
+func newBucket(rate, burst uint64, now time.Time) bucket {
+	if burst == 0 {
+		burst = rate
+	}
+
+	return bucket{
+		rate:  float64(rate),
+		size:  float64(burst),
+		level: float64(burst),
+		last:  now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.level += b.rate * now.Sub(b.last).Seconds()
+	if b.level > b.size {
+		b.level = b.size
+	}
+
+	b.last = now
+}
+
+// wait returns how long it takes until the bucket has tokens again.
+// Requests larger than the bucket are let through as soon as it is not
+// empty and leave a debt, so they are not stuck forever.
+func (b *bucket) wait() time.Duration {
+	if b.rate == 0 || b.level >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.level / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate != 0 {
+		b.level -= n
+	}
+}
+
+// Throttle is a pair of token buckets, one for requests and one for bytes.
+type Throttle struct {
+	mu     sync.Mutex
+	limits Limits
+	ios    bucket
+	bytes  bucket
+	stats  Stats
+}
+
+func NewThrottle(l Limits) *Throttle {
+	t := &Throttle{}
+	t.SetLimits(l)
+
+	return t
+}
+
+// SetLimits replaces the limits, the buckets start out full.
+func (t *Throttle) SetLimits(l Limits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.limits = l
+	t.ios = newBucket(l.IOPS, l.IOPSBurst, now)
+	t.bytes = newBucket(l.BPS, l.BPSBurst, now)
+}
+
+func (t *Throttle) Limits() Limits {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.limits
+}
+
+func (t *Throttle) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stats
+}
+
+// Wait blocks until a request of n bytes may go.
+func (t *Throttle) Wait(n int) {
+	var waited time.Duration
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		now := time.Now()
+		t.ios.refill(now)
+		t.bytes.refill(now)
+
+		d := t.ios.wait()
+		if w := t.bytes.wait(); w > d {
+			d = w
+		}
+
+		if d == 0 {
+			break
+		}
+
+		t.mu.Unlock()
+		time.Sleep(d)
+		t.mu.Lock()
+
+		waited += d
+	}
+
+	t.ios.take(1)
+	t.bytes.take(float64(n))
+
+	t.stats.Requests++
+	t.stats.Bytes += uint64(n)
+
+	if waited > 0 {
+		t.stats.Throttled++
+		t.stats.Time += waited
+	}
+}
@@ -0,0 +1,65 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/ratelimit"
+)
+
+func TestThrottleIOPS(t *testing.T) {
+	t.Parallel()
+
+	th := ratelimit.NewThrottle(ratelimit.Limits{IOPS: 100, IOPSBurst: 10})
+
+	start := time.Now()
+
+	// The burst goes through at once, the next 10 requests take 100ms.
+	for i := 0; i < 20; i++ {
+		th.Wait(0x200)
+	}
+
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("20 requests at 100 IOPS with a burst of 10 took only %v", d)
+	}
+
+	s := th.Stats()
+	if s.Requests != 20 || s.Bytes != 20*0x200 {
+		t.Fatalf("expected: %v requests, %v bytes, actual: %+v", 20, 20*0x200, s)
+	}
+
+	if s.Throttled == 0 || s.Time == 0 {
+		t.Fatalf("no throttled requests counted: %+v", s)
+	}
+}
+
+func TestThrottleBPS(t *testing.T) {
+	t.Parallel()
+
+	th := ratelimit.NewThrottle(ratelimit.Limits{BPS: 1 << 20})
+
+	start := time.Now()
+
+	// One second of burst, then a request twice that size leaves a debt
+	// which the next one has to wait for.
+	th.Wait(1 << 20)
+	th.Wait(1 << 19)
+	th.Wait(1)
+
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("1.5MiB at 1MiB/s took only %v", d)
+	}
+
+	// Unlimited again.
+	th.SetLimits(ratelimit.Limits{})
+
+	start = time.Now()
+
+	for i := 0; i < 1000; i++ {
+		th.Wait(1 << 20)
+	}
+
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("unlimited throttle took %v", d)
+	}
+}
@@ -0,0 +1,103 @@
+// Package rng provides the entropy behind virtio-rng: getrandom(2) of the
+// host, or a deterministic stream from a seed for reproducible tests.
+package rng
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/ratelimit"
+	"golang.org/x/sys/unix"
+)
+
+// Config selects the source of the entropy and its rate.
+type Config struct {
+	// Seeded makes the stream a function of Seed.
+	Seeded bool
+	Seed   uint64
+	// Rate limits the bytes per second, with bursts of up to Burst
+	// bytes. Zero means no limit.
+	Rate  uint64
+	Burst uint64
+}
+
+// New returns the source of c.
+func New(c Config) io.Reader {
+	var r io.Reader = host{}
+
+	if c.Seeded {
+		r = NewSeeded(c.Seed)
+	}
+
+	if c.Rate > 0 {
+		r = &throttled{
+			r: r,
+			t: ratelimit.NewThrottle(ratelimit.Limits{BPS: c.Rate, BPSBurst: c.Burst}),
+		}
+	}
+
+	return r
+}
+
+// host reads getrandom(2).
+type host struct{}
+
+func (host) Read(p []byte) (int, error) {
+	for {
+		n, err := unix.Getrandom(p, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+
+		return n, err
+	}
+}
+
+// Seeded is a deterministic stream: SHA-256 of the seed and a counter. It
+// is not fit for cryptography, only for replaying a guest.
+type Seeded struct {
+	seed    uint64
+	counter uint64
+	buf     []byte
+}
+
+func NewSeeded(seed uint64) *Seeded {
+	return &Seeded{seed: seed}
+}
+
+func (s *Seeded) Read(p []byte) (int, error) {
+	n := 0
+
+	for n < len(p) {
+		if len(s.buf) == 0 {
+			var b [16]byte
+
+			binary.LittleEndian.PutUint64(b[0:], s.seed)
+			binary.LittleEndian.PutUint64(b[8:], s.counter)
+			s.counter++
+
+			sum := sha256.Sum256(b[:])
+			s.buf = sum[:]
+		}
+
+		l := copy(p[n:], s.buf)
+		s.buf = s.buf[l:]
+		n += l
+	}
+
+	return n, nil
+}
+
+// throttled holds back reads until the Throttle lets them go.
+type throttled struct {
+	r io.Reader
+	t *ratelimit.Throttle
+}
+
+func (t *throttled) Read(p []byte) (int, error) {
+	t.t.Wait(len(p))
+
+	return t.r.Read(p)
+}
@@ -0,0 +1,82 @@
+package rng_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/rng"
+)
+
+func TestSeeded(t *testing.T) {
+	t.Parallel()
+
+	a := make([]byte, 100)
+	b := make([]byte, 100)
+
+	if _, err := io.ReadFull(rng.New(rng.Config{Seeded: true, Seed: 42}), a); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same stream, read in pieces.
+	r := rng.New(rng.Config{Seeded: true, Seed: 42})
+	for i := 0; i < len(b); i += 7 {
+		end := i + 7
+		if end > len(b) {
+			end = len(b)
+		}
+
+		if _, err := io.ReadFull(r, b[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(a, b) {
+		t.Fatalf("expected: %v, actual: %v", a, b)
+	}
+
+	if _, err := io.ReadFull(rng.New(rng.Config{Seeded: true, Seed: 43}), b); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(a, b) {
+		t.Fatalf("expected different streams for different seeds: %v", a)
+	}
+}
+
+func TestHost(t *testing.T) {
+	t.Parallel()
+
+	b := make([]byte, 64)
+
+	if _, err := io.ReadFull(rng.New(rng.Config{}), b); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(b, make([]byte, 64)) {
+		t.Fatalf("expected random bytes, actual: %v", b)
+	}
+}
+
+func TestRate(t *testing.T) {
+	t.Parallel()
+
+	// A burst of 100 bytes, then 1000 bytes per second.
+	r := rng.New(rng.Config{Rate: 1000, Burst: 100})
+	b := make([]byte, 100)
+
+	start := time.Now()
+
+	// The first two reads go at once, the bucket lets a read run into
+	// debt. The next two wait for 100 ms each.
+	for i := 0; i < 4; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("expected: >= %v, actual: %v", 150*time.Millisecond, d)
+	}
+}
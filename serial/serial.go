@@ -24,6 +24,9 @@ type Serial struct {
 
 	inputChan chan byte
 
+	// handlers for Ctrl-a escape sequences on the console.
+	escapes map[byte]func()
+
 	irqInjector IRQInjector
 }
 
@@ -31,12 +34,19 @@ func New(irqInjector IRQInjector) (*Serial, error) {
 	s := &Serial{
 		IER: 0, LCR: 0,
 		inputChan:   make(chan byte, 10000),
+		escapes:     map[byte]func(){},
 		irqInjector: irqInjector,
 	}
 
 	return s, nil
 }
 
+// HandleEscape registers f to be called when Ctrl-a b is typed on the console.
+// Ctrl-a x always exits.
+func (s *Serial) HandleEscape(b byte, f func()) {
+	s.escapes[b] = f
+}
+
 func (s *Serial) GetInputChan() chan<- byte {
 	return s.inputChan
 }
@@ -143,6 +153,10 @@ func (s *Serial) StartSerial(in bufio.Reader, restoreMode func(), irqInject func
 				os.Exit(0)
 			}
 
+			if f, ok := s.escapes[b]; ok && before == 0x1 {
+				f()
+			}
+
 			before = b
 		}
 	}()
@@ -8,6 +8,24 @@ import (
 
 const ifNameSize = 0x10
 
+// Offloads for SetOffload, i.e. what the tap may hand to us.
+//
+// refs https://github.com/torvalds/linux/blob/master/include/uapi/linux/if_tun.h
+const (
+	OffloadCSUM = 0x01
+	OffloadTSO4 = 0x02
+	OffloadTSO6 = 0x04
+)
+
+// Not in package syscall.
+const (
+	iffMultiQueue  = 0x0100
+	iffAttachQueue = 0x0200
+	iffDetachQueue = 0x0400
+
+	tunSetQueue = 0x400454d9
+)
+
 type Tap struct {
 	fd int
 }
@@ -40,6 +58,37 @@ func fcntl(fd, op, arg uintptr) (uintptr, error) {
 }
 
 func New(name string) (*Tap, error) {
+	return open(name, 0)
+}
+
+// NewMultiQueue opens queues file descriptors of an IFF_MULTI_QUEUE tap.
+// The kernel spreads the flows of received packets among them.
+func NewMultiQueue(name string, queues int) ([]*Tap, error) {
+	if queues == 1 {
+		t, err := New(name)
+
+		return []*Tap{t}, err
+	}
+
+	taps := make([]*Tap, 0, queues)
+
+	for i := 0; i < queues; i++ {
+		t, err := open(name, iffMultiQueue)
+		if err != nil {
+			for _, t := range taps {
+				t.Close()
+			}
+
+			return nil, err
+		}
+
+		taps = append(taps, t)
+	}
+
+	return taps, nil
+}
+
+func open(name string, flags uint16) (*Tap, error) {
 	var err error
 
 	t := &Tap{}
@@ -50,7 +99,7 @@ func New(name string) (*Tap, error) {
 
 	ifr := ifReq{
 		Name:  [ifNameSize]byte{},
-		Flags: syscall.IFF_TAP | syscall.IFF_NO_PI,
+		Flags: syscall.IFF_TAP | syscall.IFF_NO_PI | syscall.IFF_VNET_HDR | flags,
 	}
 	copy(ifr.Name[:ifNameSize-1], name)
 
@@ -64,21 +113,63 @@ func New(name string) (*Tap, error) {
 		return t, fmt.Errorf("tun SETSIG: %w", err)
 	}
 
-	var flags uintptr
+	var fl uintptr
 
 	// enable non-blocking IO for tap interface
-	if flags, err = fcntl(uintptr(t.fd), syscall.F_GETFL, 0); err != nil {
+	if fl, err = fcntl(uintptr(t.fd), syscall.F_GETFL, 0); err != nil {
 		return t, fmt.Errorf("TUN GETFL: %w", err)
 	}
 
-	flags |= syscall.O_NONBLOCK | syscall.O_ASYNC
-	if _, err = fcntl(uintptr(t.fd), syscall.F_SETFL, flags); err != nil {
+	fl |= syscall.O_NONBLOCK | syscall.O_ASYNC
+	if _, err = fcntl(uintptr(t.fd), syscall.F_SETFL, fl); err != nil {
 		return t, fmt.Errorf("TUN SETFL NONBLOCK|ASYNC: %w", err)
 	}
 
 	return t, nil
 }
 
+// SetVnetHdrSize sets the size of the struct virtio_net_hdr in front of
+// every packet read from and written to the tap. The default is 10.
+func (t *Tap) SetVnetHdrSize(n int) error {
+	sz := int32(n)
+
+	if _, err := ioctl(uintptr(t.fd), syscall.TUNSETVNETHDRSZ, uintptr(unsafe.Pointer(&sz))); err != nil {
+		return fmt.Errorf("TUN TUNSETVNETHDRSZ: %w", err)
+	}
+
+	return nil
+}
+
+// SetOffload tells the kernel which Offload* the reader of the tap can
+// handle. Packets written to the tap may use any of them regardless.
+func (t *Tap) SetOffload(flags uint) error {
+	if _, err := ioctl(uintptr(t.fd), syscall.TUNSETOFFLOAD, uintptr(flags)); err != nil {
+		return fmt.Errorf("TUN TUNSETOFFLOAD: %w", err)
+	}
+
+	return nil
+}
+
+// SetQueueEnabled attaches or detaches a queue of a multiqueue tap. The
+// kernel does not steer packets to detached queues.
+func (t *Tap) SetQueueEnabled(enabled bool) error {
+	ifr := ifReq{Flags: iffDetachQueue}
+	if enabled {
+		ifr.Flags = iffAttachQueue
+	}
+
+	if _, err := ioctl(uintptr(t.fd), tunSetQueue, uintptr(unsafe.Pointer(&ifr))); err != nil {
+		return fmt.Errorf("TUN TUNSETQUEUE: %w", err)
+	}
+
+	return nil
+}
+
+// Fd returns the file descriptor of the tap, e.g. for vhost-net.
+func (t *Tap) Fd() int {
+	return t.fd
+}
+
 func (t *Tap) Close() error {
 	return syscall.Close(t.fd)
 }
@@ -40,7 +40,8 @@ func TestWrite(t *testing.T) { // nolint:paralleltest
 		t.Fatal(err)
 	}
 
-	if _, err := tap.Write(make([]byte, 20)); err != nil {
+	// struct virtio_net_hdr, followed by an ethernet frame
+	if _, err := tap.Write(make([]byte, 10+60)); err != nil {
 		t.Fatal(err)
 	}
 
@@ -72,3 +73,55 @@ func TestRead(t *testing.T) { // nolint:paralleltest
 		t.Fatal(err)
 	}
 }
+
+func TestOffload(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	tp, err := tap.New("test_offload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tp.SetVnetHdrSize(12); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tp.SetOffload(tap.OffloadCSUM | tap.OffloadTSO4 | tap.OffloadTSO6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewMultiQueue(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	taps, err := tap.NewMultiQueue("test_mq", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(taps) != 4 {
+		t.Fatalf("expected: %v, actual: %v", 4, len(taps))
+	}
+
+	if err := taps[3].SetQueueEnabled(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := taps[3].SetQueueEnabled(true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tp := range taps {
+		if err := tp.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
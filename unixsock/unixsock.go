@@ -0,0 +1,13 @@
+// Package unixsock holds what the listeners on UNIX sockets share.
+package unixsock
+
+import "os"
+
+// RemoveStale removes a socket left behind at path, e.g. by a previous run,
+// so that it can be listened on again. Anything else at path stays, and
+// listening on it fails.
+func RemoveStale(path string) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+}
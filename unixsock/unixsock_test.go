@@ -0,0 +1,49 @@
+package unixsock_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/unixsock"
+)
+
+func TestRemoveStale(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// A regular file stays.
+	path := filepath.Join(dir, "file")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	unixsock.RemoveStale(path)
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected: %v, actual: %v", nil, err)
+	}
+
+	// A socket goes.
+	path = filepath.Join(dir, "sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	unixsock.RemoveStale(path)
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected: %v, actual: %v", os.ErrNotExist, err)
+	}
+
+	// Nothing at all is fine too.
+	unixsock.RemoveStale(path)
+}
@@ -0,0 +1,114 @@
+package usernet
+
+import (
+	"encoding/binary"
+)
+
+// A DHCP server which always hands out GuestIP.
+//
+// refs https://datatracker.ietf.org/doc/html/rfc2131
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpMagic = 0x63825363
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+
+	dhcpOptSubnetMask = 1
+	dhcpOptRouter     = 3
+	dhcpOptDNS        = 6
+	dhcpOptLeaseTime  = 51
+	dhcpOptMsgType    = 53
+	dhcpOptServerID   = 54
+	dhcpOptEnd        = 255
+
+	// Offset of the options in a BOOTP message.
+	dhcpOptionsOffset = 240
+
+	dhcpLeaseTime = 24 * 60 * 60
+)
+
+// dhcpMsgType returns the DHCP message type of a BOOTP request, or 0.
+func dhcpMsgType(p []byte) uint8 {
+	if len(p) < dhcpOptionsOffset || p[0] != 1 ||
+		binary.BigEndian.Uint32(p[236:240]) != dhcpMagic {
+		return 0
+	}
+
+	opts := p[dhcpOptionsOffset:]
+
+	for len(opts) > 0 {
+		code := opts[0]
+
+		switch code {
+		case 0:
+			opts = opts[1:]
+
+			continue
+		case dhcpOptEnd:
+			return 0
+		}
+
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return 0
+		}
+
+		if code == dhcpOptMsgType && opts[1] == 1 {
+			return opts[2]
+		}
+
+		opts = opts[2+int(opts[1]):]
+	}
+
+	return 0
+}
+
+func (s *Stack) handleDHCP(p []byte) {
+	var reply uint8
+
+	switch dhcpMsgType(p) {
+	case dhcpDiscover:
+		reply = dhcpOffer
+	case dhcpRequest:
+		reply = dhcpAck
+	default:
+		return
+	}
+
+	msg := make([]byte, dhcpOptionsOffset, 300)
+	msg[0] = 2 // BOOTREPLY
+	msg[1] = 1 // ethernet
+	msg[2] = 6
+	copy(msg[4:8], p[4:8])     // xid
+	copy(msg[10:12], p[10:12]) // flags
+	copy(msg[16:20], GuestIP[:])
+	copy(msg[20:24], GatewayIP[:])
+	copy(msg[28:44], p[28:44]) // chaddr
+	binary.BigEndian.PutUint32(msg[236:240], dhcpMagic)
+
+	lease := make([]byte, 4)
+	binary.BigEndian.PutUint32(lease, dhcpLeaseTime)
+
+	for _, opt := range []struct {
+		code uint8
+		val  []byte
+	}{
+		{dhcpOptMsgType, []byte{reply}},
+		{dhcpOptServerID, GatewayIP[:]},
+		{dhcpOptLeaseTime, lease},
+		{dhcpOptSubnetMask, Netmask[:]},
+		{dhcpOptRouter, GatewayIP[:]},
+		{dhcpOptDNS, DNSIP[:]},
+	} {
+		msg = append(msg, opt.code, uint8(len(opt.val)))
+		msg = append(msg, opt.val...)
+	}
+
+	msg = append(msg, dhcpOptEnd)
+
+	s.sendUDP(GatewayIP, dhcpServerPort, broadcastIP, dhcpClientPort, msg)
+}
@@ -0,0 +1,118 @@
+package usernet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidHostFwd = errors.New("invalid hostfwd")
+
+// HostFwd forwards a port of the host to a port of the guest.
+type HostFwd struct {
+	// Proto is "tcp" or "udp".
+	Proto string
+	// HostAddr is the address to listen on, empty for all.
+	HostAddr  string
+	HostPort  uint16
+	GuestPort uint16
+}
+
+// ParseHostFwd parses a port forward in the syntax of QEMU,
+// [tcp|udp]:[hostaddr]:hostport-[guestaddr]:guestport, e.g.
+// "tcp::2222-:22". guestaddr can only be the address of the guest.
+func ParseHostFwd(s string) (HostFwd, error) {
+	f := HostFwd{Proto: "tcp"}
+
+	host, guest, ok := strings.Cut(s, "-")
+	if !ok {
+		return f, fmt.Errorf("%w: %q has no '-'", ErrInvalidHostFwd, s)
+	}
+
+	parts := strings.Split(host, ":")
+
+	switch len(parts) {
+	case 2:
+	case 3:
+		f.Proto, parts = parts[0], parts[1:]
+		if f.Proto == "" {
+			f.Proto = "tcp"
+		}
+	default:
+		return f, fmt.Errorf("%w: %q", ErrInvalidHostFwd, s)
+	}
+
+	if f.Proto != "tcp" && f.Proto != "udp" {
+		return f, fmt.Errorf("%w: unknown protocol %q", ErrInvalidHostFwd, f.Proto)
+	}
+
+	f.HostAddr = parts[0]
+
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return f, fmt.Errorf("%w: host port %q", ErrInvalidHostFwd, parts[1])
+	}
+
+	f.HostPort = uint16(port)
+
+	guestAddr, guestPort, ok := strings.Cut(guest, ":")
+	if !ok {
+		return f, fmt.Errorf("%w: %q", ErrInvalidHostFwd, s)
+	}
+
+	if guestAddr != "" && guestAddr != net.IP(GuestIP[:]).String() {
+		return f, fmt.Errorf("%w: the guest is %v", ErrInvalidHostFwd, net.IP(GuestIP[:]))
+	}
+
+	port, err = strconv.ParseUint(guestPort, 10, 16)
+	if err != nil || port == 0 {
+		return f, fmt.Errorf("%w: guest port %q", ErrInvalidHostFwd, guestPort)
+	}
+
+	f.GuestPort = uint16(port)
+
+	return f, nil
+}
+
+func (f HostFwd) String() string {
+	return fmt.Sprintf("%s:%s:%d-:%d", f.Proto, f.HostAddr, f.HostPort, f.GuestPort)
+}
+
+func (s *Stack) listen(f HostFwd) error {
+	addr := net.JoinHostPort(f.HostAddr, strconv.Itoa(int(f.HostPort)))
+
+	if f.Proto == "udp" {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+
+		s.packets = append(s.packets, pc)
+
+		go s.serveUDPFwd(pc, f.GuestPort)
+
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.listeners = append(s.listeners, l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			s.connectGuest(conn, f.GuestPort)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,609 @@
+package usernet
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	tcpHdrLen = 20
+
+	tcpDefaultMSS = 536
+	tcpMaxMSS     = mtu - ipv4HdrLen - tcpHdrLen
+
+	// Without window scaling, this is the most we can offer.
+	tcpWindow = 0xffff
+
+	tcpDialTimeout = 10 * time.Second
+	tcpMinRTO      = time.Second
+	tcpMaxRTO      = 16 * time.Second
+	tcpMaxRetries  = 8
+
+	// Segments from the guest which are waiting to be written to the host.
+	// Beyond that, they are dropped and the guest has to send them again.
+	tcpWriteQueue = 64
+)
+
+const (
+	tcpDialing = iota
+	tcpSynSent
+	tcpSynRcvd
+	tcpEstablished
+)
+
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            uint8
+	window           uint16
+	opts             []byte
+	data             []byte
+}
+
+// tcpConn is a TCP connection with the guest, relayed to conn on the host.
+// The guest may have opened it (NAT), or the host (port forward).
+type tcpConn struct {
+	s   *Stack
+	key connKey
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state int
+	conn  net.Conn
+
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	sndWnd uint32
+	rcvNxt uint32
+	mss    int
+
+	// Data sent to the guest from sndUna on, kept for retransmission.
+	unacked []byte
+
+	finSent  bool
+	finAcked bool
+	finRcvd  bool
+	closed   bool
+
+	lastSend time.Time
+	rto      time.Duration
+	retries  int
+
+	writes chan []byte
+}
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func parseTCP(p []byte) (tcpSegment, bool) {
+	if len(p) < tcpHdrLen {
+		return tcpSegment{}, false
+	}
+
+	off := int(p[12]>>4) * 4
+	if off < tcpHdrLen || off > len(p) {
+		return tcpSegment{}, false
+	}
+
+	return tcpSegment{
+		srcPort: binary.BigEndian.Uint16(p[0:2]),
+		dstPort: binary.BigEndian.Uint16(p[2:4]),
+		seq:     binary.BigEndian.Uint32(p[4:8]),
+		ack:     binary.BigEndian.Uint32(p[8:12]),
+		flags:   p[13],
+		window:  binary.BigEndian.Uint16(p[14:16]),
+		opts:    p[tcpHdrLen:off],
+		data:    p[off:],
+	}, true
+}
+
+// mssOption returns the maximum segment size announced in a SYN.
+func mssOption(opts []byte) int {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			return tcpDefaultMSS
+		case 1:
+			opts = opts[1:]
+
+			continue
+		}
+
+		if len(opts) < 2 || opts[1] < 2 || len(opts) < int(opts[1]) {
+			return tcpDefaultMSS
+		}
+
+		if opts[0] == 2 && opts[1] == 4 {
+			mss := int(binary.BigEndian.Uint16(opts[2:4]))
+			if mss > tcpMaxMSS {
+				mss = tcpMaxMSS
+			}
+
+			return mss
+		}
+
+		opts = opts[opts[1]:]
+	}
+
+	return tcpDefaultMSS
+}
+
+func newTCPConn(s *Stack, key connKey) *tcpConn {
+	c := &tcpConn{
+		s:      s,
+		key:    key,
+		iss:    rand.Uint32(),
+		mss:    tcpDefaultMSS,
+		rto:    tcpMinRTO,
+		writes: make(chan []byte, tcpWriteQueue),
+	}
+
+	c.cond = sync.NewCond(&c.mu)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+
+	return c
+}
+
+func (s *Stack) handleTCP(src, dst ipv4, p []byte) {
+	seg, ok := parseTCP(p)
+	if !ok || src != GuestIP {
+		return
+	}
+
+	key := connKey{guestPort: seg.srcPort, remote: dst, remotePort: seg.dstPort}
+
+	s.mu.Lock()
+	c := s.tcp[key]
+	closed := s.closed
+	s.mu.Unlock()
+
+	switch {
+	case closed:
+	case c != nil:
+		c.handle(seg)
+	case seg.flags&tcpRST != 0:
+	case seg.flags&(tcpSYN|tcpACK) == tcpSYN:
+		s.acceptGuest(key, seg)
+	default:
+		s.sendRST(key, seg)
+	}
+}
+
+// sendRST answers a segment which belongs to no connection.
+func (s *Stack) sendRST(key connKey, seg tcpSegment) {
+	c := &tcpConn{s: s, key: key}
+
+	if seg.flags&tcpACK != 0 {
+		c.send(tcpRST, seg.ack, nil, nil)
+
+		return
+	}
+
+	c.rcvNxt = seg.seq + uint32(len(seg.data))
+	if seg.flags&(tcpSYN|tcpFIN) != 0 {
+		c.rcvNxt++
+	}
+
+	c.send(tcpRST|tcpACK, 0, nil, nil)
+}
+
+// acceptGuest starts a connection the guest opened with a SYN.
+func (s *Stack) acceptGuest(key connKey, seg tcpSegment) {
+	c := newTCPConn(s, key)
+	c.state = tcpDialing
+	c.rcvNxt = seg.seq + 1
+	c.sndWnd = uint32(seg.window)
+	c.mss = mssOption(seg.opts)
+
+	s.mu.Lock()
+	s.tcp[key] = c
+	s.mu.Unlock()
+
+	go c.dial()
+}
+
+func (c *tcpConn) dial() {
+	conn, err := net.DialTimeout("tcp", c.s.hostAddr(c.key.remote, c.key.remotePort), tcpDialTimeout)
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+
+		if err == nil {
+			conn.Close()
+		}
+
+		return
+	}
+
+	if err != nil {
+		c.mu.Unlock()
+		c.abort(true)
+
+		return
+	}
+
+	c.conn = conn
+	c.state = tcpSynRcvd
+	c.sendSYN()
+	c.mu.Unlock()
+
+	go c.reader()
+	go c.writer()
+}
+
+// connectGuest opens a connection to port of the guest for conn, which
+// came in on a forwarded port.
+func (s *Stack) connectGuest(conn net.Conn, port uint16) {
+	s.mu.Lock()
+	key := connKey{guestPort: port, remote: GatewayIP, remotePort: s.allocPort()}
+	c := newTCPConn(s, key)
+	c.conn = conn
+	c.state = tcpSynSent
+	s.tcp[key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.sendSYN()
+	c.mu.Unlock()
+
+	go c.reader()
+	go c.writer()
+}
+
+// sendSYN sends a SYN, or a SYN-ACK in response to the guest's SYN.
+func (c *tcpConn) sendSYN() {
+	flags := uint8(tcpSYN)
+	if c.state == tcpSynRcvd {
+		flags |= tcpACK
+	}
+
+	opts := []byte{2, 4, 0, 0}
+	binary.BigEndian.PutUint16(opts[2:], tcpMaxMSS)
+
+	c.send(flags, c.iss, nil, opts)
+	c.lastSend = time.Now()
+}
+
+// send queues a segment for the guest with the current acknowledgment.
+func (c *tcpConn) send(flags uint8, seq uint32, data, opts []byte) {
+	hl := tcpHdrLen + len(opts)
+	p := make([]byte, hl+len(data))
+
+	binary.BigEndian.PutUint16(p[0:2], c.key.remotePort)
+	binary.BigEndian.PutUint16(p[2:4], c.key.guestPort)
+	binary.BigEndian.PutUint32(p[4:8], seq)
+	binary.BigEndian.PutUint32(p[8:12], c.rcvNxt)
+	p[12] = uint8(hl/4) << 4
+	p[13] = flags
+	binary.BigEndian.PutUint16(p[14:16], tcpWindow)
+	copy(p[tcpHdrLen:], opts)
+	copy(p[hl:], data)
+
+	binary.BigEndian.PutUint16(p[16:18], checksum(p, pseudoHeaderSum(c.key.remote, GuestIP, protoTCP, len(p))))
+
+	c.s.sendIPv4(protoTCP, c.key.remote, GuestIP, p)
+}
+
+func (c *tcpConn) handle(seg tcpSegment) {
+	c.mu.Lock()
+
+	// The connection may have been removed since it was looked up, and
+	// c.writes closed with it.
+	if c.closed {
+		c.mu.Unlock()
+
+		return
+	}
+
+	if seg.flags&tcpRST != 0 {
+		c.mu.Unlock()
+		c.abort(false)
+
+		return
+	}
+
+	switch c.state {
+	case tcpDialing:
+		c.mu.Unlock()
+
+		return
+	case tcpSynSent:
+		if seg.flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK && seg.ack == c.iss+1 {
+			c.rcvNxt = seg.seq + 1
+			c.sndUna = seg.ack
+			c.sndWnd = uint32(seg.window)
+			c.mss = mssOption(seg.opts)
+			c.state = tcpEstablished
+			c.send(tcpACK, c.sndNxt, nil, nil)
+			c.cond.Broadcast()
+		}
+
+		c.mu.Unlock()
+
+		return
+	case tcpSynRcvd:
+		if seg.flags&tcpSYN != 0 {
+			c.sendSYN()
+			c.mu.Unlock()
+
+			return
+		}
+
+		if seg.flags&tcpACK == 0 || seg.ack != c.iss+1 {
+			c.mu.Unlock()
+
+			return
+		}
+
+		c.state = tcpEstablished
+		c.cond.Broadcast()
+	}
+
+	if seg.flags&tcpACK != 0 && seqLEQ(c.sndUna, seg.ack) && seqLEQ(seg.ack, c.sndNxt) {
+		n := int(seg.ack - c.sndUna)
+
+		if c.finSent && seg.ack == c.sndNxt {
+			c.finAcked = true
+			n--
+		}
+
+		if n > len(c.unacked) {
+			n = len(c.unacked)
+		}
+
+		if n > 0 {
+			c.unacked = c.unacked[n:]
+			c.lastSend = time.Now()
+			c.rto = tcpMinRTO
+			c.retries = 0
+		}
+
+		c.sndUna = seg.ack
+		c.sndWnd = uint32(seg.window)
+		c.cond.Broadcast()
+	}
+
+	if len(seg.data) > 0 || seg.flags&tcpFIN != 0 {
+		// Only data in order is taken, the guest sends the rest again.
+		if seg.seq == c.rcvNxt && !c.finRcvd {
+			if len(seg.data) > 0 {
+				select {
+				case c.writes <- append([]byte{}, seg.data...):
+					c.rcvNxt += uint32(len(seg.data))
+				default:
+				}
+			}
+
+			if seg.flags&tcpFIN != 0 && seg.seq+uint32(len(seg.data)) == c.rcvNxt {
+				select {
+				case c.writes <- nil:
+					c.rcvNxt++
+					c.finRcvd = true
+				default:
+				}
+			}
+		}
+
+		c.send(tcpACK, c.sndNxt, nil, nil)
+	}
+
+	done := c.finRcvd && c.finAcked
+	c.mu.Unlock()
+
+	// Both sides are closed, the writer closes the host side once it has
+	// written everything.
+	if done {
+		c.remove()
+	}
+}
+
+// reader passes what the host sends on to the guest.
+func (c *tcpConn) reader() {
+	buf := make([]byte, tcpMaxMSS)
+
+	c.mu.Lock()
+	for c.state != tcpEstablished && !c.closed {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		mss := c.mss
+		c.mu.Unlock()
+
+		n, err := c.conn.Read(buf[:mss])
+
+		c.mu.Lock()
+
+		// Wait for the guest to make room in its window.
+		for !c.closed && n > 0 && int(c.sndWnd)-int(c.sndNxt-c.sndUna) < n {
+			c.cond.Wait()
+		}
+
+		if c.closed {
+			c.mu.Unlock()
+
+			return
+		}
+
+		if n > 0 {
+			if len(c.unacked) == 0 {
+				c.lastSend = time.Now()
+			}
+
+			c.send(tcpACK|tcpPSH, c.sndNxt, buf[:n], nil)
+			c.unacked = append(c.unacked, buf[:n]...)
+			c.sndNxt += uint32(n)
+		}
+
+		if errors.Is(err, io.EOF) {
+			if len(c.unacked) == 0 {
+				c.lastSend = time.Now()
+			}
+
+			c.send(tcpFIN|tcpACK, c.sndNxt, nil, nil)
+			c.sndNxt++
+			c.finSent = true
+			c.mu.Unlock()
+
+			return
+		}
+
+		c.mu.Unlock()
+
+		if err != nil {
+			c.abort(true)
+
+			return
+		}
+	}
+}
+
+// writer passes what the guest sends on to the host. nil stands for FIN.
+func (c *tcpConn) writer() {
+	defer c.conn.Close()
+
+	for b := range c.writes {
+		if b == nil {
+			if tc, ok := c.conn.(*net.TCPConn); ok {
+				_ = tc.CloseWrite()
+			}
+
+			continue
+		}
+
+		if _, err := c.conn.Write(b); err != nil {
+			go c.abort(true)
+
+			for range c.writes {
+			}
+
+			return
+		}
+	}
+}
+
+// remove forgets the connection, and returns false if that happened before.
+func (c *tcpConn) remove() bool {
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+
+		return false
+	}
+
+	c.closed = true
+	c.cond.Broadcast()
+	close(c.writes)
+	c.mu.Unlock()
+
+	c.s.mu.Lock()
+	if c.s.tcp[c.key] == c {
+		delete(c.s.tcp, c.key)
+	}
+	c.s.mu.Unlock()
+
+	return true
+}
+
+// abort resets the connection on both sides.
+func (c *tcpConn) abort(reset bool) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if !c.remove() {
+		return
+	}
+
+	if reset {
+		c.mu.Lock()
+		c.send(tcpRST|tcpACK, c.sndNxt, nil, nil)
+		c.mu.Unlock()
+	}
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// tick sends segments the guest has not acknowledged in time again.
+func (c *tcpConn) tick(now time.Time) {
+	c.mu.Lock()
+
+	pending := c.state == tcpSynSent || c.state == tcpSynRcvd ||
+		len(c.unacked) > 0 || (c.finSent && !c.finAcked)
+
+	if c.closed || !pending || now.Sub(c.lastSend) < c.rto {
+		c.mu.Unlock()
+
+		return
+	}
+
+	c.retries++
+	if c.retries > tcpMaxRetries {
+		c.mu.Unlock()
+		c.abort(true)
+
+		return
+	}
+
+	switch {
+	case c.state != tcpEstablished:
+		c.sendSYN()
+	case len(c.unacked) > 0:
+		n := len(c.unacked)
+		if n > c.mss {
+			n = c.mss
+		}
+
+		c.send(tcpACK|tcpPSH, c.sndUna, c.unacked[:n], nil)
+	default:
+		c.send(tcpFIN|tcpACK, c.sndNxt-1, nil, nil)
+	}
+
+	c.lastSend = now
+
+	c.rto *= 2
+	if c.rto > tcpMaxRTO {
+		c.rto = tcpMaxRTO
+	}
+
+	c.mu.Unlock()
+}
+
+func (s *Stack) tickTCP(now time.Time) {
+	s.mu.Lock()
+	conns := make([]*tcpConn, 0, len(s.tcp))
+
+	for _, c := range s.tcp {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.tick(now)
+	}
+}
@@ -0,0 +1,202 @@
+package usernet
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpHdrLen = 8
+
+	// UDP flows without any packet for this long are forgotten.
+	udpTimeout = 60 * time.Second
+)
+
+// udpConn relays the datagrams of a flow from the guest through a socket
+// of the host.
+type udpConn struct {
+	key  connKey
+	conn *net.UDPConn
+	// last is the time of the last datagram in unix nanoseconds.
+	last atomic.Int64
+}
+
+// udpFwdPeer is a peer on the host which sent to a forwarded UDP port. The
+// guest sees it as a port of the gateway.
+type udpFwdPeer struct {
+	pc   net.PacketConn
+	addr net.Addr
+	last atomic.Int64
+}
+
+// udpFwdAddr is a peer by the forwarded port it sent to and its address.
+type udpFwdAddr struct {
+	pc   net.PacketConn
+	addr string
+}
+
+func (s *Stack) handleUDP(src, dst ipv4, p []byte) {
+	if len(p) < udpHdrLen {
+		return
+	}
+
+	l := int(binary.BigEndian.Uint16(p[4:6]))
+	if l < udpHdrLen || l > len(p) {
+		return
+	}
+
+	srcPort := binary.BigEndian.Uint16(p[0:2])
+	dstPort := binary.BigEndian.Uint16(p[2:4])
+	data := p[udpHdrLen:l]
+
+	if dstPort == dhcpServerPort {
+		s.handleDHCP(data)
+
+		return
+	}
+
+	if src != GuestIP || dst == broadcastIP {
+		return
+	}
+
+	key := connKey{guestPort: srcPort, remote: dst, remotePort: dstPort}
+	now := time.Now().UnixNano()
+
+	s.mu.Lock()
+	peer := s.udpFwd[key]
+	c := s.udp[key]
+	closed := s.closed
+	s.mu.Unlock()
+
+	if closed {
+		return
+	}
+
+	if peer != nil {
+		peer.last.Store(now)
+		_, _ = peer.pc.WriteTo(data, peer.addr)
+
+		return
+	}
+
+	if c == nil {
+		var err error
+		if c, err = s.dialUDP(key); err != nil {
+			return
+		}
+	}
+
+	c.last.Store(now)
+	_, _ = c.conn.Write(data)
+}
+
+func (s *Stack) dialUDP(key connKey) (*udpConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", s.hostAddr(key.remote, key.remotePort))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &udpConn{key: key, conn: conn}
+
+	s.mu.Lock()
+	s.udp[key] = c
+	s.mu.Unlock()
+
+	go s.udpReader(c)
+
+	return c, nil
+}
+
+// udpReader passes the replies to the guest until the flow times out.
+func (s *Stack) udpReader(c *udpConn) {
+	buf := make([]byte, mtu-ipv4HdrLen-udpHdrLen)
+
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		c.last.Store(time.Now().UnixNano())
+		s.sendUDP(c.key.remote, c.key.remotePort, GuestIP, c.key.guestPort, buf[:n])
+	}
+}
+
+// sendUDP queues a datagram for the guest.
+func (s *Stack) sendUDP(src ipv4, srcPort uint16, dst ipv4, dstPort uint16, data []byte) {
+	p := make([]byte, udpHdrLen+len(data))
+	binary.BigEndian.PutUint16(p[0:2], srcPort)
+	binary.BigEndian.PutUint16(p[2:4], dstPort)
+	binary.BigEndian.PutUint16(p[4:6], uint16(len(p)))
+	copy(p[udpHdrLen:], data)
+
+	sum := checksum(p, pseudoHeaderSum(src, dst, protoUDP, len(p)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+
+	binary.BigEndian.PutUint16(p[6:8], sum)
+
+	s.sendIPv4(protoUDP, src, dst, p)
+}
+
+// serveUDPFwd passes datagrams sent to a forwarded port on to the guest.
+func (s *Stack) serveUDPFwd(pc net.PacketConn, guestPort uint16) {
+	buf := make([]byte, mtu-ipv4HdrLen-udpHdrLen)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+
+		a := udpFwdAddr{pc: pc, addr: addr.String()}
+
+		key, ok := s.udpFwdKeys[a]
+		if !ok {
+			key = connKey{guestPort: guestPort, remote: GatewayIP, remotePort: s.allocPort()}
+			s.udpFwdKeys[a] = key
+			s.udpFwd[key] = &udpFwdPeer{pc: pc, addr: addr}
+		}
+
+		s.udpFwd[key].last.Store(time.Now().UnixNano())
+		s.mu.Unlock()
+
+		s.sendUDP(GatewayIP, key.remotePort, GuestIP, guestPort, buf[:n])
+	}
+}
+
+func (s *Stack) tickUDP(now time.Time) {
+	expired := []*udpConn{}
+
+	s.mu.Lock()
+
+	for k, c := range s.udp {
+		if now.Sub(time.Unix(0, c.last.Load())) > udpTimeout {
+			delete(s.udp, k)
+			expired = append(expired, c)
+		}
+	}
+
+	for k, p := range s.udpFwd {
+		if now.Sub(time.Unix(0, p.last.Load())) > udpTimeout {
+			delete(s.udpFwd, k)
+			delete(s.udpFwdKeys, udpFwdAddr{pc: p.pc, addr: p.addr.String()})
+		}
+	}
+
+	s.mu.Unlock()
+
+	for _, c := range expired {
+		c.conn.Close()
+	}
+}
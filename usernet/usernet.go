@@ -0,0 +1,432 @@
+// Package usernet is a network backend for virtio-net which needs neither
+// root nor a tap. Like QEMU's user mode networking (slirp), it puts the
+// guest on a virtual network behind a NAT:
+//
+//	10.0.2.2   gateway, also reaches the loopback of the host
+//	10.0.2.3   DNS, forwarded to the resolver of the host
+//	10.0.2.15  the guest, handed out by DHCP
+//
+// The guest's TCP connections and UDP datagrams are terminated by a small
+// TCP/IP stack and relayed through sockets of the host. Ports of the host
+// can be forwarded into the guest with HostFwd.
+package usernet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoPacket = errors.New("no packet for the guest")
+	ErrClosed   = errors.New("user mode network is closed")
+)
+
+type ipv4 = [4]byte
+
+var (
+	GatewayIP = ipv4{10, 0, 2, 2}
+	DNSIP     = ipv4{10, 0, 2, 3}
+	GuestIP   = ipv4{10, 0, 2, 15}
+	Netmask   = ipv4{255, 255, 255, 0}
+
+	GatewayMAC = net.HardwareAddr{0x52, 0x55, 0x0a, 0x00, 0x02, 0x02}
+
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	broadcastIP  = ipv4{255, 255, 255, 255}
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+
+	ethHdrLen  = 14
+	ipv4HdrLen = 20
+
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+
+	mtu = 1500
+
+	// Frames waiting for the guest beyond this are dropped.
+	maxQueuedFrames = 1024
+
+	// How often timers of connections are checked.
+	tickInterval = 200 * time.Millisecond
+)
+
+// Stack is the user mode network, seen by the guest as its ethernet link.
+// Write takes frames from the guest, Read returns frames for it.
+type Stack struct {
+	mu       sync.Mutex
+	guestMAC net.HardwareAddr
+	ipID     uint16
+	closed   bool
+
+	queueMu sync.Mutex
+	queue   [][]byte
+	notify  func()
+
+	resolver string
+
+	tcp      map[connKey]*tcpConn
+	udp      map[connKey]*udpConn
+	udpFwd   map[connKey]*udpFwdPeer
+	nextPort uint16
+
+	// udpFwdKeys finds the flow of a peer of a forwarded port.
+	udpFwdKeys map[udpFwdAddr]connKey
+
+	listeners []net.Listener
+	packets   []net.PacketConn
+
+	done chan struct{}
+}
+
+// connKey identifies a flow by the guest's port and the remote end as the
+// guest sees it.
+type connKey struct {
+	guestPort  uint16
+	remote     ipv4
+	remotePort uint16
+}
+
+// New starts a user mode network with the given port forwards.
+func New(fwds []HostFwd) (*Stack, error) {
+	s := &Stack{
+		guestMAC: broadcastMAC,
+		resolver: hostResolver(),
+		tcp:      map[connKey]*tcpConn{},
+		udp:      map[connKey]*udpConn{},
+		udpFwd:   map[connKey]*udpFwdPeer{},
+		nextPort: 49152,
+		done:     make(chan struct{}),
+
+		udpFwdKeys: map[udpFwdAddr]connKey{},
+	}
+
+	for _, f := range fwds {
+		if err := s.listen(f); err != nil {
+			s.Close()
+
+			return nil, err
+		}
+	}
+
+	go s.timer()
+
+	return s, nil
+}
+
+// hostResolver returns the address of the first name server of the host.
+func hostResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+
+	return "127.0.0.1:53"
+}
+
+// hostAddr returns where a flow of the guest to ip:port goes on the host.
+func (s *Stack) hostAddr(ip ipv4, port uint16) string {
+	switch ip {
+	case GatewayIP:
+		ip = ipv4{127, 0, 0, 1}
+	case DNSIP:
+		if port == 53 {
+			return s.resolver
+		}
+	}
+
+	return net.JoinHostPort(net.IP(ip[:]).String(), strconv.Itoa(int(port)))
+}
+
+// SetRxNotifier registers f to be called whenever a frame for the guest
+// is queued.
+func (s *Stack) SetRxNotifier(f func()) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	s.notify = f
+}
+
+// Read returns the next frame for the guest, or ErrNoPacket.
+func (s *Stack) Read(p []byte) (int, error) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	if len(s.queue) == 0 {
+		return 0, ErrNoPacket
+	}
+
+	n := copy(p, s.queue[0])
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+
+	return n, nil
+}
+
+func (s *Stack) enqueue(frame []byte) {
+	s.queueMu.Lock()
+
+	if len(s.queue) >= maxQueuedFrames {
+		s.queueMu.Unlock()
+
+		return
+	}
+
+	s.queue = append(s.queue, frame)
+	notify := s.notify
+	s.queueMu.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+// Write takes a frame from the guest.
+func (s *Stack) Write(p []byte) (int, error) {
+	if len(p) < ethHdrLen {
+		return len(p), nil
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+
+		return 0, ErrClosed
+	}
+
+	if p[6]&0x1 == 0 {
+		s.guestMAC = append(net.HardwareAddr{}, p[6:12]...)
+	}
+	s.mu.Unlock()
+
+	switch binary.BigEndian.Uint16(p[12:14]) {
+	case etherTypeARP:
+		s.handleARP(p[ethHdrLen:])
+	case etherTypeIPv4:
+		s.handleIPv4(p[ethHdrLen:])
+	}
+
+	return len(p), nil
+}
+
+func (s *Stack) handleARP(p []byte) {
+	// Only requests for IPv4 over ethernet
+	if len(p) < 28 || binary.BigEndian.Uint16(p[6:8]) != 1 {
+		return
+	}
+
+	var target ipv4
+
+	copy(target[:], p[24:28])
+
+	if target != GatewayIP && target != DNSIP {
+		return
+	}
+
+	reply := make([]byte, ethHdrLen+28)
+	copy(reply[0:6], p[8:14])
+	copy(reply[6:12], GatewayMAC)
+	binary.BigEndian.PutUint16(reply[12:14], etherTypeARP)
+
+	arp := reply[ethHdrLen:]
+	copy(arp[0:6], p[0:6]) // htype, ptype, hlen, plen
+	binary.BigEndian.PutUint16(arp[6:8], 2)
+	copy(arp[8:14], GatewayMAC)
+	copy(arp[14:18], target[:])
+	copy(arp[18:24], p[8:14])
+	copy(arp[24:28], p[14:18])
+
+	s.enqueue(reply)
+}
+
+func (s *Stack) handleIPv4(p []byte) {
+	if len(p) < ipv4HdrLen || p[0]>>4 != 4 {
+		return
+	}
+
+	hl := int(p[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(p[2:4]))
+
+	if hl < ipv4HdrLen || total < hl || total > len(p) {
+		return
+	}
+
+	// Fragments are not reassembled.
+	if binary.BigEndian.Uint16(p[6:8])&0x3fff != 0 {
+		return
+	}
+
+	var src, dst ipv4
+
+	copy(src[:], p[12:16])
+	copy(dst[:], p[16:20])
+
+	payload := p[hl:total]
+
+	switch p[9] {
+	case protoICMP:
+		s.handleICMP(src, dst, payload)
+	case protoUDP:
+		s.handleUDP(src, dst, payload)
+	case protoTCP:
+		s.handleTCP(src, dst, payload)
+	}
+}
+
+func (s *Stack) handleICMP(src, dst ipv4, p []byte) {
+	// Only echo requests to the gateway and the DNS server are answered.
+	if len(p) < 8 || p[0] != 8 || (dst != GatewayIP && dst != DNSIP) {
+		return
+	}
+
+	reply := append([]byte{}, p...)
+	reply[0] = 0
+	reply[2], reply[3] = 0, 0
+	binary.BigEndian.PutUint16(reply[2:4], checksum(reply, 0))
+
+	s.sendIPv4(protoICMP, dst, src, reply)
+}
+
+// sendIPv4 queues an IPv4 packet for the guest.
+func (s *Stack) sendIPv4(proto uint8, src, dst ipv4, payload []byte) {
+	s.mu.Lock()
+	mac := s.guestMAC
+	s.ipID++
+	id := s.ipID
+	s.mu.Unlock()
+
+	if dst == broadcastIP {
+		mac = broadcastMAC
+	}
+
+	frame := make([]byte, ethHdrLen+ipv4HdrLen+len(payload))
+	copy(frame[0:6], mac)
+	copy(frame[6:12], GatewayMAC)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+
+	ip := frame[ethHdrLen:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipv4HdrLen+len(payload)))
+	binary.BigEndian.PutUint16(ip[4:6], id)
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], src[:])
+	copy(ip[16:20], dst[:])
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip[:ipv4HdrLen], 0))
+
+	copy(ip[ipv4HdrLen:], payload)
+
+	s.enqueue(frame)
+}
+
+// checksum is the internet checksum of p, on top of a partial sum.
+func checksum(p []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(p); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(p[i:]))
+	}
+
+	if len(p)%2 == 1 {
+		sum += uint32(p[len(p)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum is the partial checksum of the IPv4 pseudo header of
+// TCP and UDP.
+func pseudoHeaderSum(src, dst ipv4, proto uint8, l int) uint32 {
+	return uint32(binary.BigEndian.Uint16(src[0:2])) + uint32(binary.BigEndian.Uint16(src[2:4])) +
+		uint32(binary.BigEndian.Uint16(dst[0:2])) + uint32(binary.BigEndian.Uint16(dst[2:4])) +
+		uint32(proto) + uint32(l)
+}
+
+// allocPort returns a free port of the gateway for a flow from the host.
+func (s *Stack) allocPort() uint16 {
+	s.nextPort++
+	if s.nextPort == 0 {
+		s.nextPort = 49152
+	}
+
+	return s.nextPort
+}
+
+func (s *Stack) timer() {
+	t := time.NewTicker(tickInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			s.tickTCP(now)
+			s.tickUDP(now)
+		}
+	}
+}
+
+// Close stops the port forwards and drops all connections.
+func (s *Stack) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+
+	tcps := make([]*tcpConn, 0, len(s.tcp))
+	for _, c := range s.tcp {
+		tcps = append(tcps, c)
+	}
+
+	udps := make([]*udpConn, 0, len(s.udp))
+	for _, c := range s.udp {
+		udps = append(udps, c)
+	}
+	s.mu.Unlock()
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+
+	for _, p := range s.packets {
+		p.Close()
+	}
+
+	for _, c := range tcps {
+		c.abort(false)
+	}
+
+	for _, c := range udps {
+		c.conn.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,438 @@
+package usernet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/usernet"
+)
+
+var guestMAC = []byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// guest plays the part of the guest on the other end of a Stack.
+type guest struct {
+	t  *testing.T
+	s  *usernet.Stack
+	rx chan struct{}
+}
+
+func newGuest(t *testing.T, fwds []usernet.HostFwd) *guest {
+	t.Helper()
+
+	s, err := usernet.New(fwds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	g := &guest{t: t, s: s, rx: make(chan struct{}, 1)}
+
+	s.SetRxNotifier(func() {
+		select {
+		case g.rx <- struct{}{}:
+		default:
+		}
+	})
+
+	return g
+}
+
+func (g *guest) send(etherType uint16, payload []byte) {
+	g.t.Helper()
+
+	frame := append(append([]byte{}, usernet.GatewayMAC...), guestMAC...)
+	frame = binary.BigEndian.AppendUint16(frame, etherType)
+
+	if _, err := g.s.Write(append(frame, payload...)); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+func (g *guest) sendIPv4(proto uint8, src, dst [4]byte, payload []byte) {
+	g.t.Helper()
+
+	ip := make([]byte, 20, 20+len(payload))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(payload)))
+	ip[8] = 64
+	ip[9] = proto
+	copy(ip[12:16], src[:])
+	copy(ip[16:20], dst[:])
+
+	g.send(0x0800, append(ip, payload...))
+}
+
+// recv returns the next frame for the guest.
+func (g *guest) recv() []byte {
+	g.t.Helper()
+
+	buf := make([]byte, 2048)
+	timeout := time.After(5 * time.Second)
+
+	for {
+		n, err := g.s.Read(buf)
+		if err == nil {
+			return buf[:n]
+		}
+
+		if !errors.Is(err, usernet.ErrNoPacket) {
+			g.t.Fatal(err)
+		}
+
+		select {
+		case <-g.rx:
+		case <-timeout:
+			g.t.Fatal("no frame for the guest")
+		}
+	}
+}
+
+// recvIPv4 returns the protocol and payload of the next IPv4 packet.
+func (g *guest) recvIPv4() (uint8, []byte) {
+	g.t.Helper()
+
+	for {
+		f := g.recv()
+		if binary.BigEndian.Uint16(f[12:14]) != 0x0800 {
+			continue
+		}
+
+		ip := f[14:]
+
+		return ip[9], ip[20:binary.BigEndian.Uint16(ip[2:4])]
+	}
+}
+
+type segment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            uint8
+	data             []byte
+}
+
+const (
+	fin = 0x01
+	syn = 0x02
+	rst = 0x04
+	psh = 0x08
+	ack = 0x10
+)
+
+func (g *guest) sendTCP(dst [4]byte, s segment) {
+	g.t.Helper()
+
+	p := make([]byte, 20, 20+len(s.data))
+	binary.BigEndian.PutUint16(p[0:2], s.srcPort)
+	binary.BigEndian.PutUint16(p[2:4], s.dstPort)
+	binary.BigEndian.PutUint32(p[4:8], s.seq)
+	binary.BigEndian.PutUint32(p[8:12], s.ack)
+	p[12] = 5 << 4
+	p[13] = s.flags
+	binary.BigEndian.PutUint16(p[14:16], 0xffff)
+
+	g.sendIPv4(6, usernet.GuestIP, dst, append(p, s.data...))
+}
+
+func (g *guest) recvTCP() segment {
+	g.t.Helper()
+
+	for {
+		proto, p := g.recvIPv4()
+		if proto != 6 {
+			continue
+		}
+
+		off := int(p[12]>>4) * 4
+
+		return segment{
+			srcPort: binary.BigEndian.Uint16(p[0:2]),
+			dstPort: binary.BigEndian.Uint16(p[2:4]),
+			seq:     binary.BigEndian.Uint32(p[4:8]),
+			ack:     binary.BigEndian.Uint32(p[8:12]),
+			flags:   p[13],
+			data:    p[off:],
+		}
+	}
+}
+
+func TestARP(t *testing.T) {
+	t.Parallel()
+
+	g := newGuest(t, nil)
+
+	req := []byte{0, 1, 8, 0, 6, 4, 0, 1}
+	req = append(req, guestMAC...)
+	req = append(req, usernet.GuestIP[:]...)
+	req = append(req, make([]byte, 6)...)
+	req = append(req, usernet.GatewayIP[:]...)
+
+	g.send(0x0806, req)
+
+	f := g.recv()
+	arp := f[14:]
+
+	if !bytes.Equal(usernet.GatewayMAC, arp[8:14]) {
+		t.Fatalf("expected: %v, actual: %v", usernet.GatewayMAC, arp[8:14])
+	}
+
+	if !bytes.Equal(guestMAC, f[0:6]) {
+		t.Fatalf("expected: %v, actual: %v", guestMAC, f[0:6])
+	}
+}
+
+func TestDHCP(t *testing.T) {
+	t.Parallel()
+
+	g := newGuest(t, nil)
+
+	bootp := make([]byte, 240)
+	bootp[0] = 1
+	bootp[1] = 1
+	bootp[2] = 6
+	copy(bootp[4:8], []byte{0xde, 0xad, 0xbe, 0xef})
+	copy(bootp[28:34], guestMAC)
+	binary.BigEndian.PutUint32(bootp[236:240], 0x63825363)
+	bootp = append(bootp, 53, 1, 1, 255)
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 68)
+	binary.BigEndian.PutUint16(udp[2:4], 67)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(bootp)))
+
+	g.sendIPv4(17, [4]byte{}, [4]byte{255, 255, 255, 255}, append(udp, bootp...))
+
+	proto, p := g.recvIPv4()
+	if proto != 17 || binary.BigEndian.Uint16(p[2:4]) != 68 {
+		t.Fatalf("no DHCP reply: %v", p)
+	}
+
+	offer := p[8:]
+
+	if !bytes.Equal([]byte{0xde, 0xad, 0xbe, 0xef}, offer[4:8]) {
+		t.Fatalf("xid expected: %v, actual: %v", []byte{0xde, 0xad, 0xbe, 0xef}, offer[4:8])
+	}
+
+	if !bytes.Equal(usernet.GuestIP[:], offer[16:20]) {
+		t.Fatalf("yiaddr expected: %v, actual: %v", usernet.GuestIP, offer[16:20])
+	}
+
+	// DHCPOFFER is the first option.
+	if !bytes.Equal([]byte{53, 1, 2}, offer[240:243]) {
+		t.Fatalf("expected: %v, actual: %v", []byte{53, 1, 2}, offer[240:243])
+	}
+}
+
+func TestUDP(t *testing.T) {
+	t.Parallel()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		_, _ = pc.WriteTo(bytes.ToUpper(buf[:n]), addr)
+	}()
+
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	g := newGuest(t, nil)
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 5000)
+	binary.BigEndian.PutUint16(udp[2:4], port)
+	binary.BigEndian.PutUint16(udp[4:6], 8+5)
+
+	// The gateway is the loopback of the host.
+	g.sendIPv4(17, usernet.GuestIP, usernet.GatewayIP, append(udp, []byte("hello")...))
+
+	proto, p := g.recvIPv4()
+	if proto != 17 {
+		t.Fatalf("expected: %v, actual: %v", 17, proto)
+	}
+
+	if binary.BigEndian.Uint16(p[0:2]) != port || binary.BigEndian.Uint16(p[2:4]) != 5000 {
+		t.Fatalf("unexpected ports %v", p[:4])
+	}
+
+	if !bytes.Equal([]byte("HELLO"), p[8:]) {
+		t.Fatalf("expected: %q, actual: %q", "HELLO", p[8:])
+	}
+}
+
+func TestTCP(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		_, _ = io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	g := newGuest(t, nil)
+
+	const iss = 1000
+
+	g.sendTCP(usernet.GatewayIP, segment{srcPort: 40000, dstPort: port, seq: iss, flags: syn})
+
+	s := g.recvTCP()
+	if s.flags != syn|ack || s.ack != iss+1 {
+		t.Fatalf("expected SYN-ACK for %v, actual: %+v", iss+1, s)
+	}
+
+	seq, rcv := uint32(iss+1), s.seq+1
+
+	g.sendTCP(usernet.GatewayIP, segment{srcPort: 40000, dstPort: port, seq: seq, ack: rcv, flags: ack})
+	g.sendTCP(usernet.GatewayIP, segment{
+		srcPort: 40000, dstPort: port, seq: seq, ack: rcv, flags: ack | psh, data: []byte("hello"),
+	})
+
+	seq += 5
+	echo := []byte{}
+
+	for len(echo) < 5 {
+		s = g.recvTCP()
+		if s.flags&rst != 0 {
+			t.Fatalf("reset: %+v", s)
+		}
+
+		if len(s.data) > 0 {
+			echo = append(echo, s.data...)
+			rcv = s.seq + uint32(len(s.data))
+			g.sendTCP(usernet.GatewayIP, segment{srcPort: 40000, dstPort: port, seq: seq, ack: rcv, flags: ack})
+		}
+	}
+
+	if !bytes.Equal([]byte("hello"), echo) {
+		t.Fatalf("expected: %q, actual: %q", "hello", echo)
+	}
+
+	// Closing our side makes the echo server close too.
+	g.sendTCP(usernet.GatewayIP, segment{srcPort: 40000, dstPort: port, seq: seq, ack: rcv, flags: fin | ack})
+
+	for s.flags&fin == 0 {
+		s = g.recvTCP()
+	}
+
+	if s.ack != seq+1 {
+		t.Fatalf("FIN is not acknowledged: %+v", s)
+	}
+}
+
+func TestHostFwd(t *testing.T) {
+	t.Parallel()
+
+	// Find a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	f, err := usernet.ParseHostFwd("tcp:127.0.0.1:" + strconv.Itoa(port) + "-:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGuest(t, []usernet.HostFwd{f})
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := g.recvTCP()
+	if s.flags != syn || s.dstPort != 22 {
+		t.Fatalf("expected SYN to port 22, actual: %+v", s)
+	}
+
+	const iss = 5000
+
+	peer := s.srcPort
+	g.sendTCP(usernet.GatewayIP, segment{srcPort: 22, dstPort: peer, seq: iss, ack: s.seq + 1, flags: syn | ack})
+
+	s = g.recvTCP()
+	if s.flags != ack || s.ack != iss+1 {
+		t.Fatalf("expected ACK, actual: %+v", s)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	s = g.recvTCP()
+	if !bytes.Equal([]byte("ping"), s.data) {
+		t.Fatalf("expected: %q, actual: %+v", "ping", s)
+	}
+
+	g.sendTCP(usernet.GatewayIP, segment{
+		srcPort: 22, dstPort: peer, seq: iss + 1, ack: s.seq + 4, flags: ack | psh, data: []byte("pong"),
+	})
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte("pong"), buf) {
+		t.Fatalf("expected: %q, actual: %q", "pong", buf)
+	}
+}
+
+func TestParseHostFwd(t *testing.T) { // nolint:paralleltest
+	for _, tt := range []struct {
+		s   string
+		f   usernet.HostFwd
+		err error
+	}{
+		{s: "tcp::2222-:22", f: usernet.HostFwd{Proto: "tcp", HostPort: 2222, GuestPort: 22}},
+		{s: "::2222-:22", f: usernet.HostFwd{Proto: "tcp", HostPort: 2222, GuestPort: 22}},
+		{
+			s: "udp:127.0.0.1:5353-10.0.2.15:53",
+			f: usernet.HostFwd{Proto: "udp", HostAddr: "127.0.0.1", HostPort: 5353, GuestPort: 53},
+		},
+		{s: "tcp::2222", err: usernet.ErrInvalidHostFwd},
+		{s: "sctp::1-:1", err: usernet.ErrInvalidHostFwd},
+		{s: "tcp::2222-10.0.2.16:22", err: usernet.ErrInvalidHostFwd},
+		{s: "tcp::x-:22", err: usernet.ErrInvalidHostFwd},
+	} {
+		f, err := usernet.ParseHostFwd(tt.s)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.s, err, tt.err)
+
+			continue
+		}
+
+		if err == nil && f != tt.f {
+			t.Errorf("%s: got %+v, want %+v", tt.s, f, tt.f)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package vhost drives the vhost devices of Linux, which run the data path
+// of virtio devices in the kernel: /dev/vhost-net reads and writes the
+// virtqueues of a guest straight from and to a tap.
+//
+// refs https://github.com/torvalds/linux/blob/master/include/uapi/linux/vhost.h
+package vhost
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// The ioctls of vhost have their own type, so they are built here rather
+// than with the helpers of package kvm.
+const (
+	vhostVirtio = 0xAF
+
+	iocWrite = 1
+	iocRead  = 2
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | vhostVirtio<<8 | nr
+}
+
+var (
+	vhostGetFeatures   = ioc(iocRead, 0x00, 8)
+	vhostSetFeatures   = ioc(iocWrite, 0x00, 8)
+	vhostSetOwner      = ioc(0, 0x01, 0)
+	vhostSetMemTable   = ioc(iocWrite, 0x03, 8)
+	vhostSetVringNum   = ioc(iocWrite, 0x10, unsafe.Sizeof(vringState{}))
+	vhostSetVringAddr  = ioc(iocWrite, 0x11, unsafe.Sizeof(vringAddr{}))
+	vhostSetVringBase  = ioc(iocWrite, 0x12, unsafe.Sizeof(vringState{}))
+	vhostSetVringKick  = ioc(iocWrite, 0x20, unsafe.Sizeof(vringFile{}))
+	vhostSetVringCall  = ioc(iocWrite, 0x21, unsafe.Sizeof(vringFile{}))
+	vhostNetSetBackend = ioc(iocWrite, 0x30, unsafe.Sizeof(vringFile{}))
+)
+
+type vringState struct {
+	Index uint32
+	Num   uint32
+}
+
+type vringAddr struct {
+	Index uint32
+	Flags uint32
+	Desc  uint64
+	Used  uint64
+	Avail uint64
+	Log   uint64
+}
+
+type vringFile struct {
+	Index uint32
+	FD    int32
+}
+
+// MemoryRegion maps guest physical memory to the address space of gokvm.
+type MemoryRegion struct {
+	GuestPhysAddr uint64
+	MemorySize    uint64
+	UserspaceAddr uint64
+	_             uint64 // flags_padding
+}
+
+// Vring is a virtqueue, given by the addresses of its parts in the address
+// space of gokvm. Kick is signalled by the guest when it adds buffers,
+// and the device signals Call when it has used them.
+type Vring struct {
+	Index int
+	Num   int
+	Desc  uintptr
+	Avail uintptr
+	Used  uintptr
+	Kick  int
+	Call  int
+}
+
+// Dev is an open vhost device.
+type Dev struct {
+	fd int
+}
+
+func ioctl(fd int, op, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), op, arg); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Open opens a vhost device such as /dev/vhost-net and makes gokvm its
+// owner.
+func Open(path string) (*Dev, error) {
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	d := &Dev{fd: fd}
+
+	if err := ioctl(fd, vhostSetOwner, 0); err != nil {
+		d.Close()
+
+		return nil, fmt.Errorf("VHOST_SET_OWNER: %w", err)
+	}
+
+	return d, nil
+}
+
+// OpenNet opens /dev/vhost-net.
+func OpenNet() (*Dev, error) {
+	return Open("/dev/vhost-net")
+}
+
+// Features returns the virtio features the device supports.
+func (d *Dev) Features() (uint64, error) {
+	var f uint64
+
+	if err := ioctl(d.fd, vhostGetFeatures, uintptr(unsafe.Pointer(&f))); err != nil {
+		return 0, fmt.Errorf("VHOST_GET_FEATURES: %w", err)
+	}
+
+	return f, nil
+}
+
+// SetFeatures sets the features negotiated with the guest.
+func (d *Dev) SetFeatures(f uint64) error {
+	if err := ioctl(d.fd, vhostSetFeatures, uintptr(unsafe.Pointer(&f))); err != nil {
+		return fmt.Errorf("VHOST_SET_FEATURES: %w", err)
+	}
+
+	return nil
+}
+
+// SetMemTable tells the device where the memory of the guest is.
+func (d *Dev) SetMemTable(regions []MemoryRegion) error {
+	// struct vhost_memory is a header of the number of regions followed
+	// by the regions.
+	hdrSize := int(unsafe.Sizeof(uint64(0)))
+	buf := make([]byte, hdrSize+len(regions)*int(unsafe.Sizeof(MemoryRegion{})))
+
+	*(*uint32)(unsafe.Pointer(&buf[0])) = uint32(len(regions))
+
+	for i, r := range regions {
+		*(*MemoryRegion)(unsafe.Pointer(&buf[hdrSize+i*int(unsafe.Sizeof(r))])) = r
+	}
+
+	if err := ioctl(d.fd, vhostSetMemTable, uintptr(unsafe.Pointer(&buf[0]))); err != nil {
+		return fmt.Errorf("VHOST_SET_MEM_TABLE: %w", err)
+	}
+
+	return nil
+}
+
+// SetVring hands a virtqueue to the device. The device starts at the
+// beginning of the available ring.
+func (d *Dev) SetVring(v Vring) error {
+	state := vringState{Index: uint32(v.Index), Num: uint32(v.Num)}
+	if err := ioctl(d.fd, vhostSetVringNum, uintptr(unsafe.Pointer(&state))); err != nil {
+		return fmt.Errorf("VHOST_SET_VRING_NUM: %w", err)
+	}
+
+	state.Num = 0
+	if err := ioctl(d.fd, vhostSetVringBase, uintptr(unsafe.Pointer(&state))); err != nil {
+		return fmt.Errorf("VHOST_SET_VRING_BASE: %w", err)
+	}
+
+	addr := vringAddr{
+		Index: uint32(v.Index),
+		Desc:  uint64(v.Desc),
+		Avail: uint64(v.Avail),
+		Used:  uint64(v.Used),
+	}
+	if err := ioctl(d.fd, vhostSetVringAddr, uintptr(unsafe.Pointer(&addr))); err != nil {
+		return fmt.Errorf("VHOST_SET_VRING_ADDR: %w", err)
+	}
+
+	kick := vringFile{Index: uint32(v.Index), FD: int32(v.Kick)}
+	if err := ioctl(d.fd, vhostSetVringKick, uintptr(unsafe.Pointer(&kick))); err != nil {
+		return fmt.Errorf("VHOST_SET_VRING_KICK: %w", err)
+	}
+
+	call := vringFile{Index: uint32(v.Index), FD: int32(v.Call)}
+	if err := ioctl(d.fd, vhostSetVringCall, uintptr(unsafe.Pointer(&call))); err != nil {
+		return fmt.Errorf("VHOST_SET_VRING_CALL: %w", err)
+	}
+
+	return nil
+}
+
+// SetNetBackend attaches the tap fd to a virtqueue of vhost-net. An fd of
+// -1 detaches it.
+func (d *Dev) SetNetBackend(index, fd int) error {
+	f := vringFile{Index: uint32(index), FD: int32(fd)}
+	if err := ioctl(d.fd, vhostNetSetBackend, uintptr(unsafe.Pointer(&f))); err != nil {
+		return fmt.Errorf("VHOST_NET_SET_BACKEND: %w", err)
+	}
+
+	return nil
+}
+
+func (d *Dev) Close() error {
+	return syscall.Close(d.fd)
+}
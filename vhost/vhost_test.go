@@ -0,0 +1,37 @@
+package vhost_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/vhost"
+)
+
+func TestOpenNet(t *testing.T) {
+	t.Parallel()
+
+	d, err := vhost.OpenNet()
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		t.Skipf("vhost-net is not available: %v", err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Close()
+
+	f, err := d.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f == 0 {
+		t.Fatalf("expected: non-zero features, actual: %#x", f)
+	}
+
+	if err := d.SetMemTable(nil); err != nil {
+		t.Fatal(err)
+	}
+}
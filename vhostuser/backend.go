@@ -0,0 +1,645 @@
+package vhostuser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/unixsock"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrNoSuchQueue   = errors.New("no such vhost-user queue")
+	ErrBadAddress    = errors.New("address is not in the memory table")
+	ErrBadDescriptor = errors.New("invalid descriptor chain")
+)
+
+const (
+	descFlagNext  = 0x1
+	descFlagWrite = 0x2
+
+	descSize = 16
+)
+
+// Device is what a Backend emulates.
+type Device interface {
+	// Features returns the virtio features of the device.
+	Features() uint64
+	// Queues returns the number of virtqueues.
+	Queues() int
+	// Config returns the config space of the device.
+	Config() []byte
+	// Kick is called when the driver has added buffers to q, when q
+	// starts, and after q.Wake. Calls for one queue do not overlap, and
+	// its chains must not be used after the call returns.
+	Kick(q *Queue)
+}
+
+// Backend serves a Device to a vhost-user frontend such as gokvm.
+type Backend struct {
+	dev Device
+}
+
+func NewBackend(dev Device) *Backend {
+	return &Backend{dev: dev}
+}
+
+// ListenAndServe listens on a UNIX socket at path and serves the device to
+// one frontend after another.
+func (b *Backend) ListenAndServe(path string) error {
+	unixsock.RemoveStale(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	defer l.Close()
+
+	return b.Serve(l)
+}
+
+// Serve serves the device to the frontends connecting to l, one at a time.
+func (b *Backend) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		uc, ok := c.(*net.UnixConn)
+		if !ok {
+			c.Close()
+
+			continue
+		}
+
+		if err := b.ServeConn(uc); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("vhost-user: %v", err)
+		}
+	}
+}
+
+// ServeConn serves the device to the frontend on c until it hangs up.
+func (b *Backend) ServeConn(c *net.UnixConn) error {
+	s := &session{dev: b.dev, conn: c}
+
+	for i := 0; i < b.dev.Queues(); i++ {
+		s.queues = append(s.queues, &Queue{
+			Index: i,
+			s:     s,
+			call:  -1,
+			wake:  make(chan struct{}, 1),
+		})
+	}
+
+	defer s.close()
+
+	for {
+		m, err := recv(c)
+		if err != nil {
+			return err
+		}
+
+		reply, err := s.handle(m)
+		m.closeFDs()
+
+		if m.flags&flagNeedReply != 0 && s.protocol&protocolReplyAck != 0 && reply == nil {
+			status := uint64(0)
+			if err != nil {
+				log.Printf("vhost-user: request %d: %v", m.req, err)
+
+				status = 1
+			}
+
+			reply, err = u64(status), nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("request %d: %w", m.req, err)
+		}
+
+		if reply != nil {
+			if err := send(c, &message{req: m.req, flags: flagReply, payload: reply}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// region is a part of the memory of the guest, mapped by the backend.
+type region struct {
+	gpa  uint64
+	uva  uint64
+	data []byte
+	// mapping starts at offset 0 of the fd, before data.
+	mapping []byte
+}
+
+// session is the state of the device shared with one frontend.
+type session struct {
+	dev  Device
+	conn *net.UnixConn
+
+	features uint64
+	protocol uint64
+
+	mu      sync.RWMutex
+	regions []region
+
+	queues []*Queue
+}
+
+// handle carries out a request, and returns the payload of its reply if it
+// has one.
+func (s *session) handle(m *message) ([]byte, error) {
+	switch m.req {
+	case reqGetFeatures:
+		return u64(s.dev.Features() | FeatureProtocolFeatures), nil
+	case reqSetFeatures:
+		f, err := m.u64()
+		s.features = f
+
+		return nil, err
+	case reqSetOwner:
+		return nil, nil
+	case reqGetProtocolFeatures:
+		return u64(protocolMQ | protocolReplyAck | protocolConfig), nil
+	case reqSetProtocolFeatures:
+		p, err := m.u64()
+		s.protocol = p
+
+		return nil, err
+	case reqGetQueueNum:
+		return u64(uint64(s.dev.Queues())), nil
+	case reqSetMemTable:
+		return nil, s.setMemTable(m)
+	case reqGetConfig:
+		return s.config(m)
+	}
+
+	return s.handleVring(m)
+}
+
+func (s *session) handleVring(m *message) ([]byte, error) {
+	if len(m.payload) < 8 {
+		return nil, fmt.Errorf("%w: request %d", ErrShortMessage, m.req)
+	}
+
+	// Every request on a vring starts with its index, in the low byte
+	// of the u64 of SET_VRING_KICK and SET_VRING_CALL.
+	index := binary.LittleEndian.Uint32(m.payload)
+	if m.req == reqSetVringKick || m.req == reqSetVringCall {
+		index &= 0xff
+	}
+
+	if int(index) >= len(s.queues) {
+		return nil, fmt.Errorf("%w: %d", ErrNoSuchQueue, index)
+	}
+
+	q := s.queues[index]
+	num := binary.LittleEndian.Uint32(m.payload[4:])
+
+	switch m.req {
+	case reqSetVringNum:
+		q.num = uint16(num)
+	case reqSetVringBase:
+		q.lastAvail = uint16(num)
+		q.usedIdx = uint16(num)
+	case reqGetVringBase:
+		q.stop()
+
+		return vringState(index, uint32(q.lastAvail)), nil
+	case reqSetVringAddr:
+		if len(m.payload) < 40 {
+			return nil, fmt.Errorf("%w: vring address", ErrShortMessage)
+		}
+
+		q.descAddr = binary.LittleEndian.Uint64(m.payload[8:])
+		q.usedAddr = binary.LittleEndian.Uint64(m.payload[16:])
+		q.availAddr = binary.LittleEndian.Uint64(m.payload[24:])
+	case reqSetVringKick:
+		fd, err := takeFD(m)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := q.setKick(fd); err != nil {
+			return nil, err
+		}
+
+		// Without protocol features, the queue is enabled by its kick.
+		if s.features&FeatureProtocolFeatures == 0 {
+			q.enabled = true
+		}
+
+		return nil, q.start()
+	case reqSetVringCall:
+		fd, err := takeFD(m)
+		if err != nil {
+			return nil, err
+		}
+
+		q.setCall(fd)
+	case reqSetVringEnable:
+		q.enabled = num == 1
+		if !q.enabled {
+			q.stop()
+
+			return nil, nil
+		}
+
+		return nil, q.start()
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnexpectedType, m.req)
+	}
+
+	return nil, nil
+}
+
+// takeFD takes the fd of SET_VRING_KICK or SET_VRING_CALL, -1 if there is
+// none.
+func takeFD(m *message) (int, error) {
+	v, err := m.u64()
+	if err != nil {
+		return -1, err
+	}
+
+	if v&vringNoFD != 0 || len(m.fds) == 0 {
+		return -1, nil
+	}
+
+	fd := m.fds[0]
+	m.fds = m.fds[1:]
+
+	return fd, nil
+}
+
+func (s *session) setMemTable(m *message) error {
+	if len(m.payload) < 8 {
+		return fmt.Errorf("%w: memory table", ErrShortMessage)
+	}
+
+	n := int(binary.LittleEndian.Uint32(m.payload))
+	if n != len(m.fds) || len(m.payload) < 8+n*memoryRegionSize {
+		return fmt.Errorf("%w: memory table of %d regions", ErrShortMessage, n)
+	}
+
+	regions := make([]region, 0, n)
+
+	for i := 0; i < n; i++ {
+		p := m.payload[8+i*memoryRegionSize:]
+		size := binary.LittleEndian.Uint64(p[8:])
+		offset := binary.LittleEndian.Uint64(p[24:])
+
+		mapping, err := unix.Mmap(m.fds[i], 0, int(offset+size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			unmap(regions)
+
+			return fmt.Errorf("mmap: %w", err)
+		}
+
+		regions = append(regions, region{
+			gpa:     binary.LittleEndian.Uint64(p[0:]),
+			uva:     binary.LittleEndian.Uint64(p[16:]),
+			data:    mapping[offset:],
+			mapping: mapping,
+		})
+	}
+
+	// The running queues are moved to the new mappings.
+	running := []*Queue{}
+
+	for _, q := range s.queues {
+		if q.running {
+			running = append(running, q)
+			q.stop()
+		}
+	}
+
+	s.mu.Lock()
+	old := s.regions
+	s.regions = regions
+	s.mu.Unlock()
+
+	unmap(old)
+
+	for _, q := range running {
+		if err := q.start(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unmap(regions []region) {
+	for _, r := range regions {
+		_ = unix.Munmap(r.mapping)
+	}
+}
+
+func (s *session) config(m *message) ([]byte, error) {
+	if len(m.payload) < 12 {
+		return nil, fmt.Errorf("%w: config", ErrShortMessage)
+	}
+
+	offset := binary.LittleEndian.Uint32(m.payload[0:])
+	size := binary.LittleEndian.Uint32(m.payload[4:])
+	reply := make([]byte, 12+size)
+	copy(reply, m.payload[:12])
+
+	if c := s.dev.Config(); int(offset) < len(c) {
+		copy(reply[12:], c[offset:])
+	}
+
+	return reply, nil
+}
+
+// translate returns l bytes of the memory at addr, a guest physical address
+// or, with uva, an address of the frontend.
+func (s *session) translate(addr, l uint64, uva bool) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.regions {
+		base := r.gpa
+		if uva {
+			base = r.uva
+		}
+
+		if addr >= base && addr-base+l <= uint64(len(r.data)) {
+			return r.data[addr-base : addr-base+l : addr-base+l], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %#x", ErrBadAddress, addr)
+}
+
+func (s *session) close() {
+	for _, q := range s.queues {
+		q.stop()
+		_ = q.setKick(-1)
+		q.setCall(-1)
+	}
+
+	s.mu.Lock()
+	unmap(s.regions)
+	s.regions = nil
+	s.mu.Unlock()
+}
+
+// Queue is a virtqueue of a Device, in the split layout.
+type Queue struct {
+	Index int
+	s     *session
+
+	mu        sync.Mutex
+	num       uint16
+	descAddr  uint64
+	availAddr uint64
+	usedAddr  uint64
+	desc      []byte
+	avail     []byte
+	used      []byte
+	lastAvail uint16
+	usedIdx   uint16
+	enabled   bool
+
+	kick    *os.File
+	running bool
+	stopped chan struct{}
+	wake    chan struct{}
+	call    int
+}
+
+// Chain is a descriptor chain taken from the available ring. Out are the
+// buffers the driver filled, the device fills In.
+type Chain struct {
+	Head uint16
+	Out  [][]byte
+	In   [][]byte
+}
+
+// Features returns the features negotiated with the frontend.
+func (q *Queue) Features() uint64 {
+	return q.s.features
+}
+
+func (q *Queue) setKick(fd int) error {
+	q.stop()
+
+	if q.kick != nil {
+		q.kick.Close()
+		q.kick = nil
+	}
+
+	if fd < 0 {
+		return nil
+	}
+
+	// A non-blocking fd lets the runtime poll it, so that a deadline ends
+	// a pending read.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+
+		return err
+	}
+
+	q.kick = os.NewFile(uintptr(fd), "kick")
+
+	return nil
+}
+
+// start runs the queue once it is enabled and has a kick.
+func (q *Queue) start() error {
+	if !q.enabled || q.kick == nil || q.running {
+		return nil
+	}
+
+	if q.num == 0 || q.num&(q.num-1) != 0 {
+		return fmt.Errorf("%w: size %d", ErrBadDescriptor, q.num)
+	}
+
+	var err error
+
+	q.mu.Lock()
+	q.desc, err = q.s.translate(q.descAddr, uint64(q.num)*descSize, true)
+
+	if err == nil {
+		q.avail, err = q.s.translate(q.availAddr, 4+2*uint64(q.num), true)
+	}
+
+	if err == nil {
+		q.used, err = q.s.translate(q.usedAddr, 4+8*uint64(q.num), true)
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	q.running = true
+	q.stopped = make(chan struct{})
+
+	go q.run()
+
+	return nil
+}
+
+// run calls the device for the queue until it is stopped. Only this
+// goroutine touches the rings, so the memory stays mapped while it does.
+func (q *Queue) run() {
+	defer close(q.stopped)
+
+	kicks := make(chan struct{}, 1)
+
+	go func() {
+		defer close(kicks)
+
+		buf := make([]byte, 8)
+
+		for {
+			if _, err := q.kick.Read(buf); err != nil {
+				return
+			}
+
+			select {
+			case kicks <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	for {
+		q.s.dev.Kick(q)
+
+		select {
+		case _, ok := <-kicks:
+			if !ok {
+				return
+			}
+		case <-q.wake:
+		}
+	}
+}
+
+// Wake makes the device look at the queue again, e.g. when it has packets
+// for the buffers of an rx queue.
+func (q *Queue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop waits until the device is done with the queue.
+func (q *Queue) stop() {
+	if !q.running {
+		return
+	}
+
+	_ = q.kick.SetReadDeadline(time.Now())
+	<-q.stopped
+	_ = q.kick.SetReadDeadline(time.Time{})
+	q.running = false
+
+	q.mu.Lock()
+	q.desc, q.avail, q.used = nil, nil, nil
+	q.mu.Unlock()
+}
+
+func (q *Queue) setCall(fd int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.call >= 0 {
+		unix.Close(q.call)
+	}
+
+	q.call = fd
+}
+
+// Next takes the next chain from the available ring.
+func (q *Queue) Next() (*Chain, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.avail == nil {
+		return nil, ErrNoSuchQueue
+	}
+
+	// flags and idx of the available ring are read at once.
+	idx := uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&q.avail[0]))) >> 16)
+	if idx == q.lastAvail {
+		return nil, io.EOF
+	}
+
+	head := binary.LittleEndian.Uint16(q.avail[4+2*(q.lastAvail%q.num):])
+	q.lastAvail++
+
+	c := &Chain{Head: head}
+
+	for i, id := 0, head; ; i++ {
+		if i >= int(q.num) || id >= q.num {
+			return nil, ErrBadDescriptor
+		}
+
+		d := q.desc[int(id)*descSize:]
+		addr := binary.LittleEndian.Uint64(d[0:])
+		l := binary.LittleEndian.Uint32(d[8:])
+		flags := binary.LittleEndian.Uint16(d[12:])
+
+		b, err := q.s.translate(addr, uint64(l), false)
+		if err != nil {
+			return nil, err
+		}
+
+		if flags&descFlagWrite != 0 {
+			c.In = append(c.In, b)
+		} else {
+			c.Out = append(c.Out, b)
+		}
+
+		if flags&descFlagNext == 0 {
+			break
+		}
+
+		id = binary.LittleEndian.Uint16(d[14:])
+	}
+
+	return c, nil
+}
+
+// Done puts a chain into the used ring with the number of bytes written to
+// it, and interrupts the guest.
+func (q *Queue) Done(c *Chain, written uint32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.used == nil {
+		return
+	}
+
+	e := q.used[4+8*int(q.usedIdx%q.num):]
+	binary.LittleEndian.PutUint32(e[0:], uint32(c.Head))
+	binary.LittleEndian.PutUint32(e[4:], written)
+	q.usedIdx++
+
+	// The entry must be visible before the index, which is written with
+	// the flags of the used ring, always 0.
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&q.used[0])), uint32(q.usedIdx)<<16)
+
+	if q.call >= 0 {
+		_, _ = unix.Write(q.call, u64(1))
+	}
+}
@@ -0,0 +1,245 @@
+package vhostuser
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/block"
+)
+
+const (
+	blkTypeIn    = 0
+	blkTypeOut   = 1
+	blkTypeFlush = 4
+
+	blkStatusOK     = 0
+	blkStatusIOErr  = 1
+	blkStatusUnsupp = 2
+
+	blkFeatureFlush = 1 << 9
+	blkFeatureMQ    = 1 << 12
+
+	sectorSize = 512
+
+	// Size of struct virtio_blk_req before the data.
+	blkReqSize = 16
+
+	// Size of struct virtio_net_hdr. VIRTIO_NET_F_MRG_RXBUF is not offered,
+	// so it never has num_buffers.
+	netHdrSize = 10
+)
+
+// BlkDevice is a virtio-blk device on a block.Backend, with synchronous I/O.
+type BlkDevice struct {
+	disk   block.Backend
+	queues int
+}
+
+func NewBlkDevice(disk block.Backend, queues int) *BlkDevice {
+	if queues < 1 {
+		queues = 1
+	}
+
+	return &BlkDevice{disk: disk, queues: queues}
+}
+
+func (d *BlkDevice) Features() uint64 {
+	return blkFeatureFlush | blkFeatureMQ
+}
+
+func (d *BlkDevice) Queues() int {
+	return d.queues
+}
+
+// Config returns struct virtio_blk_config up to num_queues.
+func (d *BlkDevice) Config() []byte {
+	c := make([]byte, 36)
+	binary.LittleEndian.PutUint64(c[0:], d.disk.Size()/sectorSize)
+	binary.LittleEndian.PutUint16(c[34:], uint16(d.queues))
+
+	return c
+}
+
+func (d *BlkDevice) Kick(q *Queue) {
+	for {
+		c, err := q.Next()
+		if err != nil {
+			return
+		}
+
+		q.Done(c, d.handle(q, c))
+	}
+}
+
+// handle serves a request, which is struct virtio_blk_req spread over the
+// buffers of c: the header and the data to write are in Out, the data to
+// read and the status byte in In.
+func (d *BlkDevice) handle(q *Queue, c *Chain) uint32 {
+	out := concat(c.Out)
+	in := c.In
+
+	if len(in) == 0 || len(in[len(in)-1]) == 0 {
+		return 0
+	}
+
+	last := in[len(in)-1]
+	status := &last[len(last)-1]
+	in[len(in)-1] = last[:len(last)-1]
+
+	if len(out) < blkReqSize {
+		*status = blkStatusIOErr
+
+		return 1
+	}
+
+	off := int64(binary.LittleEndian.Uint64(out[8:]) * sectorSize)
+	written := uint32(1)
+
+	var err error
+
+	switch binary.LittleEndian.Uint32(out) {
+	case blkTypeIn:
+		for _, b := range in {
+			if _, err = d.disk.ReadAt(b, off); err != nil {
+				break
+			}
+
+			off += int64(len(b))
+			written += uint32(len(b))
+		}
+	case blkTypeOut:
+		if _, err = d.disk.WriteAt(out[blkReqSize:], off); err == nil && q.Features()&blkFeatureFlush == 0 {
+			err = d.disk.Sync()
+		}
+	case blkTypeFlush:
+		err = d.disk.Sync()
+	default:
+		*status = blkStatusUnsupp
+
+		return written
+	}
+
+	*status = blkStatusOK
+	if err != nil {
+		*status = blkStatusIOErr
+	}
+
+	return written
+}
+
+func concat(bufs [][]byte) []byte {
+	if len(bufs) == 1 {
+		return bufs[0]
+	}
+
+	b := []byte{}
+	for _, buf := range bufs {
+		b = append(b, buf...)
+	}
+
+	return b
+}
+
+// NetDevice is a virtio-net device with a single queue pair whose frames go
+// to and come from rw, e.g. a netsock.Conn to a switch. Reads of rw must
+// not block; if it has a SetRxNotifier, it is called when frames arrive.
+type NetDevice struct {
+	rw io.ReadWriter
+
+	mu      sync.Mutex
+	rx      *Queue
+	buf     []byte
+	pending []byte
+}
+
+func NewNetDevice(rw io.ReadWriter) *NetDevice {
+	d := &NetDevice{rw: rw, buf: make([]byte, 0x10000)}
+
+	if n, ok := rw.(interface{ SetRxNotifier(f func()) }); ok {
+		n.SetRxNotifier(d.wakeRx)
+	}
+
+	return d
+}
+
+func (d *NetDevice) Features() uint64 {
+	return 0
+}
+
+func (d *NetDevice) Queues() int {
+	return 2
+}
+
+func (d *NetDevice) Config() []byte {
+	return nil
+}
+
+func (d *NetDevice) wakeRx() {
+	d.mu.Lock()
+	rx := d.rx
+	d.mu.Unlock()
+
+	if rx != nil {
+		rx.Wake()
+	}
+}
+
+func (d *NetDevice) Kick(q *Queue) {
+	if q.Index == 0 {
+		d.receive(q)
+
+		return
+	}
+
+	for {
+		c, err := q.Next()
+		if err != nil {
+			return
+		}
+
+		if frame := concat(c.Out); len(frame) > netHdrSize {
+			_, _ = d.rw.Write(frame[netHdrSize:])
+		}
+
+		q.Done(c, 0)
+	}
+}
+
+// receive fills the rx buffers of the guest with frames of rw. A frame
+// which finds no buffer waits for the next kick.
+func (d *NetDevice) receive(q *Queue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rx = q
+
+	for {
+		if d.pending == nil {
+			n, err := d.rw.Read(d.buf[netHdrSize:])
+			if err != nil || n <= 0 {
+				return
+			}
+
+			for i := 0; i < netHdrSize; i++ {
+				d.buf[i] = 0
+			}
+
+			d.pending = d.buf[:netHdrSize+n]
+		}
+
+		c, err := q.Next()
+		if err != nil {
+			return
+		}
+
+		written := 0
+		for _, b := range c.In {
+			written += copy(b, d.pending[written:])
+		}
+
+		d.pending = nil
+
+		q.Done(c, uint32(written))
+	}
+}
@@ -0,0 +1,265 @@
+package vhostuser
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/vhost"
+)
+
+// Frontend is the connection of gokvm to a vhost-user backend, the
+// "master" of the protocol. It mirrors vhost.Dev, with messages instead of
+// ioctls.
+type Frontend struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+
+	features  uint64
+	protocol  uint64
+	queueNum  int
+	hasConfig bool
+}
+
+// Dial connects to the backend listening on path and negotiates the
+// protocol features with it.
+func Dial(path string) (*Frontend, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Frontend{conn: conn}
+
+	if err := f.init(); err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return f, nil
+}
+
+func (f *Frontend) init() error {
+	var err error
+
+	if f.features, err = f.getU64(reqGetFeatures); err != nil {
+		return err
+	}
+
+	if f.features&FeatureProtocolFeatures != 0 {
+		p, err := f.getU64(reqGetProtocolFeatures)
+		if err != nil {
+			return err
+		}
+
+		f.protocol = p & (protocolMQ | protocolReplyAck | protocolConfig)
+
+		if err := f.set(reqSetProtocolFeatures, u64(f.protocol), nil); err != nil {
+			return err
+		}
+	}
+
+	f.queueNum = 1
+
+	if f.protocol&protocolMQ != 0 {
+		n, err := f.getU64(reqGetQueueNum)
+		if err != nil {
+			return err
+		}
+
+		f.queueNum = int(n)
+	}
+
+	f.hasConfig = f.protocol&protocolConfig != 0
+
+	return f.set(reqSetOwner, nil, nil)
+}
+
+// call sends a request and waits for its reply.
+func (f *Frontend) call(req uint32, payload []byte) (*message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := send(f.conn, &message{req: req, payload: payload}); err != nil {
+		return nil, err
+	}
+
+	m, err := recv(f.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	m.closeFDs()
+
+	if m.req != req || m.flags&flagReply == 0 {
+		return nil, fmt.Errorf("%w: %d to request %d", ErrUnexpectedType, m.req, req)
+	}
+
+	return m, nil
+}
+
+func (f *Frontend) getU64(req uint32) (uint64, error) {
+	m, err := f.call(req, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.u64()
+}
+
+// set sends a request without a reply. If the backend supports
+// VHOST_USER_PROTOCOL_F_REPLY_ACK, it is asked whether the request
+// succeeded.
+func (f *Frontend) set(req uint32, payload []byte, fds []int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m := &message{req: req, payload: payload, fds: fds}
+
+	ack := f.protocol&protocolReplyAck != 0
+	if ack {
+		m.flags |= flagNeedReply
+	}
+
+	if err := send(f.conn, m); err != nil {
+		return err
+	}
+
+	if !ack {
+		return nil
+	}
+
+	r, err := recv(f.conn)
+	if err != nil {
+		return err
+	}
+
+	r.closeFDs()
+
+	if r.req != req || r.flags&flagReply == 0 {
+		return fmt.Errorf("%w: %d to request %d", ErrUnexpectedType, r.req, req)
+	}
+
+	if v, err := r.u64(); err != nil || v != 0 {
+		return fmt.Errorf("%w: request %d", ErrNack, req)
+	}
+
+	return nil
+}
+
+// Features returns the virtio features of the device.
+func (f *Frontend) Features() uint64 {
+	return f.features &^ FeatureProtocolFeatures
+}
+
+// QueueNum returns the number of queues the backend supports, as the
+// device counts them, e.g. queue pairs for net.
+func (f *Frontend) QueueNum() int {
+	return f.queueNum
+}
+
+// SetFeatures sets the features negotiated with the guest.
+func (f *Frontend) SetFeatures(features uint64) error {
+	features &= f.Features()
+	if f.features&FeatureProtocolFeatures != 0 {
+		features |= FeatureProtocolFeatures
+	}
+
+	return f.set(reqSetFeatures, u64(features), nil)
+}
+
+// SetMemTable shares the memory of the guest with the backend, which maps
+// the fds of the regions.
+func (f *Frontend) SetMemTable(regions []MemoryRegion) error {
+	if len(regions) > maxFDs {
+		return ErrTooManyFDs
+	}
+
+	// struct vhost_user_memory is the number of regions, padding and the
+	// regions.
+	b := make([]byte, 8+len(regions)*memoryRegionSize)
+	binary.LittleEndian.PutUint32(b, uint32(len(regions)))
+
+	fds := make([]int, len(regions))
+
+	for i, r := range regions {
+		p := b[8+i*memoryRegionSize:]
+		binary.LittleEndian.PutUint64(p[0:], r.GuestPhysAddr)
+		binary.LittleEndian.PutUint64(p[8:], r.MemorySize)
+		binary.LittleEndian.PutUint64(p[16:], r.UserspaceAddr)
+		binary.LittleEndian.PutUint64(p[24:], r.MmapOffset)
+		fds[i] = r.FD
+	}
+
+	return f.set(reqSetMemTable, b, fds)
+}
+
+// SetVring hands a virtqueue to the backend, which starts at the beginning
+// of the available ring.
+func (f *Frontend) SetVring(v vhost.Vring) error {
+	index := uint32(v.Index)
+
+	if err := f.set(reqSetVringNum, vringState(index, uint32(v.Num)), nil); err != nil {
+		return err
+	}
+
+	if err := f.set(reqSetVringBase, vringState(index, 0), nil); err != nil {
+		return err
+	}
+
+	// struct vhost_vring_addr
+	addr := make([]byte, 40)
+	binary.LittleEndian.PutUint32(addr[0:], index)
+	binary.LittleEndian.PutUint64(addr[8:], uint64(v.Desc))
+	binary.LittleEndian.PutUint64(addr[16:], uint64(v.Used))
+	binary.LittleEndian.PutUint64(addr[24:], uint64(v.Avail))
+
+	if err := f.set(reqSetVringAddr, addr, nil); err != nil {
+		return err
+	}
+
+	if err := f.set(reqSetVringCall, u64(uint64(index)), []int{v.Call}); err != nil {
+		return err
+	}
+
+	// The backend starts the queue once it has the kick.
+	if err := f.set(reqSetVringKick, u64(uint64(index)), []int{v.Kick}); err != nil {
+		return err
+	}
+
+	// With protocol features, queues start out disabled.
+	if f.features&FeatureProtocolFeatures != 0 {
+		return f.set(reqSetVringEnable, vringState(index, 1), nil)
+	}
+
+	return nil
+}
+
+// Config reads size bytes of the config space of the device, such as
+// struct virtio_blk_config, from offset.
+func (f *Frontend) Config(offset, size uint32) ([]byte, error) {
+	if !f.hasConfig {
+		return nil, ErrNoConfig
+	}
+
+	b := make([]byte, 12+size)
+	binary.LittleEndian.PutUint32(b[0:], offset)
+	binary.LittleEndian.PutUint32(b[4:], size)
+
+	m, err := f.call(reqGetConfig, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.payload) < len(b) {
+		return nil, fmt.Errorf("%w: config", ErrShortMessage)
+	}
+
+	return m.payload[12:], nil
+}
+
+func (f *Frontend) Close() error {
+	return f.conn.Close()
+}
@@ -0,0 +1,230 @@
+// Package vhostuser runs virtio devices in other processes with the
+// vhost-user protocol: the Frontend in gokvm shares the memory of the guest
+// with a backend over a UNIX socket, and tells it where the virtqueues are
+// and which eventfds the guest kicks and the backend calls. Backend is a
+// simple implementation of the other side, with the devices in devices.go.
+//
+// refs https://qemu.readthedocs.io/en/latest/interop/vhost-user.html
+package vhostuser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrShortMessage   = errors.New("vhost-user message is too short")
+	ErrUnexpectedType = errors.New("unexpected vhost-user reply")
+	ErrNoConfig       = errors.New("vhost-user backend does not share its config")
+	ErrNack           = errors.New("vhost-user backend failed the request")
+	ErrTooManyFDs     = errors.New("too many fds in a vhost-user message")
+)
+
+// Requests from the frontend to the backend.
+const (
+	reqGetFeatures         = 1
+	reqSetFeatures         = 2
+	reqSetOwner            = 3
+	reqSetMemTable         = 5
+	reqSetVringNum         = 8
+	reqSetVringAddr        = 9
+	reqSetVringBase        = 10
+	reqGetVringBase        = 11
+	reqSetVringKick        = 12
+	reqSetVringCall        = 13
+	reqGetProtocolFeatures = 15
+	reqSetProtocolFeatures = 16
+	reqGetQueueNum         = 17
+	reqSetVringEnable      = 18
+	reqGetConfig           = 24
+)
+
+const (
+	hdrSize = 12
+
+	flagVersion   = 0x1
+	flagReply     = 0x4
+	flagNeedReply = 0x8
+
+	// VHOST_USER_F_PROTOCOL_FEATURES, a feature of the backend which the
+	// guest never sees.
+	FeatureProtocolFeatures = 1 << 30
+
+	protocolMQ       = 1 << 0
+	protocolReplyAck = 1 << 3
+	protocolConfig   = 1 << 9
+
+	// The file descriptor of SET_VRING_KICK and SET_VRING_CALL is absent.
+	vringNoFD = 1 << 8
+
+	// A message carries at most one fd per memory region.
+	maxFDs = 8
+
+	// Payloads beyond this are bogus, the largest is a memory table.
+	maxPayloadSize = 0x1000
+)
+
+// message is a vhost-user message. The fds travel as SCM_RIGHTS.
+type message struct {
+	req     uint32
+	flags   uint32
+	payload []byte
+	fds     []int
+}
+
+func send(c *net.UnixConn, m *message) error {
+	b := make([]byte, hdrSize+len(m.payload))
+	binary.LittleEndian.PutUint32(b[0:], m.req)
+	binary.LittleEndian.PutUint32(b[4:], m.flags|flagVersion)
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(m.payload)))
+	copy(b[hdrSize:], m.payload)
+
+	var oob []byte
+	if len(m.fds) > 0 {
+		oob = unix.UnixRights(m.fds...)
+	}
+
+	if _, _, err := c.WriteMsgUnix(b, oob, nil); err != nil {
+		return fmt.Errorf("vhost-user: %w", err)
+	}
+
+	return nil
+}
+
+func recv(c *net.UnixConn) (*message, error) {
+	hdr := make([]byte, hdrSize)
+	oob := make([]byte, unix.CmsgSpace(maxFDs*4))
+
+	// The fds come with the first byte of the message.
+	n, oobn, _, _, err := c.ReadMsgUnix(hdr, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	fds, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	m := &message{fds: fds}
+
+	if err := readFull(c, hdr[n:]); err != nil {
+		m.closeFDs()
+
+		return nil, err
+	}
+
+	m.req = binary.LittleEndian.Uint32(hdr[0:])
+	m.flags = binary.LittleEndian.Uint32(hdr[4:])
+
+	size := binary.LittleEndian.Uint32(hdr[8:])
+	if size > maxPayloadSize {
+		m.closeFDs()
+
+		return nil, fmt.Errorf("%w: payload of %d bytes", ErrShortMessage, size)
+	}
+
+	m.payload = make([]byte, size)
+	if err := readFull(c, m.payload); err != nil {
+		m.closeFDs()
+
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func readFull(c *net.UnixConn, b []byte) error {
+	for len(b) > 0 {
+		n, err := c.Read(b)
+		if err != nil {
+			return err
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+
+	scms, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	fds := []int{}
+
+	for _, scm := range scms {
+		f, err := unix.ParseUnixRights(&scm)
+		if err != nil {
+			return nil, err
+		}
+
+		fds = append(fds, f...)
+	}
+
+	if len(fds) > maxFDs {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+
+		return nil, ErrTooManyFDs
+	}
+
+	return fds, nil
+}
+
+func (m *message) closeFDs() {
+	for _, fd := range m.fds {
+		unix.Close(fd)
+	}
+
+	m.fds = nil
+}
+
+// u64 returns the payload of the requests which take a single number.
+func (m *message) u64() (uint64, error) {
+	if len(m.payload) < 8 {
+		return 0, fmt.Errorf("%w: request %d", ErrShortMessage, m.req)
+	}
+
+	return binary.LittleEndian.Uint64(m.payload), nil
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+
+	return b
+}
+
+// vringState is struct vhost_vring_state.
+func vringState(index, num uint32) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b[0:], index)
+	binary.LittleEndian.PutUint32(b[4:], num)
+
+	return b
+}
+
+// MemoryRegion is a part of the memory of the guest, shared as an fd.
+// UserspaceAddr is where gokvm mapped it, the addresses of the virtqueues
+// are given in this address space.
+type MemoryRegion struct {
+	GuestPhysAddr uint64
+	MemorySize    uint64
+	UserspaceAddr uint64
+	MmapOffset    uint64
+	FD            int
+}
+
+const memoryRegionSize = 32
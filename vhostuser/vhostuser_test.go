@@ -0,0 +1,334 @@
+package vhostuser_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/block"
+	"github.com/bobuhiro11/gokvm/vhost"
+	"github.com/bobuhiro11/gokvm/vhostuser"
+	"github.com/bobuhiro11/gokvm/virtio"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	memSize = 1 << 20
+
+	descFlagNext  = 0x1
+	descFlagWrite = 0x2
+)
+
+// guest is the memory of a guest shared with a backend, as gokvm does.
+type guest struct {
+	fd  int
+	mem []byte
+	f   *vhostuser.Frontend
+}
+
+func newGuest(t *testing.T, dev vhostuser.Device) *guest {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "vhost-user.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() { _ = vhostuser.NewBackend(dev).Serve(l) }()
+
+	g := &guest{}
+
+	if g.fd, err = unix.MemfdCreate("guest", unix.MFD_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Ftruncate(g.fd, memSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.mem, err = unix.Mmap(g.fd, 0, memSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.f, err = vhostuser.Dial(path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		g.f.Close()
+		unix.Munmap(g.mem)
+		unix.Close(g.fd)
+	})
+
+	return g
+}
+
+// queue is a virtqueue in the memory of the guest, at 64 KiB * (index+1).
+type queue struct {
+	vq         *virtio.VirtQueue
+	kick, call int
+}
+
+func (g *guest) setVring(t *testing.T, index int) *queue {
+	t.Helper()
+
+	q := &queue{vq: (*virtio.VirtQueue)(unsafe.Pointer(&g.mem[0x10000*(index+1)]))}
+
+	var err error
+
+	if q.kick, err = unix.Eventfd(0, unix.EFD_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.call, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		unix.Close(q.kick)
+		unix.Close(q.call)
+	})
+
+	err = g.f.SetVring(vhost.Vring{
+		Index: index,
+		Num:   virtio.QueueSize,
+		Desc:  uintptr(unsafe.Pointer(&q.vq.DescTable)),
+		Avail: uintptr(unsafe.Pointer(&q.vq.AvailRing)),
+		Used:  uintptr(unsafe.Pointer(&q.vq.UsedRing)),
+		Kick:  q.kick,
+		Call:  q.call,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func (g *guest) setMemTable(t *testing.T) {
+	t.Helper()
+
+	err := g.f.SetMemTable([]vhostuser.MemoryRegion{{
+		GuestPhysAddr: 0,
+		MemorySize:    memSize,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&g.mem[0]))),
+		FD:            g.fd,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// add makes a chain of buffers at the given guest addresses available,
+// starting at descriptor 0.
+func (q *queue) add(bufs []uint64, lens []uint32, flags []uint16) {
+	for i := range bufs {
+		d := &q.vq.DescTable[i]
+		d.Addr, d.Len, d.Flags = bufs[i], lens[i], flags[i]
+
+		if i+1 < len(bufs) {
+			d.Flags |= descFlagNext
+			d.Next = uint16(i + 1)
+		}
+	}
+
+	a := &q.vq.AvailRing
+	a.Ring[a.Idx%virtio.QueueSize] = 0
+	a.Idx++
+
+	_, _ = unix.Write(q.kick, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+}
+
+// wait waits for the backend to call the guest.
+func (q *queue) wait(t *testing.T) {
+	t.Helper()
+
+	buf := make([]byte, 8)
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if _, err := unix.Read(q.call, buf); err == nil {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("the backend did not call")
+}
+
+func TestBlk(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := block.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer disk.Close()
+
+	g := newGuest(t, vhostuser.NewBlkDevice(disk, 2))
+
+	if n := g.f.QueueNum(); n != 2 {
+		t.Fatalf("expected: %d, actual: %d", 2, n)
+	}
+
+	c, err := g.f.Config(0, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if capacity := *(*uint64)(unsafe.Pointer(&c[0])); capacity != 2048 {
+		t.Fatalf("expected: %d, actual: %d", 2048, capacity)
+	}
+
+	// VIRTIO_BLK_F_FLUSH
+	if err := g.f.SetFeatures(1 << 9); err != nil {
+		t.Fatal(err)
+	}
+
+	g.setMemTable(t)
+	q := g.setVring(t, 0)
+
+	// Write sector 1 with 0xab: the header, the data and the status.
+	copy(g.mem[0x80000:], []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0})
+	copy(g.mem[0x81000:], bytes.Repeat([]byte{0xab}, 512))
+	g.mem[0x82000] = 0xff
+
+	q.add([]uint64{0x80000, 0x81000, 0x82000}, []uint32{16, 512, 1}, []uint16{0, 0, descFlagWrite})
+	q.wait(t)
+
+	if g.mem[0x82000] != 0 {
+		t.Fatalf("expected: %d, actual: %d", 0, g.mem[0x82000])
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data[512:1024], g.mem[0x81000:0x81200]) {
+		t.Fatalf("expected: %v, actual: %v", g.mem[0x81000:0x81200], data[512:1024])
+	}
+
+	// Read it back.
+	copy(g.mem[0x80000:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0})
+	g.mem[0x82000] = 0xff
+
+	q.add([]uint64{0x80000, 0x83000, 0x82000}, []uint32{16, 512, 1}, []uint16{0, descFlagWrite, descFlagWrite})
+	q.wait(t)
+
+	if g.mem[0x82000] != 0 || !bytes.Equal(g.mem[0x83000:0x83200], data[512:1024]) {
+		t.Fatalf("expected: %v, actual: %v", data[512:1024], g.mem[0x83000:0x83200])
+	}
+
+	if idx := q.vq.UsedRing.Idx; idx != 2 {
+		t.Fatalf("expected: %d, actual: %d", 2, idx)
+	}
+
+	if l := q.vq.UsedRing.Ring[1].Len; l != 513 {
+		t.Fatalf("expected: %d, actual: %d", 513, l)
+	}
+}
+
+type mockNet struct {
+	mu      sync.Mutex
+	written [][]byte
+	toRead  [][]byte
+	notify  func()
+}
+
+func (m *mockNet) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.written = append(m.written, append([]byte(nil), p...))
+
+	return len(p), nil
+}
+
+func (m *mockNet) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.toRead) == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	n := copy(p, m.toRead[0])
+	m.toRead = m.toRead[1:]
+
+	return n, nil
+}
+
+func (m *mockNet) SetRxNotifier(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.notify = f
+}
+
+func (m *mockNet) receive(frame []byte) {
+	m.mu.Lock()
+	m.toRead = append(m.toRead, frame)
+	notify := m.notify
+	m.mu.Unlock()
+
+	notify()
+}
+
+func TestNet(t *testing.T) {
+	t.Parallel()
+
+	m := &mockNet{}
+	g := newGuest(t, vhostuser.NewNetDevice(m))
+
+	if err := g.f.SetFeatures(0); err != nil {
+		t.Fatal(err)
+	}
+
+	g.setMemTable(t)
+	rx := g.setVring(t, 0)
+	tx := g.setVring(t, 1)
+
+	// A frame from the guest, after its struct virtio_net_hdr.
+	frame := []byte("\x02\x00\x00\x00\x00\x01\x02\x00\x00\x00\x00\x02\x08\x00hello")
+	copy(g.mem[0x80000+10:], frame)
+
+	tx.add([]uint64{0x80000}, []uint32{uint32(10 + len(frame))}, []uint16{0})
+	tx.wait(t)
+
+	m.mu.Lock()
+	written := m.written
+	m.mu.Unlock()
+
+	if len(written) != 1 || !bytes.Equal(written[0], frame) {
+		t.Fatalf("expected: %v, actual: %v", [][]byte{frame}, written)
+	}
+
+	// A frame for the guest waits for a buffer.
+	rx.add([]uint64{0x90000}, []uint32{2048}, []uint16{descFlagWrite})
+	m.receive(frame)
+	rx.wait(t)
+
+	if l := rx.vq.UsedRing.Ring[0].Len; l != uint32(10+len(frame)) {
+		t.Fatalf("expected: %d, actual: %d", 10+len(frame), l)
+	}
+
+	if !bytes.Equal(g.mem[0x90000+10:0x90000+10+len(frame)], frame) {
+		t.Fatalf("expected: %v, actual: %v", frame, g.mem[0x90000+10:0x90000+10+len(frame)])
+	}
+}
@@ -0,0 +1,443 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+var ErrNoBalloonStats = errors.New("the guest sent no memory statistics")
+
+const (
+	BalloonIOPortStart = 0x6700
+	BalloonIOPortSize  = 0x100
+
+	// BalloonPageSize is the unit of the balloon, whatever the page size
+	// of the guest.
+	BalloonPageSize = 4096
+
+	// refs https://github.com/torvalds/linux/blob/master/include/uapi/linux/virtio_balloon.h
+	balloonFeatureStatsVQ      = 1 << 1
+	balloonFeatureDeflateOnOOM = 1 << 2
+	balloonFeatureReporting    = 1 << 5
+
+	// The size of struct virtio_balloon_stat.
+	balloonStatSize = 10
+
+	// The ISR bit of a change of the configuration.
+	isrConfig = 0x2
+)
+
+// The queues of the balloon. The statsq and the reporting_vq only exist
+// with their features, and the queues which follow move up.
+const (
+	balloonInflate = iota
+	balloonDeflate
+	balloonStats
+	balloonReporting
+)
+
+// BalloonStats are the memory statistics of the guest, in bytes.
+type BalloonStats struct {
+	SwapIn      uint64
+	SwapOut     uint64
+	MajorFaults uint64
+	MinorFaults uint64
+	Free        uint64
+	Total       uint64
+	Available   uint64
+	Caches      uint64
+
+	// Updated is when the guest sent them.
+	Updated time.Time
+}
+
+type balloonHdr struct {
+	commonHeader  commonHeader
+	balloonHeader balloonHeader
+}
+
+type balloonHeader struct {
+	numPages uint32
+	actual   uint32
+}
+
+func (h balloonHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Balloon is a virtio-balloon device. The pages the guest gives up, either
+// to inflate the balloon or as free page reports, are passed to discard,
+// which returns their memory to the host.
+type Balloon struct {
+	Hdr balloonHdr
+
+	VirtQueue    [4]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [4]uint16
+
+	discard     func(addr, size uint64) error
+	kick        chan struct{}
+	featuresSet bool
+
+	// mu guards the configuration and the statistics. The buffer of
+	// the statistics is kept until they are asked for again.
+	mu        sync.Mutex
+	stats     BalloonStats
+	statsHead uint16
+	statsHeld bool
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Balloon) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1002,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 5, // Memory Balloon
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			BalloonIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Balloon) Read(port uint64, bytes []byte) error {
+	offset := int(port - BalloonIOPortStart)
+
+	v.mu.Lock()
+	b, err := v.Hdr.Bytes()
+	v.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if offset+len(bytes) > len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:offset+len(bytes)])
+
+	return nil
+}
+
+func (v *Balloon) Write(port uint64, bytes []byte) error {
+	offset := int(port - BalloonIOPortStart)
+
+	switch offset {
+	case 4:
+		v.featuresSet = true
+	case 24:
+		// actual, the number of pages in the balloon.
+		v.mu.Lock()
+		v.Hdr.balloonHeader.actual = uint32(pci.BytesToNum(bytes))
+		v.mu.Unlock()
+
+		return nil
+	}
+
+	return v.Hdr.commonHeader.write(offset, bytes, v.VirtQueue[:v.queues()], v.Mem, v.notify)
+}
+
+func (v *Balloon) notify(int) error {
+	v.mu.Lock()
+	v.Hdr.commonHeader.isr = 0x0
+	v.mu.Unlock()
+
+	kick(v.kick)
+
+	return nil
+}
+
+// queue returns the index of a queue, or -1 if the guest did not take its
+// feature. The guest has yet to acknowledge the features while it selects
+// the queues, so those offered count then.
+func (v *Balloon) queue(role int) int {
+	features := v.Hdr.commonHeader.guestFeatures
+	if !v.featuresSet {
+		features = v.Hdr.commonHeader.hostFeatures
+	}
+
+	sel := role
+
+	if role >= balloonStats && features&balloonFeatureStatsVQ == 0 {
+		if role == balloonStats {
+			return -1
+		}
+
+		sel--
+	}
+
+	if role == balloonReporting && features&balloonFeatureReporting == 0 {
+		return -1
+	}
+
+	return sel
+}
+
+func (v *Balloon) queues() int {
+	n := 2
+
+	for _, role := range []int{balloonStats, balloonReporting} {
+		if v.queue(role) >= 0 {
+			n++
+		}
+	}
+
+	return n
+}
+
+// IOThreadEntry serves the queues of the guest and never returns.
+func (v *Balloon) IOThreadEntry() {
+	for range v.kick {
+		if err := v.IO(); err != nil {
+			log.Printf("virtio-balloon: %v", err)
+		}
+	}
+}
+
+// IO serves all queues of the guest.
+func (v *Balloon) IO() error {
+	used := false
+
+	for _, role := range []int{balloonInflate, balloonDeflate, balloonReporting} {
+		sel := v.queue(role)
+		if sel < 0 || v.VirtQueue[sel] == nil {
+			continue
+		}
+
+		for {
+			ok, err := v.serve(sel, role)
+			if err != nil {
+				log.Printf("virtio-balloon: discard: %v", err)
+			}
+
+			if !ok {
+				break
+			}
+
+			used = true
+		}
+	}
+
+	if sel := v.queue(balloonStats); sel >= 0 && v.VirtQueue[sel] != nil {
+		v.receiveStats(sel)
+	}
+
+	if !used {
+		return nil
+	}
+
+	return v.interrupt(0x1)
+}
+
+// serve takes the next chain of queue sel and returns whether there was
+// one, and whether its memory could not be discarded.
+func (v *Balloon) serve(sel, role int) (bool, error) {
+	vq := v.VirtQueue[sel]
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[sel] == availRing.Idx {
+		return false, nil
+	}
+
+	headDescID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+
+	// The guest gets its buffers back even if the memory stays with it.
+	var failed error
+
+	for descID := headDescID; ; {
+		desc := vq.DescTable[descID]
+		buf := v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+
+		switch role {
+		case balloonInflate:
+			// An array of the page frame numbers.
+			for i := 0; i+4 <= len(buf); i += 4 {
+				pfn := uint64(binary.LittleEndian.Uint32(buf[i:]))
+
+				if err := v.discard(pfn*BalloonPageSize, BalloonPageSize); err != nil {
+					failed = err
+				}
+			}
+		case balloonReporting:
+			// The buffers are the free pages themselves.
+			if err := v.discard(desc.Addr, uint64(desc.Len)); err != nil {
+				failed = err
+			}
+		case balloonDeflate:
+			// The pages come back on their own when the guest touches
+			// them.
+		}
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+	usedRing.Idx++
+	v.LastAvailIdx[sel]++
+
+	return true, failed
+}
+
+// receiveStats reads the statistics in the buffer of the guest, and keeps
+// the buffer for the next time.
+func (v *Balloon) receiveStats(sel int) {
+	vq := v.VirtQueue[sel]
+
+	if v.LastAvailIdx[sel] == vq.AvailRing.Idx {
+		return
+	}
+
+	head := vq.AvailRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+	v.LastAvailIdx[sel]++
+
+	desc := vq.DescTable[head]
+	buf := v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+
+	s := BalloonStats{Updated: time.Now()}
+	fields := []*uint64{
+		&s.SwapIn, &s.SwapOut, &s.MajorFaults, &s.MinorFaults,
+		&s.Free, &s.Total, &s.Available, &s.Caches,
+	}
+
+	for i := 0; i+balloonStatSize <= len(buf); i += balloonStatSize {
+		tag := binary.LittleEndian.Uint16(buf[i:])
+		val := binary.LittleEndian.Uint64(buf[i+2:])
+
+		if int(tag) < len(fields) {
+			*fields[tag] = val
+		}
+	}
+
+	v.mu.Lock()
+	v.stats = s
+	v.statsHead = head
+	v.statsHeld = true
+	v.mu.Unlock()
+}
+
+// interrupt sets bits of the ISR and interrupts the guest.
+func (v *Balloon) interrupt(isr uint8) error {
+	v.mu.Lock()
+	v.Hdr.commonHeader.isr |= isr
+	v.mu.Unlock()
+
+	return v.IRQInjector.InjectVirtioBalloonIRQ()
+}
+
+// SetTarget asks the guest to put pages into the balloon, or to take them
+// back.
+func (v *Balloon) SetTarget(pages uint32) error {
+	v.mu.Lock()
+	v.Hdr.balloonHeader.numPages = pages
+	v.mu.Unlock()
+
+	return v.interrupt(isrConfig)
+}
+
+// Target returns the number of pages the balloon should have, and the
+// number it has.
+func (v *Balloon) Target() (target, actual uint32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.balloonHeader.numPages, v.Hdr.balloonHeader.actual
+}
+
+// Stats returns the last statistics of the guest.
+func (v *Balloon) Stats() BalloonStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.stats
+}
+
+// UpdateStats asks the guest for new statistics and waits up to timeout
+// for them. It returns the last ones if the guest does not answer in time.
+func (v *Balloon) UpdateStats(timeout time.Duration) (BalloonStats, error) {
+	sel := v.queue(balloonStats)
+
+	v.mu.Lock()
+	last := v.stats.Updated
+	held := v.statsHeld
+
+	if held {
+		vq := v.VirtQueue[sel]
+		vq.UsedRing.Ring[vq.UsedRing.Idx%QueueSize].Idx = uint32(v.statsHead)
+		vq.UsedRing.Ring[vq.UsedRing.Idx%QueueSize].Len = 0
+		vq.UsedRing.Idx++
+		v.statsHeld = false
+	}
+	v.mu.Unlock()
+
+	if !held {
+		if last.IsZero() {
+			return BalloonStats{}, ErrNoBalloonStats
+		}
+
+		return v.Stats(), nil
+	}
+
+	if err := v.interrupt(0x1); err != nil {
+		return BalloonStats{}, err
+	}
+
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		if s := v.Stats(); s.Updated != last {
+			return s, nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return v.Stats(), nil
+}
+
+func (v *Balloon) IOPort() uint64 {
+	return BalloonIOPortStart
+}
+
+func (v *Balloon) Size() uint64 {
+	return BalloonIOPortSize
+}
+
+// NewBalloon creates a virtio-balloon device. discard returns the memory of
+// the guest at addr to the host.
+func NewBalloon(discard func(addr, size uint64) error, irq uint8, irqInjector IRQInjector, mem []byte) *Balloon {
+	return &Balloon{
+		Hdr: balloonHdr{
+			commonHeader: commonHeader{
+				hostFeatures: balloonFeatureStatsVQ | balloonFeatureDeflateOnOOM | balloonFeatureReporting,
+				queueNUM:     QueueSize,
+			},
+		},
+		Mem:         mem,
+		discard:     discard,
+		kick:        make(chan struct{}, 1),
+		irq:         irq,
+		IRQInjector: irqInjector,
+	}
+}
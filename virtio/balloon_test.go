@@ -0,0 +1,159 @@
+package virtio_test
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestBalloonInflate(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x100000)
+	discarded := [][2]uint64{}
+	discard := func(addr, size uint64) error {
+		discarded = append(discarded, [2]uint64{addr, size})
+
+		return nil
+	}
+	v := virtio.NewBalloon(discard, 7, &mockInjector{}, mem)
+
+	// The page frame numbers 0x10 and 0x20.
+	binary.LittleEndian.PutUint32(mem[0x1000:], 0x10)
+	binary.LittleEndian.PutUint32(mem[0x1004:], 0x20)
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x1000
+	vq.DescTable[0].Len = 8
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[0] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	expected := [][2]uint64{{0x10000, 0x1000}, {0x20000, 0x1000}}
+	if !reflect.DeepEqual(expected, discarded) {
+		t.Fatalf("expected: %v, actual: %v", expected, discarded)
+	}
+
+	if vq.UsedRing.Idx != 1 {
+		t.Fatalf("expected: %v, actual: %v", 1, vq.UsedRing.Idx)
+	}
+
+	if !v.IRQInjector.(*mockInjector).isCalled() {
+		t.Fatalf("irqInjected = false\n")
+	}
+}
+
+func TestBalloonTarget(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewBalloon(nil, 7, &mockInjector{}, []byte{})
+
+	if err := v.SetTarget(0x100); err != nil {
+		t.Fatal(err)
+	}
+
+	// num_pages, and the ISR tells of a change of the configuration.
+	b := make([]byte, 4)
+	_ = v.Read(virtio.BalloonIOPortStart+20, b)
+
+	if n := binary.LittleEndian.Uint32(b); n != 0x100 {
+		t.Fatalf("expected: %v, actual: %v", 0x100, n)
+	}
+
+	_ = v.Read(virtio.BalloonIOPortStart+19, b[:1])
+
+	if b[0]&0x2 == 0 {
+		t.Fatalf("expected: %v, actual: %v", 0x2, b[0])
+	}
+
+	// The guest reports what it did through actual.
+	_ = v.Write(virtio.BalloonIOPortStart+24, []byte{0x80, 0, 0, 0})
+
+	if target, actual := v.Target(); target != 0x100 || actual != 0x80 {
+		t.Fatalf("expected: %v, %v, actual: %v, %v", 0x100, 0x80, target, actual)
+	}
+}
+
+func TestBalloonStats(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x100000)
+	v := virtio.NewBalloon(nil, 7, &mockInjector{}, mem)
+
+	if _, err := v.UpdateStats(0); err == nil {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrNoBalloonStats, err)
+	}
+
+	// VIRTIO_BALLOON_S_MEMFREE and VIRTIO_BALLOON_S_MEMTOT.
+	stat := func(off int, tag uint16, val uint64) {
+		binary.LittleEndian.PutUint16(mem[off:], tag)
+		binary.LittleEndian.PutUint64(mem[off+2:], val)
+	}
+	stat(0x1000, 4, 1<<20)
+	stat(0x100a, 5, 1<<30)
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x1000
+	vq.DescTable[0].Len = 20
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[2] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// The buffer stays with the device until the next request.
+	if vq.UsedRing.Idx != 0 {
+		t.Fatalf("expected: %v, actual: %v", 0, vq.UsedRing.Idx)
+	}
+
+	s, err := v.UpdateStats(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Free != 1<<20 || s.Total != 1<<30 {
+		t.Fatalf("expected: %v, %v, actual: %v, %v", 1<<20, 1<<30, s.Free, s.Total)
+	}
+
+	if vq.UsedRing.Idx != 1 {
+		t.Fatalf("expected: %v, actual: %v", 1, vq.UsedRing.Idx)
+	}
+}
+
+func TestBalloonQueuesWithoutStats(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x100000)
+	discarded := uint64(0)
+	discard := func(addr, size uint64) error {
+		discarded += size
+
+		return nil
+	}
+	v := virtio.NewBalloon(discard, 7, &mockInjector{}, mem)
+
+	// Only VIRTIO_BALLOON_F_FREE_PAGE_REPORTING, the reporting_vq moves up.
+	_ = v.Write(virtio.BalloonIOPortStart+4, []byte{0x20, 0, 0, 0})
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x80000
+	vq.DescTable[0].Len = 0x40000
+	vq.DescTable[0].Flags = 0x2
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[2] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if discarded != 0x40000 {
+		t.Fatalf("expected: %v, actual: %v", 0x40000, discarded)
+	}
+}
@@ -3,10 +3,15 @@ package virtio
 import (
 	"bytes"
 	"encoding/binary"
-	"os"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/block"
 	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/ratelimit"
 )
 
 const (
@@ -14,17 +19,46 @@ const (
 	BlkIOPortSize  = 0x100
 
 	SectorSize = 512
+
+	blkTypeIn    = 0
+	blkTypeOut   = 1
+	blkTypeFlush = 4
+
+	blkStatusOK     = 0
+	blkStatusIOErr  = 1
+	blkStatusUnsupp = 2
+
+	// VIRTIO_BLK_F_FLUSH lets the guest decide when data must reach stable
+	// storage, instead of after every write.
+	blkFeatureFlush = 1 << 9
+	// VIRTIO_BLK_F_MQ, the number of request queues is in num_queues.
+	blkFeatureMQ = 1 << 12
 )
 
+var ErrNotSnapshot = errors.New("disk is not in snapshot mode")
+
 type Blk struct {
-	file *os.File
-	Hdr  blkHdr
+	disk     block.Backend
+	engine   block.Engine
+	throttle *ratelimit.Throttle
+	Hdr      blkHdr
 
-	VirtQueue    [1]*VirtQueue
+	// One entry per request queue, each served by its own I/O worker.
+	VirtQueue    []*VirtQueue
 	Mem          []byte
-	LastAvailIdx [1]uint16
+	LastAvailIdx []uint16
+
+	// usedMu serializes the completions into each used ring.
+	usedMu []sync.Mutex
 
-	kick chan interface{}
+	// kick wakes the worker of each queue. The notification of the guest
+	// never waits for it, so that a throttled disk only holds back its own
+	// requests and not the vCPU.
+	kick []chan struct{}
+
+	dataPath   DataPath
+	offloaded  atomic.Bool
+	driverOKed bool
 
 	irq         uint8
 	IRQInjector IRQInjector
@@ -45,11 +79,20 @@ func (h blkHdr) Bytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// blkHeader is struct virtio_blk_config, up to num_queues.
 type blkHeader struct {
-	capacity uint64
+	capacity  uint64
+	_         uint32 // size_max
+	_         uint32 // seg_max
+	_         uint32 // geometry
+	_         uint32 // blk_size
+	_         uint64 // topology
+	_         uint8  // writeback
+	_         uint8
+	numQueues uint16
 }
 
-func (v Blk) GetDeviceHeader() pci.DeviceHeader {
+func (v *Blk) GetDeviceHeader() pci.DeviceHeader {
 	return pci.DeviceHeader{
 		DeviceID:    0x1001,
 		VendorID:    0x1AF4,
@@ -66,7 +109,7 @@ func (v Blk) GetDeviceHeader() pci.DeviceHeader {
 	}
 }
 
-func (v Blk) Read(port uint64, bytes []byte) error {
+func (v *Blk) Read(port uint64, bytes []byte) error {
 	offset := int(port - BlkIOPortStart)
 
 	b, err := v.Hdr.Bytes()
@@ -80,9 +123,18 @@ func (v Blk) Read(port uint64, bytes []byte) error {
 	return nil
 }
 
+// IOThreadEntry runs one I/O worker per queue and never returns.
 func (v *Blk) IOThreadEntry() {
-	for range v.kick {
-		for v.IO() == nil {
+	for sel := 1; sel < len(v.kick); sel++ {
+		go v.ioThread(uint16(sel))
+	}
+
+	v.ioThread(0)
+}
+
+func (v *Blk) ioThread(sel uint16) {
+	for range v.kick[sel] {
+		for v.IO(sel) == nil {
 		}
 	}
 }
@@ -93,11 +145,15 @@ type BlkReq struct {
 	Sector uint64
 }
 
-func (v *Blk) IO() error {
-	sel := uint16(0)
+// IO takes every request from the virt queue sel and hands it to the I/O
+// engine. The requests are completed asynchronously, in any order.
+func (v *Blk) IO(sel uint16) error {
 	// v.dumpDesc(sel)
+	if v.offloaded.Load() {
+		return ErrOffloaded
+	}
+
 	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
 
 	if v.LastAvailIdx[sel] == availRing.Idx {
 		return ErrNoTxPacket
@@ -105,72 +161,163 @@ func (v *Blk) IO() error {
 
 	for v.LastAvailIdx[sel] != availRing.Idx {
 		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+		v.LastAvailIdx[sel]++
 
-		// This structure is holding both the index of the descriptor chain and the
-		// number of bytes that were written to the memory as part of serving the request.
-		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
-		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
-
-		var buf [3][]byte
+		v.submit(sel, descID)
+	}
 
-		for i := 0; i < 3; i++ {
-			desc := v.VirtQueue[sel].DescTable[descID]
-			buf[i] = v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+	return nil
+}
 
-			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
-			descID = desc.Next
+func (v *Blk) submit(sel, headID uint16) {
+	var (
+		bufs  [3][]byte
+		total uint32
+	)
+
+	// buf[0] contains type, reserved, and sector fields.
+	// buf[1] contains raw io data.
+	// buf[2] contains a status field.
+	// A flush request has no data, so its status field comes second.
+	//
+	// refs https://wiki.osdev.org/Virtio#Block_Device_Packets
+	descID := headID
+	n := 3
+
+	for i := 0; i < n; i++ {
+		desc := v.VirtQueue[sel].DescTable[descID]
+		bufs[i] = v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+		total += desc.Len
+		descID = desc.Next
+
+		if i == 0 && (*BlkReq)(unsafe.Pointer(&bufs[0][0])).Type == blkTypeFlush {
+			n = 2
 		}
+	}
 
-		// buf[0] contains type, reserved, and sector fields.
-		// buf[1] contains raw io data.
-		// buf[2] contains a status field.
-		//
-		// refs https://wiki.osdev.org/Virtio#Block_Device_Packets
-		blkReq := *((*BlkReq)(unsafe.Pointer(&buf[0][0])))
-		data := buf[1]
-
-		var err error
-		if blkReq.Type&0x1 == 0x1 {
-			// write to file
-			_, err = v.file.WriteAt(data, int64(blkReq.Sector*SectorSize))
-		} else {
-			// read from file
-			_, err = v.file.ReadAt(data, int64(blkReq.Sector*SectorSize))
-		}
+	if n == 2 {
+		bufs[1], bufs[2] = nil, bufs[1]
+	}
+
+	blkReq := *((*BlkReq)(unsafe.Pointer(&bufs[0][0])))
+	status := bufs[2]
 
-		if err != nil {
-			return err
+	req := &block.Request{
+		Buf: bufs[1],
+		Off: int64(blkReq.Sector * SectorSize),
+	}
+
+	switch blkReq.Type {
+	case blkTypeIn:
+		req.Op = block.OpRead
+	case blkTypeOut:
+		req.Op = block.OpWrite
+	case blkTypeFlush:
+		req.Op = block.OpFlush
+	default:
+		if len(status) > 0 {
+			status[0] = blkStatusUnsupp
 		}
 
-		if err = v.file.Sync(); err != nil {
-			return err
+		v.complete(sel, headID, total)
+
+		return
+	}
+
+	req.Done = func(err error) {
+		// Without VIRTIO_BLK_F_FLUSH the guest expects writes to be on
+		// stable storage when they complete. Done runs on the engine, which
+		// must not wait for itself, so the flush is submitted from elsewhere.
+		if err == nil && req.Op == block.OpWrite && v.Hdr.commonHeader.guestFeatures&blkFeatureFlush == 0 {
+			go v.engine.Submit(&block.Request{
+				Op: block.OpFlush,
+				Done: func(err error) {
+					v.setStatus(status, err)
+					v.complete(sel, headID, total)
+				},
+			})
+
+			return
 		}
 
-		usedRing.Idx++
-		v.LastAvailIdx[sel]++
+		v.setStatus(status, err)
+		v.complete(sel, headID, total)
 	}
 
+	v.engine.Submit(req)
+}
+
+func (v *Blk) setStatus(status []byte, err error) {
+	if len(status) == 0 {
+		return
+	}
+
+	status[0] = blkStatusOK
+	if err != nil {
+		status[0] = blkStatusIOErr
+	}
+}
+
+// complete puts a finished request into the used ring and notifies the guest.
+// Every queue raises its own interrupt, but without MSI-X they all end up on
+// the same legacy line and the guest checks each used ring.
+func (v *Blk) complete(sel, descID uint16, l uint32) {
+	v.usedMu[sel].Lock()
+	usedRing := &v.VirtQueue[sel].UsedRing
+
+	// This structure is holding both the index of the descriptor chain and the
+	// number of bytes that were written to the memory as part of serving the request.
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = l
+	usedRing.Idx++
+
 	v.Hdr.commonHeader.isr = 0x1
+	v.usedMu[sel].Unlock()
+
 	if err := v.IRQInjector.InjectVirtioBlkIRQ(); err != nil {
-		return err
+		log.Printf("InjectVirtioBlkIRQ: %v", err)
 	}
-
-	return nil
 }
 
 func (v *Blk) Write(port uint64, bytes []byte) error {
 	offset := int(port - BlkIOPortStart)
 
 	switch offset {
+	case 4:
+		v.Hdr.commonHeader.guestFeatures = uint32(pci.BytesToNum(bytes))
 	case 8:
 		// Queue PFN is aligned to page (4096 bytes)
 		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
-		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		if int(v.Hdr.commonHeader.queueSEL) < len(v.VirtQueue) {
+			v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		}
 	case 14:
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+
+		// A size of zero tells the guest that the queue does not exist.
+		v.Hdr.commonHeader.queueNUM = 0
+		if int(v.Hdr.commonHeader.queueSEL) < len(v.VirtQueue) {
+			v.Hdr.commonHeader.queueNUM = QueueSize
+		}
 	case 16:
+		sel := int(pci.BytesToNum(bytes))
+		if sel >= len(v.kick) {
+			break
+		}
+
+		// With a data path, the ISR stays set for its interrupts, which
+		// do not go through gokvm.
+		if v.offloaded.Load() {
+			break
+		}
+
 		v.Hdr.commonHeader.isr = 0x0
-		v.kick <- true
+		kick(v.kick[sel])
+	case 18:
+		if bytes[0]&statusDriverOK != 0 && !v.driverOKed {
+			v.driverOKed = true
+			v.startDataPath()
+		}
 	case 19:
 	default:
 	}
@@ -178,45 +325,109 @@ func (v *Blk) Write(port uint64, bytes []byte) error {
 	return nil
 }
 
-func (v Blk) IOPort() uint64 {
+// SetDataPath hands the request queues to d once the guest driver is
+// ready. Features which d lacks are no longer offered to the guest.
+func (v *Blk) SetDataPath(d DataPath) {
+	v.Hdr.commonHeader.hostFeatures &= uint32(d.Features())
+	v.dataPath = d
+}
+
+// startDataPath hands the queues to the data path. If it fails, the
+// I/O workers of the Blk keep running them.
+func (v *Blk) startDataPath() {
+	if v.dataPath == nil {
+		return
+	}
+
+	if err := v.dataPath.Start(uint64(v.Hdr.commonHeader.guestFeatures), v.VirtQueue); err != nil {
+		log.Printf("virtio-blk: falling back to userspace: %v", err)
+
+		return
+	}
+
+	v.offloaded.Store(true)
+	v.Hdr.commonHeader.isr = 0x1
+}
+
+// Commit merges the writes buffered by a snapshot disk back into its image.
+func (v *Blk) Commit() error {
+	c, ok := v.disk.(block.Committer)
+	if !ok {
+		return ErrNotSnapshot
+	}
+
+	return c.Commit()
+}
+
+// SetLimits changes the I/O limits of the disk while the guest is running.
+func (v *Blk) SetLimits(l ratelimit.Limits) {
+	v.throttle.SetLimits(l)
+}
+
+func (v *Blk) Limits() ratelimit.Limits {
+	return v.throttle.Limits()
+}
+
+func (v *Blk) ThrottleStats() ratelimit.Stats {
+	return v.throttle.Stats()
+}
+
+func (v *Blk) IOPort() uint64 {
 	return BlkIOPortStart
 }
 
-func (v Blk) Size() uint64 {
+func (v *Blk) Size() uint64 {
 	return BlkIOPortSize
 }
 
-func NewBlk(path string, irq uint8, irqInjector IRQInjector, mem []byte) (*Blk, error) {
-	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+// NewBlk creates a virtio-blk device for the disk image at path with the
+// given number of request queues. The image format (raw or qcow2) is
+// detected from its header.
+func NewBlk(path string, queues int, irq uint8, irqInjector IRQInjector, mem []byte) (*Blk, error) {
+	disk, err := block.Open(path)
 	if err != nil {
 		return nil, err
 	}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, err
+	return NewBlkWithBackend(disk, queues, irq, irqInjector, mem), nil
+}
+
+// NewBlkWithBackend creates a virtio-blk device on top of an already opened
+// block.Backend.
+func NewBlkWithBackend(disk block.Backend, queues int, irq uint8, irqInjector IRQInjector, mem []byte) *Blk {
+	if queues < 1 {
+		queues = 1
 	}
 
-	fileSize := uint64(fileInfo.Size())
+	throttle := ratelimit.NewThrottle(ratelimit.Limits{})
 
 	res := &Blk{
 		Hdr: blkHdr{
 			commonHeader: commonHeader{
-				queueNUM: QueueSize,
-				isr:      0x0,
+				hostFeatures: blkFeatureFlush | blkFeatureMQ,
+				queueNUM:     QueueSize,
+				isr:          0x0,
 			},
 			blkHeader: blkHeader{
-				capacity: fileSize / SectorSize,
+				capacity:  disk.Size() / SectorSize,
+				numQueues: uint16(queues),
 			},
 		},
-		file:         file,
+		disk:         disk,
+		engine:       block.NewThrottledEngine(block.NewEngine(disk, QueueSize), throttle),
+		throttle:     throttle,
 		irq:          irq,
 		IRQInjector:  irqInjector,
-		kick:         make(chan interface{}),
+		kick:         make([]chan struct{}, queues),
 		Mem:          mem,
-		VirtQueue:    [1]*VirtQueue{},
-		LastAvailIdx: [1]uint16{0},
+		VirtQueue:    make([]*VirtQueue, queues),
+		LastAvailIdx: make([]uint16, queues),
+		usedMu:       make([]sync.Mutex, queues),
+	}
+
+	for i := range res.kick {
+		res.kick[i] = make(chan struct{}, 1)
 	}
 
-	return res, nil
+	return res
 }
@@ -2,17 +2,23 @@ package virtio_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/block"
+	"github.com/bobuhiro11/gokvm/ratelimit"
 	"github.com/bobuhiro11/gokvm/virtio"
 )
 
 func TestBlkGetDeviceHeader(t *testing.T) {
 	t.Parallel()
 
-	v, err := virtio.NewBlk("/dev/zero", 9, &mockInjector{}, []byte{})
+	v, err := virtio.NewBlk("/dev/zero", 1, 9, &mockInjector{}, []byte{})
 	if err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
@@ -28,7 +34,7 @@ func TestBlkGetDeviceHeader(t *testing.T) {
 func TestBlkGetIORange(t *testing.T) {
 	t.Parallel()
 
-	v, err := virtio.NewBlk("/dev/zero", 9, &mockInjector{}, []byte{})
+	v, err := virtio.NewBlk("/dev/zero", 1, 9, &mockInjector{}, []byte{})
 	if err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
@@ -44,7 +50,7 @@ func TestBlkGetIORange(t *testing.T) {
 func TestBlkIOInHandler(t *testing.T) {
 	t.Parallel()
 
-	v, err := virtio.NewBlk("/dev/zero", 9, &mockInjector{}, []byte{})
+	v, err := virtio.NewBlk("/dev/zero", 1, 9, &mockInjector{}, []byte{})
 	if err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
@@ -63,7 +69,7 @@ func TestIO(t *testing.T) {
 
 	mem := make([]byte, 0x1000000)
 
-	v, err := virtio.NewBlk("../vda.img", 10, &mockInjector{}, mem)
+	v, err := virtio.NewBlk("../vda.img", 1, 10, &mockInjector{}, mem)
 
 	if os.IsNotExist(err) {
 		t.Skipf("../vda.img does not exist, skipping this test")
@@ -93,13 +99,11 @@ func TestIO(t *testing.T) {
 
 	v.VirtQueue[0] = &vq
 
-	if err := v.IO(); err != nil {
+	if err := v.IO(0); err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
 
-	if !v.IRQInjector.(*mockInjector).called {
-		t.Fatalf("irqInjected = false\n")
-	}
+	v.IRQInjector.(*mockInjector).waitCalled(t)
 
 	expected := []byte{0x53, 0xef}
 	actual := mem[0x438:0x43a]
@@ -108,3 +112,230 @@ func TestIO(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+func TestIOWriteQCOW2(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := block.CreateQCOW2(path, 1<<20, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000000)
+
+	v, err := virtio.NewBlk(path, 1, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	expected := uint16(1 << 20 / virtio.SectorSize)
+	actual := make([]byte, 2)
+	_ = v.Read(virtio.BlkIOPortStart+20, actual)
+
+	if actual := binary.LittleEndian.Uint16(actual); actual != expected {
+		t.Fatalf("capacity expected: %v, actual: %v", expected, actual)
+	}
+
+	// Init virt queue
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+
+	// for blk request
+	vq.DescTable[0].Addr = 0
+	vq.DescTable[0].Len = 1
+	vq.DescTable[0].Next = 1
+
+	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
+	blkReq.Type = 1
+	blkReq.Sector = 3
+
+	// for data
+	vq.DescTable[1].Addr = 0x400
+	vq.DescTable[1].Len = 0x200
+	vq.DescTable[1].Next = 2
+
+	copy(mem[0x400:], []byte{0xca, 0xfe})
+
+	v.VirtQueue[0] = &vq
+
+	if err := v.IO(0); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	v.IRQInjector.(*mockInjector).waitCalled(t)
+
+	d, err := block.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	data := make([]byte, 2)
+	if _, err := d.ReadAt(data, 3*virtio.SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte{0xca, 0xfe}, data) {
+		t.Fatalf("expected: %v, actual: %v", []byte{0xca, 0xfe}, data)
+	}
+}
+
+func TestBlkMultiQueue(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000000)
+
+	v, err := virtio.NewBlk(path, 2, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// num_queues of struct virtio_blk_config
+	actual := make([]byte, 2)
+	_ = v.Read(virtio.BlkIOPortStart+20+34, actual)
+
+	if !bytes.Equal([]byte{0x02, 0x00}, actual) {
+		t.Fatalf("expected: %v, actual: %v", []byte{0x02, 0x00}, actual)
+	}
+
+	// The queue after the last one does not exist.
+	_ = v.Write(virtio.BlkIOPortStart+14, []byte{0x02, 0x00})
+	_ = v.Read(virtio.BlkIOPortStart+12, actual)
+
+	if !bytes.Equal([]byte{0x00, 0x00}, actual) {
+		t.Fatalf("expected: %v, actual: %v", []byte{0x00, 0x00}, actual)
+	}
+
+	// Init the second virt queue
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+
+	// for blk request
+	vq.DescTable[0].Addr = 0
+	vq.DescTable[0].Len = 16
+	vq.DescTable[0].Next = 1
+
+	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
+	blkReq.Type = 1
+	blkReq.Sector = 1
+
+	// for data
+	vq.DescTable[1].Addr = 0x400
+	vq.DescTable[1].Len = 0x200
+	vq.DescTable[1].Next = 2
+
+	// for status
+	vq.DescTable[2].Addr = 0x800
+	vq.DescTable[2].Len = 1
+	mem[0x800] = 0xff
+
+	copy(mem[0x400:], []byte{0xbe, 0xef})
+
+	v.VirtQueue[1] = &vq
+
+	if err := v.IO(1); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	v.IRQInjector.(*mockInjector).waitCalled(t)
+
+	if mem[0x800] != 0 {
+		t.Fatalf("status expected: %v, actual: %v", 0, mem[0x800])
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal([]byte{0xbe, 0xef}, data[virtio.SectorSize:virtio.SectorSize+2]) {
+		t.Fatalf("expected: %v, actual: %v", []byte{0xbe, 0xef}, data[virtio.SectorSize:virtio.SectorSize+2])
+	}
+}
+
+func TestBlkDataPath(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000000)
+
+	v, err := virtio.NewBlk("/dev/zero", 2, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// The data path supports VIRTIO_BLK_F_FLUSH but not VIRTIO_BLK_F_MQ.
+	d := &mockDataPath{features: 1 << 9}
+	v.SetDataPath(d)
+
+	features := make([]byte, 4)
+	_ = v.Read(virtio.BlkIOPortStart, features)
+
+	if features[1] != 0x2 {
+		t.Fatalf("expected: %x, actual: %x", []byte{0, 0x2, 0, 0}, features)
+	}
+
+	_ = v.Write(virtio.BlkIOPortStart+14, []byte{0x0, 0x0})
+	_ = v.Write(virtio.BlkIOPortStart+8, []byte{0x10, 0x00, 0x00, 0x00})
+	_ = v.Write(virtio.BlkIOPortStart+18, []byte{0x7}) // DRIVER_OK
+
+	if len(d.started) != 2 || d.started[0] != v.VirtQueue[0] {
+		t.Fatalf("expected: %v, actual: %v", v.VirtQueue, d.started)
+	}
+
+	if err := v.IO(0); !errors.Is(err, virtio.ErrOffloaded) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrOffloaded, err)
+	}
+}
+
+func TestBlkThrottledNotify(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000000)
+
+	v, err := virtio.NewBlk(path, 1, 10, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// One request a second, so that the last of three reads waits.
+	v.SetLimits(ratelimit.Limits{IOPS: 1, IOPSBurst: 1})
+
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 3
+
+	vq.DescTable[0].Addr = 0
+	vq.DescTable[0].Len = 16
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0x400
+	vq.DescTable[1].Len = 0x200
+	vq.DescTable[1].Next = 2
+	vq.DescTable[2].Addr = 0x800
+	vq.DescTable[2].Len = 1
+
+	v.VirtQueue[0] = &vq
+
+	go v.IOThreadEntry()
+
+	// The notifications of the vCPU do not wait for the throttled I/O.
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if err := v.Write(virtio.BlkIOPortStart+16, []byte{0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected: %v, actual: %v", "no wait", d)
+	}
+}
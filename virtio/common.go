@@ -1,5 +1,11 @@
 package virtio
 
+import (
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
 const (
 	// The number of free descriptors in virt queue must exceed
 	// MAX_SKB_FRAGS (16). Otherwise, packet transmission from
@@ -7,22 +13,77 @@ const (
 	//
 	// refs https://github.com/torvalds/linux/blob/5859a2b/drivers/net/virtio_net.c#L1754
 	QueueSize = 32
+
+	// VIRTIO_CONFIG_S_DRIVER_OK in the device status.
+	statusDriverOK = 4
 )
 
 type IRQInjector interface {
 	InjectVirtioNetIRQ() error
 	InjectVirtioBlkIRQ() error
+	InjectVirtioVsockIRQ() error
+	InjectVirtioConsoleIRQ() error
+	InjectVirtioRngIRQ() error
+	InjectVirtioBalloonIRQ() error
+	InjectVirtioP9IRQ() error
+	InjectVirtioPmemIRQ() error
+	InjectVirtioMemIRQ() error
 }
 
 type commonHeader struct {
-	_        uint32 // hostFeatures
-	_        uint32 // guestFeatures
-	_        uint32 // queuePFN
-	queueNUM uint16
-	queueSEL uint16
-	_        uint16 // queueNotify
-	_        uint8  // status
-	isr      uint8
+	hostFeatures  uint32
+	guestFeatures uint32
+	_             uint32 // queuePFN
+	queueNUM      uint16
+	queueSEL      uint16
+	_             uint16 // queueNotify
+	_             uint8  // status
+	isr           uint8
+}
+
+// write handles a write to the registers of the legacy interface which
+// devices have in common: the features the guest accepts, the selector and
+// the address of the queues in mem, and the queue notify register, which
+// calls notify with a queue of the device. Writes to other registers are
+// ignored.
+func (h *commonHeader) write(offset int, bytes []byte, queues []*VirtQueue, mem []byte,
+	notify func(sel int) error,
+) error {
+	switch offset {
+	case 4:
+		h.guestFeatures = uint32(pci.BytesToNum(bytes)) & h.hostFeatures
+	case 8:
+		// Queue PFN is aligned to page (4096 bytes)
+		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
+		if int(h.queueSEL) < len(queues) {
+			queues[h.queueSEL] = (*VirtQueue)(unsafe.Pointer(&mem[physAddr]))
+		}
+	case 14:
+		h.queueSEL = uint16(pci.BytesToNum(bytes))
+
+		// A size of zero tells the guest that the queue does not exist.
+		h.queueNUM = 0
+		if int(h.queueSEL) < len(queues) {
+			h.queueNUM = QueueSize
+		}
+	case 16:
+		if sel := int(pci.BytesToNum(bytes)); sel < len(queues) {
+			return notify(sel)
+		}
+	}
+
+	return nil
+}
+
+// DataPath runs the virtqueues of a device outside of its goroutines, like
+// vhost-net in the kernel or a vhost-user backend in another process.
+type DataPath interface {
+	// Features returns the features of virtio the data path supports.
+	Features() uint64
+	// Start takes over the queues once the guest driver is ready, with
+	// the features the guest acknowledged. A queue is nil if the guest
+	// did not set it up.
+	Start(features uint64, queues []*VirtQueue) error
 }
 
 // refs: https://wiki.osdev.org/Virtio#Virtual_Queue_Descriptor
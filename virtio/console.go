@@ -0,0 +1,455 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	ConsoleIOPortStart = 0x6500
+	ConsoleIOPortSize  = 0x100
+
+	// refs https://github.com/torvalds/linux/blob/master/include/uapi/linux/virtio_console.h
+	consoleFeatureMultiport = 1 << 1
+
+	consoleCtrlRxQueue = 2
+	consoleCtrlTxQueue = 3
+
+	// Events of struct virtio_console_control.
+	consoleDeviceReady = 0
+	consoleDeviceAdd   = 1
+	consolePortReady   = 3
+	consoleConsolePort = 4
+	consolePortOpen    = 6
+	consolePortName    = 7
+
+	consoleCtrlSize = 8
+)
+
+// ConsolePort is a port of a virtio-console. The guest finds a console port
+// as an hvc, and the others as /dev/virtio-ports/Name.
+type ConsolePort struct {
+	Name    string
+	Console bool
+	Backend io.ReadWriter
+}
+
+type consoleHdr struct {
+	commonHeader  commonHeader
+	consoleHeader consoleHeader
+}
+
+type consoleHeader struct {
+	_          uint16 // cols
+	_          uint16 // rows
+	maxNrPorts uint32
+}
+
+func (h consoleHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Console is a virtio-console device with VIRTIO_CONSOLE_F_MULTIPORT. Port
+// 0 uses VirtQueue[0] and [1], the control queues are [2] and [3], and
+// port i > 0 uses [2*i+2] and [2*i+3].
+type Console struct {
+	Hdr consoleHdr
+
+	VirtQueue    []*VirtQueue
+	Mem          []byte
+	LastAvailIdx []uint16
+
+	ports []*consolePort
+
+	// mu guards the control queues, the messages in ctrl wait for
+	// buffers of the guest.
+	mu   sync.Mutex
+	ctrl [][]byte
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+type consolePort struct {
+	ConsolePort
+
+	rxKick chan struct{}
+	txKick chan struct{}
+	txBuf  []byte
+}
+
+func consoleRxQueue(id int) int {
+	if id == 0 {
+		return 0
+	}
+
+	return 2*id + 2
+}
+
+func (v *Console) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1003,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 3, // Console
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			ConsoleIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Console) Read(port uint64, bytes []byte) error {
+	offset := int(port - ConsoleIOPortStart)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if offset+len(bytes) > len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:offset+len(bytes)])
+
+	return nil
+}
+
+func (v *Console) Write(port uint64, bytes []byte) error {
+	return v.Hdr.commonHeader.write(int(port-ConsoleIOPortStart), bytes, v.VirtQueue, v.Mem, v.notify)
+}
+
+func (v *Console) notify(sel int) error {
+	v.Hdr.commonHeader.isr = 0x0
+
+	switch sel {
+	case consoleCtrlRxQueue:
+		return v.flushCtrl()
+	case consoleCtrlTxQueue:
+		return v.Ctrl()
+	}
+
+	id := sel / 2
+	if sel < consoleCtrlRxQueue {
+		id = 0
+	} else {
+		id--
+	}
+
+	if sel%2 == 0 {
+		kick(v.ports[id].rxKick)
+	} else {
+		kick(v.ports[id].txKick)
+	}
+
+	return nil
+}
+
+// RxThreadEntry passes what the backends of the ports read to the guest,
+// one goroutine per port, and never returns.
+func (v *Console) RxThreadEntry() {
+	for id := range v.ports {
+		go v.rxThread(id)
+	}
+
+	select {}
+}
+
+func (v *Console) rxThread(id int) {
+	p := v.ports[id]
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := p.Backend.Read(buf)
+
+		for data := buf[:n]; len(data) > 0; {
+			l, err := v.Rx(id, data)
+			if err != nil {
+				// Wait for buffers of the guest.
+				<-p.rxKick
+
+				continue
+			}
+
+			data = data[l:]
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// put copies data into the next buffer of queue sel, and returns how much
+// of it fit.
+func (v *Console) put(sel int, data []byte) (int, error) {
+	vq := v.VirtQueue[sel]
+	if vq == nil {
+		return 0, ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[sel] == availRing.Idx {
+		return 0, ErrNoRxBuf
+	}
+
+	headDescID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+	written := 0
+
+	for descID := headDescID; written < len(data); {
+		desc := &vq.DescTable[descID]
+		written += copy(v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)], data[written:])
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = uint32(written)
+	usedRing.Idx++
+	v.LastAvailIdx[sel]++
+
+	return written, nil
+}
+
+// Rx puts data for port id into a buffer of the guest, and returns how much
+// of it fit.
+func (v *Console) Rx(id int, data []byte) (int, error) {
+	n, err := v.put(consoleRxQueue(id), data)
+	if err != nil {
+		return 0, err
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return n, v.IRQInjector.InjectVirtioConsoleIRQ()
+}
+
+// TxThreadEntry passes what the guest writes to the backends of the ports,
+// one goroutine per port, and never returns.
+func (v *Console) TxThreadEntry() {
+	for id := 1; id < len(v.ports); id++ {
+		go v.txThread(id)
+	}
+
+	v.txThread(0)
+}
+
+func (v *Console) txThread(id int) {
+	for range v.ports[id].txKick {
+		for v.Tx(id) == nil {
+		}
+	}
+}
+
+// get gathers the next chain of buffers of queue sel.
+func (v *Console) get(sel int, buf []byte) ([]byte, error) {
+	vq := v.VirtQueue[sel]
+	if vq == nil {
+		return nil, ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[sel] == availRing.Idx {
+		return nil, ErrNoTxPacket
+	}
+
+	descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+
+	for {
+		desc := vq.DescTable[descID]
+
+		buf = append(buf, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)]...)
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Idx++
+	v.LastAvailIdx[sel]++
+
+	return buf, nil
+}
+
+// Tx passes what the guest wrote to port id to its backend.
+func (v *Console) Tx(id int) error {
+	p := v.ports[id]
+
+	buf, err := v.get(consoleRxQueue(id)+1, p.txBuf[:0])
+	if err != nil {
+		return err
+	}
+
+	p.txBuf = buf
+
+	if _, err := p.Backend.Write(buf); err != nil {
+		log.Printf("virtio-console: port %d: %v", id, err)
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioConsoleIRQ()
+}
+
+// Ctrl handles the control messages of the guest.
+func (v *Console) Ctrl() error {
+	v.mu.Lock()
+
+	for {
+		msg, err := v.get(consoleCtrlTxQueue, nil)
+		if err != nil {
+			break
+		}
+
+		if len(msg) < consoleCtrlSize {
+			continue
+		}
+
+		id := binary.LittleEndian.Uint32(msg[0:])
+		event := binary.LittleEndian.Uint16(msg[4:])
+		value := binary.LittleEndian.Uint16(msg[6:])
+
+		switch event {
+		case consoleDeviceReady:
+			if value == 1 {
+				for i := range v.ports {
+					v.sendCtrl(uint32(i), consoleDeviceAdd, 0, nil)
+				}
+			}
+		case consolePortReady:
+			if value != 1 || int(id) >= len(v.ports) {
+				break
+			}
+
+			p := v.ports[id]
+
+			if p.Console {
+				v.sendCtrl(id, consoleConsolePort, 1, nil)
+			}
+
+			if len(p.Name) > 0 {
+				v.sendCtrl(id, consolePortName, 1, []byte(p.Name))
+			}
+
+			// The host side is always open.
+			v.sendCtrl(id, consolePortOpen, 1, nil)
+		case consolePortOpen:
+			// Nothing changes for the backend when the guest opens or
+			// closes the port.
+		}
+	}
+
+	v.mu.Unlock()
+
+	if err := v.flushCtrl(); err != nil {
+		return err
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioConsoleIRQ()
+}
+
+// sendCtrl queues a control message for the guest, the caller holds mu.
+func (v *Console) sendCtrl(id uint32, event, value uint16, data []byte) {
+	msg := make([]byte, consoleCtrlSize, consoleCtrlSize+len(data))
+	binary.LittleEndian.PutUint32(msg[0:], id)
+	binary.LittleEndian.PutUint16(msg[4:], event)
+	binary.LittleEndian.PutUint16(msg[6:], value)
+
+	v.ctrl = append(v.ctrl, append(msg, data...))
+}
+
+// flushCtrl moves the queued control messages into the buffers of the
+// guest.
+func (v *Console) flushCtrl() error {
+	v.mu.Lock()
+
+	sent := false
+
+	for len(v.ctrl) > 0 {
+		if _, err := v.put(consoleCtrlRxQueue, v.ctrl[0]); err != nil {
+			break
+		}
+
+		v.ctrl = v.ctrl[1:]
+		sent = true
+	}
+
+	v.mu.Unlock()
+
+	if !sent {
+		return nil
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioConsoleIRQ()
+}
+
+func (v *Console) IOPort() uint64 {
+	return ConsoleIOPortStart
+}
+
+func (v *Console) Size() uint64 {
+	return ConsoleIOPortSize
+}
+
+// NewConsole creates a virtio-console device with the given ports.
+func NewConsole(ports []ConsolePort, irq uint8, irqInjector IRQInjector, mem []byte) *Console {
+	queues := 2 * (len(ports) + 1)
+
+	res := &Console{
+		Hdr: consoleHdr{
+			commonHeader: commonHeader{
+				hostFeatures: consoleFeatureMultiport,
+				queueNUM:     QueueSize,
+			},
+			consoleHeader: consoleHeader{
+				maxNrPorts: uint32(len(ports)),
+			},
+		},
+		VirtQueue:    make([]*VirtQueue, queues),
+		Mem:          mem,
+		LastAvailIdx: make([]uint16, queues),
+		irq:          irq,
+		IRQInjector:  irqInjector,
+	}
+
+	for _, p := range ports {
+		res.ports = append(res.ports, &consolePort{
+			ConsolePort: p,
+			rxKick:      make(chan struct{}, 1),
+			txKick:      make(chan struct{}, 1),
+		})
+	}
+
+	return res
+}
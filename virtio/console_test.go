@@ -0,0 +1,138 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// ctrlMsg is a struct virtio_console_control.
+func ctrlMsg(id uint32, event, value uint16) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b[0:], id)
+	binary.LittleEndian.PutUint16(b[4:], event)
+	binary.LittleEndian.PutUint16(b[6:], value)
+
+	return b
+}
+
+func TestConsoleCtrl(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	ports := []virtio.ConsolePort{
+		{Name: "hvc", Console: true, Backend: &bytes.Buffer{}},
+		{Name: "org.gokvm.agent", Backend: &bytes.Buffer{}},
+	}
+	v := virtio.NewConsole(ports, 5, &mockInjector{}, mem)
+
+	// max_nr_ports
+	actual := make([]byte, 4)
+	_ = v.Read(virtio.ConsoleIOPortStart+24, actual)
+
+	if expected := []byte{2, 0, 0, 0}; !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+
+	// Buffers for the control messages of the device.
+	rx := virtio.VirtQueue{}
+	for i := 0; i < 8; i++ {
+		rx.DescTable[i].Addr = uint64(0x2000 + 0x100*i)
+		rx.DescTable[i].Len = 0x100
+		rx.DescTable[i].Flags = 0x2
+		rx.AvailRing.Ring[i] = uint16(i)
+	}
+
+	rx.AvailRing.Idx = 8
+	v.VirtQueue[2] = &rx
+
+	// VIRTIO_CONSOLE_DEVICE_READY, then VIRTIO_CONSOLE_PORT_READY of port 1.
+	tx := virtio.VirtQueue{}
+	copy(mem[0x1000:], ctrlMsg(0, 0, 1))
+	copy(mem[0x1100:], ctrlMsg(1, 3, 1))
+	tx.DescTable[0].Addr = 0x1000
+	tx.DescTable[0].Len = 8
+	tx.DescTable[1].Addr = 0x1100
+	tx.DescTable[1].Len = 8
+	tx.AvailRing.Ring[1] = 1
+	tx.AvailRing.Idx = 2
+	v.VirtQueue[3] = &tx
+
+	if err := v.Ctrl(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// VIRTIO_CONSOLE_DEVICE_ADD for both ports, VIRTIO_CONSOLE_PORT_NAME
+	// and VIRTIO_CONSOLE_PORT_OPEN for port 1.
+	if rx.UsedRing.Idx != 4 {
+		t.Fatalf("expected: %v, actual: %v", 4, rx.UsedRing.Idx)
+	}
+
+	expected := [][]byte{
+		ctrlMsg(0, 1, 0),
+		ctrlMsg(1, 1, 0),
+		append(ctrlMsg(1, 7, 1), "org.gokvm.agent"...),
+		ctrlMsg(1, 6, 1),
+	}
+
+	for i, e := range expected {
+		if l := rx.UsedRing.Ring[i].Len; l != uint32(len(e)) {
+			t.Fatalf("expected: %v, actual: %v", len(e), l)
+		}
+
+		if a := mem[0x2000+0x100*i : 0x2000+0x100*i+len(e)]; !bytes.Equal(e, a) {
+			t.Fatalf("expected: %v, actual: %v", e, a)
+		}
+	}
+}
+
+func TestConsoleTxRx(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	b := &bytes.Buffer{}
+	ports := []virtio.ConsolePort{
+		{Console: true, Backend: &bytes.Buffer{}},
+		{Name: "log", Backend: b},
+	}
+	v := virtio.NewConsole(ports, 5, &mockInjector{}, mem)
+
+	// The transmitq of port 1 is the 6th queue.
+	tx := virtio.VirtQueue{}
+	copy(mem[0x1000:], "hello")
+	tx.DescTable[0].Addr = 0x1000
+	tx.DescTable[0].Len = 5
+	tx.AvailRing.Idx = 1
+	v.VirtQueue[5] = &tx
+
+	if err := v.Tx(1); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if b.String() != "hello" {
+		t.Fatalf("expected: %v, actual: %v", "hello", b.String())
+	}
+
+	// Only 3 bytes fit in the buffer of the receiveq of port 1.
+	rx := virtio.VirtQueue{}
+	rx.DescTable[0].Addr = 0x2000
+	rx.DescTable[0].Len = 3
+	rx.DescTable[0].Flags = 0x2
+	rx.AvailRing.Idx = 1
+	v.VirtQueue[4] = &rx
+
+	n, err := v.Rx(1, []byte("world"))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if n != 3 || string(mem[0x2000:0x2003]) != "wor" {
+		t.Fatalf("expected: %v, actual: %v", "wor", string(mem[0x2000:0x2000+n]))
+	}
+
+	if !v.IRQInjector.(*mockInjector).isCalled() {
+		t.Fatalf("irqInjected = false\n")
+	}
+}
@@ -0,0 +1,404 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+var ErrMemSize = errors.New("bad size of virtio-mem")
+
+const (
+	MemIOPortStart = 0x6a00
+	MemIOPortSize  = 0x100
+
+	// MemBlockSize is the default unit the guest plugs memory in.
+	MemBlockSize = 2 << 20
+
+	// refs https://github.com/torvalds/linux/blob/master/include/uapi/linux/virtio_mem.h
+	memFeatureACPIPXM = 1 << 0
+
+	memReqPlug      = 0
+	memReqUnplug    = 1
+	memReqUnplugAll = 2
+	memReqState     = 3
+
+	memRespAck   = 0
+	memRespNack  = 1
+	memRespError = 3
+
+	memStatePlugged   = 0
+	memStateUnplugged = 1
+	memStateMixed     = 2
+
+	// The sizes of struct virtio_mem_req and struct virtio_mem_resp.
+	memReqSize  = 24
+	memRespSize = 10
+)
+
+type memHdr struct {
+	commonHeader commonHeader
+	memHeader    memHeader
+}
+
+// memHeader is a struct virtio_mem_config.
+type memHeader struct {
+	blockSize        uint64
+	nodeID           uint16
+	_                [6]uint8
+	addr             uint64
+	regionSize       uint64
+	usableRegionSize uint64
+	pluggedSize      uint64
+	requestedSize    uint64
+}
+
+func (h memHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Mem is a virtio-mem device. The guest plugs the blocks of its region to
+// reach the size the host requests, and unplugs them to give memory back.
+// plug and unplug make the blocks memory of the guest, and free them.
+type Mem struct {
+	Hdr memHdr
+
+	VirtQueue    [1]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [1]uint16
+
+	plug    func(addr, size uint64) error
+	unplug  func(addr, size uint64) error
+	kick    chan struct{}
+	plugged []bool
+
+	// mu guards the configuration.
+	mu sync.Mutex
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Mem) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		// virtio-mem has no transitional device ID. The legacy driver
+		// takes any in 0x1000-0x103f and goes by the subsystem ID.
+		DeviceID:    0x1000 + 24,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 24, // MEM
+		Command:     1,  // Enable IO port
+		BAR: [6]uint32{
+			MemIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Mem) Read(port uint64, bytes []byte) error {
+	offset := int(port - MemIOPortStart)
+
+	v.mu.Lock()
+	b, err := v.Hdr.Bytes()
+	v.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if offset+len(bytes) > len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:offset+len(bytes)])
+
+	return nil
+}
+
+func (v *Mem) Write(port uint64, bytes []byte) error {
+	return v.Hdr.commonHeader.write(int(port-MemIOPortStart), bytes, v.VirtQueue[:], v.Mem, v.notify)
+}
+
+func (v *Mem) notify(int) error {
+	v.mu.Lock()
+	v.Hdr.commonHeader.isr = 0x0
+	v.mu.Unlock()
+	kick(v.kick)
+
+	return nil
+}
+
+// IOThreadEntry serves the requests of the guest and never returns.
+func (v *Mem) IOThreadEntry() {
+	for range v.kick {
+		for v.IO() == nil {
+		}
+	}
+}
+
+// IO serves the next request of the guest: a struct virtio_mem_req to
+// read, then a struct virtio_mem_resp to write.
+func (v *Mem) IO() error {
+	vq := v.VirtQueue[0]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[0] == availRing.Idx {
+		return ErrNoTxPacket
+	}
+
+	headDescID := availRing.Ring[v.LastAvailIdx[0]%QueueSize]
+	req := []byte{}
+	written := uint32(0)
+
+	for descID := headDescID; ; {
+		desc := &vq.DescTable[descID]
+
+		switch {
+		case desc.Flags&0x2 == 0:
+			req = append(req, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)]...)
+		case desc.Len >= memRespSize && written == 0:
+			resp := v.Mem[desc.Addr : desc.Addr+memRespSize]
+			for i := range resp {
+				resp[i] = 0
+			}
+
+			typ, state := v.handle(req)
+			binary.LittleEndian.PutUint16(resp[0:], typ)
+			binary.LittleEndian.PutUint16(resp[8:], state)
+
+			written = memRespSize
+		}
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = written
+	usedRing.Idx++
+	v.LastAvailIdx[0]++
+
+	v.mu.Lock()
+	v.Hdr.commonHeader.isr |= 0x1
+	v.mu.Unlock()
+
+	return v.IRQInjector.InjectVirtioMemIRQ()
+}
+
+// handle carries out a struct virtio_mem_req, and returns the type of the
+// response and the state of the blocks.
+func (v *Mem) handle(req []byte) (uint16, uint16) {
+	if len(req) < memReqSize {
+		return memRespError, 0
+	}
+
+	typ := binary.LittleEndian.Uint16(req[0:])
+	addr := binary.LittleEndian.Uint64(req[8:])
+	n := uint64(binary.LittleEndian.Uint16(req[16:]))
+
+	if typ == memReqUnplugAll {
+		return v.unplugAll(), 0
+	}
+
+	v.mu.Lock()
+	h := v.Hdr.memHeader
+	v.mu.Unlock()
+
+	// The blocks must be in the usable region.
+	first := (addr - h.addr) / h.blockSize
+	if n == 0 || addr < h.addr || (addr-h.addr)%h.blockSize != 0 || first+n > h.usableRegionSize/h.blockSize {
+		return memRespError, 0
+	}
+
+	plugged := 0
+
+	for _, p := range v.plugged[first : first+n] {
+		if p {
+			plugged++
+		}
+	}
+
+	size := n * h.blockSize
+
+	switch typ {
+	case memReqPlug:
+		if plugged > 0 {
+			return memRespError, 0
+		}
+
+		if h.pluggedSize+size > h.requestedSize {
+			return memRespNack, 0
+		}
+
+		if err := v.plug(addr, size); err != nil {
+			log.Printf("virtio-mem: plug: %v", err)
+
+			return memRespError, 0
+		}
+
+		v.setPlugged(first, n, true)
+	case memReqUnplug:
+		if plugged < int(n) {
+			return memRespError, 0
+		}
+
+		if err := v.unplug(addr, size); err != nil {
+			log.Printf("virtio-mem: unplug: %v", err)
+
+			return memRespError, 0
+		}
+
+		v.setPlugged(first, n, false)
+	case memReqState:
+		switch plugged {
+		case 0:
+			return memRespAck, memStateUnplugged
+		case int(n):
+			return memRespAck, memStatePlugged
+		}
+
+		return memRespAck, memStateMixed
+	default:
+		return memRespError, 0
+	}
+
+	return memRespAck, 0
+}
+
+// setPlugged marks the n blocks from first as plugged or not, and counts
+// them in the configuration.
+func (v *Mem) setPlugged(first, n uint64, plugged bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for i := first; i < first+n; i++ {
+		v.plugged[i] = plugged
+	}
+
+	if plugged {
+		v.Hdr.memHeader.pluggedSize += n * v.Hdr.memHeader.blockSize
+	} else {
+		v.Hdr.memHeader.pluggedSize -= n * v.Hdr.memHeader.blockSize
+	}
+}
+
+// unplugAll unplugs each run of plugged blocks.
+func (v *Mem) unplugAll() uint16 {
+	for first := uint64(0); first < uint64(len(v.plugged)); first++ {
+		if !v.plugged[first] {
+			continue
+		}
+
+		n := uint64(1)
+		for first+n < uint64(len(v.plugged)) && v.plugged[first+n] {
+			n++
+		}
+
+		bs := v.Hdr.memHeader.blockSize
+		if err := v.unplug(v.Hdr.memHeader.addr+first*bs, n*bs); err != nil {
+			log.Printf("virtio-mem: unplug: %v", err)
+
+			return memRespError
+		}
+
+		v.setPlugged(first, n, false)
+		first += n
+	}
+
+	return memRespAck
+}
+
+// SetRequestedSize asks the guest to plug or unplug blocks until size
+// bytes are plugged.
+func (v *Mem) SetRequestedSize(size uint64) error {
+	v.mu.Lock()
+
+	h := &v.Hdr.memHeader
+	if size%h.blockSize != 0 || size > h.usableRegionSize {
+		v.mu.Unlock()
+
+		return fmt.Errorf("%w: %d is not a multiple of %d up to %d", ErrMemSize, size, h.blockSize, h.usableRegionSize)
+	}
+
+	h.requestedSize = size
+	v.Hdr.commonHeader.isr |= isrConfig
+	v.mu.Unlock()
+
+	return v.IRQInjector.InjectVirtioMemIRQ()
+}
+
+// Sizes returns the number of bytes the guest is to plug, and the number
+// it has plugged.
+func (v *Mem) Sizes() (requested, plugged uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.memHeader.requestedSize, v.Hdr.memHeader.pluggedSize
+}
+
+func (v *Mem) IOPort() uint64 {
+	return MemIOPortStart
+}
+
+func (v *Mem) Size() uint64 {
+	return MemIOPortSize
+}
+
+// NewMem creates a virtio-mem device for the region of size bytes at addr,
+// which is plugged in blocks of blockSize bytes. With node >= 0 the guest
+// puts the memory into the NUMA node of that proximity domain.
+func NewMem(addr, size, blockSize uint64, node int, plug, unplug func(addr, size uint64) error,
+	irq uint8, irqInjector IRQInjector, mem []byte,
+) (*Mem, error) {
+	if blockSize == 0 || blockSize&(blockSize-1) != 0 || size == 0 || size%blockSize != 0 || addr%blockSize != 0 {
+		return nil, fmt.Errorf("%w: region of %d bytes at 0x%x in blocks of %d", ErrMemSize, size, addr, blockSize)
+	}
+
+	v := &Mem{
+		Hdr: memHdr{
+			commonHeader: commonHeader{
+				queueNUM: QueueSize,
+			},
+			memHeader: memHeader{
+				blockSize:        blockSize,
+				addr:             addr,
+				regionSize:       size,
+				usableRegionSize: size,
+			},
+		},
+		Mem:         mem,
+		plug:        plug,
+		unplug:      unplug,
+		kick:        make(chan struct{}, 1),
+		plugged:     make([]bool, size/blockSize),
+		irq:         irq,
+		IRQInjector: irqInjector,
+	}
+
+	if node >= 0 {
+		v.Hdr.commonHeader.hostFeatures = memFeatureACPIPXM
+		v.Hdr.memHeader.nodeID = uint16(node)
+	}
+
+	return v, nil
+}
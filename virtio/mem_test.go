@@ -0,0 +1,154 @@
+package virtio_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// memRanges counts the bytes plugged.
+type memRanges struct {
+	plugged uint64
+}
+
+func (r *memRanges) plug(addr, size uint64) error {
+	r.plugged += size
+
+	return nil
+}
+
+func (r *memRanges) unplug(addr, size uint64) error {
+	r.plugged -= size
+
+	return nil
+}
+
+func newMem(t *testing.T, mem []byte) (*virtio.Mem, *memRanges) {
+	t.Helper()
+
+	r := &memRanges{}
+
+	v, err := virtio.NewMem(1<<32, 16<<20, 2<<20, -1, r.plug, r.unplug, 15, &mockInjector{}, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.VirtQueue[0] = &virtio.VirtQueue{}
+
+	return v, r
+}
+
+// memRequest sends a struct virtio_mem_req, and returns the type and the
+// state of the struct virtio_mem_resp.
+func memRequest(t *testing.T, v *virtio.Mem, typ uint16, addr uint64, n uint16) (uint16, uint16) {
+	t.Helper()
+
+	req := v.Mem[0x1000:0x1018]
+	binary.LittleEndian.PutUint16(req[0:], typ)
+	binary.LittleEndian.PutUint64(req[8:], addr)
+	binary.LittleEndian.PutUint16(req[16:], n)
+
+	vq := v.VirtQueue[0]
+	i := vq.AvailRing.Idx % virtio.QueueSize
+
+	vq.DescTable[0].Addr, vq.DescTable[0].Len, vq.DescTable[0].Flags, vq.DescTable[0].Next = 0x1000, 24, 0x1, 1
+	vq.DescTable[1].Addr, vq.DescTable[1].Len, vq.DescTable[1].Flags = 0x2000, 10, 0x2
+	vq.AvailRing.Ring[i] = 0
+	vq.AvailRing.Idx++
+
+	if err := v.IO(); err != nil {
+		t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint16(v.Mem[0x2000:]), binary.LittleEndian.Uint16(v.Mem[0x2008:])
+}
+
+func TestMemConfig(t *testing.T) {
+	t.Parallel()
+
+	v, _ := newMem(t, []byte{})
+
+	if err := v.SetRequestedSize(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// struct virtio_mem_config
+	actual := make([]uint64, 7)
+	for i := range actual {
+		b := make([]byte, 8)
+		_ = v.Read(virtio.MemIOPortStart+20+uint64(8*i), b)
+		actual[i] = binary.LittleEndian.Uint64(b)
+	}
+
+	expected := []uint64{2 << 20, 0, 1 << 32, 16 << 20, 16 << 20, 0, 4 << 20}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected: %v, actual: %v", expected, actual)
+		}
+	}
+
+	if err := v.SetRequestedSize(3 << 20); !errors.Is(err, virtio.ErrMemSize) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrMemSize, err)
+	}
+
+	if _, err := virtio.NewMem(1<<32, 3<<20, 2<<20, -1, nil, nil, 15, &mockInjector{}, nil); !errors.Is(err, virtio.ErrMemSize) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrMemSize, err)
+	}
+}
+
+func TestMemPlug(t *testing.T) {
+	t.Parallel()
+
+	const (
+		plug      = 0
+		unplug    = 1
+		unplugAll = 2
+		state     = 3
+
+		ack     = 0
+		nack    = 1
+		respErr = 3
+
+		plugged   = 0
+		unplugged = 1
+		mixed     = 2
+	)
+
+	v, r := newMem(t, make([]byte, 0x10000))
+
+	if err := v.SetRequestedSize(6 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		typ          uint16
+		addr         uint64
+		n            uint16
+		resp, status uint16
+	}{
+		{plug, 1 << 32, 2, ack, 0},
+		{plug, 1<<32 + 2<<20, 1, respErr, 0},      // plugged already
+		{plug, 1<<32 + 6<<20, 2, nack, 0},         // more than requested
+		{plug, 1<<32 + 1<<20, 1, respErr, 0},      // not aligned
+		{plug, 1<<32 + 16<<20, 1, respErr, 0},     // out of the region
+		{state, 1 << 32, 3, ack, mixed},           //
+		{state, 1 << 32, 2, ack, plugged},         //
+		{state, 1<<32 + 4<<20, 4, ack, unplugged}, //
+		{unplug, 1 << 32, 3, respErr, 0},          // not all plugged
+		{unplug, 1 << 32, 1, ack, 0},              //
+		{plug, 1<<32 + 8<<20, 2, ack, 0},          //
+		{unplugAll, 0, 0, ack, 0},                 //
+		{state, 1 << 32, 8, ack, unplugged},       //
+	} {
+		resp, status := memRequest(t, v, tt.typ, tt.addr, tt.n)
+		if resp != tt.resp || status != tt.status {
+			t.Fatalf("%d: expected: %v, actual: %v", i, [2]uint16{tt.resp, tt.status}, [2]uint16{resp, status})
+		}
+	}
+
+	if requested, p := v.Sizes(); requested != 6<<20 || p != 0 || r.plugged != 0 {
+		t.Fatalf("expected: %v, actual: %v", 0, p)
+	}
+}
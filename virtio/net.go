@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/pci"
+	"github.com/bobuhiro11/gokvm/tap"
 )
 
 var (
@@ -21,34 +24,104 @@ var (
 	ErrNoRxPacket  = errors.New("no packet for rx")
 	ErrVQNotInit   = errors.New("vq not initialized")
 	ErrNoRxBuf     = errors.New("no buffer found for rx")
+	ErrOffloaded   = errors.New("queues are run by the data path")
 )
 
 const (
 	NetIOPortStart = 0x6200
 	NetIOPortSize  = 0x100
+
+	// refs https://github.com/torvalds/linux/blob/master/include/uapi/linux/virtio_net.h
+	netFeatureCSUM      = 1 << 0
+	netFeatureGuestCSUM = 1 << 1
+	netFeatureGuestTSO4 = 1 << 7
+	netFeatureGuestTSO6 = 1 << 8
+	netFeatureHostTSO4  = 1 << 11
+	netFeatureHostTSO6  = 1 << 12
+	netFeatureMrgRxBuf  = 1 << 15
+	netFeatureCtrlVQ    = 1 << 17
+	netFeatureMQ        = 1 << 22
+
+	// Size of struct virtio_net_hdr, and of struct
+	// virtio_net_hdr_mrg_rxbuf which adds num_buffers.
+	netHdrSize          = 10
+	netHdrMrgRxBufSize  = 12
+	netNumBuffersOffset = 10
+
+	// A 64 KiB TSO packet plus an ethernet header with a VLAN tag.
+	netMaxFrameSize = 0x10000 + 18
+
+	// Commands on the control virtqueue, struct virtio_net_ctrl_hdr.
+	netCtrlMQ           = 4
+	netCtrlMQVQPairsSet = 0
+	netCtrlOK           = 0
+	netCtrlErr          = 1
 )
 
+// VnetHdrBackend is a network backend which passes a struct virtio_net_hdr
+// in front of every packet, like a tap opened with IFF_VNET_HDR. With it,
+// the guest can leave checksums and segmentation to the host.
+type VnetHdrBackend interface {
+	io.ReadWriter
+	SetVnetHdrSize(n int) error
+	// SetOffload takes the tap.Offload* the guest is able to receive.
+	SetOffload(flags uint) error
+}
+
+// RxNotifier is a backend which does not raise SIGIO like a tap, but calls
+// a function when it has packets for the guest.
+type RxNotifier interface {
+	SetRxNotifier(f func())
+}
+
+// QueueEnabler is a backend of one queue pair of a multiqueue device, like
+// an fd of an IFF_MULTI_QUEUE tap, which stops taking packets for the guest
+// while the pair is not in use.
+type QueueEnabler interface {
+	SetQueueEnabled(enabled bool) error
+}
+
 type netHdr struct {
 	commonHeader commonHeader
-	_            netHeader
+	netHeader    netHeader
 }
 
+// Net is a virtio-net device with one or more pairs of queues, rx and tx
+// of pair i are VirtQueue[2*i] and VirtQueue[2*i+1]. With more than one
+// pair, the last VirtQueue is the control virtqueue.
 type Net struct {
 	Hdr netHdr
 
-	VirtQueue    [2]*VirtQueue
+	VirtQueue    []*VirtQueue
 	Mem          []byte
-	LastAvailIdx [2]uint16
+	LastAvailIdx []uint16
 
-	tap io.ReadWriter
+	pairs []*netQueuePair
 
-	txKick chan interface{}
-	rxKick chan os.Signal
+	dataPath   DataPath
+	offloaded  atomic.Bool
+	driverOKed bool
+
+	sigio chan os.Signal
 
 	irq         uint8
 	IRQInjector IRQInjector
 }
 
+type netQueuePair struct {
+	tap     io.ReadWriter
+	vnetHdr VnetHdrBackend
+	rxBuf   []byte
+	txBuf   []byte
+
+	// rxPending is a packet of the backend, in rxBuf, which waits for
+	// the guest to add rx buffers.
+	rxPending []byte
+
+	rxKick chan struct{}
+	txKick chan interface{}
+}
+
 func (h netHdr) Bytes() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
@@ -60,12 +133,12 @@ func (h netHdr) Bytes() ([]byte, error) {
 }
 
 type netHeader struct {
-	_ [6]uint8 // mac
-	_ uint16   // netStatus
-	_ uint16   // maxVirtQueuePairs
+	_                 [6]uint8 // mac
+	_                 uint16   // netStatus
+	maxVirtQueuePairs uint16
 }
 
-func (v Net) GetDeviceHeader() pci.DeviceHeader {
+func (v *Net) GetDeviceHeader() pci.DeviceHeader {
 	return pci.DeviceHeader{
 		DeviceID:    0x1000,
 		VendorID:    0x1AF4,
@@ -82,7 +155,7 @@ func (v Net) GetDeviceHeader() pci.DeviceHeader {
 	}
 }
 
-func (v Net) Read(port uint64, bytes []byte) error {
+func (v *Net) Read(port uint64, bytes []byte) error {
 	offset := int(port - NetIOPortStart)
 
 	b, err := v.Hdr.Bytes()
@@ -96,28 +169,69 @@ func (v Net) Read(port uint64, bytes []byte) error {
 	return nil
 }
 
+// RxThreadEntry runs one rx worker per queue pair and never returns.
+// A SIGIO from the backends wakes all of them.
 func (v *Net) RxThreadEntry() {
-	for range v.rxKick {
-		for v.Rx() == nil {
+	for i := range v.pairs {
+		go v.rxThread(i)
+	}
+
+	for range v.sigio {
+		for i := range v.pairs {
+			v.kickRx(i)
+		}
+	}
+}
+
+func (v *Net) rxThread(pair int) {
+	for range v.pairs[pair].rxKick {
+		for v.Rx(pair) == nil {
 		}
 	}
 }
 
-func (v *Net) Rx() error {
-	// read raw packet from tap device
-	packet := make([]byte, 4096)
+func (v *Net) kickRx(pair int) {
+	select {
+	case v.pairs[pair].rxKick <- struct{}{}:
+	default:
+	}
+}
 
-	n, err := v.tap.Read(packet)
-	if err != nil {
-		return ErrNoRxPacket
+// hdrLen returns the size of the header in front of every packet, as
+// negotiated with the guest.
+func (v *Net) hdrLen() int {
+	if v.Hdr.commonHeader.guestFeatures&netFeatureMrgRxBuf != 0 {
+		return netHdrMrgRxBufSize
 	}
 
-	packet = packet[:n]
+	return netHdrSize
+}
+
+// readPacket reads a packet from the backend of pair p, including its
+// struct virtio_net_hdr. Backends without one get a header of zeros.
+func (v *Net) readPacket(p *netQueuePair) ([]byte, error) {
+	if p.vnetHdr != nil {
+		n, err := p.tap.Read(p.rxBuf)
+
+		return p.rxBuf[:n], err
+	}
+
+	hdrLen := v.hdrLen()
+	for i := 0; i < hdrLen; i++ {
+		p.rxBuf[i] = 0
+	}
 
-	// append struct virtio_net_hdr
-	packet = append(make([]byte, 10), packet...)
+	n, err := p.tap.Read(p.rxBuf[hdrLen:])
 
-	sel := 0
+	return p.rxBuf[:hdrLen+n], err
+}
+
+func (v *Net) Rx(pair int) error {
+	sel := 2 * pair
+
+	if v.offloaded.Load() {
+		return ErrOffloaded
+	}
 
 	if v.VirtQueue[sel] == nil {
 		return ErrVQNotInit
@@ -130,63 +244,147 @@ func (v *Net) Rx() error {
 		return ErrNoRxBuf
 	}
 
-	const NONE = uint16(256)
-	headDescID := NONE
-	prevDescID := NONE
-
-	for len(packet) > 0 {
-		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+	p := v.pairs[pair]
 
-		// head of vring chain
-		if headDescID == NONE {
-			headDescID = descID
+	packet := p.rxPending
+	if packet == nil {
+		var err error
 
-			// This structure is holding both the index of the descriptor chain and the
-			// number of bytes that were written to the memory as part of serving the request.
-			usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
-			usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+		if packet, err = v.readPacket(p); err != nil {
+			return ErrNoRxPacket
 		}
+	}
 
-		desc := &v.VirtQueue[sel].DescTable[descID]
-		l := uint32(len(packet))
+	// Without VIRTIO_NET_F_MRG_RXBUF, a packet goes into a single chain of
+	// descriptors. With it, the packet may span several chains, and the
+	// guest learns how many from num_buffers in the header.
+	mrgRxBuf := v.Hdr.commonHeader.guestFeatures&netFeatureMrgRxBuf != 0
 
-		if l > desc.Len {
-			l = desc.Len
-		}
+	switch room := v.rxRoom(sel, mrgRxBuf, len(packet)); {
+	case room >= len(packet):
+		p.rxPending = nil
+	case mrgRxBuf:
+		// The packet goes in once the guest adds buffers.
+		p.rxPending = packet
 
-		copy(v.Mem[desc.Addr:desc.Addr+uint64(l)], packet[:l])
-		packet = packet[l:]
-		desc.Len = l
+		return ErrNoRxBuf
+	default:
+		// A single chain too small for the packet never grows, the
+		// packet is dropped rather than cut short.
+		p.rxPending = nil
 
-		usedRing.Ring[usedRing.Idx%QueueSize].Len += l
+		return nil
+	}
 
-		if prevDescID != NONE {
-			v.VirtQueue[sel].DescTable[prevDescID].Flags |= 0x1
-			v.VirtQueue[sel].DescTable[prevDescID].Next = descID
-		}
+	hdr := []byte{}
+	buffers := uint16(0)
+
+	for len(packet) > 0 && v.LastAvailIdx[sel] != availRing.Idx {
+		headDescID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+		descID := headDescID
+		written := uint32(0)
 
-		prevDescID = descID
 		v.LastAvailIdx[sel]++
+
+		for len(packet) > 0 {
+			desc := &v.VirtQueue[sel].DescTable[descID]
+			l := uint32(len(packet))
+
+			if l > desc.Len {
+				l = desc.Len
+			}
+
+			if buffers == 0 && written == 0 {
+				hdr = v.Mem[desc.Addr : desc.Addr+uint64(l)]
+			}
+
+			copy(v.Mem[desc.Addr:desc.Addr+uint64(l)], packet[:l])
+			packet = packet[l:]
+			written += l
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		// This structure is holding both the index of the descriptor chain and the
+		// number of bytes that were written to the memory as part of serving the request.
+		usedRing.Ring[(usedRing.Idx+buffers)%QueueSize].Idx = uint32(headDescID)
+		usedRing.Ring[(usedRing.Idx+buffers)%QueueSize].Len = written
+		buffers++
+
+		if !mrgRxBuf {
+			break
+		}
+	}
+
+	if mrgRxBuf && len(hdr) >= netHdrMrgRxBufSize {
+		binary.LittleEndian.PutUint16(hdr[netNumBuffersOffset:], buffers)
 	}
 
-	usedRing.Idx++
+	usedRing.Idx += buffers
 
 	v.Hdr.commonHeader.isr = 0x1
 
 	return v.IRQInjector.InjectVirtioNetIRQ()
 }
 
+// rxRoom returns how many bytes the rx buffers of the guest hold, up to
+// need. Without VIRTIO_NET_F_MRG_RXBUF, only the first chain counts.
+func (v *Net) rxRoom(sel int, mrgRxBuf bool, need int) int {
+	availRing := &v.VirtQueue[sel].AvailRing
+	room := 0
+
+	for idx := v.LastAvailIdx[sel]; idx != availRing.Idx && room < need; idx++ {
+		descID := availRing.Ring[idx%QueueSize]
+
+		for i := 0; i < QueueSize; i++ {
+			desc := &v.VirtQueue[sel].DescTable[descID]
+			room += int(desc.Len)
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		if !mrgRxBuf {
+			break
+		}
+	}
+
+	return room
+}
+
+// TxThreadEntry runs one tx worker per queue pair and never returns.
 func (v *Net) TxThreadEntry() {
-	for range v.txKick {
-		for v.Tx() == nil {
+	for i := 1; i < len(v.pairs); i++ {
+		go v.txThread(i)
+	}
+
+	v.txThread(0)
+}
+
+func (v *Net) txThread(pair int) {
+	for range v.pairs[pair].txKick {
+		for v.Tx(pair) == nil {
 		}
 	}
 }
 
-func (v *Net) Tx() error {
-	sel := v.Hdr.commonHeader.queueSEL
-	if sel == 0 {
-		return ErrInvalidSel
+func (v *Net) Tx(pair int) error {
+	sel := 2*pair + 1
+	p := v.pairs[pair]
+
+	if v.offloaded.Load() {
+		return ErrOffloaded
+	}
+
+	if v.VirtQueue[sel] == nil {
+		return ErrVQNotInit
 	}
 
 	availRing := &v.VirtQueue[sel].AvailRing
@@ -197,7 +395,7 @@ func (v *Net) Tx() error {
 	}
 
 	for v.LastAvailIdx[sel] != availRing.Idx {
-		buf := []byte{}
+		buf := p.txBuf[:0]
 		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
 
 		// This structure is holding both the index of the descriptor chain and the
@@ -208,9 +406,7 @@ func (v *Net) Tx() error {
 		for {
 			desc := v.VirtQueue[sel].DescTable[descID]
 
-			b := make([]byte, desc.Len)
-			copy(b, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)])
-			buf = append(buf, b...)
+			buf = append(buf, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)]...)
 
 			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
 
@@ -221,13 +417,139 @@ func (v *Net) Tx() error {
 			}
 		}
 
-		// Skip struct virtio_net_hdr
+		p.txBuf = buf
+
+		// A backend with vnet headers takes struct virtio_net_hdr as is,
+		// everyone else gets a plain ethernet frame.
 		// refs https://github.com/torvalds/linux/blob/38f80f42/include/uapi/linux/virtio_net.h#L178-L191
-		buf = buf[10:]
+		if p.vnetHdr == nil {
+			buf = buf[v.hdrLen():]
+		}
+
+		if _, err := p.tap.Write(buf); err != nil {
+			return err
+		}
+		usedRing.Idx++
+		v.LastAvailIdx[sel]++
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioNetIRQ()
+}
+
+// setFeatures applies the features acknowledged by the guest to the backends.
+func (v *Net) setFeatures(features uint32) error {
+	v.Hdr.commonHeader.guestFeatures = features & v.Hdr.commonHeader.hostFeatures
+	features = v.Hdr.commonHeader.guestFeatures
+
+	offload := uint(0)
+
+	if features&netFeatureGuestCSUM != 0 {
+		offload |= tap.OffloadCSUM
+
+		if features&netFeatureGuestTSO4 != 0 {
+			offload |= tap.OffloadTSO4
+		}
+
+		if features&netFeatureGuestTSO6 != 0 {
+			offload |= tap.OffloadTSO6
+		}
+	}
+
+	for _, p := range v.pairs {
+		if p.vnetHdr == nil {
+			continue
+		}
+
+		if err := p.vnetHdr.SetVnetHdrSize(v.hdrLen()); err != nil {
+			return err
+		}
 
-		if _, err := v.tap.Write(buf); err != nil {
+		if err := p.vnetHdr.SetOffload(offload); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// setPairs switches to the first n queue pairs, the backends of the others
+// stop taking packets.
+func (v *Net) setPairs(n int) error {
+	for i, p := range v.pairs {
+		if e, ok := p.tap.(QueueEnabler); ok && len(v.pairs) > 1 {
+			if err := e.SetQueueEnabled(i < n); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		v.kickRx(i)
+	}
+
+	return nil
+}
+
+// Ctrl handles the requests on the control virtqueue. Only
+// VIRTIO_NET_CTRL_MQ_VQ_PAIRS_SET is supported.
+func (v *Net) Ctrl() error {
+	sel := len(v.VirtQueue) - 1
+
+	if v.VirtQueue[sel] == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &v.VirtQueue[sel].AvailRing
+	usedRing := &v.VirtQueue[sel].UsedRing
+
+	for v.LastAvailIdx[sel] != availRing.Idx {
+		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+
+		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+
+		// The device readable part is struct virtio_net_ctrl_hdr followed
+		// by the command, the writable one is the ack.
+		req := []byte{}
+		ack := []byte{}
+
+		for {
+			desc := v.VirtQueue[sel].DescTable[descID]
+			b := v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+
+			if desc.Flags&0x2 != 0 {
+				ack = b
+			} else {
+				req = append(req, b...)
+			}
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		status := byte(netCtrlErr)
+
+		if len(req) >= 4 && req[0] == netCtrlMQ && req[1] == netCtrlMQVQPairsSet {
+			n := int(binary.LittleEndian.Uint16(req[2:4]))
+			if n >= 1 && n <= len(v.pairs) {
+				if err := v.setPairs(n); err != nil {
+					log.Printf("virtio-net: %d queue pairs: %v", n, err)
+				} else {
+					status = netCtrlOK
+				}
+			}
+		}
+
+		if len(ack) > 0 {
+			ack[0] = status
+			usedRing.Ring[usedRing.Idx%QueueSize].Len = 1
+		}
+
 		usedRing.Idx++
 		v.LastAvailIdx[sel]++
 	}
@@ -241,15 +563,46 @@ func (v *Net) Write(port uint64, bytes []byte) error {
 	offset := int(port - NetIOPortStart)
 
 	switch offset {
+	case 4:
+		return v.setFeatures(uint32(pci.BytesToNum(bytes)))
 	case 8:
 		// Queue PFN is aligned to page (4096 bytes)
 		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
-		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		if int(v.Hdr.commonHeader.queueSEL) < len(v.VirtQueue) {
+			v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		}
 	case 14:
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+
+		// A size of zero tells the guest that the queue does not exist.
+		v.Hdr.commonHeader.queueNUM = 0
+		if int(v.Hdr.commonHeader.queueSEL) < len(v.VirtQueue) {
+			v.Hdr.commonHeader.queueNUM = QueueSize
+		}
 	case 16:
-		v.Hdr.commonHeader.isr = 0x0
-		v.txKick <- true
+		// With a data path, the ISR stays set for its interrupts, which
+		// do not go through gokvm.
+		if !v.offloaded.Load() {
+			v.Hdr.commonHeader.isr = 0x0
+		}
+
+		sel := int(pci.BytesToNum(bytes))
+
+		switch {
+		case sel >= len(v.VirtQueue):
+		case sel == 2*len(v.pairs):
+			return v.Ctrl()
+		case sel%2 == 0:
+			// New rx buffers may let a pending packet in.
+			v.kickRx(sel / 2)
+		default:
+			v.pairs[sel/2].txKick <- true
+		}
+	case 18:
+		if bytes[0]&statusDriverOK != 0 && !v.driverOKed {
+			v.driverOKed = true
+			v.startDataPath()
+		}
 	case 19:
 		fmt.Printf("ISR was written!\r\n")
 	default:
@@ -258,33 +611,115 @@ func (v *Net) Write(port uint64, bytes []byte) error {
 	return nil
 }
 
-func (v Net) IOPort() uint64 {
+// SetDataPath hands the rx and tx queues to d once the guest driver is
+// ready, those of pair i are queues[2*i] and queues[2*i+1]. The control
+// virtqueue stays with the Net. VIRTIO_NET_F_MRG_RXBUF is no longer
+// offered to the guest if d lacks it.
+func (v *Net) SetDataPath(d DataPath) {
+	if d.Features()&netFeatureMrgRxBuf == 0 {
+		v.Hdr.commonHeader.hostFeatures &^= netFeatureMrgRxBuf
+	}
+
+	v.dataPath = d
+}
+
+// startDataPath hands the queues to the data path. If it fails, the
+// goroutines of the Net keep running them.
+func (v *Net) startDataPath() {
+	if v.dataPath == nil {
+		return
+	}
+
+	if err := v.dataPath.Start(uint64(v.Hdr.commonHeader.guestFeatures), v.VirtQueue[:2*len(v.pairs)]); err != nil {
+		log.Printf("virtio-net: falling back to userspace: %v", err)
+
+		return
+	}
+
+	v.offloaded.Store(true)
+	v.Hdr.commonHeader.isr = 0x1
+}
+
+func (v *Net) IOPort() uint64 {
 	return NetIOPortStart
 }
 
-func (v Net) Size() uint64 {
+func (v *Net) Size() uint64 {
 	return NetIOPortSize
 }
 
+// NewNet creates a virtio-net device on top of a backend such as a tap. If
+// the backend is a VnetHdrBackend, checksum and segmentation offloads are
+// offered to the guest.
 func NewNet(irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *Net {
+	return NewMultiQueueNet(irq, irqInjector, []io.ReadWriter{tap}, mem)
+}
+
+// NewMultiQueueNet creates a virtio-net device with one queue pair for each
+// backend, e.g. the fds of a multiqueue tap. Offloads are offered if all
+// backends are VnetHdrBackends.
+func NewMultiQueueNet(irq uint8, irqInjector IRQInjector, taps []io.ReadWriter, mem []byte) *Net {
+	queues := 2 * len(taps)
+	features := uint32(netFeatureMrgRxBuf | netFeatureCSUM | netFeatureGuestCSUM |
+		netFeatureGuestTSO4 | netFeatureGuestTSO6 |
+		netFeatureHostTSO4 | netFeatureHostTSO6)
+
+	if len(taps) > 1 {
+		queues++
+		features |= netFeatureCtrlVQ | netFeatureMQ
+	}
+
 	res := &Net{
 		Hdr: netHdr{
 			commonHeader: commonHeader{
 				queueNUM: QueueSize,
 				isr:      0x0,
 			},
+			netHeader: netHeader{
+				maxVirtQueuePairs: uint16(len(taps)),
+			},
 		},
 		irq:          irq,
 		IRQInjector:  irqInjector,
-		txKick:       make(chan interface{}),
-		rxKick:       make(chan os.Signal),
-		tap:          tap,
+		sigio:        make(chan os.Signal, 1),
 		Mem:          mem,
-		VirtQueue:    [2]*VirtQueue{},
-		LastAvailIdx: [2]uint16{0, 0},
+		VirtQueue:    make([]*VirtQueue, queues),
+		LastAvailIdx: make([]uint16, queues),
+	}
+
+	for _, t := range taps {
+		p := &netQueuePair{
+			tap:    t,
+			rxBuf:  make([]byte, netHdrMrgRxBufSize+netMaxFrameSize),
+			txBuf:  make([]byte, 0, netHdrMrgRxBufSize+netMaxFrameSize),
+			rxKick: make(chan struct{}, 1),
+			txKick: make(chan interface{}),
+		}
+
+		if b, ok := t.(VnetHdrBackend); ok {
+			p.vnetHdr = b
+		} else {
+			features &= netFeatureMrgRxBuf | netFeatureCtrlVQ | netFeatureMQ
+		}
+
+		res.pairs = append(res.pairs, p)
+	}
+
+	res.Hdr.commonHeader.hostFeatures = features
+
+	for i, p := range res.pairs {
+		if n, ok := p.tap.(RxNotifier); ok {
+			pair := i
+			n.SetRxNotifier(func() { res.kickRx(pair) })
+		}
+	}
+
+	// The guest starts out with a single pair.
+	if err := res.setPairs(1); err != nil {
+		log.Printf("virtio-net: %v", err)
 	}
 
-	signal.Notify(res.rxKick, syscall.SIGIO)
+	signal.Notify(res.sigio, syscall.SIGIO)
 
 	return res
 }
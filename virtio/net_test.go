@@ -2,24 +2,101 @@ package virtio_test
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"sync"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/bobuhiro11/gokvm/virtio"
 )
 
 type mockInjector struct {
+	mu     sync.Mutex
 	called bool
 }
 
-func (m *mockInjector) InjectVirtioNetIRQ() error {
+func (m *mockInjector) inject() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.called = true
+}
+
+func (m *mockInjector) isCalled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.called
+}
+
+// waitCalled waits for an interrupt from a device which completes its
+// requests asynchronously.
+func (m *mockInjector) waitCalled(t *testing.T) {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		if m.isCalled() {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("irqInjected = false\n")
+}
+
+func (m *mockInjector) InjectVirtioNetIRQ() error {
+	m.inject()
 
 	return nil
 }
 
 func (m *mockInjector) InjectVirtioBlkIRQ() error {
-	m.called = true
+	m.inject()
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioVsockIRQ() error {
+	m.inject()
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioConsoleIRQ() error {
+	m.inject()
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioRngIRQ() error {
+	m.inject()
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioBalloonIRQ() error {
+	m.inject()
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioP9IRQ() error {
+	m.inject()
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioPmemIRQ() error {
+	m.inject()
+
+	return nil
+}
+
+func (m *mockInjector) InjectVirtioMemIRQ() error {
+	m.inject()
 
 	return nil
 }
@@ -123,11 +200,11 @@ func TestQueueNotifyHandler(t *testing.T) {
 	vq.AvailRing.Idx = 1
 	v.VirtQueue[sel] = &vq
 
-	if err := v.Tx(); err != nil {
+	if err := v.Tx(0); err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
 
-	if !v.IRQInjector.(*mockInjector).called {
+	if !v.IRQInjector.(*mockInjector).isCalled() {
 		t.Fatalf("irqInjected = false\n")
 	}
 
@@ -153,11 +230,11 @@ func TestRx(t *testing.T) {
 	// Size of struct virtio_net_hdr
 	const K = 10
 
-	if err := v.Rx(); err != nil {
+	if err := v.Rx(0); err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
 
-	if !v.IRQInjector.(*mockInjector).called {
+	if !v.IRQInjector.(*mockInjector).isCalled() {
 		t.Fatalf("irqInjected = false\n")
 	}
 
@@ -166,3 +243,282 @@ func TestRx(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+type mockVnetHdrBackend struct {
+	*bytes.Buffer
+	hdrSize int
+	offload uint
+}
+
+func (b *mockVnetHdrBackend) SetVnetHdrSize(n int) error {
+	b.hdrSize = n
+
+	return nil
+}
+
+func (b *mockVnetHdrBackend) SetOffload(flags uint) error {
+	b.offload = flags
+
+	return nil
+}
+
+func TestRxMergeable(t *testing.T) {
+	t.Parallel()
+
+	expected := bytes.Repeat([]byte{0xaa}, 0x300)
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer(expected), mem)
+
+	// Acknowledge VIRTIO_NET_F_MRG_RXBUF
+	_ = v.Write(virtio.NetIOPortStart+4, []byte{0x00, 0x80, 0x00, 0x00})
+
+	// Two buffers of 0x200 bytes each
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 2
+	vq.AvailRing.Ring[0] = 0
+	vq.AvailRing.Ring[1] = 1
+	vq.DescTable[0].Addr = 0x1000
+	vq.DescTable[0].Len = 0x200
+	vq.DescTable[1].Addr = 0x2000
+	vq.DescTable[1].Len = 0x200
+	v.VirtQueue[0] = &vq
+
+	// Size of struct virtio_net_hdr_mrg_rxbuf
+	const K = 12
+
+	if err := v.Rx(0); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if vq.UsedRing.Idx != 2 {
+		t.Fatalf("used buffers expected: %v, actual: %v", 2, vq.UsedRing.Idx)
+	}
+
+	// num_buffers
+	if mem[0x1000+10] != 2 {
+		t.Fatalf("num_buffers expected: %v, actual: %v", 2, mem[0x1000+10])
+	}
+
+	actual := append(append([]byte{}, mem[0x1000+K:0x1200]...), mem[0x2000:0x2000+K+0x100]...)
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestRxMergeableWaitsForBuffers(t *testing.T) {
+	t.Parallel()
+
+	expected := bytes.Repeat([]byte{0xaa}, 0x300)
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer(expected), mem)
+
+	// Acknowledge VIRTIO_NET_F_MRG_RXBUF
+	_ = v.Write(virtio.NetIOPortStart+4, []byte{0x00, 0x80, 0x00, 0x00})
+
+	// One buffer of 0x200 bytes, too small for the packet
+	vq := virtio.VirtQueue{}
+	vq.AvailRing.Idx = 1
+	vq.AvailRing.Ring[0] = 0
+	vq.AvailRing.Ring[1] = 1
+	vq.DescTable[0].Addr = 0x1000
+	vq.DescTable[0].Len = 0x200
+	vq.DescTable[1].Addr = 0x2000
+	vq.DescTable[1].Len = 0x200
+	v.VirtQueue[0] = &vq
+
+	if err := v.Rx(0); !errors.Is(err, virtio.ErrNoRxBuf) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrNoRxBuf, err)
+	}
+
+	if vq.UsedRing.Idx != 0 {
+		t.Fatalf("used buffers expected: %v, actual: %v", 0, vq.UsedRing.Idx)
+	}
+
+	// The guest adds a second buffer.
+	vq.AvailRing.Idx = 2
+
+	if err := v.Rx(0); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if vq.UsedRing.Idx != 2 || mem[0x1000+10] != 2 {
+		t.Fatalf("expected: %v, actual: %v used, num_buffers %v", 2, vq.UsedRing.Idx, mem[0x1000+10])
+	}
+
+	actual := append(append([]byte{}, mem[0x1000+12:0x1200]...), mem[0x2000:0x2000+12+0x100]...)
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestTxVnetHdr(t *testing.T) {
+	t.Parallel()
+
+	b := &mockVnetHdrBackend{Buffer: bytes.NewBuffer([]byte{})}
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, b, mem)
+
+	// Acknowledge GUEST_CSUM, GUEST_TSO4 and MRG_RXBUF
+	_ = v.Write(virtio.NetIOPortStart+4, []byte{0x82, 0x80, 0x00, 0x00})
+
+	if b.hdrSize != 12 {
+		t.Fatalf("header size expected: %v, actual: %v", 12, b.hdrSize)
+	}
+
+	if b.offload != 0x3 {
+		t.Fatalf("offload expected: %v, actual: %v", 0x3, b.offload)
+	}
+
+	// The header goes to the backend as is.
+	expected := []byte{0x01, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xaa, 0xbb}
+	copy(mem[0x100:], expected)
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = uint32(len(expected))
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[1] = &vq
+
+	if err := v.Tx(0); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if !bytes.Equal(expected, b.Bytes()) {
+		t.Fatalf("expected: %v, actual: %v", expected, b.Bytes())
+	}
+}
+
+type mockQueueBackend struct {
+	*bytes.Buffer
+	enabled bool
+}
+
+func (b *mockQueueBackend) SetQueueEnabled(enabled bool) error {
+	b.enabled = enabled
+
+	return nil
+}
+
+func TestNetMultiQueue(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000000)
+	b := []*mockQueueBackend{
+		{Buffer: bytes.NewBuffer([]byte{})},
+		{Buffer: bytes.NewBuffer([]byte{})},
+	}
+	v := virtio.NewMultiQueueNet(9, &mockInjector{}, []io.ReadWriter{b[0], b[1]}, mem)
+
+	features := make([]byte, 4)
+	_ = v.Read(virtio.NetIOPortStart, features)
+
+	if features[2]&0x42 != 0x42 {
+		t.Fatalf("VIRTIO_NET_F_CTRL_VQ and VIRTIO_NET_F_MQ are not offered: %v", features)
+	}
+
+	// max_virtqueue_pairs
+	actual := make([]byte, 2)
+	_ = v.Read(virtio.NetIOPortStart+20+8, actual)
+
+	if !bytes.Equal([]byte{0x02, 0x00}, actual) {
+		t.Fatalf("expected: %v, actual: %v", []byte{0x02, 0x00}, actual)
+	}
+
+	if !b[0].enabled || b[1].enabled {
+		t.Fatalf("only the first pair should be enabled: %v, %v", b[0].enabled, b[1].enabled)
+	}
+
+	// VIRTIO_NET_CTRL_MQ_VQ_PAIRS_SET with 2 pairs on the control virtqueue #4
+	copy(mem[0x100:], []byte{4, 0, 2, 0})
+	mem[0x200] = 0xff
+
+	ctrl := virtio.VirtQueue{}
+	ctrl.DescTable[0].Addr = 0x100
+	ctrl.DescTable[0].Len = 2
+	ctrl.DescTable[0].Flags = 0x1
+	ctrl.DescTable[0].Next = 1
+	ctrl.DescTable[1].Addr = 0x102
+	ctrl.DescTable[1].Len = 2
+	ctrl.DescTable[1].Flags = 0x1
+	ctrl.DescTable[1].Next = 2
+	ctrl.DescTable[2].Addr = 0x200
+	ctrl.DescTable[2].Len = 1
+	ctrl.DescTable[2].Flags = 0x2
+	ctrl.AvailRing.Idx = 1
+	v.VirtQueue[4] = &ctrl
+
+	if err := v.Write(virtio.NetIOPortStart+16, []byte{4, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if mem[0x200] != 0 {
+		t.Fatalf("ack expected: %v, actual: %v", 0, mem[0x200])
+	}
+
+	if !b[0].enabled || !b[1].enabled {
+		t.Fatalf("both pairs should be enabled: %v, %v", b[0].enabled, b[1].enabled)
+	}
+
+	// tx of the second pair goes to the second backend.
+	expected := []byte{0xaa, 0xbb}
+	copy(mem[0x300+10:], expected)
+
+	tx := virtio.VirtQueue{}
+	tx.DescTable[0].Addr = 0x300
+	tx.DescTable[0].Len = 10 + 2
+	tx.AvailRing.Idx = 1
+	v.VirtQueue[3] = &tx
+
+	if err := v.Tx(1); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if b[0].Len() != 0 || !bytes.Equal(expected, b[1].Bytes()) {
+		t.Fatalf("expected: [] %v, actual: %v %v", expected, b[0].Bytes(), b[1].Bytes())
+	}
+}
+
+type mockDataPath struct {
+	features uint64
+	started  []*virtio.VirtQueue
+}
+
+func (m *mockDataPath) Features() uint64 {
+	return m.features
+}
+
+func (m *mockDataPath) Start(features uint64, queues []*virtio.VirtQueue) error {
+	m.started = queues
+
+	return nil
+}
+
+func TestNetDataPath(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
+	d := &mockDataPath{}
+
+	v.SetDataPath(d)
+
+	// The data path does not support VIRTIO_NET_F_MRG_RXBUF.
+	features := make([]byte, 4)
+	_ = v.Read(virtio.NetIOPortStart, features)
+
+	if features[1]&0x80 != 0 {
+		t.Fatalf("expected: %v, actual: %x", "no VIRTIO_NET_F_MRG_RXBUF", features)
+	}
+
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{0x0, 0x0})
+	_ = v.Write(virtio.NetIOPortStart+8, []byte{0x10, 0x00, 0x00, 0x00})
+	_ = v.Write(virtio.NetIOPortStart+18, []byte{0x7}) // DRIVER_OK
+
+	if len(d.started) != 2 || d.started[0] != v.VirtQueue[0] {
+		t.Fatalf("expected: %v, actual: %v", v.VirtQueue[:2], d.started)
+	}
+
+	if err := v.Rx(0); !errors.Is(err, virtio.ErrOffloaded) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrOffloaded, err)
+	}
+}
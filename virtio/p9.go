@@ -0,0 +1,204 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	P9IOPortStart = 0x6800
+	P9IOPortSize  = 0x100
+
+	// VIRTIO_9P_MOUNT_TAG: the config space holds the tag to mount.
+	p9FeatureMountTag = 1 << 0
+)
+
+type p9Hdr struct {
+	commonHeader commonHeader
+	tag          string
+}
+
+func (h p9Hdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h.commonHeader); err != nil {
+		return []byte{}, err
+	}
+
+	// struct virtio_9p_config is tag_len followed by the tag, which is
+	// not NUL-terminated.
+	if err := binary.Write(buf, binary.LittleEndian, uint16(len(h.tag))); err != nil {
+		return []byte{}, err
+	}
+
+	buf.WriteString(h.tag)
+
+	return buf.Bytes(), nil
+}
+
+// P9Handler serves a 9P T-message with its R-message, such as a p9.Server.
+type P9Handler interface {
+	Handle(req []byte) []byte
+}
+
+// P9 is a virtio-9p device. A request of the guest is a chain of readable
+// descriptors with the T-message followed by writable ones for the reply,
+// which may point straight at the pages of the guest's buffer.
+type P9 struct {
+	Hdr p9Hdr
+
+	VirtQueue    [1]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [1]uint16
+
+	handler P9Handler
+	reqBuf  []byte
+	kick    chan struct{}
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *P9) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1009,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 9, // 9P Transport
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			P9IOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *P9) Read(port uint64, bytes []byte) error {
+	offset := int(port - P9IOPortStart)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if offset+len(bytes) > len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:offset+len(bytes)])
+
+	return nil
+}
+
+func (v *P9) Write(port uint64, bytes []byte) error {
+	return v.Hdr.commonHeader.write(int(port-P9IOPortStart), bytes, v.VirtQueue[:], v.Mem, v.notify)
+}
+
+func (v *P9) notify(int) error {
+	v.Hdr.commonHeader.isr = 0x0
+	kick(v.kick)
+
+	return nil
+}
+
+// IOThreadEntry serves the requests of the guest and never returns, so
+// that a slow file system of the host does not hold up the vCPU.
+func (v *P9) IOThreadEntry() {
+	for range v.kick {
+		for v.IO() == nil {
+		}
+	}
+}
+
+// IO serves the next request of the guest.
+func (v *P9) IO() error {
+	vq := v.VirtQueue[0]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[0] == availRing.Idx {
+		return ErrNoTxPacket
+	}
+
+	headDescID := availRing.Ring[v.LastAvailIdx[0]%QueueSize]
+	req := v.reqBuf[:0]
+
+	// The T-message, up to the first writable descriptor.
+	descID := headDescID
+	for {
+		desc := &vq.DescTable[descID]
+		if desc.Flags&0x2 != 0 {
+			break
+		}
+
+		req = append(req, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)]...)
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	v.reqBuf = req
+	resp := v.handler.Handle(req)
+	written := 0
+
+	// The R-message, over the writable descriptors.
+	for len(resp) > 0 {
+		desc := &vq.DescTable[descID]
+		if desc.Flags&0x2 != 0 {
+			l := copy(v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)], resp)
+			resp = resp[l:]
+			written += l
+		}
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = uint32(written)
+	usedRing.Idx++
+	v.LastAvailIdx[0]++
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioP9IRQ()
+}
+
+func (v *P9) IOPort() uint64 {
+	return P9IOPortStart
+}
+
+func (v *P9) Size() uint64 {
+	return P9IOPortSize
+}
+
+// NewP9 creates a virtio-9p device which the guest mounts by tag.
+func NewP9(tag string, handler P9Handler, irq uint8, irqInjector IRQInjector, mem []byte) *P9 {
+	return &P9{
+		Hdr: p9Hdr{
+			commonHeader: commonHeader{
+				hostFeatures: p9FeatureMountTag,
+				queueNUM:     QueueSize,
+			},
+			tag: tag,
+		},
+		Mem:         mem,
+		handler:     handler,
+		kick:        make(chan struct{}, 1),
+		irq:         irq,
+		IRQInjector: irqInjector,
+	}
+}
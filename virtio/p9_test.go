@@ -0,0 +1,91 @@
+package virtio_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// echoHandler replies with the request it got, twice.
+type echoHandler struct {
+	req []byte
+}
+
+func (h *echoHandler) Handle(req []byte) []byte {
+	h.req = append([]byte{}, req...)
+
+	return append(append([]byte{}, req...), req...)
+}
+
+func TestP9Config(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewP9("data", &echoHandler{}, 12, &mockInjector{}, []byte{})
+
+	// VIRTIO_9P_MOUNT_TAG
+	actual := make([]byte, 4)
+	_ = v.Read(virtio.P9IOPortStart, actual)
+
+	if expected := []byte{1, 0, 0, 0}; !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+
+	actual = make([]byte, 6)
+	_ = v.Read(virtio.P9IOPortStart+20, actual)
+
+	if expected := []byte{4, 0, 'd', 'a', 't', 'a'}; !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestP9IO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	h := &echoHandler{}
+	v := virtio.NewP9("data", h, 12, &mockInjector{}, mem)
+
+	// The request in two readable descriptors, room for the reply in two
+	// writable ones.
+	vq := virtio.VirtQueue{}
+	copy(mem[0x1000:], "abc")
+	copy(mem[0x2000:], "de")
+	vq.DescTable[0].Addr = 0x1000
+	vq.DescTable[0].Len = 3
+	vq.DescTable[0].Flags = 0x1
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0x2000
+	vq.DescTable[1].Len = 2
+	vq.DescTable[1].Flags = 0x1
+	vq.DescTable[1].Next = 2
+	vq.DescTable[2].Addr = 0x3000
+	vq.DescTable[2].Len = 4
+	vq.DescTable[2].Flags = 0x1 | 0x2
+	vq.DescTable[2].Next = 3
+	vq.DescTable[3].Addr = 0x4000
+	vq.DescTable[3].Len = 0x100
+	vq.DescTable[3].Flags = 0x2
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[0] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if string(h.req) != "abcde" {
+		t.Fatalf("expected: %v, actual: %v", "abcde", string(h.req))
+	}
+
+	if vq.UsedRing.Idx != 1 || vq.UsedRing.Ring[0].Len != 10 {
+		t.Fatalf("expected: %v, actual: %v", 10, vq.UsedRing.Ring[0].Len)
+	}
+
+	if actual := string(mem[0x3000:0x3004]) + string(mem[0x4000:0x4006]); actual != "abcdeabcde" {
+		t.Fatalf("expected: %v, actual: %v", "abcdeabcde", actual)
+	}
+
+	if !v.IRQInjector.(*mockInjector).isCalled() {
+		t.Fatalf("irqInjected = false\n")
+	}
+}
@@ -0,0 +1,194 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	PmemIOPortStart = 0x6900
+	PmemIOPortSize  = 0x100
+
+	// VIRTIO_PMEM_REQ_TYPE_FLUSH, the only request.
+	pmemReqFlush = 0
+)
+
+type pmemHdr struct {
+	commonHeader commonHeader
+	pmemHeader   pmemHeader
+}
+
+// pmemHeader is a struct virtio_pmem_config.
+type pmemHeader struct {
+	start uint64
+	size  uint64
+}
+
+func (h pmemHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Pmem is a virtio-pmem device. The memory itself is a region of the guest
+// physical memory, which the guest accesses directly. The device only tells
+// the guest where it is, and writes it back to the host on request.
+type Pmem struct {
+	Hdr pmemHdr
+
+	VirtQueue    [1]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [1]uint16
+
+	flush func() error
+	kick  chan struct{}
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Pmem) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		// virtio-pmem has no transitional device ID. The legacy driver
+		// takes any in 0x1000-0x103f and goes by the subsystem ID.
+		DeviceID:    0x1000 + 27,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 27, // PMEM
+		Command:     1,  // Enable IO port
+		BAR: [6]uint32{
+			PmemIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Pmem) Read(port uint64, bytes []byte) error {
+	offset := int(port - PmemIOPortStart)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if offset+len(bytes) > len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:offset+len(bytes)])
+
+	return nil
+}
+
+func (v *Pmem) Write(port uint64, bytes []byte) error {
+	return v.Hdr.commonHeader.write(int(port-PmemIOPortStart), bytes, v.VirtQueue[:], v.Mem, v.notify)
+}
+
+func (v *Pmem) notify(int) error {
+	v.Hdr.commonHeader.isr = 0x0
+	kick(v.kick)
+
+	return nil
+}
+
+// IOThreadEntry serves the flush requests of the guest and never returns,
+// so that the vCPU does not wait for the disk of the host.
+func (v *Pmem) IOThreadEntry() {
+	for range v.kick {
+		for v.IO() == nil {
+		}
+	}
+}
+
+// IO serves the next flush request of the guest: a struct virtio_pmem_req
+// to read, then a struct virtio_pmem_resp to write.
+func (v *Pmem) IO() error {
+	vq := v.VirtQueue[0]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[0] == availRing.Idx {
+		return ErrNoTxPacket
+	}
+
+	headDescID := availRing.Ring[v.LastAvailIdx[0]%QueueSize]
+	written := uint32(0)
+
+	for descID := headDescID; ; {
+		desc := &vq.DescTable[descID]
+
+		switch {
+		case desc.Flags&0x2 == 0 && desc.Len >= 4:
+			if typ := binary.LittleEndian.Uint32(v.Mem[desc.Addr:]); typ != pmemReqFlush {
+				log.Printf("virtio-pmem: unknown request %d", typ)
+			}
+		case desc.Flags&0x2 != 0 && desc.Len >= 4 && written == 0:
+			// The guest only looks at whether ret is zero.
+			ret := uint32(0)
+			if err := v.flush(); err != nil {
+				log.Printf("virtio-pmem: flush: %v", err)
+
+				ret = ^uint32(0)
+			}
+
+			binary.LittleEndian.PutUint32(v.Mem[desc.Addr:], ret)
+			written = 4
+		}
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = written
+	usedRing.Idx++
+	v.LastAvailIdx[0]++
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioPmemIRQ()
+}
+
+func (v *Pmem) IOPort() uint64 {
+	return PmemIOPortStart
+}
+
+func (v *Pmem) Size() uint64 {
+	return PmemIOPortSize
+}
+
+// NewPmem creates a virtio-pmem device for the size bytes of the guest
+// physical memory at start. flush writes them back to the host.
+func NewPmem(start, size uint64, flush func() error, irq uint8, irqInjector IRQInjector, mem []byte) *Pmem {
+	return &Pmem{
+		Hdr: pmemHdr{
+			commonHeader: commonHeader{
+				queueNUM: QueueSize,
+			},
+			pmemHeader: pmemHeader{
+				start: start,
+				size:  size,
+			},
+		},
+		Mem:         mem,
+		flush:       flush,
+		kick:        make(chan struct{}, 1),
+		irq:         irq,
+		IRQInjector: irqInjector,
+	}
+}
@@ -0,0 +1,87 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+var errFlush = errors.New("flush")
+
+func TestPmemConfig(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewPmem(1<<32, 2<<20, func() error { return nil }, 14, &mockInjector{}, []byte{})
+
+	// struct virtio_pmem_config
+	actual := make([]byte, 16)
+	_ = v.Read(virtio.PmemIOPortStart+20, actual[:8])
+	_ = v.Read(virtio.PmemIOPortStart+28, actual[8:])
+
+	expected := make([]byte, 16)
+	binary.LittleEndian.PutUint64(expected[0:], 1<<32)
+	binary.LittleEndian.PutUint64(expected[8:], 2<<20)
+
+	if !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+}
+
+func TestPmemFlush(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	flushed := 0
+	flush := func() error {
+		flushed++
+
+		if flushed > 1 {
+			return errFlush
+		}
+
+		return nil
+	}
+	v := virtio.NewPmem(1<<32, 2<<20, flush, 14, &mockInjector{}, mem)
+
+	// Two requests: struct virtio_pmem_req, then struct virtio_pmem_resp.
+	vq := virtio.VirtQueue{}
+	for i := 0; i < 2; i++ {
+		vq.DescTable[2*i].Addr = uint64(0x1000 + 0x100*i)
+		vq.DescTable[2*i].Len = 4
+		vq.DescTable[2*i].Flags = 0x1
+		vq.DescTable[2*i].Next = uint16(2*i + 1)
+		vq.DescTable[2*i+1].Addr = uint64(0x2000 + 0x100*i)
+		vq.DescTable[2*i+1].Len = 4
+		vq.DescTable[2*i+1].Flags = 0x2
+		vq.AvailRing.Ring[i] = uint16(2 * i)
+	}
+
+	vq.AvailRing.Idx = 2
+	v.VirtQueue[0] = &vq
+
+	for i := 0; i < 2; i++ {
+		if err := v.IO(); err != nil {
+			t.Fatalf("err: %v\n", err)
+		}
+	}
+
+	if flushed != 2 || vq.UsedRing.Idx != 2 || vq.UsedRing.Ring[0].Len != 4 {
+		t.Fatalf("expected: %v, actual: %v", 2, flushed)
+	}
+
+	// ret is 0 on success, and not on failure.
+	if ret := binary.LittleEndian.Uint32(mem[0x2000:]); ret != 0 {
+		t.Fatalf("expected: %v, actual: %v", 0, ret)
+	}
+
+	if ret := binary.LittleEndian.Uint32(mem[0x2100:]); ret == 0 {
+		t.Fatalf("expected: non-zero, actual: %v", ret)
+	}
+
+	if !v.IRQInjector.(*mockInjector).isCalled() {
+		t.Fatalf("irqInjected = false\n")
+	}
+}
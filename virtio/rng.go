@@ -0,0 +1,161 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	RngIOPortStart = 0x6600
+	RngIOPortSize  = 0x100
+)
+
+type rngHdr struct {
+	commonHeader commonHeader
+}
+
+func (h rngHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Rng is a virtio-rng device, which fills the buffers of the guest from
+// an entropy source.
+type Rng struct {
+	Hdr rngHdr
+
+	VirtQueue    [1]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [1]uint16
+
+	source io.Reader
+	kick   chan struct{}
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Rng) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1005,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 4, // Entropy Source
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			RngIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Rng) Read(port uint64, bytes []byte) error {
+	offset := int(port - RngIOPortStart)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if offset+len(bytes) > len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:offset+len(bytes)])
+
+	return nil
+}
+
+func (v *Rng) Write(port uint64, bytes []byte) error {
+	return v.Hdr.commonHeader.write(int(port-RngIOPortStart), bytes, v.VirtQueue[:], v.Mem, v.notify)
+}
+
+func (v *Rng) notify(int) error {
+	v.Hdr.commonHeader.isr = 0x0
+	kick(v.kick)
+
+	return nil
+}
+
+// IOThreadEntry serves the requests of the guest and never returns. The
+// source may block, e.g. when it is rate limited, which does not hold up
+// the vCPU.
+func (v *Rng) IOThreadEntry() {
+	for range v.kick {
+		for v.IO() == nil {
+		}
+	}
+}
+
+// IO fills the next buffer of the guest.
+func (v *Rng) IO() error {
+	vq := v.VirtQueue[0]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[0] == availRing.Idx {
+		return ErrNoRxBuf
+	}
+
+	headDescID := availRing.Ring[v.LastAvailIdx[0]%QueueSize]
+	written := uint32(0)
+
+	for descID := headDescID; ; {
+		desc := &vq.DescTable[descID]
+
+		n, err := io.ReadFull(v.source, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)])
+		written += uint32(n)
+
+		if err != nil || desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = written
+	usedRing.Idx++
+	v.LastAvailIdx[0]++
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioRngIRQ()
+}
+
+func (v *Rng) IOPort() uint64 {
+	return RngIOPortStart
+}
+
+func (v *Rng) Size() uint64 {
+	return RngIOPortSize
+}
+
+// NewRng creates a virtio-rng device on an entropy source.
+func NewRng(source io.Reader, irq uint8, irqInjector IRQInjector, mem []byte) *Rng {
+	return &Rng{
+		Hdr: rngHdr{
+			commonHeader: commonHeader{
+				queueNUM: QueueSize,
+			},
+		},
+		Mem:         mem,
+		source:      source,
+		kick:        make(chan struct{}, 1),
+		irq:         irq,
+		IRQInjector: irqInjector,
+	}
+}
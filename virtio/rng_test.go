@@ -0,0 +1,43 @@
+package virtio_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestRngIO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	source := bytes.Repeat([]byte{0xaa}, 0x100)
+	v := virtio.NewRng(bytes.NewReader(source), 6, &mockInjector{}, mem)
+
+	if id := v.GetDeviceHeader().SubsystemID; id != 4 {
+		t.Fatalf("expected: %v, actual: %v", 4, id)
+	}
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x1000
+	vq.DescTable[0].Len = 0x40
+	vq.DescTable[0].Flags = 0x2
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[0] = &vq
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if vq.UsedRing.Idx != 1 || vq.UsedRing.Ring[0].Len != 0x40 {
+		t.Fatalf("expected: %v, actual: %v", 0x40, vq.UsedRing.Ring[0].Len)
+	}
+
+	if !bytes.Equal(mem[0x1000:0x1040], source[:0x40]) {
+		t.Fatalf("expected: %v, actual: %v", source[:0x40], mem[0x1000:0x1040])
+	}
+
+	if !v.IRQInjector.(*mockInjector).isCalled() {
+		t.Fatalf("irqInjected = false\n")
+	}
+}
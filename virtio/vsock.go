@@ -0,0 +1,289 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	VsockIOPortStart = 0x6400
+	VsockIOPortSize  = 0x100
+
+	// The rx, tx and event queues.
+	vsockRxQueue    = 0
+	vsockTxQueue    = 1
+	vsockEventQueue = 2
+
+	// A packet of the host is a struct virtio_vsock_hdr of 44 bytes and
+	// up to 4 KiB of data.
+	vsockMaxPacketSize = 44 + 4096
+)
+
+type vsockHdr struct {
+	commonHeader commonHeader
+	vsockHeader  vsockHeader
+}
+
+type vsockHeader struct {
+	guestCID uint64
+}
+
+func (h vsockHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Vsock is a virtio-vsock device. The backend, such as a vsock.Muxer, takes
+// the packets of the guest with Write and returns those for the guest with
+// Read, a packet at a time. It tells the device about new packets for the
+// guest with SetRxNotifier.
+type Vsock struct {
+	Hdr vsockHdr
+
+	VirtQueue    [3]*VirtQueue
+	Mem          []byte
+	LastAvailIdx [3]uint16
+
+	backend io.ReadWriter
+	rxBuf   []byte
+	txBuf   []byte
+
+	rxKick chan struct{}
+	txKick chan struct{}
+
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Vsock) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1012,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 19, // Socket Device
+		Command:     1,  // Enable IO port
+		BAR: [6]uint32{
+			VsockIOPortStart | 0x1,
+		},
+		InterruptPin:  1,
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Vsock) Read(port uint64, bytes []byte) error {
+	offset := int(port - VsockIOPortStart)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if offset+len(bytes) > len(b) {
+		return nil
+	}
+
+	copy(bytes, b[offset:offset+len(bytes)])
+
+	return nil
+}
+
+func (v *Vsock) Write(port uint64, bytes []byte) error {
+	return v.Hdr.commonHeader.write(int(port-VsockIOPortStart), bytes, v.VirtQueue[:], v.Mem, v.notify)
+}
+
+func (v *Vsock) notify(sel int) error {
+	v.Hdr.commonHeader.isr = 0x0
+
+	switch sel {
+	case vsockRxQueue:
+		// New rx buffers may let pending packets in.
+		kick(v.rxKick)
+	case vsockTxQueue:
+		kick(v.txKick)
+	case vsockEventQueue:
+		// The only event is a reset of the transport, which the
+		// device never sends.
+	}
+
+	return nil
+}
+
+func kick(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// RxThreadEntry moves the packets of the backend to the guest and never
+// returns.
+func (v *Vsock) RxThreadEntry() {
+	for range v.rxKick {
+		for v.Rx() == nil {
+		}
+	}
+}
+
+// Rx puts a packet of the backend into a buffer of the guest.
+func (v *Vsock) Rx() error {
+	vq := v.VirtQueue[vsockRxQueue]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[vsockRxQueue] == availRing.Idx {
+		return ErrNoRxBuf
+	}
+
+	headDescID := availRing.Ring[v.LastAvailIdx[vsockRxQueue]%QueueSize]
+
+	// The packet must fit in the chain of buffers.
+	size := 0
+	for descID := headDescID; ; {
+		desc := &vq.DescTable[descID]
+		size += int(desc.Len)
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	if size > len(v.rxBuf) {
+		size = len(v.rxBuf)
+	}
+
+	n, err := v.backend.Read(v.rxBuf[:size])
+	if err != nil {
+		return ErrNoRxPacket
+	}
+
+	packet := v.rxBuf[:n]
+
+	for descID := headDescID; len(packet) > 0; {
+		desc := &vq.DescTable[descID]
+		l := copy(v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)], packet)
+		packet = packet[l:]
+
+		if desc.Flags&0x1 == 0 {
+			break
+		}
+
+		descID = desc.Next
+	}
+
+	usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
+	usedRing.Ring[usedRing.Idx%QueueSize].Len = uint32(n)
+	usedRing.Idx++
+	v.LastAvailIdx[vsockRxQueue]++
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioVsockIRQ()
+}
+
+// TxThreadEntry moves the packets of the guest to the backend and never
+// returns.
+func (v *Vsock) TxThreadEntry() {
+	for range v.txKick {
+		for v.Tx() == nil {
+		}
+	}
+}
+
+// Tx passes the packets of the guest to the backend.
+func (v *Vsock) Tx() error {
+	vq := v.VirtQueue[vsockTxQueue]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	availRing := &vq.AvailRing
+	usedRing := &vq.UsedRing
+
+	if v.LastAvailIdx[vsockTxQueue] == availRing.Idx {
+		return ErrNoTxPacket
+	}
+
+	for v.LastAvailIdx[vsockTxQueue] != availRing.Idx {
+		buf := v.txBuf[:0]
+		descID := availRing.Ring[v.LastAvailIdx[vsockTxQueue]%QueueSize]
+
+		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
+		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+
+		for {
+			desc := vq.DescTable[descID]
+
+			buf = append(buf, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)]...)
+
+			if desc.Flags&0x1 == 0 {
+				break
+			}
+
+			descID = desc.Next
+		}
+
+		v.txBuf = buf
+
+		// The packet is dropped if the backend refuses it, the guest
+		// learns about that from a reset.
+		_, _ = v.backend.Write(buf)
+
+		usedRing.Idx++
+		v.LastAvailIdx[vsockTxQueue]++
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioVsockIRQ()
+}
+
+func (v *Vsock) IOPort() uint64 {
+	return VsockIOPortStart
+}
+
+func (v *Vsock) Size() uint64 {
+	return VsockIOPortSize
+}
+
+// NewVsock creates a virtio-vsock device for the guest with the given CID.
+// If the backend is a RxNotifier, it wakes the device on new packets.
+func NewVsock(cid uint64, irq uint8, irqInjector IRQInjector, backend io.ReadWriter, mem []byte) *Vsock {
+	res := &Vsock{
+		Hdr: vsockHdr{
+			commonHeader: commonHeader{
+				queueNUM: QueueSize,
+			},
+			vsockHeader: vsockHeader{
+				guestCID: cid,
+			},
+		},
+		Mem:         mem,
+		backend:     backend,
+		rxBuf:       make([]byte, vsockMaxPacketSize),
+		txBuf:       make([]byte, 0, vsockMaxPacketSize),
+		rxKick:      make(chan struct{}, 1),
+		txKick:      make(chan struct{}, 1),
+		irq:         irq,
+		IRQInjector: irqInjector,
+	}
+
+	if n, ok := backend.(RxNotifier); ok {
+		n.SetRxNotifier(func() { kick(res.rxKick) })
+	}
+
+	return res
+}
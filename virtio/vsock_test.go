@@ -0,0 +1,129 @@
+package virtio_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// mockPackets is a backend which returns a packet at a time.
+type mockPackets struct {
+	written [][]byte
+	toRead  [][]byte
+}
+
+func (m *mockPackets) Write(p []byte) (int, error) {
+	m.written = append(m.written, append([]byte(nil), p...))
+
+	return len(p), nil
+}
+
+func (m *mockPackets) Read(p []byte) (int, error) {
+	if len(m.toRead) == 0 {
+		return 0, virtio.ErrNoRxPacket
+	}
+
+	n := copy(p, m.toRead[0])
+	m.toRead = m.toRead[1:]
+
+	return n, nil
+}
+
+func TestVsockGuestCID(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewVsock(42, 11, &mockInjector{}, &mockPackets{}, []byte{})
+
+	actual := make([]byte, 8)
+	_ = v.Read(virtio.VsockIOPortStart+20, actual)
+
+	if expected := []byte{42, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(expected, actual) {
+		t.Fatalf("expected: %v, actual: %v", expected, actual)
+	}
+
+	if id := v.GetDeviceHeader().SubsystemID; id != 19 {
+		t.Fatalf("expected: %v, actual: %v", 19, id)
+	}
+}
+
+func TestVsockTx(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	b := &mockPackets{}
+	v := virtio.NewVsock(3, 11, &mockInjector{}, b, mem)
+
+	// A header and its data in two descriptors.
+	copy(mem[0x100:], bytes.Repeat([]byte{0xaa}, 44))
+	copy(mem[0x200:], []byte{0xbb, 0xcc})
+
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = 44
+	vq.DescTable[0].Flags = 0x1
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0x200
+	vq.DescTable[1].Len = 2
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[1] = &vq
+
+	if err := v.Tx(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	expected := append(bytes.Repeat([]byte{0xaa}, 44), 0xbb, 0xcc)
+	if len(b.written) != 1 || !bytes.Equal(expected, b.written[0]) {
+		t.Fatalf("expected: %v, actual: %v", [][]byte{expected}, b.written)
+	}
+
+	if !v.IRQInjector.(*mockInjector).isCalled() {
+		t.Fatalf("irqInjected = false\n")
+	}
+}
+
+func TestVsockRx(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x10000)
+	packet := append(bytes.Repeat([]byte{0xaa}, 44), 0xbb, 0xcc)
+	b := &mockPackets{toRead: [][]byte{packet}}
+	v := virtio.NewVsock(3, 11, &mockInjector{}, b, mem)
+
+	// A buffer for the header and one for the data, like older Linux.
+	vq := virtio.VirtQueue{}
+	vq.DescTable[0].Addr = 0x100
+	vq.DescTable[0].Len = 44
+	vq.DescTable[0].Flags = 0x1 | 0x2
+	vq.DescTable[0].Next = 1
+	vq.DescTable[1].Addr = 0x200
+	vq.DescTable[1].Len = 4096
+	vq.DescTable[1].Flags = 0x2
+	vq.AvailRing.Idx = 1
+	v.VirtQueue[0] = &vq
+
+	if err := v.Rx(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if vq.UsedRing.Idx != 1 || vq.UsedRing.Ring[0].Len != uint32(len(packet)) {
+		t.Fatalf("expected: %v, actual: %v", len(packet), vq.UsedRing.Ring[0].Len)
+	}
+
+	actual := append(append([]byte{}, mem[0x100:0x100+44]...), mem[0x200:0x202]...)
+	if !bytes.Equal(packet, actual) {
+		t.Fatalf("expected: %v, actual: %v", packet, actual)
+	}
+
+	// Without packets, the buffer stays with the device.
+	vq.AvailRing.Idx = 2
+	vq.AvailRing.Ring[1] = 0
+
+	if err := v.Rx(); err == nil {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrNoRxPacket, err)
+	}
+
+	if vq.UsedRing.Idx != 1 {
+		t.Fatalf("expected: %v, actual: %v", 1, vq.UsedRing.Idx)
+	}
+}
@@ -0,0 +1,249 @@
+package vmm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/mgmt"
+	"github.com/bobuhiro11/gokvm/netem"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+var (
+	ErrNoSuchDrive = errors.New("no such drive")
+	ErrNoSuchNIC   = errors.New("no such network interface")
+	ErrNoBalloon   = errors.New("no balloon device")
+	ErrNoVirtioMem = errors.New("no virtio-mem device")
+)
+
+// startMgmt serves the management interface if a socket was configured.
+func (v *VMM) startMgmt() error {
+	if len(v.MgmtSock) == 0 {
+		return nil
+	}
+
+	s := mgmt.New()
+
+	s.Handle("throttle", "throttle DRIVE [iops=N][,bps=N][,iops_burst=N][,bps_burst=N]", v.throttle)
+	s.Handle("blockstats", "blockstats", v.blockStats)
+	s.Handle("netem", "netem NIC [rate=N][,delay=D][,jitter=D][,loss=P][,duplicate=P][,reorder=P][,seed=N]", v.netem)
+	s.Handle("netstats", "netstats", v.netStats)
+	s.Handle("balloon", "balloon [SIZE]", v.balloon)
+	s.Handle("balloonstats", "balloonstats", v.balloonStats)
+	s.Handle("memhotplug", "memhotplug [SIZE]", v.memHotplug)
+	s.Handle("cpus", "cpus [N]", v.cpus)
+
+	return s.Listen(v.MgmtSock)
+}
+
+// driveName returns the name of the i-th disk in the guest.
+func driveName(i int) string {
+	return "vd" + string(rune('a'+i))
+}
+
+func (v *VMM) drive(name string) (*virtio.Blk, error) {
+	for i, d := range v.Disks() {
+		if driveName(i) == name {
+			return d, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrNoSuchDrive, name)
+}
+
+// throttle shows or changes the I/O limits of a drive. Limits which are
+// not given keep their value, 0 removes a limit.
+func (v *VMM) throttle(args []string) (string, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", fmt.Errorf("%w: usage: throttle DRIVE [LIMITS]", mgmt.ErrUsage)
+	}
+
+	d, err := v.drive(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	if len(args) == 2 {
+		l := d.Limits()
+		if err := flag.ParseLimits(args[1], &l); err != nil {
+			return "", err
+		}
+
+		d.SetLimits(l)
+	}
+
+	l := d.Limits()
+
+	return fmt.Sprintf("iops=%d,bps=%d,iops_burst=%d,bps_burst=%d",
+		l.IOPS, l.BPS, l.IOPSBurst, l.BPSBurst), nil
+}
+
+func (v *VMM) blockStats([]string) (string, error) {
+	lines := []string{}
+
+	for i, d := range v.Disks() {
+		s := d.ThrottleStats()
+		lines = append(lines, fmt.Sprintf("%s: requests=%d bytes=%d throttled_requests=%d throttled_time=%v",
+			driveName(i), s.Requests, s.Bytes, s.Throttled, s.Time))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// The name of the NIC in the guest.
+const nicName = "net0"
+
+func (v *VMM) nic(name string) (*netem.Netem, error) {
+	if n := v.Netem(); n != nil && name == nicName {
+		return n, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrNoSuchNIC, name)
+}
+
+// netem shows or changes the impairments of a NIC. Those which are not
+// given keep their value, 0 removes one. The random decisions start over
+// from the seed.
+func (v *VMM) netem(args []string) (string, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", fmt.Errorf("%w: usage: netem NIC [OPTIONS]", mgmt.ErrUsage)
+	}
+
+	n, err := v.nic(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	if len(args) == 2 {
+		c := n.Config()
+		if err := flag.ParseNetem(args[1], &c); err != nil {
+			return "", err
+		}
+
+		n.SetConfig(c)
+	}
+
+	c := n.Config()
+
+	return fmt.Sprintf("rate=%d,delay=%v,jitter=%v,loss=%g%%,duplicate=%g%%,reorder=%g%%,seed=%d",
+		c.Rate, c.Delay, c.Jitter, c.Loss, c.Duplicate, c.Reorder, c.Seed), nil
+}
+
+func (v *VMM) netStats([]string) (string, error) {
+	n := v.Netem()
+	if n == nil {
+		return "", nil
+	}
+
+	s := n.Stats()
+
+	return fmt.Sprintf("%s: frames=%d bytes=%d lost=%d duplicated=%d reordered=%d overflows=%d",
+		nicName, s.Frames, s.Bytes, s.Lost, s.Duplicated, s.Reordered, s.Overflows), nil
+}
+
+// balloon shows or changes the size of the memory the guest is to keep,
+// with M as the default unit. The rest goes into the balloon.
+func (v *VMM) balloon(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("%w: usage: balloon [SIZE]", mgmt.ErrUsage)
+	}
+
+	b := v.Balloon()
+	if b == nil {
+		return "", ErrNoBalloon
+	}
+
+	if len(args) == 1 {
+		size, err := flag.ParseSize(args[0], "m")
+		if err != nil {
+			return "", err
+		}
+
+		if size > v.MemSize {
+			size = v.MemSize
+		}
+
+		if err := b.SetTarget(uint32((v.MemSize - size) / virtio.BalloonPageSize)); err != nil {
+			return "", err
+		}
+	}
+
+	target, actual := b.Target()
+
+	return fmt.Sprintf("target=%d actual=%d",
+		v.MemSize-int(target)*virtio.BalloonPageSize,
+		v.MemSize-int(actual)*virtio.BalloonPageSize), nil
+}
+
+// balloonStats asks the guest for its memory statistics.
+func (v *VMM) balloonStats([]string) (string, error) {
+	b := v.Balloon()
+	if b == nil {
+		return "", ErrNoBalloon
+	}
+
+	s, err := b.UpdateStats(time.Second)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("total=%d free=%d available=%d caches=%d swap_in=%d swap_out=%d "+
+		"major_faults=%d minor_faults=%d age=%v",
+		s.Total, s.Free, s.Available, s.Caches, s.SwapIn, s.SwapOut,
+		s.MajorFaults, s.MinorFaults, time.Since(s.Updated).Round(time.Millisecond)), nil
+}
+
+// memHotplug shows or changes the size of the memory the guest is to plug
+// through virtio-mem, with M as the default unit.
+func (v *VMM) memHotplug(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("%w: usage: memhotplug [SIZE]", mgmt.ErrUsage)
+	}
+
+	d := v.VirtioMem()
+	if d == nil {
+		return "", ErrNoVirtioMem
+	}
+
+	if len(args) == 1 {
+		size, err := flag.ParseSize(args[0], "m")
+		if err != nil {
+			return "", err
+		}
+
+		if err := d.SetRequestedSize(uint64(size)); err != nil {
+			return "", err
+		}
+	}
+
+	requested, plugged := d.Sizes()
+
+	return fmt.Sprintf("requested=%d plugged=%d", requested, plugged), nil
+}
+
+// cpus shows or changes the number of vCPUs which are present. A vCPU
+// being unplugged is present until the guest ejects it.
+func (v *VMM) cpus(args []string) (string, error) {
+	if len(args) > 1 {
+		return "", fmt.Errorf("%w: usage: cpus [N]", mgmt.ErrUsage)
+	}
+
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return "", fmt.Errorf("%w: %q is not a number", mgmt.ErrUsage, args[0])
+		}
+
+		if err := v.SetCPUs(n); err != nil {
+			return "", err
+		}
+	}
+
+	present, possible := v.CPUs()
+
+	return fmt.Sprintf("present=%d max=%d", present, possible), nil
+}
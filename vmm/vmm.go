@@ -7,9 +7,18 @@ import (
 	"os"
 	"sync"
 
+	"github.com/bobuhiro11/gokvm/chardev"
 	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/netem"
+	"github.com/bobuhiro11/gokvm/netsock"
+	"github.com/bobuhiro11/gokvm/numa"
+	"github.com/bobuhiro11/gokvm/pcap"
 	"github.com/bobuhiro11/gokvm/pvh"
+	"github.com/bobuhiro11/gokvm/ratelimit"
+	"github.com/bobuhiro11/gokvm/rng"
 	"github.com/bobuhiro11/gokvm/term"
+	"github.com/bobuhiro11/gokvm/usernet"
 )
 
 // Config defines the configuration of the
@@ -21,10 +30,63 @@ type Config struct {
 	Initrd     string
 	Params     string
 	TapIfName  string
+	TapQueues  int
+	TapVhost   bool
+	NetUser    bool
+	HostFwds   []usernet.HostFwd
+	NetSocket  netsock.Config
+	NetCapture pcap.Config
+	NetShaping netem.Config
 	Disk       string
 	NCPUs      int
 	MemSize    int
+	MemBackend memory.Backend
+	NUMA       numa.Config
 	TraceCount int
+
+	DiskSnapshot bool
+	DiskQueues   int
+	DiskLimits   ratelimit.Limits
+
+	// NetVhostUser and DiskVhostUser are the sockets of vhost-user
+	// backends which run the network and the disk.
+	NetVhostUser  string
+	DiskVhostUser string
+
+	// VsockCID and VsockPath add a virtio-vsock device if VsockPath is set.
+	VsockCID  uint64
+	VsockPath string
+
+	// ConsolePorts add a virtio-console with these ports.
+	ConsolePorts []chardev.Port
+
+	// Rng adds a virtio-rng device if set.
+	Rng *rng.Config
+
+	// MemBalloon adds a virtio-balloon device.
+	MemBalloon bool
+
+	// ShareDir is shared with the guest over virtio-9p by ShareTag.
+	ShareDir string
+	ShareTag string
+
+	// Pmem is a file mapped into the guest by virtio-pmem.
+	Pmem         string
+	PmemReadonly bool
+
+	// MemHotplug is the size of the memory the guest may plug through
+	// virtio-mem in blocks of MemHotplugBlock, into NUMA node
+	// MemHotplugNode. There is no virtio-mem device without it.
+	MemHotplug      int
+	MemHotplugBlock int
+	MemHotplugNode  int
+
+	// MaxCPUs is the number of vCPUs with CPU hotplug, of which NCPUs are
+	// there at boot. There is no CPU hotplug without it.
+	MaxCPUs int
+
+	// MgmtSock is the path of the UNIX socket for the management interface.
+	MgmtSock string
 }
 
 type VMM struct {
@@ -41,28 +103,124 @@ func New(c Config) *VMM {
 
 // Init instantiates a machine.
 func (v *VMM) Init() error {
-	m, err := machine.New(v.Dev, v.NCPUs, v.MemSize)
+	m, err := machine.NewWithBackend(v.Dev, v.maxCPUs(), v.MemSize, v.MemHotplug, v.MemBackend)
 	if err != nil {
 		return err
 	}
 
+	if v.MaxCPUs > 0 {
+		if err := m.EnableCPUHotplug(v.NCPUs); err != nil {
+			return err
+		}
+	}
+
+	if len(v.Config.NUMA.Nodes) > 0 {
+		if err := m.SetNUMA(v.Config.NUMA); err != nil {
+			return err
+		}
+	}
+
+	// With the management interface, the impairments can be added later,
+	// unless the packets are to bypass gokvm with vhost-net. Until then
+	// the frames pass straight through.
+	if v.NetShaping != (netem.Config{}) || (len(v.MgmtSock) > 0 && !v.TapVhost && len(v.NetVhostUser) == 0) {
+		m.ShapeNet(v.NetShaping)
+	}
+
+	if len(v.NetCapture.Path) > 0 {
+		if err := m.CaptureNet(v.NetCapture); err != nil {
+			return err
+		}
+	}
+
 	if len(v.TapIfName) > 0 {
-		if err := m.AddTapIf(v.TapIfName); err != nil {
+		if err := m.AddTapIf(v.TapIfName, v.TapQueues, v.TapVhost); err != nil {
+			return err
+		}
+	} else if len(v.NetVhostUser) > 0 {
+		if err := m.AddVhostUserNet(v.NetVhostUser); err != nil {
+			return err
+		}
+	} else if v.NetUser {
+		if err := m.AddUserNet(v.HostFwds); err != nil {
+			return err
+		}
+	} else if len(v.NetSocket.Type) > 0 {
+		if err := m.AddSocketNet(v.NetSocket); err != nil {
 			return err
 		}
 	}
 
-	if len(v.Disk) > 0 {
-		if err := m.AddDisk(v.Disk); err != nil {
+	if len(v.DiskVhostUser) > 0 {
+		if err := m.AddVhostUserDisk(v.DiskVhostUser, v.DiskQueues); err != nil {
+			return err
+		}
+	} else if len(v.Disk) > 0 && v.DiskSnapshot {
+		if err := m.AddSnapshotDisk(v.Disk, v.DiskQueues); err != nil {
+			return err
+		}
+	} else if len(v.Disk) > 0 {
+		if err := m.AddDisk(v.Disk, v.DiskQueues); err != nil {
 			return err
 		}
 	}
 
+	if len(v.VsockPath) > 0 {
+		if err := m.AddVsock(v.VsockCID, v.VsockPath); err != nil {
+			return err
+		}
+	}
+
+	if len(v.ConsolePorts) > 0 {
+		if err := m.AddConsole(v.ConsolePorts); err != nil {
+			return err
+		}
+	}
+
+	if v.Rng != nil {
+		m.AddRng(*v.Rng)
+	}
+
+	if v.MemBalloon {
+		m.AddBalloon()
+	}
+
+	if len(v.ShareDir) > 0 {
+		if err := m.AddShare(v.ShareDir, v.ShareTag); err != nil {
+			return err
+		}
+	}
+
+	if len(v.Pmem) > 0 {
+		if err := m.AddPmem(v.Pmem, v.PmemReadonly); err != nil {
+			return err
+		}
+	}
+
+	if v.MemHotplug > 0 {
+		if err := m.AddMemHotplug(uint64(v.MemHotplugBlock), v.MemHotplugNode); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range m.Disks() {
+		d.SetLimits(v.DiskLimits)
+	}
+
 	v.Machine = m
 
 	return nil
 }
 
+// maxCPUs is the number of vCPUs the guest may have.
+func (v *VMM) maxCPUs() int {
+	if v.MaxCPUs > v.NCPUs {
+		return v.MaxCPUs
+	}
+
+	return v.NCPUs
+}
+
 func (v *VMM) Setup() error {
 	var initrd *os.File
 	// Kernel arg required to load kernel or firmware image
@@ -106,8 +264,14 @@ func (v *VMM) Boot() error {
 		return fmt.Errorf("setting trace to %v:%w", trace, err)
 	}
 
-	for cpu := 0; cpu < v.NCPUs; cpu++ {
-		fmt.Printf("Start CPU %d of %d\r\n", cpu, v.NCPUs)
+	if err := v.startMgmt(); err != nil {
+		return fmt.Errorf("management interface: %w", err)
+	}
+
+	// The vCPUs which are not present wait in KVM until the guest starts
+	// them once they are plugged.
+	for cpu := 0; cpu < v.maxCPUs(); cpu++ {
+		fmt.Printf("Start CPU %d of %d\r\n", cpu, v.maxCPUs())
 		v.StartVCPU(cpu, v.TraceCount, &wg)
 		wg.Add(1)
 	}
@@ -132,6 +296,17 @@ func (v *VMM) Boot() error {
 
 	in := bufio.NewReader(os.Stdin)
 
+	// Ctrl-a s saves the snapshot disk back to its image, as in QEMU.
+	v.GetSerial().HandleEscape('s', func() {
+		if err := v.CommitDisks(); err != nil {
+			fmt.Printf("commit: %v\r\n", err)
+
+			return
+		}
+
+		fmt.Printf("disk changes committed\r\n")
+	})
+
 	v.GetSerial().StartSerial(*in, restoreMode, v.InjectSerialIRQ)
 
 	fmt.Printf("Waiting for CPUs to exit\r\n")
@@ -0,0 +1,667 @@
+// Package vsock is the host side of virtio-vsock on AF_UNIX sockets, like
+// the hybrid vsock of Firecracker and cloud-hypervisor:
+//
+//   - A connection of the guest to port N of the host is connected to the
+//     UNIX socket PATH_N.
+//   - A program on the host connects to the UNIX socket PATH and sends
+//     "CONNECT N\n" to reach port N of the guest. Once the guest accepts,
+//     it receives "OK M\n", M being the port of the host side.
+//
+// Muxer speaks the packets of virtio-vsock with the guest, as a backend of
+// virtio.Vsock: Write takes the packets of the guest, Read returns the
+// packets for it.
+//
+// refs https://github.com/firecracker-microvm/firecracker/blob/main/docs/vsock.md
+package vsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/unixsock"
+)
+
+var (
+	ErrNoPacket    = errors.New("no packet for the guest")
+	ErrShortPacket = errors.New("vsock packet is too short")
+	ErrBadConnect  = errors.New("expected CONNECT <port>")
+)
+
+const (
+	// HostCID is the address of the host.
+	HostCID = 2
+
+	// HeaderSize is the size of struct virtio_vsock_hdr.
+	HeaderSize = 44
+
+	typeStream = 1
+
+	opRequest       = 1
+	opResponse      = 2
+	opRst           = 3
+	opShutdown      = 4
+	opRW            = 5
+	opCreditUpdate  = 6
+	opCreditRequest = 7
+
+	shutdownRcv  = 1
+	shutdownSend = 2
+
+	// bufAlloc is the buffer space of the host for each connection, the
+	// guest sends no more than this ahead of what was forwarded.
+	bufAlloc = 256 << 10
+
+	// maxPayload is what the host sends in one packet, the size of the rx
+	// buffers of Linux.
+	maxPayload = 4096
+
+	// The ports of the host side of connections from the host.
+	firstLocalPort = 1 << 30
+)
+
+// Header is struct virtio_vsock_hdr.
+type Header struct {
+	SrcCID   uint64
+	DstCID   uint64
+	SrcPort  uint32
+	DstPort  uint32
+	Len      uint32
+	Type     uint16
+	Op       uint16
+	Flags    uint32
+	BufAlloc uint32
+	FwdCnt   uint32
+}
+
+// ParseHeader reads a header from the start of b.
+func ParseHeader(b []byte) (Header, error) {
+	if len(b) < HeaderSize {
+		return Header{}, ErrShortPacket
+	}
+
+	return Header{
+		SrcCID:   binary.LittleEndian.Uint64(b[0:]),
+		DstCID:   binary.LittleEndian.Uint64(b[8:]),
+		SrcPort:  binary.LittleEndian.Uint32(b[16:]),
+		DstPort:  binary.LittleEndian.Uint32(b[20:]),
+		Len:      binary.LittleEndian.Uint32(b[24:]),
+		Type:     binary.LittleEndian.Uint16(b[28:]),
+		Op:       binary.LittleEndian.Uint16(b[30:]),
+		Flags:    binary.LittleEndian.Uint32(b[32:]),
+		BufAlloc: binary.LittleEndian.Uint32(b[36:]),
+		FwdCnt:   binary.LittleEndian.Uint32(b[40:]),
+	}, nil
+}
+
+// Put writes the header to the start of b.
+func (h Header) Put(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:], h.SrcCID)
+	binary.LittleEndian.PutUint64(b[8:], h.DstCID)
+	binary.LittleEndian.PutUint32(b[16:], h.SrcPort)
+	binary.LittleEndian.PutUint32(b[20:], h.DstPort)
+	binary.LittleEndian.PutUint32(b[24:], h.Len)
+	binary.LittleEndian.PutUint16(b[28:], h.Type)
+	binary.LittleEndian.PutUint16(b[30:], h.Op)
+	binary.LittleEndian.PutUint32(b[32:], h.Flags)
+	binary.LittleEndian.PutUint32(b[36:], h.BufAlloc)
+	binary.LittleEndian.PutUint32(b[40:], h.FwdCnt)
+}
+
+// key identifies a connection by its ports on the host and in the guest.
+type key struct {
+	local, peer uint32
+}
+
+// conn is a connection between a port of the guest and a UNIX socket.
+type conn struct {
+	key
+	c net.Conn
+
+	established bool
+	closed      bool
+
+	// cond is signalled on new credit and on writes.
+	cond *sync.Cond
+
+	// The credit of the guest: it has room for peerBufAlloc bytes, of
+	// which txCnt-peerFwdCnt are in flight.
+	peerBufAlloc uint32
+	peerFwdCnt   uint32
+	txCnt        uint32
+
+	// rxCnt bytes of the guest were received, fwdCnt of them written to
+	// the socket, the guest last heard of sentFwdCnt.
+	rxCnt      uint32
+	fwdCnt     uint32
+	sentFwdCnt uint32
+	writes     []chunk
+}
+
+// chunk is something to write to the socket.
+type chunk struct {
+	data []byte
+	// ctl is for the program on the host, not data of the guest.
+	ctl bool
+	// eof shuts down the writing side of the socket.
+	eof bool
+}
+
+func (c *conn) peerFree() uint32 {
+	if inFlight := c.txCnt - c.peerFwdCnt; inFlight < c.peerBufAlloc {
+		return c.peerBufAlloc - inFlight
+	}
+
+	return 0
+}
+
+// packet is a packet waiting for the guest.
+type packet struct {
+	hdr  Header
+	data []byte
+}
+
+// Muxer connects the vsock connections of a guest to UNIX sockets.
+type Muxer struct {
+	cid      uint64
+	path     string
+	listener net.Listener
+
+	mu        sync.Mutex
+	conns     map[key]*conn
+	queue     []packet
+	nextLocal uint32
+	notify    func()
+}
+
+// Listen creates the host side of the guest with the given CID, and listens
+// for connections from the host on path.
+func Listen(cid uint64, path string) (*Muxer, error) {
+	unixsock.RemoveStale(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Muxer{
+		cid:       cid,
+		path:      path,
+		listener:  l,
+		conns:     map[key]*conn{},
+		nextLocal: firstLocalPort,
+	}
+
+	go m.accept()
+
+	return m, nil
+}
+
+// CID is the address of the guest.
+func (m *Muxer) CID() uint64 {
+	return m.cid
+}
+
+// SetRxNotifier registers f to be called when there are packets for the
+// guest.
+func (m *Muxer) SetRxNotifier(f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.notify = f
+}
+
+func (m *Muxer) wake() {
+	m.mu.Lock()
+	f := m.notify
+	m.mu.Unlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+// Read returns the next packet for the guest, a header followed by up to
+// len(p)-HeaderSize bytes of data, or ErrNoPacket.
+func (m *Muxer) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.queue) == 0 || len(p) < HeaderSize {
+		return 0, ErrNoPacket
+	}
+
+	pkt := &m.queue[0]
+	n := copy(p[HeaderSize:], pkt.data)
+
+	hdr := pkt.hdr
+	hdr.Len = uint32(n)
+
+	// The credit is as of now.
+	if c, ok := m.conns[key{local: hdr.SrcPort, peer: hdr.DstPort}]; ok {
+		hdr.FwdCnt = c.fwdCnt
+		c.sentFwdCnt = c.fwdCnt
+	}
+
+	hdr.Put(p)
+
+	// Data which does not fit goes in the next packet.
+	if pkt.data = pkt.data[n:]; len(pkt.data) == 0 {
+		m.queue = m.queue[1:]
+	}
+
+	return HeaderSize + n, nil
+}
+
+// Write takes a packet of the guest.
+func (m *Muxer) Write(p []byte) (int, error) {
+	hdr, err := ParseHeader(p)
+	if err != nil {
+		return 0, err
+	}
+
+	data := p[HeaderSize:]
+	if int(hdr.Len) < len(data) {
+		data = data[:hdr.Len]
+	}
+
+	m.mu.Lock()
+	queued := m.handle(hdr, data)
+	m.mu.Unlock()
+
+	if queued {
+		m.wake()
+	}
+
+	return len(p), nil
+}
+
+// reply queues a packet for the guest on the connection k, the caller
+// holds mu.
+func (m *Muxer) reply(k key, op uint16, flags uint32, data []byte) {
+	m.queue = append(m.queue, packet{
+		hdr: Header{
+			SrcCID:   HostCID,
+			DstCID:   m.cid,
+			SrcPort:  k.local,
+			DstPort:  k.peer,
+			Type:     typeStream,
+			Op:       op,
+			Flags:    flags,
+			BufAlloc: bufAlloc,
+		},
+		data: data,
+	})
+}
+
+// handle carries out a packet of the guest, and returns whether a packet
+// for the guest was queued. The caller holds mu.
+func (m *Muxer) handle(hdr Header, data []byte) bool {
+	k := key{local: hdr.DstPort, peer: hdr.SrcPort}
+
+	if hdr.DstCID != HostCID || hdr.Type != typeStream {
+		if hdr.Op == opRst {
+			return false
+		}
+
+		m.reply(k, opRst, 0, nil)
+
+		return true
+	}
+
+	c, ok := m.conns[k]
+	if !ok {
+		switch hdr.Op {
+		case opRequest:
+			m.connect(k, hdr)
+
+			return false
+		case opRst:
+			return false
+		default:
+			m.reply(k, opRst, 0, nil)
+		}
+
+		return true
+	}
+
+	c.peerBufAlloc = hdr.BufAlloc
+	c.peerFwdCnt = hdr.FwdCnt
+	c.cond.Broadcast()
+
+	switch hdr.Op {
+	case opResponse:
+		if c.established || c.c == nil {
+			return false
+		}
+
+		// The guest accepted the connection from the host.
+		c.established = true
+		c.writes = append(c.writes, chunk{data: []byte(fmt.Sprintf("OK %d\n", c.local)), ctl: true})
+
+		go m.read(c)
+	case opRW:
+		// A guest which sends past the credit of the host is reset, lest
+		// the writes grow without bound.
+		if c.rxCnt += uint32(len(data)); c.rxCnt-c.fwdCnt > bufAlloc {
+			m.close(c)
+			m.reply(k, opRst, 0, nil)
+
+			return true
+		}
+
+		if len(data) > 0 {
+			c.writes = append(c.writes, chunk{data: append([]byte(nil), data...)})
+		}
+	case opCreditRequest:
+		m.reply(k, opCreditUpdate, 0, nil)
+
+		return true
+	case opShutdown:
+		if hdr.Flags&(shutdownRcv|shutdownSend) == shutdownRcv|shutdownSend {
+			m.close(c)
+			m.reply(k, opRst, 0, nil)
+
+			return true
+		}
+
+		if hdr.Flags&shutdownSend != 0 {
+			// The socket sees EOF once the data of the guest is written.
+			c.writes = append(c.writes, chunk{eof: true})
+		}
+	case opRst:
+		m.close(c)
+	}
+
+	return false
+}
+
+// connect connects the guest to PATH_N for port N of the host. The caller
+// holds mu.
+func (m *Muxer) connect(k key, hdr Header) {
+	c := &conn{
+		key:          k,
+		cond:         sync.NewCond(&m.mu),
+		peerBufAlloc: hdr.BufAlloc,
+		peerFwdCnt:   hdr.FwdCnt,
+	}
+
+	m.conns[k] = c
+
+	// A slow listener must not stall the other connections.
+	go m.dial(c)
+}
+
+// dial opens the socket of a connection of the guest, and accepts or resets
+// it.
+func (m *Muxer) dial(c *conn) {
+	s, err := net.Dial("unix", m.path+"_"+strconv.FormatUint(uint64(c.local), 10))
+
+	m.mu.Lock()
+
+	switch {
+	case c.closed:
+		// The guest gave up in the meantime.
+		if err == nil {
+			s.Close()
+		}
+
+		m.mu.Unlock()
+
+		return
+	case err != nil:
+		m.close(c)
+		m.reply(c.key, opRst, 0, nil)
+	default:
+		c.c = s
+		c.established = true
+		m.reply(c.key, opResponse, 0, nil)
+
+		go m.write(c)
+		go m.read(c)
+	}
+
+	m.mu.Unlock()
+
+	m.wake()
+}
+
+// add registers a connection and starts writing the data of the guest to
+// its socket. The caller holds mu.
+func (m *Muxer) add(k key, s net.Conn) *conn {
+	c := &conn{
+		key:  k,
+		c:    s,
+		cond: sync.NewCond(&m.mu),
+	}
+
+	m.conns[k] = c
+
+	go m.write(c)
+
+	return c
+}
+
+// close forgets a connection. What the guest sent is still written to the
+// socket before it is closed. The caller holds mu.
+func (m *Muxer) close(c *conn) {
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+	delete(m.conns, c.key)
+	c.cond.Broadcast()
+}
+
+// write writes the data of the guest to the socket.
+func (m *Muxer) write(c *conn) {
+	defer c.c.Close()
+
+	for {
+		m.mu.Lock()
+		for len(c.writes) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+
+		if len(c.writes) == 0 {
+			m.mu.Unlock()
+
+			return
+		}
+
+		w := c.writes[0]
+		c.writes = c.writes[1:]
+		m.mu.Unlock()
+
+		if w.eof {
+			if u, ok := c.c.(*net.UnixConn); ok {
+				_ = u.CloseWrite()
+			}
+
+			continue
+		}
+
+		if _, err := c.c.Write(w.data); err != nil {
+			m.reset(c)
+
+			return
+		}
+
+		if w.ctl {
+			continue
+		}
+
+		m.mu.Lock()
+		c.fwdCnt += uint32(len(w.data))
+
+		// Tell the guest about the room before it runs out.
+		update := !c.closed && c.fwdCnt-c.sentFwdCnt >= bufAlloc/4
+		if update {
+			m.reply(c.key, opCreditUpdate, 0, nil)
+		}
+		m.mu.Unlock()
+
+		if update {
+			m.wake()
+		}
+	}
+}
+
+// read sends what the socket receives to the guest, as long as the guest
+// has room for it.
+func (m *Muxer) read(c *conn) {
+	buf := make([]byte, maxPayload)
+
+	for {
+		m.mu.Lock()
+		for !c.closed && c.peerFree() == 0 {
+			c.cond.Wait()
+		}
+
+		closed, n := c.closed, c.peerFree()
+		m.mu.Unlock()
+
+		if closed {
+			return
+		}
+
+		if n > maxPayload {
+			n = maxPayload
+		}
+
+		n2, err := c.c.Read(buf[:n])
+
+		m.mu.Lock()
+		if c.closed {
+			m.mu.Unlock()
+
+			return
+		}
+
+		if n2 > 0 {
+			c.txCnt += uint32(n2)
+			m.reply(c.key, opRW, 0, append([]byte(nil), buf[:n2]...))
+		}
+
+		// The guest closes the connection with a reset once it has
+		// read everything.
+		if err != nil {
+			m.reply(c.key, opShutdown, shutdownRcv|shutdownSend, nil)
+		}
+		m.mu.Unlock()
+
+		m.wake()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// reset tears down a connection whose socket failed.
+func (m *Muxer) reset(c *conn) {
+	m.mu.Lock()
+	queued := !c.closed
+	if queued {
+		m.close(c)
+		m.reply(c.key, opRst, 0, nil)
+	}
+	m.mu.Unlock()
+
+	if queued {
+		m.wake()
+	}
+}
+
+// accept takes the connections of the host to the guest.
+func (m *Muxer) accept() {
+	for {
+		s, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go m.handshake(s)
+	}
+}
+
+// handshake reads "CONNECT N\n" and asks port N of the guest to accept.
+func (m *Muxer) handshake(s net.Conn) {
+	// The line is read byte by byte, so that nothing after it is lost.
+	line := []byte{}
+	b := make([]byte, 1)
+
+	for len(line) < 64 {
+		if _, err := s.Read(b); err != nil {
+			s.Close()
+
+			return
+		}
+
+		if b[0] == '\n' {
+			break
+		}
+
+		line = append(line, b[0])
+	}
+
+	port, err := parseConnect(string(line))
+	if err != nil {
+		log.Printf("vsock: %v", err)
+		s.Close()
+
+		return
+	}
+
+	m.mu.Lock()
+
+	k := key{local: m.nextLocal, peer: port}
+	m.nextLocal++
+
+	m.add(k, s)
+	m.queue = append(m.queue, packet{hdr: Header{
+		SrcCID:   HostCID,
+		DstCID:   m.cid,
+		SrcPort:  k.local,
+		DstPort:  k.peer,
+		Type:     typeStream,
+		Op:       opRequest,
+		BufAlloc: bufAlloc,
+	}})
+	m.mu.Unlock()
+
+	m.wake()
+}
+
+func parseConnect(line string) (uint32, error) {
+	f := strings.Fields(line)
+	if len(f) != 2 || f[0] != "CONNECT" {
+		return 0, fmt.Errorf("%w: %q", ErrBadConnect, line)
+	}
+
+	port, err := strconv.ParseUint(f[1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q: %w", line, err)
+	}
+
+	return uint32(port), nil
+}
+
+// Close stops listening and closes all connections.
+func (m *Muxer) Close() error {
+	err := m.listener.Close()
+
+	m.mu.Lock()
+	for _, c := range m.conns {
+		m.close(c)
+	}
+	m.mu.Unlock()
+
+	return err
+}
@@ -0,0 +1,195 @@
+package vsock_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/vsock"
+)
+
+const (
+	guestCID = 3
+
+	opRequest  = 1
+	opResponse = 2
+	opRst      = 3
+	opRW       = 5
+)
+
+func newMuxer(t *testing.T) (*vsock.Muxer, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "v.sock")
+
+	m, err := vsock.Listen(guestCID, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { m.Close() })
+
+	return m, path
+}
+
+// send writes a packet of the guest.
+func send(t *testing.T, m *vsock.Muxer, hdr vsock.Header, data []byte) {
+	t.Helper()
+
+	hdr.SrcCID, hdr.DstCID, hdr.Type = guestCID, vsock.HostCID, 1
+	hdr.Len = uint32(len(data))
+	hdr.BufAlloc = 1 << 16
+
+	p := make([]byte, vsock.HeaderSize+len(data))
+	hdr.Put(p)
+	copy(p[vsock.HeaderSize:], data)
+
+	if _, err := m.Write(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recv waits for a packet for the guest.
+func recv(t *testing.T, m *vsock.Muxer) (vsock.Header, []byte) {
+	t.Helper()
+
+	p := make([]byte, vsock.HeaderSize+4096)
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		n, err := m.Read(p)
+		if errors.Is(err, vsock.ErrNoPacket) {
+			time.Sleep(time.Millisecond)
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, err := vsock.ParseHeader(p[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hdr, p[vsock.HeaderSize:n]
+	}
+
+	t.Fatal("no packet for the guest")
+
+	return vsock.Header{}, nil
+}
+
+func TestConnectToHost(t *testing.T) {
+	t.Parallel()
+
+	m, path := newMuxer(t)
+
+	l, err := net.Listen("unix", path+"_52")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	send(t, m, vsock.Header{SrcPort: 1234, DstPort: 52, Op: opRequest}, nil)
+
+	hdr, _ := recv(t, m)
+	if hdr.Op != opResponse || hdr.SrcPort != 52 || hdr.DstPort != 1234 || hdr.DstCID != guestCID {
+		t.Fatalf("expected: RESPONSE 52 -> 1234, actual: %+v", hdr)
+	}
+
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	send(t, m, vsock.Header{SrcPort: 1234, DstPort: 52, Op: opRW}, []byte("ping"))
+
+	buf := make([]byte, 4)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected: %s, actual: %s", "ping", buf)
+	}
+
+	if _, err := s.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, data := recv(t, m)
+	if hdr.Op != opRW || string(data) != "pong" {
+		t.Fatalf("expected: %s, actual: %d %s", "pong", hdr.Op, data)
+	}
+
+	if hdr.FwdCnt != 4 {
+		t.Fatalf("expected: %d, actual: %d", 4, hdr.FwdCnt)
+	}
+}
+
+func TestConnectToGuest(t *testing.T) {
+	t.Parallel()
+
+	m, path := newMuxer(t)
+
+	s, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if _, err := s.Write([]byte("CONNECT 80\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, _ := recv(t, m)
+	if hdr.Op != opRequest || hdr.DstPort != 80 {
+		t.Fatalf("expected: REQUEST -> 80, actual: %+v", hdr)
+	}
+
+	send(t, m, vsock.Header{SrcPort: 80, DstPort: hdr.SrcPort, Op: opResponse}, nil)
+
+	line, err := bufio.NewReader(s).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := fmt.Sprintf("OK %d\n", hdr.SrcPort); line != expected {
+		t.Fatalf("expected: %q, actual: %q", expected, line)
+	}
+}
+
+func TestCreditExceeded(t *testing.T) {
+	t.Parallel()
+
+	m, path := newMuxer(t)
+
+	l, err := net.Listen("unix", path+"_52")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	send(t, m, vsock.Header{SrcPort: 1234, DstPort: 52, Op: opRequest}, nil)
+
+	if hdr, _ := recv(t, m); hdr.Op != opResponse {
+		t.Fatalf("expected: %d, actual: %d", opResponse, hdr.Op)
+	}
+
+	// More than the 256 KiB the host has room for.
+	send(t, m, vsock.Header{SrcPort: 1234, DstPort: 52, Op: opRW}, make([]byte, 257<<10))
+
+	if hdr, _ := recv(t, m); hdr.Op != opRst {
+		t.Fatalf("expected: %d, actual: %d", opRst, hdr.Op)
+	}
+}